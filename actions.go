@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+)
+
+// actionConflict is a pair of actions that make no sense together in a
+// single filter. Fatal conflicts contradict each other and are errors, the
+// others are warned about.
+type actionConflict struct {
+	a      string
+	b      string
+	fatal  bool
+	reason string
+}
+
+// actionConflicts is the matrix of conflicting actions, by the name of their
+// key in the filter file.
+var actionConflicts = []actionConflict{
+	{a: "archiveUnlessToMe", b: "archiveUnlessCcMe", fatal: true, reason: "they archive different mail"},
+	{a: "important", b: "neverImportant", fatal: true, reason: "they contradict each other"},
+	{a: "archive", b: "archiveUnlessToMe", reason: "the archive is ignored"},
+	{a: "archive", b: "archiveUnlessCcMe", reason: "the archive is ignored"},
+	{a: "delete", b: "archive", reason: "deleted mail is not in the inbox anyway"},
+	{a: "delete", b: "archiveUnlessToMe", reason: "deleted mail is not in the inbox anyway"},
+	{a: "delete", b: "archiveUnlessCcMe", reason: "deleted mail is not in the inbox anyway"},
+	{a: "delete", b: "star", reason: "starring mail that is deleted is pointless"},
+	{a: "delete", b: "important", reason: "marking mail that is deleted as important is pointless"},
+	{a: "delete", b: "label", reason: "labeling mail that is deleted is pointless"},
+}
+
+// actions returns the set of actions the filter takes, by the name of their
+// key in the filter file.
+func (f filter) actions() map[string]bool {
+	actions := map[string]bool{
+		"archive":           f.Archive,
+		"read":              f.Read,
+		"delete":            f.Delete,
+		"star":              f.Star,
+		"important":         f.Important,
+		"neverImportant":    f.NeverImportant,
+		"neverSpam":         f.NeverSpam,
+		"archiveUnlessToMe": f.ArchiveUnlessToMe,
+		"archiveUnlessCcMe": f.ArchiveUnlessCcMe,
+		"label":             len(f.Label) > 0,
+		"forwardTo":         len(f.ForwardTo) > 0,
+	}
+	for name, set := range actions {
+		if !set {
+			delete(actions, name)
+		}
+	}
+	return actions
+}
+
+// conflictingActions returns the conflicts between the actions of the
+// filter.
+func (f filter) conflictingActions() []actionConflict {
+	actions := f.actions()
+
+	var conflicts []actionConflict
+	for _, c := range actionConflicts {
+		if actions[c.a] && actions[c.b] {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// String returns a description of the conflict.
+func (c actionConflict) String() string {
+	if c.fatal {
+		return fmt.Sprintf("cannot have both %s and %s, %s", c.a, c.b, c.reason)
+	}
+	return fmt.Sprintf("%s and %s make no sense together, %s", c.a, c.b, c.reason)
+}
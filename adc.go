@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// adcTokenSource returns the token source of the Google Application Default
+// Credentials: the key in GOOGLE_APPLICATION_CREDENTIALS, the credentials of
+// gcloud auth application-default login, or the metadata server on Google
+// Cloud. It also returns where the credentials were found, for display.
+func adcTokenSource(ctx context.Context) (oauth2.TokenSource, []string, string, error) {
+	creds, err := google.FindDefaultCredentials(ctx, oauthScopes()...)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("finding the application default credentials failed: %v", err)
+	}
+
+	// Without a key, the credentials come from the metadata server, which
+	// can only act as the service account of the machine.
+	if len(creds.JSON) < 1 {
+		if len(impersonate) > 0 {
+			return nil, nil, "", errors.New("impersonating a user needs a service account key, point GOOGLE_APPLICATION_CREDENTIALS at it")
+		}
+		return creds.TokenSource, oauthScopes(), "application default credentials from the metadata server", nil
+	}
+
+	if isServiceAccount(creds.JSON) {
+		config, err := serviceAccountConfig(creds.JSON)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return config.TokenSource(ctx), config.Scopes, "application default credentials, service account impersonating " + impersonate, nil
+	}
+
+	return creds.TokenSource, oauthScopes(), "application default credentials", nil
+}
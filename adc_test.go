@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestADCTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	defer func(user string) { impersonate = user }(impersonate)
+
+	for _, tc := range []struct {
+		creds       string
+		impersonate string
+		expected    string
+	}{
+		{
+			creds:    `{"type": "authorized_user", "client_id": "123", "client_secret": "secret", "refresh_token": "refresh"}`,
+			expected: "application default credentials",
+		},
+		{
+			creds:       `{"type": "service_account", "client_email": "filters@example.iam.gserviceaccount.com", "private_key": "key"}`,
+			impersonate: "me@example.com",
+			expected:    "application default credentials, service account impersonating me@example.com",
+		},
+	} {
+		file := filepath.Join(dir, "creds.json")
+		if err := ioutil.WriteFile(file, []byte(tc.creds), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", file)
+		impersonate = tc.impersonate
+
+		_, _, got, err := adcTokenSource(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.expected {
+			t.Fatalf("expected %q, got %q", tc.expected, got)
+		}
+	}
+
+	// A service account key cannot be used without a user to impersonate.
+	impersonate = ""
+	if _, _, _, err := adcTokenSource(context.Background()); err == nil {
+		t.Fatal("expected an error without --impersonate")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const applyHelp = `Sync the filters and labels in the account with filter files.`
+
+const applyLongHelp = applyHelp + `
+
+Pass - as a file to read the filters from stdin, along with --yes since
+there is no asking for confirmation then.`
+
+func (cmd *applyCommand) Name() string      { return "apply" }
+func (cmd *applyCommand) Args() string      { return "<file>..." }
+func (cmd *applyCommand) ShortHelp() string { return applyHelp }
+func (cmd *applyCommand) LongHelp() string  { return applyLongHelp }
+func (cmd *applyCommand) Hidden() bool      { return false }
+
+func (cmd *applyCommand) Register(fs *flag.FlagSet) {
+	registerSyncFlags(fs)
+
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes that would be made without making them")
+	fs.StringVar(&cmd.output, "output", "text", "output format of --dry-run: text or json")
+
+	fs.BoolVar(&continueOnError, "continue-on-error", false, "keep going when a filter fails and report all failures at the end")
+
+	fs.BoolVar(&resume, "resume", false, "resume an interrupted or partially failed sync from its checkpoint")
+}
+
+type applyCommand struct {
+	output string
+}
+
+func (cmd *applyCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+	if err := validateOutput(cmd.output); err != nil {
+		return err
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	return syncFilterFile(ctx, ff, cmd.output)
+}
+
+// syncFilterFile makes the filters and labels in the account match the filter
+// file, or prints what would change with --dry-run, in the output format.
+func syncFilterFile(ctx context.Context, ff filterfile, output string) error {
+	// Plan the sync with the labels it would create as placeholders, so the
+	// limits are checked before anything is changed in the account.
+	diff, newLabels, names, err := planFileSync(ctx, ff)
+	if err != nil {
+		return err
+	}
+	if err := checkFilterCount(diff); err != nil {
+		return err
+	}
+	if err := checkForwardingAddresses(ctx, diff); err != nil {
+		return err
+	}
+
+	// Only print what would change if we are doing a dry run.
+	if dryRun {
+		if output == "json" {
+			return writeDiffJSON(os.Stdout, "", diff, newLabels, names)
+		}
+		for _, name := range newLabels {
+			fmt.Printf("+ label %s\n", name)
+		}
+		printDiff(os.Stdout, diff, names)
+
+		return nil
+	}
+
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+
+	labels, err := getLabelMap(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Reconcile the declared labels and apply the label settings.
+	if err := reconcileLabels(ctx, ff, &labels); err != nil {
+		return err
+	}
+
+	// Compute what needs to change.
+	wanted, groups, err := wantedFilters(ctx, ff.Filter, &labels)
+	if err != nil {
+		return err
+	}
+
+	return syncFilters(ctx, wanted, groups, ff.Protect)
+}
+
+// planFileSync returns the diff syncing the filter file would apply, within
+// the pruning and protection settings, along with the labels it would create
+// and a map of label IDs to names for display.
+func planFileSync(ctx context.Context, ff filterfile) (filterDiff, []string, labelMap, error) {
+	diff, newLabels, names, err := planSync(ctx, ff)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+	// The filters an unfinished sync created are ours when resuming it.
+	if resume {
+		cp, err := loadCheckpoint(checkpointFile())
+		if err != nil {
+			return filterDiff{}, nil, nil, err
+		}
+		if cp != nil {
+			for _, f := range cp.Created {
+				state.add(f)
+			}
+		}
+	}
+
+	return diff.scoped(state, ff.Protect), newLabels, names, nil
+}
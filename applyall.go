@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+const applyAllHelp = `Sync the filters of several accounts from a manifest.`
+
+const applyAllLongHelp = applyAllHelp + `
+
+The manifest maps each account to its filter files, with an [[account]]
+table per account:
+
+  [[account]]
+  address = "alice@example.com"
+  files = ["alice.toml"]
+
+  [[account]]
+  address = "bob@example.com"
+  files = ["shared.toml", "bob.toml"]
+  profile = "work"
+
+The files are relative to the manifest. Each account is synced by running
+apply with --account, and its profile if it has one, so it uses its own
+token and state, and a failing account does not stop the others. A summary
+of what was done to each account is printed at the end.
+
+The accounts are synced in turn, or --concurrency of them at a time. As they
+then cannot be asked for confirmation, pass --yes along with --prune or
+--dedupe, and --rate-limit to cap the requests of each account so the ones
+synced at the same time stay under the quota of the project.`
+
+func (cmd *applyAllCommand) Name() string      { return "apply-all" }
+func (cmd *applyAllCommand) Args() string      { return "<manifest>" }
+func (cmd *applyAllCommand) ShortHelp() string { return applyAllHelp }
+func (cmd *applyAllCommand) LongHelp() string  { return applyAllLongHelp }
+func (cmd *applyAllCommand) Hidden() bool      { return false }
+
+func (cmd *applyAllCommand) Register(fs *flag.FlagSet) {
+	registerSyncFlags(fs)
+
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes that would be made without making them")
+
+	fs.BoolVar(&continueOnError, "continue-on-error", false, "keep going when a filter fails and report all failures at the end")
+
+	fs.BoolVar(&resume, "resume", false, "resume an interrupted or partially failed sync from its checkpoint")
+
+	fs.IntVar(&cmd.concurrency, "concurrency", 1, "number of accounts to sync at the same time")
+
+	cmd.fs = fs
+}
+
+type applyAllCommand struct {
+	fs          *flag.FlagSet
+	concurrency int
+}
+
+func (cmd *applyAllCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("must pass the path to the manifest of the accounts")
+	}
+	if cmd.concurrency < 1 {
+		return errors.New("--concurrency must be at least 1")
+	}
+
+	accounts, err := loadManifest(args[0])
+	if err != nil {
+		return withExitCode(exitValidation, err)
+	}
+
+	// The flags are passed on to apply, they come between the command and
+	// the manifest.
+	flags := withoutFlags(cmd.fs, os.Args[2:len(os.Args)-len(args)], "concurrency")
+
+	return reportAccountResults(runAccounts(ctx, accounts, flags, cmd.concurrency))
+}
+
+// runAccounts syncs the accounts, up to concurrency of them at a time, and
+// returns their results in the order of the accounts. Only a single account
+// at a time gets the terminal, to confirm the changes with.
+func runAccounts(ctx context.Context, accounts []manifestAccount, flags []string, concurrency int) []accountResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]accountResult, len(accounts))
+	sem := make(chan struct{}, concurrency)
+	var (
+		wg   sync.WaitGroup
+		done int64
+	)
+	for i, a := range accounts {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			results[i] = accountResult{account: a.Address, err: "not synced, interrupted"}
+			continue
+		}
+		infof("Syncing %s with %s\n", a.Address, strings.Join(a.Files, ", "))
+		wg.Add(1)
+		go func(i int, a manifestAccount) {
+			defer wg.Done()
+			results[i] = runAccount(ctx, a, flags, concurrency == 1)
+			<-sem
+			if concurrency > 1 {
+				infof("Synced %s, %d of %d done\n", a.Address, atomic.AddInt64(&done, 1), len(accounts))
+			}
+		}(i, a)
+	}
+	wg.Wait()
+	return results
+}
+
+// reportAccountResults prints or logs the results of the accounts, and
+// returns an error if any of them failed.
+func reportAccountResults(results []accountResult) error {
+	if logFormat == "json" {
+		for _, r := range results {
+			fields := r.summary.fields()
+			fields["account"] = r.account
+			fields["exitCode"] = r.exitCode
+			if len(r.err) > 0 {
+				fields["error"] = r.err
+			}
+			logrus.WithFields(fields).Info("Account synced")
+		}
+	} else {
+		fmt.Fprintln(infoOut())
+		if err := printAccountResults(infoOut(), results); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.failed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return withExitCode(exitPartial, fmt.Errorf("syncing %d of %d accounts failed", failed, len(results)))
+	}
+	return nil
+}
+
+// manifestAccount is an account in the manifest of apply-all.
+type manifestAccount struct {
+	Address string   `toml:"address"`
+	Files   []string `toml:"files"`
+	Profile string   `toml:"profile"`
+}
+
+// loadManifest reads the accounts in the manifest, with their files relative
+// to it.
+func loadManifest(path string) ([]manifestAccount, error) {
+	var m struct {
+		Account []manifestAccount `toml:"account"`
+	}
+	md, err := toml.DecodeFile(path, &m)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest %s failed: %v", path, err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %s", path, keys[0])
+	}
+	if len(m.Account) < 1 {
+		return nil, fmt.Errorf("%s: no [[account]] in the manifest", path)
+	}
+
+	seen := map[string]bool{}
+	for i, a := range m.Account {
+		if !strings.Contains(a.Address, "@") {
+			return nil, fmt.Errorf("%s: account %d: invalid address %q", path, i+1, a.Address)
+		}
+		key := strings.ToLower(a.Address) + "/" + a.Profile
+		if seen[key] {
+			return nil, fmt.Errorf("%s: %s is in the manifest twice", path, a.Address)
+		}
+		seen[key] = true
+		if len(a.Files) < 1 {
+			return nil, fmt.Errorf("%s: %s has no filter files", path, a.Address)
+		}
+		for j, f := range a.Files {
+			if !filepath.IsAbs(f) && !strings.Contains(f, "://") {
+				m.Account[i].Files[j] = filepath.Join(filepath.Dir(path), f)
+			}
+		}
+	}
+	return m.Account, nil
+}
+
+// accountResult is how syncing an account went.
+type accountResult struct {
+	account  string
+	summary  syncSummary
+	exitCode int
+	err      string
+}
+
+func (r accountResult) failed() bool {
+	return r.exitCode != 0 || len(r.err) > 0
+}
+
+// selfExecutable returns the path to the gmailfilters binary, to run apply
+// for each account with.
+var selfExecutable = os.Executable
+
+// accountOutput serializes the output of the accounts synced at the same
+// time.
+var accountOutput sync.Mutex
+
+// runAccount syncs the account by running apply for it with the flags. It
+// logs in JSON so we can pick its summary from the log. Unless interactive,
+// apply cannot ask for confirmation and what it prints is held back until it
+// is done, not to mix with the other accounts.
+func runAccount(ctx context.Context, a manifestAccount, flags []string, interactive bool) accountResult {
+	r := accountResult{account: a.Address}
+
+	exe, err := selfExecutable()
+	if err != nil {
+		r.err = err.Error()
+		return r
+	}
+	// The flags for the account come last to win over the ones passed.
+	args := append(append([]string{"apply"}, flags...), "--account", a.Address, "--log-format", "json")
+	if len(a.Profile) > 0 {
+		args = append(args, "--profile", a.Profile)
+	}
+	args = append(args, a.Files...)
+
+	c := exec.CommandContext(ctx, exe, args...)
+	var out bytes.Buffer
+	if interactive {
+		c.Stdin = os.Stdin
+		c.Stdout = os.Stdout
+	} else {
+		c.Stdout = &out
+	}
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		r.err = err.Error()
+		return r
+	}
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		r.err = err.Error()
+		return r
+	}
+	readAccountLog(stderr, &r)
+	err = c.Wait()
+	r.summary.duration = time.Since(start)
+	if out.Len() > 0 {
+		accountOutput.Lock()
+		os.Stdout.Write(out.Bytes())
+		accountOutput.Unlock()
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		r.exitCode = exitErr.ExitCode()
+		if len(r.err) < 1 {
+			r.err = err.Error()
+		}
+	case err != nil:
+		r.err = err.Error()
+	default:
+		// Whatever it printed was not what it failed with.
+		r.err = ""
+	}
+	return r
+}
+
+// readAccountLog logs what apply logged for the account, picking the summary
+// of the sync and the last error out of it. The error apply exits with is
+// not logged, but printed as is.
+func readAccountLog(rd io.Reader, r *accountResult) {
+	s := bufio.NewScanner(rd)
+	for s.Scan() {
+		line := s.Text()
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", r.account, line)
+				r.err = line
+			}
+			continue
+		}
+
+		msg, _ := entry["msg"].(string)
+		level, err := logrus.ParseLevel(fmt.Sprint(entry["level"]))
+		if err != nil {
+			level = logrus.InfoLevel
+		}
+		delete(entry, "msg")
+		delete(entry, "level")
+		delete(entry, "time")
+
+		if msg == "Sync finished" {
+			r.summary = summaryFromFields(entry)
+			if logFormat != "json" {
+				continue
+			}
+		}
+		if level == logrus.InfoLevel && logFormat != "json" {
+			infof("%s: %s\n", r.account, msg)
+			continue
+		}
+		logEntry(logrus.WithFields(logrus.Fields(entry)).WithField("account", r.account), level, msg)
+	}
+}
+
+// summaryFromFields returns the summary of a sync from its log fields.
+func summaryFromFields(fields map[string]interface{}) syncSummary {
+	count := func(key string) int {
+		n, _ := fields[key].(float64)
+		return int(n)
+	}
+	return syncSummary{
+		created:   count("created"),
+		updated:   count("updated"),
+		deleted:   count("deleted"),
+		unchanged: count("unchanged"),
+		failed:    count("failed"),
+		apiCalls:  int64(count("apiCalls")),
+	}
+}
+
+// logEntry logs the message at the level.
+func logEntry(e *logrus.Entry, level logrus.Level, msg string) {
+	switch level {
+	case logrus.DebugLevel, logrus.TraceLevel:
+		e.Debug(msg)
+	case logrus.InfoLevel:
+		e.Info(msg)
+	case logrus.WarnLevel:
+		e.Warn(msg)
+	default:
+		e.Error(msg)
+	}
+}
+
+// withoutFlags returns the arguments without the flags named, and their
+// values.
+func withoutFlags(fs *flag.FlagSet, args []string, names ...string) []string {
+	skip := map[string]bool{}
+	for _, n := range names {
+		skip[n] = true
+	}
+
+	var out []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == args[i] || !skip[strings.SplitN(name, "=", 2)[0]] {
+			out = append(out, args[i])
+			continue
+		}
+		if strings.Contains(name, "=") {
+			continue
+		}
+		// Without an =, the value of a flag that is not a bool is the next
+		// argument.
+		if f := fs.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+	return out
+}
+
+// printAccountResults writes the results of the accounts as a table.
+func printAccountResults(w io.Writer, results []accountResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tRESULT\tCREATED\tUPDATED\tDELETED\tUNCHANGED\tFAILED\tDURATION")
+	for _, r := range results {
+		result := "ok"
+		if r.failed() {
+			result = "failed"
+			if r.exitCode != 0 {
+				result = fmt.Sprintf("failed (%d)", r.exitCode)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", r.account, result,
+			r.summary.created, r.summary.updated, r.summary.deleted, r.summary.unchanged, r.summary.failed,
+			r.summary.duration.Round(time.Millisecond))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	failed := false
+	for _, r := range results {
+		if r.failed() {
+			fmt.Fprintf(w, "\n%s: %s", r.account, r.err)
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Fprintln(w)
+	}
+	return nil
+}
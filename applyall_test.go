@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "accounts.toml")
+	manifest := `[[account]]
+address = "alice@example.com"
+files = ["alice.toml"]
+
+[[account]]
+address = "bob@example.com"
+files = ["/shared.toml", "bob.toml"]
+profile = "work"
+`
+	if err := ioutil.WriteFile(file, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := loadManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []manifestAccount{
+		{Address: "alice@example.com", Files: []string{filepath.Join(dir, "alice.toml")}},
+		{Address: "bob@example.com", Files: []string{"/shared.toml", filepath.Join(dir, "bob.toml")}, Profile: "work"},
+	}
+	if diff := cmp.Diff(expected, accounts); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	for _, bad := range []string{
+		"",
+		"[[account]]\naddress = \"alice\"\nfiles = [\"a.toml\"]\n",
+		"[[account]]\naddress = \"alice@example.com\"\n",
+		"[[account]]\naddress = \"alice@example.com\"\nfiles = [\"a.toml\"]\n[[account]]\naddress = \"Alice@example.com\"\nfiles = [\"b.toml\"]\n",
+		"[[account]]\naddress = \"alice@example.com\"\nfile = [\"a.toml\"]\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadManifest(file); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRunAccount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake gmailfilters is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake gmailfilters syncs alice and fails for everyone else.
+	script := `#!/bin/sh
+case "$*" in
+*"--account alice@example.com"*)
+	echo '{"level":"info","msg":"Creating 1, updating 0 and deleting 0 filters, this might take a bit..."}' >&2
+	echo '{"created":1,"unchanged":4,"apiCalls":3,"level":"info","msg":"Sync finished"}' >&2
+	;;
+*)
+	echo '{"level":"warning","msg":"Getting token failed"}' >&2
+	echo "creating client failed: no token" >&2
+	exit 3
+	;;
+esac
+`
+	exe := filepath.Join(dir, "gmailfilters")
+	if err := ioutil.WriteFile(exe, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old func() (string, error)) { selfExecutable = old }(selfExecutable)
+	selfExecutable = func() (string, error) { return exe, nil }
+	defer func(old bool) { quiet = old }(quiet)
+	quiet = true
+
+	accounts := []manifestAccount{
+		{Address: "alice@example.com", Files: []string{"filters.toml"}},
+		{Address: "bob@example.com", Files: []string{"filters.toml"}},
+	}
+	results := runAccounts(context.Background(), accounts, nil, 2)
+	for i := range results {
+		results[i].summary.duration = time.Second
+	}
+
+	var buf bytes.Buffer
+	if err := printAccountResults(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	expected := `ACCOUNT            RESULT      CREATED  UPDATED  DELETED  UNCHANGED  FAILED  DURATION
+alice@example.com  ok          1        0        0        4          0       1s
+bob@example.com    failed (3)  0        0        0        0          0       1s
+
+bob@example.com: creating client failed: no token
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
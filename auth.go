@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+const authHelp = `Authorize gmailfilters to access the account.`
+
+const authLongHelp = authHelp + `
+
+Opens the OAuth flow in the browser and saves the token to the keyring or
+the token file, replacing the one there if any, so the other commands can
+run unattended.
+With a service account key or the application default credentials, only
+checks the account can be managed.
+With --print, also prints the token base64 encoded, to pass in the
+GMAILFILTERS_TOKEN environment variable where there is no token file.`
+
+func (cmd *authCommand) Name() string      { return "auth" }
+func (cmd *authCommand) Args() string      { return "" }
+func (cmd *authCommand) ShortHelp() string { return authHelp }
+func (cmd *authCommand) LongHelp() string  { return authLongHelp }
+func (cmd *authCommand) Hidden() bool      { return false }
+
+func (cmd *authCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.print, "print", false, "print the token base64 encoded, for the GMAILFILTERS_TOKEN environment variable")
+}
+
+type authCommand struct {
+	print bool
+}
+
+func (cmd *authCommand) Run(ctx context.Context, args []string) error {
+	// Service accounts and the application default credentials get their
+	// own tokens, so there is no token to save.
+	if source, ok := tokenlessCredentials(ctx); ok {
+		if err := connect(ctx); err != nil {
+			return err
+		}
+		if _, err := getLabelMap(ctx); err != nil {
+			return withExitCode(exitAuth, fmt.Errorf("%s cannot manage the account: %v", source, err))
+		}
+		infof("Authorized with %s\n", source)
+		return nil
+	}
+
+	if source, ok := externalToken(); ok {
+		return fmt.Errorf("the token is read from %s and cannot be replaced, run gmailfilters auth --print without it to get a new one", source)
+	}
+
+	// Get a new token even if we already have one.
+	if err := removeToken(); err != nil {
+		return err
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	// Make sure the token works.
+	if _, err := getLabelMap(ctx); err != nil {
+		return err
+	}
+
+	infof("Authorized, the token is saved to %s\n", tokenLocation())
+
+	if cmd.print {
+		tok, err := readToken(ctx)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(b))
+	}
+
+	return nil
+}
+
+// tokenlessCredentials returns what the credentials are if they do not need
+// a token file.
+func tokenlessCredentials(ctx context.Context) (string, bool) {
+	if useADC {
+		return "the application default credentials", true
+	}
+	if creds, err := readCredentials(ctx); err == nil && isServiceAccount(creds) {
+		return fmt.Sprintf("the service account in %s impersonating %s", credentialsLocation(), impersonate), true
+	}
+	return "", false
+}
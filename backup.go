@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// snapshot is a copy of the filters and labels in the account at a point in
+// time.
+type snapshot struct {
+	Time time.Time `json:"time"`
+	// Account is the address of the account with --account, empty for the
+	// authorized user.
+	Account string          `json:"account,omitempty"`
+	Filters []*gmail.Filter `json:"filters"`
+	Labels  []*gmail.Label  `json:"labels"`
+}
+
+// writeSnapshot downloads the filters and labels in the account and writes
+// them to a timestamped file in dir, which can be an s3:// or gs:// prefix. The
+// file is named after the account with --account, so the snapshots of several
+// accounts can share the directory. It returns the path to the file.
+func writeSnapshot(ctx context.Context, dir string) (string, error) {
+	filters, err := api.Users.Settings.Filters.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("listing filters failed: %v", err)
+	}
+
+	labels, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("listing labels failed: %v", err)
+	}
+
+	s := snapshot{
+		Time:    time.Now().UTC(),
+		Filters: filters.Filter,
+		Labels:  labels.Labels,
+	}
+	if gmailUser != "me" {
+		s.Account = strings.ToLower(gmailUser)
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding snapshot failed: %v", err)
+	}
+
+	name := fmt.Sprintf("snapshot-%s.json", s.Time.Format("20060102T150405.000Z"))
+	if len(s.Account) > 0 {
+		name = fmt.Sprintf("snapshot-%s-%s.json", s.Account, s.Time.Format("20060102T150405.000Z"))
+	}
+	if isObjectURL(dir) {
+		file := joinObjectURL(dir, name)
+		if err := writeObject(ctx, file, b); err != nil {
+			return "", fmt.Errorf("writing snapshot %s failed: %v", file, err)
+		}
+		return file, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating backup directory %s failed: %v", dir, err)
+	}
+
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		return "", fmt.Errorf("writing snapshot %s failed: %v", file, err)
+	}
+
+	return file, nil
+}
+
+// readSnapshot reads a snapshot written by writeSnapshot.
+func readSnapshot(file string) (snapshot, error) {
+	var s snapshot
+
+	b, err := readFile(file)
+	if err != nil {
+		return s, fmt.Errorf("reading snapshot %s failed: %v", file, err)
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("decoding snapshot %s failed: %v", file, err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+	"google.golang.org/api/gmail/v1"
+)
+
+const browseHelp = `Browse and edit the filters in the account in a terminal UI.`
+
+const browseLongHelp = browseHelp + `
+
+Move with the arrow keys or j and k and search with /. The actions of the
+selected filter are toggled with a (archive), r (read), s (star),
+i (important) and t (trash), e edits its query and l its label. Changes
+are staged until they are written to the filter file with w or applied to
+the account with A. q quits.`
+
+func (cmd *browseCommand) Name() string      { return "browse" }
+func (cmd *browseCommand) Args() string      { return "[<file>]" }
+func (cmd *browseCommand) ShortHelp() string { return browseHelp }
+func (cmd *browseCommand) LongHelp() string  { return browseLongHelp }
+func (cmd *browseCommand) Hidden() bool      { return false }
+
+func (cmd *browseCommand) Register(fs *flag.FlagSet) {}
+
+type browseCommand struct{}
+
+func (cmd *browseCommand) Run(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("can only write to one gmail filter configuration file")
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return errors.New("browse needs a terminal")
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	names, err := getLabelMapOnID(ctx)
+	if err != nil {
+		return err
+	}
+
+	b := newBrowser(remote, names)
+	if len(args) > 0 {
+		b.file = args[0]
+	}
+
+	return b.run(ctx, fd)
+}
+
+// browseEntry is a filter shown in the browser along with the filters in the
+// account it was exported from.
+type browseEntry struct {
+	filter  filter
+	sources []gmail.Filter
+	// changed is true if the filter was edited.
+	changed bool
+}
+
+// browseAction is what the browser needs done after a key press, for the
+// things that cannot be done while drawing the screen.
+type browseAction int
+
+const (
+	browseNothing browseAction = iota
+	browseQuit
+	browseWrite
+	browseApply
+)
+
+// browsePrompt is a line of input being read in the status line.
+type browsePrompt struct {
+	label string
+	text  string
+	// done is called with the text once enter is pressed.
+	done func(text string)
+	// changed, if set, is called with the text after every key press.
+	changed func(text string)
+}
+
+// browser is the state of the terminal UI, kept apart from the terminal so it
+// can be driven by keys and rendered to lines.
+type browser struct {
+	entries []browseEntry
+	// file is the filter file changes are written to, if there is one.
+	file string
+	// cursor is the index of the selected entry among the visible ones.
+	cursor int
+	// offset is the index of the first visible entry on screen.
+	offset int
+	search string
+	status string
+	prompt *browsePrompt
+}
+
+// newBrowser returns a browser for the remote filters, merged the same way
+// they are when exported, given a map of label IDs to names.
+func newBrowser(remote []gmail.Filter, names labelMap) *browser {
+	exported := make([]filter, 0, len(remote))
+	for _, f := range remote {
+		exported = append(exported, exportFilter(f, names))
+	}
+
+	merged, sources := mergeExportedFilterSources(exported)
+	b := &browser{}
+	for i, f := range merged {
+		e := browseEntry{filter: f}
+		for _, j := range sources[i] {
+			e.sources = append(e.sources, remote[j])
+		}
+		b.entries = append(b.entries, e)
+	}
+	sortBrowseEntries(b.entries)
+
+	return b
+}
+
+// sortBrowseEntries sorts the entries the same way exported filters are.
+func sortBrowseEntries(entries []browseEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return exportSortKey(entries[i].filter) < exportSortKey(entries[j].filter)
+	})
+}
+
+// visible returns the indexes of the entries matching the search.
+func (b *browser) visible() []int {
+	var idx []int
+	search := strings.ToLower(b.search)
+	for i, e := range b.entries {
+		if len(search) < 1 || strings.Contains(strings.ToLower(browseSummary(e.filter)+" "+e.filter.Label), search) {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// selected returns the selected entry, or nil if no entry is visible.
+func (b *browser) selected() *browseEntry {
+	idx := b.visible()
+	if len(idx) < 1 {
+		return nil
+	}
+	if b.cursor >= len(idx) {
+		b.cursor = len(idx) - 1
+	}
+	return &b.entries[idx[b.cursor]]
+}
+
+// changed returns the entries that were edited.
+func (b *browser) changed() []browseEntry {
+	var changed []browseEntry
+	for _, e := range b.entries {
+		if e.changed {
+			changed = append(changed, e)
+		}
+	}
+	return changed
+}
+
+// key handles a key press and returns what needs to be done next.
+func (b *browser) key(k string) browseAction {
+	if b.prompt != nil {
+		b.promptKey(k)
+		return browseNothing
+	}
+	b.status = ""
+
+	switch k {
+	case "q", "ctrl-c":
+		return browseQuit
+	case "up", "k":
+		if b.cursor > 0 {
+			b.cursor--
+		}
+	case "down", "j":
+		if b.cursor < len(b.visible())-1 {
+			b.cursor++
+		}
+	case "/":
+		b.prompt = &browsePrompt{
+			label:   "Search",
+			text:    b.search,
+			done:    func(text string) {},
+			changed: func(text string) { b.search = text; b.cursor = 0 },
+		}
+	case "a", "r", "s", "i", "t":
+		if e := b.selected(); e != nil {
+			toggleAction(&e.filter, k)
+			e.changed = true
+		}
+	case "e":
+		if e := b.selected(); e != nil {
+			q := e.filter.Query
+			if len(e.filter.QueryOr) > 0 {
+				q = strings.Join(e.filter.QueryOr, " OR ")
+			}
+			b.prompt = &browsePrompt{label: "Query", text: q, done: func(text string) {
+				if _, err := parseQuery(text); err != nil {
+					b.status = fmt.Sprintf("invalid query %q: %v", text, err)
+					return
+				}
+				e.filter.Query = text
+				e.filter.QueryOr = nil
+				e.changed = true
+			}}
+		}
+	case "l":
+		if e := b.selected(); e != nil {
+			b.prompt = &browsePrompt{label: "Label", text: e.filter.Label, done: func(text string) {
+				if len(text) > 0 {
+					if err := validateLabelName(text); err != nil {
+						b.status = err.Error()
+						return
+					}
+				}
+				e.filter.Label = text
+				e.changed = true
+			}}
+		}
+	case "w":
+		return browseWrite
+	case "A":
+		return browseApply
+	}
+
+	return browseNothing
+}
+
+// promptKey handles a key press while reading a line of input.
+func (b *browser) promptKey(k string) {
+	p := b.prompt
+	switch k {
+	case "enter":
+		b.prompt = nil
+		p.done(p.text)
+		return
+	case "esc", "ctrl-c":
+		b.prompt = nil
+		return
+	case "backspace":
+		if r := []rune(p.text); len(r) > 0 {
+			p.text = string(r[:len(r)-1])
+		}
+	case "up", "down", "pgup", "pgdown":
+	default:
+		p.text += k
+	}
+	if p.changed != nil {
+		p.changed(p.text)
+	}
+}
+
+// toggleAction flips the action of the filter bound to the key.
+func toggleAction(f *filter, k string) {
+	switch k {
+	case "a":
+		f.Archive = !f.Archive
+		f.ArchiveUnlessToMe = false
+		f.ArchiveUnlessCcMe = false
+	case "r":
+		f.Read = !f.Read
+	case "s":
+		f.Star = !f.Star
+	case "i":
+		f.Important = !f.Important
+	case "t":
+		f.Delete = !f.Delete
+	}
+}
+
+// browseSummary returns a one line description of what the filter matches.
+func browseSummary(f filter) string {
+	switch {
+	case len(f.Query) > 0:
+		return f.Query
+	case len(f.QueryOr) > 0:
+		return strings.Join(f.QueryOr, " OR ")
+	case len(f.From) > 0:
+		return "from:" + f.From.orQuery()
+	case len(f.To) > 0:
+		return "to:" + f.To.orQuery()
+	case len(f.Subject) > 0:
+		return "subject:" + f.Subject
+	}
+	return "(no criteria)"
+}
+
+// render returns the lines of the screen for the given size.
+func (b *browser) render(width, height int) []string {
+	idx := b.visible()
+	if b.cursor >= len(idx) {
+		b.cursor = len(idx) - 1
+	}
+	if b.cursor < 0 {
+		b.cursor = 0
+	}
+
+	title := fmt.Sprintf("gmailfilters: %d filters, %d changed", len(b.entries), len(b.changed()))
+	if len(b.search) > 0 {
+		title += fmt.Sprintf(", %d matching %q", len(idx), b.search)
+	}
+	lines := []string{fitWidth(title, width)}
+
+	// Keep the cursor on screen.
+	rows := height - 2
+	if rows < 1 {
+		rows = 1
+	}
+	if b.cursor < b.offset {
+		b.offset = b.cursor
+	}
+	if b.cursor >= b.offset+rows {
+		b.offset = b.cursor - rows + 1
+	}
+
+	listWidth := width * 2 / 5
+	var detail []string
+	if e := b.selected(); e != nil {
+		detail = browseDetail(*e)
+	}
+
+	for row := 0; row < rows; row++ {
+		left := ""
+		if i := b.offset + row; i < len(idx) {
+			e := b.entries[idx[i]]
+			marker := "  "
+			if i == b.cursor {
+				marker = "> "
+			}
+			if e.changed {
+				marker = marker[:1] + "*"
+			}
+			left = marker + browseSummary(e.filter)
+		}
+		right := ""
+		if row < len(detail) {
+			right = detail[row]
+		}
+		lines = append(lines, fitWidth(padWidth(left, listWidth-1)+"│"+right, width))
+	}
+
+	status := b.status
+	switch {
+	case b.prompt != nil:
+		status = b.prompt.label + ": " + b.prompt.text + "_"
+	case len(status) < 1:
+		status = "a archive  r read  s star  i important  t trash  e query  l label  / search  w write  A apply  q quit"
+	}
+	lines = append(lines, fitWidth(status, width))
+
+	return lines
+}
+
+// browseDetail returns the lines describing the entry: its TOML form and the
+// filters in the account it came from.
+func browseDetail(e browseEntry) []string {
+	var buf bytes.Buffer
+	encoder := toml.NewEncoder(&buf)
+	encoder.Indent = ""
+	if err := encoder.Encode(filterfile{Filter: []filter{e.filter}}); err != nil {
+		return []string{err.Error()}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		// Leave out the settings that are not set.
+		if strings.HasSuffix(line, "= false") || strings.HasSuffix(line, `= ""`) {
+			continue
+		}
+		lines = append(lines, " "+line)
+	}
+
+	lines = append(lines, "")
+	for _, f := range e.sources {
+		lines = append(lines, fmt.Sprintf(" filter %s (fingerprint %s)", f.Id, fingerprint(f)))
+	}
+	if len(e.sources) < 1 {
+		lines = append(lines, " not in the account")
+	}
+	return lines
+}
+
+// fitWidth cuts the line to the width.
+func fitWidth(s string, width int) string {
+	if width < 1 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// padWidth cuts or pads the line to the width.
+func padWidth(s string, width int) string {
+	s = fitWidth(s, width)
+	if n := width - len([]rune(s)); n > 0 {
+		s += strings.Repeat(" ", n)
+	}
+	return s
+}
+
+// run draws the browser on the terminal and handles key presses until the
+// user quits.
+func (b *browser) run(ctx context.Context, fd int) error {
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("setting up the terminal failed: %v", err)
+	}
+	// Use the alternate screen so the shell is left as it was.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	restore := func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		terminal.Restore(fd, state)
+	}
+	defer func() { restore() }()
+
+	buf := make([]byte, 64)
+	for {
+		width, height, err := terminal.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		fmt.Print("\x1b[H\x1b[2J" + strings.Join(b.render(width, height), "\r\n"))
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		switch b.key(parseKey(buf[:n])) {
+		case browseQuit:
+			return nil
+		case browseWrite:
+			b.status = b.write()
+		case browseApply:
+			// Leave the screen so the plan can be confirmed.
+			restore()
+			if err := b.apply(ctx); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Print("Press enter to continue")
+			fmt.Scanln()
+			if state, err = terminal.MakeRaw(fd); err != nil {
+				return fmt.Errorf("setting up the terminal failed: %v", err)
+			}
+			fmt.Print("\x1b[?1049h\x1b[?25l")
+		}
+	}
+}
+
+// parseKey returns the name of the key read from the terminal, or the text
+// that was typed.
+func parseKey(in []byte) string {
+	switch string(in) {
+	case "\x1b[A", "\x1bOA":
+		return "up"
+	case "\x1b[B", "\x1bOB":
+		return "down"
+	case "\x1b[5~":
+		return "pgup"
+	case "\x1b[6~":
+		return "pgdown"
+	case "\x1b":
+		return "esc"
+	case "\r", "\n":
+		return "enter"
+	case "\x7f", "\b":
+		return "backspace"
+	case "\x03":
+		return "ctrl-c"
+	}
+	return string(in)
+}
+
+// write writes all the entries to the filter file, returning the status to
+// show.
+func (b *browser) write() string {
+	if len(b.file) < 1 {
+		return "no filter file to write to, pass one to browse"
+	}
+
+	filters := make([]filter, 0, len(b.entries))
+	for _, e := range b.entries {
+		filters = append(filters, e.filter)
+	}
+
+	// Keep the comments of an existing file. Both print a summary, which the
+	// next draw clears.
+	var err error
+	if _, serr := os.Stat(b.file); serr == nil {
+		err = mergeFiltersIntoFile(filters, b.file)
+	} else {
+		err = writeFiltersToFile(filterfile{Filter: filters}, b.file)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("wrote %d filters to %s", len(filters), b.file)
+}
+
+// apply replaces the filters in the account the changed entries came from
+// with the changed entries, leaving all the other filters alone.
+func (b *browser) apply(ctx context.Context) error {
+	changed := b.changed()
+	if len(changed) < 1 {
+		infof("Nothing to apply\n")
+		return nil
+	}
+
+	labels, err := getLabelMap(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wanted, remote []gmail.Filter
+	for _, e := range changed {
+		gf, err := e.filter.toGmailFilters(ctx, &labels)
+		if err != nil {
+			return fmt.Errorf("%s: %v", browseSummary(e.filter), err)
+		}
+		wanted = append(wanted, gf...)
+		remote = append(remote, e.sources...)
+	}
+
+	diff := computeDiff(wanted, remote)
+	printDiff(promptOut(), diff, labelNamesByID(ctx))
+	if diff.empty() {
+		return nil
+	}
+	if err := checkForwardingAddresses(ctx, diff); err != nil {
+		return err
+	}
+
+	ok, err := confirm(fmt.Sprintf("Apply the changes to %d filters?", len(changed)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAborted
+	}
+
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+	file, err := writeSnapshot(ctx, backupDir)
+	if err != nil {
+		return err
+	}
+	infof("Backed up existing filters to %s\n", file)
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+	_, err = applyDiff(ctx, diff, state, nil)
+	if serr := state.save(stateFile); serr != nil {
+		logrus.Warn(serr)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The account now has the changed filters.
+	remaining, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	names := labelNamesByID(ctx)
+	*b = browser{file: b.file, search: b.search, entries: newBrowser(remaining, names).entries}
+	infof("Applied the changes to %d filters\n", len(changed))
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestBrowser(t *testing.T) {
+	labels := &labelMap{"dev": "Label_1"}
+	var remote []gmail.Filter
+	for i, f := range []filter{
+		{Query: "list:dev", Label: "dev", ArchiveUnlessToMe: true},
+		{From: stringList{"a@example.com"}, Read: true},
+	} {
+		gf, err := f.toGmailFilters(context.Background(), labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range gf {
+			gf[j].Id = string(rune('a'+i)) + string(rune('0'+j))
+		}
+		remote = append(remote, gf...)
+	}
+
+	b := newBrowser(remote, labelMap{"Label_1": "dev"})
+	if len(b.entries) != 2 {
+		t.Fatalf("expected the archiveUnlessToMe filters to be merged into 2 entries, got %d", len(b.entries))
+	}
+
+	// Search for the mailing list and archive all of it.
+	for _, k := range []string{"/", "l", "i", "s", "t", "enter", "a"} {
+		b.key(k)
+	}
+	e := b.selected()
+	if e.filter.Query != "list:dev" || !e.filter.Archive || e.filter.ArchiveUnlessToMe || !e.changed {
+		t.Fatalf("expected the mailing list filter to archive everything, got %#v", e)
+	}
+	if len(e.sources) != 2 {
+		t.Fatalf("expected the entry to come from 2 filters, got %d", len(e.sources))
+	}
+
+	// Invalid queries are not taken.
+	for _, k := range []string{"e", "backspace", "backspace", "backspace", "(", "enter"} {
+		b.key(k)
+	}
+	if e.filter.Query != "list:dev" || !strings.Contains(b.status, "invalid query") {
+		t.Fatalf("expected the invalid query to be refused, got %q and status %q", e.filter.Query, b.status)
+	}
+
+	lines := b.render(80, 10)
+	if len(lines) != 10 {
+		t.Fatalf("expected 10 lines, got %d", len(lines))
+	}
+	if !strings.Contains(lines[0], "2 filters, 1 changed, 1 matching \"list\"") {
+		t.Fatalf("unexpected title %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], ">*list:dev") {
+		t.Fatalf("expected the selected entry first, got %q", lines[1])
+	}
+
+	if b.key("q") != browseQuit {
+		t.Fatal("expected q to quit")
+	}
+}
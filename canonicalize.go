@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const canonicalizeHelp = `Print filter files in a canonical form to compare them as text.`
+
+const canonicalizeLongHelp = canonicalizeHelp + `
+
+The snippets, templates, queryOr lists and match blocks are expanded into
+plain queries, the queries are normalized, and the filters and labels are
+sorted, so two files from different sources that mean the same thing print
+the same. The filter files are merged into one, without the filters they
+suppress.`
+
+func (cmd *canonicalizeCommand) Name() string      { return "canonicalize" }
+func (cmd *canonicalizeCommand) Args() string      { return "<file>..." }
+func (cmd *canonicalizeCommand) ShortHelp() string { return canonicalizeHelp }
+func (cmd *canonicalizeCommand) LongHelp() string  { return canonicalizeLongHelp }
+func (cmd *canonicalizeCommand) Hidden() bool      { return false }
+
+func (cmd *canonicalizeCommand) Register(fs *flag.FlagSet) {}
+
+type canonicalizeCommand struct{}
+
+func (cmd *canonicalizeCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	values, err := flagTemplateValues()
+	if err != nil {
+		return err
+	}
+
+	// The files are decoded without putting the filters in the group of
+	// their file, which would tell apart files with the same filters.
+	var ff filterfile
+	for _, file := range args {
+		f, err := decodeFile(file, values)
+		if err != nil {
+			return withExitCode(exitValidation, err)
+		}
+		if expandEnvVars {
+			if f.Filter, err = expandFilterEnv(f.Filter); err != nil {
+				return withExitCode(exitValidation, err)
+			}
+		}
+		if ff.Filter, err = suppressFilters(ff.Filter, f.Suppress); err != nil {
+			return withExitCode(exitValidation, fmt.Errorf("%s: %v", file, err))
+		}
+		if ff, err = ff.merge(f); err != nil {
+			return withExitCode(exitValidation, fmt.Errorf("merging filter file %s failed: %v", file, err))
+		}
+	}
+
+	b, err := canonicalFilterFile(ff)
+	if err != nil {
+		return withExitCode(exitValidation, err)
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// canonicalFilterFile returns the filter file in canonical form, formatted
+// like fmt does.
+func canonicalFilterFile(ff filterfile) ([]byte, error) {
+	// The filters are sorted like export does, and then on all they set.
+	type entry struct {
+		key  string
+		text string
+	}
+	entries := make([]entry, 0, len(ff.Filter))
+	for _, f := range ff.Filter {
+		c, err := f.canonical()
+		if err != nil {
+			return nil, err
+		}
+
+		var text bytes.Buffer
+		text.WriteString("[[filter]]\n")
+		writeCanonicalFields(&text, c, canonicalFilterFields...)
+		if c.LabelColor != nil {
+			text.WriteString("[filter.labelColor]\n")
+			writeCanonicalFields(&text, *c.LabelColor, "Background", "Text")
+		}
+		entries = append(entries, entry{key: exportSortKey(c), text: text.String()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].text < entries[j].text
+	})
+
+	protect := append([]protectRule{}, ff.Protect...)
+	sort.SliceStable(protect, func(i, j int) bool {
+		return protect[i].Fingerprint+"\x00"+protect[i].Query < protect[j].Fingerprint+"\x00"+protect[j].Query
+	})
+
+	var buf bytes.Buffer
+	for _, p := range protect {
+		buf.WriteString("[[protect]]\n")
+		writeCanonicalFields(&buf, p, "Fingerprint", "Query")
+	}
+	writeCanonicalLabels(&buf, sortedLabelDefinitions(ff.Label), "label")
+	for _, e := range entries {
+		buf.WriteString(e.text)
+	}
+
+	return formatFilterFile(buf.Bytes())
+}
+
+// canonicalFilterFields are the fields of a canonical filter written as
+// keys, the query is all that is left of QueryOr and Match.
+var canonicalFilterFields = []string{
+	"Query",
+	"Archive",
+	"Read",
+	"Delete",
+	"Star",
+	"Important",
+	"NeverImportant",
+	"NeverSpam",
+	"ToMe",
+	"ArchiveUnlessToMe",
+	"ArchiveUnlessCcMe",
+	"From",
+	"To",
+	"Subject",
+	"NegatedQuery",
+	"HasAttachment",
+	"ExcludeChats",
+	"Size",
+	"SizeComparison",
+	"Label",
+	"LabelListVisibility",
+	"MessageListVisibility",
+	"ForwardTo",
+	"Group",
+}
+
+// writeCanonicalFields writes the fields of v that are set as keys.
+func writeCanonicalFields(buf *bytes.Buffer, v interface{}, fields ...string) {
+	rv := reflect.ValueOf(v)
+	for _, field := range fields {
+		fv := rv.FieldByName(field)
+		if isEmptyValue(fv) {
+			continue
+		}
+		fmt.Fprintf(buf, "%s = %s\n", lowerFirst(field), tomlValue(fv))
+	}
+}
+
+// writeCanonicalLabels writes the label definitions as the array of tables
+// named name, with their nested labels.
+func writeCanonicalLabels(buf *bytes.Buffer, defs []labelDefinition, name string) {
+	for _, d := range defs {
+		fmt.Fprintf(buf, "[[%s]]\n", name)
+		writeCanonicalFields(buf, d, "Name", "LabelListVisibility", "MessageListVisibility")
+		if d.Color != nil {
+			fmt.Fprintf(buf, "[%s.color]\n", name)
+			writeCanonicalFields(buf, *d.Color, "Background", "Text")
+		}
+		writeCanonicalLabels(buf, d.Label, name+".label")
+	}
+}
+
+// canonical returns the filter with its queryOr and match block compiled
+// into its query, the queries normalized and the from and to lists sorted.
+// Queries mixing OR with other terms without parentheses are only
+// normalized, with a warning.
+func (f filter) canonical() (filter, error) {
+	q, err := f.compiledQuery(nil)
+	if err != nil {
+		return f, err
+	}
+	f.QueryOr, f.Match = nil, nil
+
+	for _, query := range []*string{&q, &f.NegatedQuery} {
+		if len(*query) < 1 {
+			continue
+		}
+		c, err := canonicalQuery(*query)
+		if err != nil {
+			if _, perr := parseQuery(*query); perr != nil {
+				return f, fmt.Errorf("query %q is invalid: %v", *query, perr)
+			}
+			logrus.Warnf("Filter with query %q: %v", *query, err)
+			c = normalizeQuery(*query)
+		}
+		*query = c
+	}
+	f.Query = q
+
+	f.From, f.To = sortedList(f.From), sortedList(f.To)
+	return f, nil
+}
+
+// sortedList returns a sorted copy of the list.
+func sortedList(l stringList) stringList {
+	if l == nil {
+		return nil
+	}
+	sorted := append(stringList{}, l...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i]) < strings.ToLower(sorted[j])
+	})
+	return sorted
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCanonicalFilterFile(t *testing.T) {
+	a := `
+[[filter]]
+queryOr = ["list:dev", "list:announce"]
+label = "lists"
+archive = true
+
+[[filter]]
+from = ["b@example.com", "a@example.com"]
+label = "friends"
+star = true
+
+[[label]]
+name = "zebra"
+[[label]]
+name = "lists"
+`
+	b := `
+[snippets]
+dev = "list:dev"
+
+[[label]]
+name = "lists"
+
+[[filter]]
+From = ["a@example.com", "b@example.com"]
+Star = true
+Label = "friends"
+
+[[label]]
+name = "zebra"
+
+[[filter]]
+label = "lists"
+query = "( @dev  |  LIST:announce )"
+archive = true
+`
+	expected := `[[label]]
+name = "lists"
+
+[[label]]
+name = "zebra"
+
+[[filter]]
+star = true
+from = ["a@example.com", "b@example.com"]
+label = "friends"
+
+[[filter]]
+query = "list:dev OR list:announce"
+archive = true
+label = "lists"
+`
+
+	var (
+		outputs []string
+		err     error
+	)
+	for _, in := range []string{a, b} {
+		var ff filterfile
+		if _, err := toml.Decode(in, &ff); err != nil {
+			t.Fatal(err)
+		}
+		ff.Filter, err = expandFilterSnippets(ff.Filter, ff.Snippets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := canonicalFilterFile(ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, string(got))
+	}
+
+	if diff := cmp.Diff(expected, outputs[0]); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if diff := cmp.Diff(outputs[0], outputs[1]); len(diff) > 1 {
+		t.Fatalf("expected both files to be canonicalized the same, got diff: %s", diff)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const checkHelp = `Check that the filters in the account match a filter file.`
+
+const checkLongHelp = checkHelp + `
+
+Exits with 6 if a sync would change anything. A summary line of
+space separated key=value pairs is written to stdout and the details
+to stderr, so it can be run from CI. With --output json the whole
+plan is written to stdout as JSON instead.`
+
+func (cmd *checkCommand) Name() string      { return "check" }
+func (cmd *checkCommand) Args() string      { return "<file>..." }
+func (cmd *checkCommand) ShortHelp() string { return checkHelp }
+func (cmd *checkCommand) LongHelp() string  { return checkLongHelp }
+func (cmd *checkCommand) Hidden() bool      { return false }
+
+func (cmd *checkCommand) Register(fs *flag.FlagSet) {
+	registerSyncFlags(fs)
+
+	fs.StringVar(&cmd.output, "output", "text", "output format: text or json")
+}
+
+type checkCommand struct {
+	output string
+}
+
+// errDrift is returned when the account does not match the filter file.
+var errDrift = errors.New("the filters in the account have drifted from the filter file")
+
+func (cmd *checkCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+	if err := validateOutput(cmd.output); err != nil {
+		return err
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	diff, newLabels, names, err := planSync(ctx, ff)
+	if err != nil {
+		return err
+	}
+
+	// Only what a sync would change counts as drift.
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+	diff = diff.scoped(state, ff.Protect)
+
+	if cmd.output == "json" {
+		status := "ok"
+		if drifted(diff, newLabels) {
+			status = "drift"
+		}
+		if err := writeDiffJSON(os.Stdout, status, diff, newLabels, names); err != nil {
+			return err
+		}
+		if status == "drift" {
+			return errDrift
+		}
+		return nil
+	}
+
+	printCheckSummary(os.Stdout, diff, newLabels)
+	if !drifted(diff, newLabels) {
+		return nil
+	}
+
+	for _, name := range newLabels {
+		noticef("+ label %s\n", name)
+	}
+	printDiff(noticeOut(), diff, names)
+
+	return errDrift
+}
+
+// printCheckSummary writes a single line summary of the drift.
+func printCheckSummary(w io.Writer, diff filterDiff, newLabels []string) {
+	status := "ok"
+	if drifted(diff, newLabels) {
+		status = "drift"
+	}
+
+	fmt.Fprintf(w, "status=%s labels=%d create=%d update=%d delete=%d unchanged=%d kept=%d protected=%d conflicts=%d\n",
+		status, len(newLabels), len(diff.Create), len(diff.Update), len(diff.Delete),
+		len(diff.Unchanged), len(diff.Kept), len(diff.Protected), len(diff.Conflicts))
+}
+
+// drifted returns true if the account does not match the file. Filters
+// changed in the account since the last sync count even though a sync would
+// leave them alone.
+func drifted(diff filterDiff, newLabels []string) bool {
+	return !diff.empty() || len(newLabels) > 0 || len(diff.Conflicts) > 0
+}
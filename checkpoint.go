@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// checkpoint records the progress of a sync while it is being applied, so a
+// sync that was interrupted or partially failed can be resumed. It is
+// written next to the state file and removed once the sync finishes.
+type checkpoint struct {
+	Time time.Time `json:"time"`
+	// Created holds the filters created so far.
+	Created []gmail.Filter `json:"created"`
+	// Delete holds the filters the sync still has to delete.
+	Delete []gmail.Filter `json:"delete"`
+
+	file string
+}
+
+// checkpointFile returns the path to the checkpoint for the state file.
+func checkpointFile() string {
+	return stateFile + ".checkpoint"
+}
+
+// loadCheckpoint reads the checkpoint file, returning nil if there is no
+// sync to resume.
+func loadCheckpoint(file string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s failed: %v", file, err)
+	}
+
+	c := &checkpoint{file: file}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("decoding checkpoint %s failed: %v", file, err)
+	}
+
+	return c, nil
+}
+
+// save writes the checkpoint to its file. It does nothing for a nil
+// checkpoint so callers that do not need one can pass nil.
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint failed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(c.file, b, 0600); err != nil {
+		return fmt.Errorf("writing checkpoint %s failed: %v", c.file, err)
+	}
+
+	return nil
+}
+
+// created records that the filter was created.
+func (c *checkpoint) created(f gmail.Filter) error {
+	if c == nil {
+		return nil
+	}
+	c.Created = append(c.Created, f)
+	return c.save()
+}
+
+// deleted records that the filter was deleted.
+func (c *checkpoint) deleted(f gmail.Filter) error {
+	if c == nil {
+		return nil
+	}
+	var remaining []gmail.Filter
+	for _, d := range c.Delete {
+		if d.Id != f.Id {
+			remaining = append(remaining, d)
+		}
+	}
+	c.Delete = remaining
+	return c.save()
+}
+
+// remove deletes the checkpoint file once the sync is done.
+func (c *checkpoint) remove() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing checkpoint %s failed: %v", c.file, err)
+	}
+	return nil
+}
+
+// resumed returns the diff with the remote filters the checkpointed sync
+// still had to delete moved back into the deletions. They were already
+// approved, so they are deleted even if we are not pruning.
+func (d filterDiff) resumed(c *checkpoint) filterDiff {
+	pending := map[string]bool{}
+	for _, f := range c.Delete {
+		pending[f.Id] = true
+	}
+
+	var kept []gmail.Filter
+	for _, f := range d.Kept {
+		if pending[f.Id] {
+			d.Delete = append(d.Delete, f)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	d.Kept = kept
+	return d
+}
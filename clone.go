@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+)
+
+const cloneHelp = `Copy the filters and labels of an account to another.`
+
+const cloneLongHelp = cloneHelp + `
+
+Reads the filters and the labels, with their colors and visibility, of the
+first account and syncs the second one with them, as if they were exported
+and applied, for moving to a new address. Each account uses its own token
+and state, like with --account, and is authorized if it was not yet.
+Pass --prune to also delete the filters of the second account that the
+first one does not have.`
+
+func (cmd *cloneCommand) Name() string      { return "clone" }
+func (cmd *cloneCommand) Args() string      { return "<from> <to>" }
+func (cmd *cloneCommand) ShortHelp() string { return cloneHelp }
+func (cmd *cloneCommand) LongHelp() string  { return cloneLongHelp }
+func (cmd *cloneCommand) Hidden() bool      { return false }
+
+func (cmd *cloneCommand) Register(fs *flag.FlagSet) {
+	registerSyncFlags(fs)
+
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes that would be made without making them")
+
+	fs.BoolVar(&continueOnError, "continue-on-error", false, "keep going when a filter fails and report all failures at the end")
+
+	cmd.fs = fs
+}
+
+type cloneCommand struct {
+	fs *flag.FlagSet
+}
+
+func (cmd *cloneCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("must pass the account to copy from and the account to copy to")
+	}
+	if flagPassed(cmd.fs, "token-file") || flagPassed(cmd.fs, "impersonate") {
+		return errors.New("cannot clone with --token-file or --impersonate, each account needs its own")
+	}
+
+	if err := useAccount(cmd.fs, args[0]); err != nil {
+		return err
+	}
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	ff, err := accountFilterFile(ctx)
+	if err != nil {
+		return err
+	}
+	infof("Read %d filters and %d labels from %s\n", len(ff.Filter), len(ff.Label), args[0])
+
+	if err := useAccount(cmd.fs, args[1]); err != nil {
+		return err
+	}
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	return syncFilterFile(ctx, ff, "text")
+}
+
+// accountFilterFile returns the filters and the labels in the account as a
+// filter file, like export.
+func accountFilterFile(ctx context.Context) (filterfile, error) {
+	filters, err := getExistingFilters(ctx)
+	if err != nil {
+		return filterfile{}, err
+	}
+	labels, err := exportLabels(ctx)
+	if err != nil {
+		return filterfile{}, err
+	}
+
+	sortExportedFilters(filters)
+	return filterfile{Label: labels, Filter: mergeExportedFilters(filters)}, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestAccountFilterFile(t *testing.T) {
+	// A fake Gmail API with two labels and the filters adding them.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/me/labels":
+			json.NewEncoder(w).Encode(gmail.ListLabelsResponse{Labels: []*gmail.Label{
+				{Id: "INBOX", Name: "INBOX", Type: "system"},
+				{Id: "Label_2", Name: "Lists/golang", Type: "user"},
+				{Id: "Label_1", Name: "Lists", Type: "user", LabelListVisibility: "labelShow", Color: &gmail.LabelColor{BackgroundColor: "#000000", TextColor: "#ffffff"}},
+			}})
+		case "/me/settings/filters":
+			json.NewEncoder(w).Encode(gmail.ListFiltersResponse{Filter: []*gmail.Filter{
+				{Id: "1", Criteria: &gmail.FilterCriteria{Query: "list:golang-nuts"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_2"}}},
+				{Id: "2", Criteria: &gmail.FilterCriteria{Query: "list:golang-nuts"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	// Listing the labels caches their names next to the state.
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { stateFile = old }(stateFile)
+	stateFile = filepath.Join(dir, "state.json")
+
+	ff, err := accountFilterFile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []labelDefinition{
+		{Name: "Lists", LabelListVisibility: "labelShow", Color: &labelColor{Background: "#000000", Text: "#ffffff"}},
+		{Name: "Lists/golang"},
+	}
+	if diff := cmp.Diff(expected, ff.Label); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if len(ff.Filter) != 1 || ff.Filter[0].Label != "Lists/golang" || !ff.Filter[0].Archive {
+		t.Fatalf("expected the filters to be merged into one, got %+v", ff.Filter)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// The ANSI escape codes used to color diffs.
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// useColor returns true if the output written to w should be colored, as
+// asked for with --color. By default only terminals get colors, unless the
+// NO_COLOR environment variable is set.
+func useColor(w io.Writer) bool {
+	switch colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+
+	if len(os.Getenv("NO_COLOR")) > 0 || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+
+	return isTerminal(w)
+}
+
+// isTerminal returns true if w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printDiffLine writes a line of a diff, colored by its prefix.
+func printDiffLine(w io.Writer, line string) {
+	color := ""
+	if len(line) > 0 && useColor(w) {
+		switch line[0] {
+		case '+':
+			color = colorGreen
+		case '-':
+			color = colorRed
+		case '!':
+			color = colorYellow
+		case '@':
+			color = colorCyan
+		}
+	}
+
+	if len(color) < 1 {
+		fmt.Fprintln(w, line)
+		return
+	}
+	fmt.Fprintln(w, color+line+colorReset)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/genuinetools/pkg/cli"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+const completionHelp = `Print a shell completion script for bash, zsh or fish.`
+
+const completionLongHelp = completionHelp + `
+
+Load it from your shell profile, for example:
+
+  source <(gmailfilters completion bash)
+  source <(gmailfilters completion zsh)
+  gmailfilters completion fish | source
+
+The --only flag and the pattern of rm complete the names of the labels seen
+the last time the labels were listed from the account.`
+
+func (cmd *completionCommand) Name() string      { return "completion" }
+func (cmd *completionCommand) Args() string      { return "<bash|zsh|fish>" }
+func (cmd *completionCommand) ShortHelp() string { return completionHelp }
+func (cmd *completionCommand) LongHelp() string  { return completionLongHelp }
+func (cmd *completionCommand) Hidden() bool      { return false }
+
+func (cmd *completionCommand) Register(fs *flag.FlagSet) {}
+
+// completionCommand needs the other commands and the global flags to
+// complete them.
+type completionCommand struct {
+	commands []cli.Command
+	global   *flag.FlagSet
+}
+
+func (cmd *completionCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("must pass the shell to print the completion script for: bash, zsh or fish")
+	}
+
+	commands := completionCommands(cmd.commands, cmd.global)
+	switch args[0] {
+	case "bash":
+		return writeBashCompletion(os.Stdout, commands)
+	case "zsh":
+		// zsh can run bash completion functions.
+		fmt.Fprintln(os.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+		return writeBashCompletion(os.Stdout, commands)
+	case "fish":
+		return writeFishCompletion(os.Stdout, commands)
+	}
+	return fmt.Errorf("unsupported shell %q, must be bash, zsh or fish", args[0])
+}
+
+// completedCommand is a command along with the flags it takes.
+type completedCommand struct {
+	name  string
+	help  string
+	flags []string
+}
+
+// completionCommands returns the visible commands with their flags, the
+// global flags included, sorted by name.
+func completionCommands(commands []cli.Command, global *flag.FlagSet) []completedCommand {
+	var globalFlags []string
+	global.VisitAll(func(f *flag.Flag) {
+		globalFlags = append(globalFlags, f.Name)
+	})
+
+	completed := []completedCommand{{name: "version", help: "Show the version information.", flags: globalFlags}}
+	for _, c := range commands {
+		if c.Hidden() {
+			continue
+		}
+
+		// The flags are registered on a scratch set to list them.
+		fs := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+		c.Register(fs)
+		flags := append([]string{}, globalFlags...)
+		fs.VisitAll(func(f *flag.Flag) {
+			flags = append(flags, f.Name)
+		})
+		sort.Strings(flags)
+
+		completed = append(completed, completedCommand{name: c.Name(), help: c.ShortHelp(), flags: flags})
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].name < completed[j].name
+	})
+	return completed
+}
+
+// writeBashCompletion writes the bash completion script.
+func writeBashCompletion(w io.Writer, commands []completedCommand) error {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+
+	fmt.Fprintf(w, `_gmailfilters() {
+	local cur prev flags
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+
+	local IFS=$'\n'
+	if [ "$prev" = "--only" ] || [ "$prev" = "-only" ] || { [ "${COMP_WORDS[1]}" = "rm" ] && [ "$COMP_CWORD" -eq 2 ]; }; then
+		COMPREPLY=($(compgen -W "$(gmailfilters __labels 2>/dev/null)" -- "$cur"))
+		return
+	fi
+	unset IFS
+
+	case "$cur" in
+	-*)
+		case "${COMP_WORDS[1]}" in
+`, strings.Join(names, " "))
+
+	for _, c := range commands {
+		var flags []string
+		for _, f := range c.flags {
+			if len(f) == 1 {
+				flags = append(flags, "-"+f)
+				continue
+			}
+			flags = append(flags, "--"+f)
+		}
+		fmt.Fprintf(w, "\t\t%s) flags=\"%s\" ;;\n", c.name, strings.Join(flags, " "))
+	}
+
+	_, err := fmt.Fprint(w, `		esac
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+		;;
+	*)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		;;
+	esac
+}
+complete -o filenames -F _gmailfilters gmailfilters
+`)
+	return err
+}
+
+// writeFishCompletion writes the fish completion script.
+func writeFishCompletion(w io.Writer, commands []completedCommand) error {
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c gmailfilters -n __fish_use_subcommand -f -a %s -d %s\n", c.name, fishQuote(c.help))
+	}
+	for _, c := range commands {
+		for _, f := range c.flags {
+			option := "-l"
+			if len(f) == 1 {
+				option = "-s"
+			}
+			fmt.Fprintf(w, "complete -c gmailfilters -n '__fish_seen_subcommand_from %s' %s %s\n", c.name, option, f)
+		}
+	}
+	fmt.Fprintln(w, "complete -c gmailfilters -n '__fish_seen_subcommand_from apply check diff explain' -l only -x -a '(gmailfilters __labels 2>/dev/null)'")
+	_, err := fmt.Fprintln(w, "complete -c gmailfilters -n '__fish_seen_subcommand_from rm' -f -a '(gmailfilters __labels 2>/dev/null)'")
+	return err
+}
+
+// fishQuote quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+const labelsCompletionHelp = `Print the cached label names, for shell completion.`
+
+func (cmd *labelsCompletionCommand) Name() string      { return "__labels" }
+func (cmd *labelsCompletionCommand) Args() string      { return "" }
+func (cmd *labelsCompletionCommand) ShortHelp() string { return labelsCompletionHelp }
+func (cmd *labelsCompletionCommand) LongHelp() string  { return labelsCompletionHelp }
+func (cmd *labelsCompletionCommand) Hidden() bool      { return true }
+
+func (cmd *labelsCompletionCommand) Register(fs *flag.FlagSet) {}
+
+type labelsCompletionCommand struct{}
+
+// Run prints the cached names without talking to the API, so completing is
+// fast and never asks to authorize.
+func (cmd *labelsCompletionCommand) Run(ctx context.Context, args []string) error {
+	b, err := ioutil.ReadFile(labelCacheFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// labelCacheFile returns the file the names of the labels in the account are
+// cached in for shell completion, next to the state file.
+func labelCacheFile() string {
+	return filepath.Join(filepath.Dir(stateFile), "gmailfilters-labels.txt")
+}
+
+// cacheLabelNames writes the names of the user labels to the label cache,
+// one per line. Failing to is not worth failing the command over.
+func cacheLabelNames(labels []*gmail.Label) {
+	var names []string
+	for _, l := range labels {
+		if l.Type != "system" {
+			names = append(names, l.Name)
+		}
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(labelCacheFile())
+	if err != nil {
+		logrus.Debugf("Caching label names failed: %v", err)
+		return
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	for _, name := range names {
+		fmt.Fprintln(bw, name)
+	}
+	if err := bw.Flush(); err != nil {
+		logrus.Debugf("Caching label names failed: %v", err)
+	}
+}
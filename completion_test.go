@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/genuinetools/pkg/cli"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompletionCommands(t *testing.T) {
+	global := flag.NewFlagSet("gmailfilters", flag.ContinueOnError)
+	global.Bool("d", false, "")
+	global.String("creds-file", "", "")
+
+	commands := completionCommands([]cli.Command{&validateCommand{}, &labelsCompletionCommand{}}, global)
+	expected := []completedCommand{
+		{name: "validate", help: validateHelp, flags: []string{"creds-file", "d", "strict"}},
+		{name: "version", help: "Show the version information.", flags: []string{"creds-file", "d"}},
+	}
+	if diff := cmp.Diff(expected, commands, cmp.AllowUnexported(completedCommand{})); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := writeBashCompletion(&buf, commands); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`compgen -W "validate version"`, `validate) flags="--creds-file -d --strict" ;;`, "complete -o filenames -F _gmailfilters gmailfilters"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected the bash script to contain %s, got:\n%s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := writeFishCompletion(&buf, commands); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"-f -a validate -d 'Check filter files for mistakes without talking to Gmail.'", "'__fish_seen_subcommand_from validate' -s d", "'__fish_seen_subcommand_from validate' -l strict"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected the fish script to contain %s, got:\n%s", s, buf.String())
+		}
+	}
+}
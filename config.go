@@ -0,0 +1,384 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+// configFile is the path of the config file, passed with --config.
+var configFile string
+
+// configDir is the directory holding the config file, the token, the state
+// and the backups, passed with --config-dir.
+var configDir string
+
+// profile is the profile of the config file to use, passed with --profile.
+var profile string
+
+// configDirFiles are the names in the config directory of the files and
+// directories the flags default to.
+var configDirFiles = map[string]string{
+	"config":     "config.toml",
+	"token-file": "token.json",
+	"state-file": "state.json",
+	"backup-dir": "backups",
+}
+
+// legacyFiles are where the token and the state used to be kept, moved to the
+// config directory the first time it is used.
+var legacyFiles = map[string]string{
+	"token-file": filepath.Join(os.TempDir(), "token.json"),
+	"state-file": filepath.Join(os.TempDir(), "gmailfilters-state.json"),
+}
+
+// defaultFiles are the filter files used by the commands taking filter files
+// when none are passed, as set in the config file.
+var defaultFiles []string
+
+// flagAliases maps the short names of the global flags to their long names,
+// so a setting applies to both.
+var flagAliases = map[string]string{
+	"d":     "debug",
+	"f":     "creds-file",
+	"force": "yes",
+	"q":     "quiet",
+	"t":     "token-file",
+	"y":     "yes",
+}
+
+// canonicalFlag returns the long name of the flag.
+func canonicalFlag(name string) string {
+	if long, ok := flagAliases[name]; ok {
+		return long
+	}
+	return name
+}
+
+// defaultConfigDir returns the gmailfilters directory in the user config
+// directory of the platform: $XDG_CONFIG_HOME or ~/.config on Linux,
+// ~/Library/Application Support on macOS and %AppData% on Windows.
+func defaultConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "gmailfilters")
+	}
+	return filepath.Join(dir, "gmailfilters")
+}
+
+// configDirFile returns the path in the default config directory the flag
+// defaults to.
+func configDirFile(name string) string {
+	return filepath.Join(defaultConfigDir(), configDirFiles[name])
+}
+
+// profileNamePattern is what the names of the profiles can be made of, as
+// they name a directory.
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// profileDir returns the directory in the config directory holding the
+// token, the state and the backups of the profile.
+func profileDir(name string) string {
+	return filepath.Join(configDir, "profiles", name)
+}
+
+// applyConfigDir points the flags not passed at their files in the config
+// directory, creating it, and moves the token and the state there from where
+// they used to be kept. With a profile, the files but the config file are in
+// the directory of the profile. The flags are not marked as set, so the
+// config file can still change them.
+func applyConfigDir(fs *flag.FlagSet) error {
+	dir := configDir
+	if len(profile) > 0 {
+		if !profileNamePattern.MatchString(profile) {
+			return fmt.Errorf("invalid profile %q, must be made of letters, digits, - and _", profile)
+		}
+		dir = profileDir(profile)
+	}
+
+	passed := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		passed[canonicalFlag(f.Name)] = true
+	})
+
+	names := make([]string, 0, len(configDirFiles))
+	for name := range configDirFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	created := false
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || passed[name] {
+			continue
+		}
+		if name == "config" {
+			if err := f.Value.Set(filepath.Join(configDir, configDirFiles[name])); err != nil {
+				return err
+			}
+			continue
+		}
+		path := filepath.Join(dir, configDirFiles[name])
+		if err := f.Value.Set(path); err != nil {
+			return err
+		}
+
+		if !created {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return fmt.Errorf("creating config directory %s failed: %v", dir, err)
+			}
+			created = true
+		}
+		// The files used to be kept for a single account.
+		if legacy, ok := legacyFiles[name]; ok && len(profile) < 1 {
+			if err := moveLegacyFile(legacy, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyAccount points the token and state files at the ones of the account
+// passed with --account, unless they were set, and makes the API calls for
+// that account so a token for another one is refused.
+func applyAccount(fs *flag.FlagSet) error {
+	if len(account) < 1 {
+		return nil
+	}
+	if !strings.Contains(account, "@") || strings.ContainsAny(account, `/\`) {
+		return fmt.Errorf("invalid account %q, must be a Gmail address", account)
+	}
+	gmailUser = account
+
+	dir := configDir
+	if len(profile) > 0 {
+		dir = profileDir(profile)
+	}
+	for _, f := range []struct {
+		flag, dir string
+		file      *string
+	}{
+		{"token-file", "tokens", &tokenFile},
+		{"state-file", "state", &stateFile},
+	} {
+		if flagPassed(fs, f.flag) {
+			continue
+		}
+		sub := filepath.Join(dir, f.dir)
+		if err := os.MkdirAll(sub, 0700); err != nil {
+			return fmt.Errorf("creating directory %s failed: %v", sub, err)
+		}
+		*f.file = filepath.Join(sub, strings.ToLower(account)+".json")
+	}
+	return nil
+}
+
+// useAccount switches to the account, for the commands working on more than
+// one, with its own token and state like with --account.
+func useAccount(fs *flag.FlagSet, address string) error {
+	account = address
+	return applyAccount(fs)
+}
+
+// applyReadOnly points the token file at a token of its own with --read-only,
+// unless a token file was set, so the read-only token and the full one are
+// not mistaken for each other.
+func applyReadOnly(fs *flag.FlagSet) {
+	if !readOnly || flagPassed(fs, "token-file") {
+		return
+	}
+	tokenFile = strings.TrimSuffix(tokenFile, ".json") + ".readonly.json"
+}
+
+// flagPassed returns true if the flag was set, under any of its names, on the
+// command line, in the environment or in the config file.
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if canonicalFlag(f.Name) == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// moveLegacyFile copies the file from where it used to be kept, unless there
+// is one already.
+func moveLegacyFile(legacy, path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %v", legacy, err)
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("moving %s to %s failed: %v", legacy, path, err)
+	}
+	logrus.Infof("Moved %s to %s", legacy, path)
+	return os.Remove(legacy)
+}
+
+// loadConfig applies the settings of the config file to the flags that were
+// not passed on the command line. The settings are named after the flags,
+// known lists the names of the flags of all the commands, and "files" sets
+// the default filter files. The settings of the profile passed with
+// --profile, in its [profile.<name>] table, win over the others. A missing
+// config file is fine unless it was passed with --config or a profile was.
+func loadConfig(fs *flag.FlagSet, known map[string]bool) error {
+	// The flags passed on the command line win.
+	passed := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		passed[canonicalFlag(f.Name)] = true
+	})
+
+	path := configFile
+	if !passed["config"] {
+		if _, err := os.Stat(path); len(path) < 1 || os.IsNotExist(err) {
+			if len(profile) > 0 {
+				return fmt.Errorf("no profile %q, there is no config file %s to define it in", profile, path)
+			}
+			return nil
+		}
+	}
+
+	var settings map[string]interface{}
+	if _, err := toml.DecodeFile(path, &settings); err != nil {
+		return fmt.Errorf("reading config file %s failed: %v", path, err)
+	}
+	settings, err := profileSettings(path, settings)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := settings[key]
+		if key == "files" {
+			files, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s: files must be a list of filter files", path)
+			}
+			defaultFiles = nil
+			for _, f := range files {
+				defaultFiles = append(defaultFiles, fmt.Sprint(f))
+			}
+			continue
+		}
+
+		name := canonicalFlag(key)
+		if !known[name] {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		// Settings for the flags of other commands do not apply.
+		if passed[name] || fs.Lookup(name) == nil {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: setting %s failed: %v", path, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// profileSettings returns the settings with the ones of the profile passed
+// with --profile in their place, and without the profile tables.
+func profileSettings(path string, settings map[string]interface{}) (map[string]interface{}, error) {
+	profiles := map[string]interface{}{}
+	if v, ok := settings["profile"]; ok {
+		if profiles, ok = v.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s: profile must be tables of settings, like [profile.work]", path)
+		}
+		delete(settings, "profile")
+	}
+	if len(profile) < 1 {
+		return settings, nil
+	}
+
+	p, ok := profiles[profile].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: no profile %q, add its settings in a [profile.%s] table", path, profile, profile)
+	}
+	for key, value := range p {
+		// The setting of the profile replaces the global one, whichever name
+		// of the flag they use.
+		for k := range settings {
+			if canonicalFlag(k) == canonicalFlag(key) {
+				delete(settings, k)
+			}
+		}
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// envPrefix is the prefix of the environment variables setting the flags.
+const envPrefix = "GMAILFILTERS_"
+
+// flagEnvVar returns the name of the environment variable setting the flag,
+// GMAILFILTERS_CREDS_FILE for --creds-file.
+func flagEnvVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadEnv applies the GMAILFILTERS_* environment variables to the flags that
+// were not passed on the command line. They win over the config file, which
+// is only applied to the flags still not set.
+func loadEnv(fs *flag.FlagSet) error {
+	passed := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		passed[canonicalFlag(f.Name)] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		// The short names are set along with the long ones.
+		if _, ok := flagAliases[f.Name]; ok || passed[f.Name] || err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvVar(f.Name))
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %v", flagEnvVar(f.Name), e)
+		}
+	})
+	return err
+}
+
+// filterFileArgs returns the filter files passed as arguments, or the
+// default ones from the config file if none were.
+func filterFileArgs(args []string) []string {
+	if len(args) < 1 {
+		return defaultFiles
+	}
+	return args
+}
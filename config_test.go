@@ -0,0 +1,379 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile = filepath.Join(dir, "config.toml")
+	defer func() {
+		configFile = ""
+		defaultFiles = nil
+	}()
+	if err := ioutil.WriteFile(configFile, []byte(`files = ["filters.toml", "work.toml"]
+creds-file = "creds.json"
+token-file = "token.json"
+q = true
+set = ["domain=example.com", "team=infra"]
+indent = 4
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var creds, token string
+	var quiet bool
+	var sets setFlag
+	fs.StringVar(&creds, "creds-file", "", "")
+	fs.StringVar(&creds, "f", "", "")
+	fs.StringVar(&token, "token-file", "", "")
+	fs.BoolVar(&quiet, "quiet", false, "")
+	fs.Var(&sets, "set", "")
+	if err := fs.Parse([]string{"-f", "other.json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	known := map[string]bool{"creds-file": true, "token-file": true, "quiet": true, "set": true, "indent": true}
+	if err := loadConfig(fs, known); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{creds, token, sets.String(), strings.Join(defaultFiles, ",")}
+	expected := []string{"other.json", "token.json", "domain=example.com,team=infra", "filters.toml,work.toml"}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if !quiet {
+		t.Fatal("expected q to set quiet")
+	}
+
+	// Unknown settings are mistakes.
+	if err := ioutil.WriteFile(configFile, []byte("colour = \"never\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), known); err == nil || !strings.Contains(err.Error(), `unknown setting "colour"`) {
+		t.Fatalf("expected an unknown setting error, got %v", err)
+	}
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile = filepath.Join(dir, "config.toml")
+	defer func() {
+		configFile = ""
+		defaultFiles = nil
+		profile = ""
+	}()
+	if err := ioutil.WriteFile(configFile, []byte(`files = ["filters.toml"]
+f = "creds.json"
+log-level = "warn"
+
+[profile.work]
+creds-file = "work-creds.json"
+files = ["work.toml"]
+
+[profile.personal]
+token-file = "personal-token.json"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]bool{"creds-file": true, "token-file": true, "log-level": true}
+
+	for _, tc := range []struct {
+		profile  string
+		expected []string
+	}{
+		{"", []string{"creds.json", "", "warn", "filters.toml"}},
+		{"work", []string{"work-creds.json", "", "warn", "work.toml"}},
+		{"personal", []string{"creds.json", "personal-token.json", "warn", "filters.toml"}},
+	} {
+		profile = tc.profile
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		var creds, token, level string
+		fs.StringVar(&creds, "creds-file", "", "")
+		fs.StringVar(&creds, "f", "", "")
+		fs.StringVar(&token, "token-file", "", "")
+		fs.StringVar(&level, "log-level", "", "")
+		if err := loadConfig(fs, known); err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{creds, token, level, strings.Join(defaultFiles, ",")}
+		if diff := cmp.Diff(tc.expected, got); len(diff) > 1 {
+			t.Fatalf("%s: got diff: %s", tc.profile, diff)
+		}
+	}
+
+	profile = "home"
+	if err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), known); err == nil || !strings.Contains(err.Error(), `no profile "home"`) {
+		t.Fatalf("expected a missing profile error, got %v", err)
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", filepath.Join(os.TempDir(), "gmailfilters-missing-config.toml"), "")
+	defer func() { configFile = "" }()
+
+	// A missing default config file is fine.
+	if err := loadConfig(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Parse([]string{"-config", configFile}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, nil); err == nil {
+		t.Fatal("expected an error for a missing --config file")
+	}
+}
+
+func TestFilterFileArgs(t *testing.T) {
+	defaultFiles = []string{"filters.toml"}
+	defer func() { defaultFiles = nil }()
+
+	if diff := cmp.Diff([]string{"filters.toml"}, filterFileArgs(nil)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"work.toml"}, filterFileArgs([]string{"work.toml"})); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		"GMAILFILTERS_CREDS_FILE": "env.json",
+		"GMAILFILTERS_TOKEN_FILE": "env-token.json",
+		"GMAILFILTERS_DRY_RUN":    "true",
+		"GMAILFILTERS_F":          "short.json",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var creds, token string
+	var dryRun bool
+	fs.StringVar(&creds, "creds-file", "", "")
+	fs.StringVar(&creds, "f", "", "")
+	fs.StringVar(&token, "token-file", "", "")
+	fs.StringVar(&token, "t", "", "")
+	fs.BoolVar(&dryRun, "dry-run", false, "")
+	if err := fs.Parse([]string{"-t", "flag-token.json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []interface{}{creds, token, dryRun}
+	expected := []interface{}{"env.json", "flag-token.json", true}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	os.Setenv("GMAILFILTERS_DRY_RUN", "maybe")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.BoolVar(&dryRun, "dry-run", false, "")
+	if err := loadEnv(fs); err == nil || !strings.Contains(err.Error(), "GMAILFILTERS_DRY_RUN") {
+		t.Fatalf("expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestApplyConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := filepath.Join(dir, "legacy-token.json")
+	if err := ioutil.WriteFile(legacy, []byte(`{"access_token":"abc"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { legacyFiles["token-file"] = old }(legacyFiles["token-file"])
+	legacyFiles["token-file"] = legacy
+	defer func(old string) { legacyFiles["state-file"] = old }(legacyFiles["state-file"])
+	legacyFiles["state-file"] = filepath.Join(dir, "missing-state.json")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var config, token, state, backups string
+	fs.StringVar(&configDir, "config-dir", "", "")
+	fs.StringVar(&config, "config", "", "")
+	fs.StringVar(&token, "token-file", "", "")
+	fs.StringVar(&state, "state-file", "", "")
+	fs.StringVar(&backups, "backup-dir", "", "")
+	defer func() { configDir = "" }()
+
+	home := filepath.Join(dir, "home")
+	if err := fs.Parse([]string{"-config-dir", home, "-state-file", "state.json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigDir(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{config, token, state, backups}
+	expected := []string{
+		filepath.Join(home, "config.toml"),
+		filepath.Join(home, "token.json"),
+		"state.json",
+		filepath.Join(home, "backups"),
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// The token was moved from where it used to be kept.
+	b, err := ioutil.ReadFile(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"access_token":"abc"}` {
+		t.Fatalf("expected the legacy token, got %q", b)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("expected the legacy token to be removed, got %v", err)
+	}
+
+	// The flags are not marked as set, so the config file can change them.
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "token-file" {
+			t.Fatal("expected token-file not to be marked as set")
+		}
+	})
+}
+
+func TestApplyConfigDirProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old string) { legacyFiles["token-file"] = old }(legacyFiles["token-file"])
+	legacyFiles["token-file"] = filepath.Join(dir, "legacy-token.json")
+	if err := ioutil.WriteFile(legacyFiles["token-file"], []byte(`{"access_token":"abc"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var config, token string
+	fs.StringVar(&configDir, "config-dir", dir, "")
+	fs.StringVar(&config, "config", "", "")
+	fs.StringVar(&token, "token-file", "", "")
+	defer func() {
+		configDir = ""
+		profile = ""
+	}()
+
+	profile = "work"
+	if err := applyConfigDir(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config file is shared, the token is the profile's own.
+	got := []string{config, token}
+	expected := []string{filepath.Join(dir, "config.toml"), filepath.Join(dir, "profiles", "work", "token.json")}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if _, err := os.Stat(token); !os.IsNotExist(err) {
+		t.Fatalf("expected the legacy token not to be moved to the profile, got %v", err)
+	}
+
+	profile = "../work"
+	if err := applyConfigDir(fs); err == nil {
+		t.Fatal("expected an error for an invalid profile")
+	}
+}
+
+func TestApplyAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(dir, token, state string) {
+		configDir, tokenFile, stateFile = dir, token, state
+		account, gmailUser = "", "me"
+	}(configDir, tokenFile, stateFile)
+	configDir = dir
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&tokenFile, "token-file", filepath.Join(dir, "token.json"), "")
+	fs.StringVar(&tokenFile, "t", filepath.Join(dir, "token.json"), "")
+	fs.StringVar(&stateFile, "state-file", filepath.Join(dir, "state.json"), "")
+
+	account = "Me@Example.com"
+	if err := applyAccount(fs); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{gmailUser, tokenFile, stateFile}
+	expected := []string{"Me@Example.com", filepath.Join(dir, "tokens", "me@example.com.json"), filepath.Join(dir, "state", "me@example.com.json")}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// A token file passed is used as is.
+	if err := fs.Parse([]string{"-t", "other.json"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyAccount(fs); err != nil {
+		t.Fatal(err)
+	}
+	if tokenFile != "other.json" {
+		t.Fatalf("expected the token file passed, got %s", tokenFile)
+	}
+
+	account = "../me"
+	if err := applyAccount(fs); err == nil {
+		t.Fatal("expected an error for an invalid account")
+	}
+}
+
+func TestApplyReadOnly(t *testing.T) {
+	defer func(file string) {
+		tokenFile = file
+		readOnly = false
+	}(tokenFile)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&tokenFile, "token-file", filepath.Join("config", "token.json"), "")
+	fs.StringVar(&tokenFile, "t", filepath.Join("config", "token.json"), "")
+
+	readOnly = true
+	applyReadOnly(fs)
+	if expected := filepath.Join("config", "token.readonly.json"); tokenFile != expected {
+		t.Fatalf("expected %s, got %s", expected, tokenFile)
+	}
+
+	// A token file passed is used as is.
+	if err := fs.Parse([]string{"-t", "other.json"}); err != nil {
+		t.Fatal(err)
+	}
+	applyReadOnly(fs)
+	if tokenFile != "other.json" {
+		t.Fatalf("expected the token file passed, got %s", tokenFile)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// confirm asks the user to confirm a destructive operation. It returns true
+// right away if --yes was passed, and fails if we cannot ask because stdin is
+// not a terminal.
+func confirm(prompt string) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false, errors.New("refusing to make destructive changes without confirmation, pass --yes to skip it")
+	}
+
+	fmt.Printf("%s [y/N]: ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("reading confirmation failed: %v", err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// errAborted is returned when the user does not confirm an operation.
+var errAborted = errors.New("aborted")
+
+// ask asks the user a question and returns the answer, or the default if
+// there is no answer or --yes was passed.
+func ask(question, def string) (string, error) {
+	if assumeYes {
+		return def, nil
+	}
+
+	fmt.Printf("%s [%s]: ", question, def)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(answer) < 1 {
+		return def, nil
+	}
+
+	if answer = strings.TrimSpace(answer); len(answer) > 0 {
+		return answer, nil
+	}
+	return def, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+const deleteHelp = `Delete the filters created by gmailfilters from the account.`
+
+const deleteLongHelp = deleteHelp + `
+
+Filters created by hand in Gmail are left alone, and so are the filters
+protected by the filter files, if any are passed. The filters are backed up
+first, pass the snapshot to restore to bring them back.`
+
+func (cmd *deleteCommand) Name() string      { return "delete" }
+func (cmd *deleteCommand) Args() string      { return "[<file>...]" }
+func (cmd *deleteCommand) ShortHelp() string { return deleteHelp }
+func (cmd *deleteCommand) LongHelp() string  { return deleteLongHelp }
+func (cmd *deleteCommand) Hidden() bool      { return false }
+
+func (cmd *deleteCommand) Register(fs *flag.FlagSet) {}
+
+type deleteCommand struct{}
+
+func (cmd *deleteCommand) Run(ctx context.Context, args []string) error {
+	// The filter files are only needed for their protect rules.
+	var rules []protectRule
+	if len(args) > 0 {
+		ff, err := loadFilterFiles(args)
+		if err != nil {
+			return err
+		}
+		rules = ff.Protect
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+
+	diff := filterDiff{Delete: managedFilters(remote, state)}.withoutProtected(rules)
+	printDiffNotes(infoOut(), diff)
+	if diff.empty() {
+		infof("No filters to delete\n")
+		return nil
+	}
+
+	printDiff(promptOut(), diff, labelNamesByID(ctx))
+	ok, err := confirm(fmt.Sprintf("Delete %d filters?", len(diff.Delete)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAborted
+	}
+
+	file, err := writeSnapshot(ctx, backupDir)
+	if err != nil {
+		return err
+	}
+	infof("Backed up existing filters to %s\n", file)
+
+	_, err = applyDiff(ctx, diff, state, nil)
+	if serr := state.save(stateFile); serr != nil {
+		logrus.Warn(serr)
+	}
+	if err != nil {
+		return err
+	}
+
+	infof("Successfully deleted %d filters\n", len(diff.Delete))
+
+	return nil
+}
+
+// managedFilters returns the filters that were created by this tool.
+func managedFilters(filters []gmail.Filter, state *syncState) []gmail.Filter {
+	var managed []gmail.Filter
+	for _, f := range filters {
+		if state.managed(f) {
+			managed = append(managed, f)
+		}
+	}
+	return managed
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// deviceCodeURL is where Google hands out the codes of the OAuth device flow.
+var deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+
+// deviceCode is the code the user enters on another device, and the code we
+// poll the token with meanwhile.
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceError is the error of a request in the device flow.
+type deviceError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *deviceError) Error() string {
+	if len(e.Description) < 1 {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// getTokenFromDevice runs the OAuth device flow, for machines without a
+// browser: the user enters a code on another device while we poll for the
+// token.
+func getTokenFromDevice(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	dc, err := requestDeviceCode(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("On any device, go to %s and enter the code %s to authorize gmailfilters.\n", dc.VerificationURL, dc.UserCode)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(dc.ExpiresIn)*time.Second)
+	defer cancel()
+
+	return pollDeviceToken(ctx, config, dc.DeviceCode, interval)
+}
+
+// requestDeviceCode asks for the codes of the device flow.
+func requestDeviceCode(ctx context.Context, config *oauth2.Config) (deviceCode, error) {
+	var dc deviceCode
+	body, err := postDeviceForm(ctx, deviceCodeURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	})
+	if err != nil {
+		return dc, fmt.Errorf("requesting a device code failed: %v", err)
+	}
+	if err := json.Unmarshal(body, &dc); err != nil {
+		return dc, fmt.Errorf("decoding the device code failed: %v", err)
+	}
+	return dc, nil
+}
+
+// pollDeviceToken polls for the token every interval until the user
+// authorized the device, refused it, or the context is done.
+func pollDeviceToken(ctx context.Context, config *oauth2.Config, code string, interval time.Duration) (*oauth2.Token, error) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("the device code expired before gmailfilters was authorized")
+			}
+			return nil, ctx.Err()
+		}
+
+		body, err := postDeviceForm(ctx, config.Endpoint.TokenURL, url.Values{
+			"client_id":     {config.ClientID},
+			"client_secret": {config.ClientSecret},
+			"device_code":   {code},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		})
+		if err, ok := err.(*deviceError); ok {
+			switch err.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve token from device flow: %v", err)
+		}
+
+		var tok struct {
+			AccessToken  string `json:"access_token"`
+			TokenType    string `json:"token_type"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int    `json:"expires_in"`
+		}
+		if err := json.Unmarshal(body, &tok); err != nil {
+			return nil, fmt.Errorf("decoding the token failed: %v", err)
+		}
+		t := &oauth2.Token{
+			AccessToken:  tok.AccessToken,
+			TokenType:    tok.TokenType,
+			RefreshToken: tok.RefreshToken,
+		}
+		if tok.ExpiresIn > 0 {
+			t.Expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+		}
+		return t, nil
+	}
+}
+
+// postDeviceForm posts the form and returns the body of the response, or a
+// *deviceError if the server returned one.
+func postDeviceForm(ctx context.Context, u string, form url.Values) ([]byte, error) {
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &deviceError{}
+		if err := json.Unmarshal(body, e); err != nil || len(e.Code) < 1 {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil, e
+	}
+	return body, nil
+}
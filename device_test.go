@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device/code":
+			if r.Form.Get("scope") != "a b" {
+				t.Errorf("expected the scopes a b, got %q", r.Form.Get("scope"))
+			}
+			w.Write([]byte(`{"device_code": "dev", "user_code": "ABC-DEF", "verification_url": "https://www.google.com/device", "expires_in": 1800, "interval": 5}`))
+		case "/token":
+			if r.Form.Get("device_code") != "dev" {
+				t.Errorf("expected the device code dev, got %q", r.Form.Get("device_code"))
+			}
+			polls++
+			if polls < 3 {
+				w.WriteHeader(http.StatusPreconditionRequired)
+				w.Write([]byte(`{"error": "authorization_pending"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "access", "token_type": "Bearer", "refresh_token": "refresh", "expires_in": 3599}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(u string) { deviceCodeURL = u }(deviceCodeURL)
+	deviceCodeURL = srv.URL + "/device/code"
+	config := &oauth2.Config{
+		ClientID: "id",
+		Scopes:   []string{"a", "b"},
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL + "/token"},
+	}
+
+	ctx := context.Background()
+	dc, err := requestDeviceCode(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := deviceCode{DeviceCode: "dev", UserCode: "ABC-DEF", VerificationURL: "https://www.google.com/device", ExpiresIn: 1800, Interval: 5}
+	if diff := cmp.Diff(expected, dc); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	tok, err := pollDeviceToken(ctx, config, dc.DeviceCode, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls != 3 || tok.AccessToken != "access" || tok.RefreshToken != "refresh" || tok.Expiry.IsZero() {
+		t.Fatalf("expected the token after 3 polls, got %+v after %d", tok, polls)
+	}
+
+	_, err = pollDeviceToken(ctx, &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.URL + "/denied"}}, "dev", time.Millisecond)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
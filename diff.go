@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const diffHelp = `Show the differences between a filter file and the filters in the account.`
+
+const diffLongHelp = diffHelp + `
+
+With --local, compares two filter files instead, without connecting to the
+account. Both are expanded and their queries normalized first, so only the
+differences in what the filters do are shown:
+
+  $ gmailfilters diff --local work.toml personal.toml`
+
+func (cmd *diffCommand) Name() string      { return "diff" }
+func (cmd *diffCommand) Args() string      { return "<file>..." }
+func (cmd *diffCommand) ShortHelp() string { return diffHelp }
+func (cmd *diffCommand) LongHelp() string  { return diffLongHelp }
+func (cmd *diffCommand) Hidden() bool      { return false }
+
+func (cmd *diffCommand) Register(fs *flag.FlagSet) {
+	registerSelectFlags(fs)
+
+	fs.StringVar(&cmd.output, "output", "text", "output format: text or json")
+	fs.BoolVar(&cmd.local, "local", false, "compare two filter files instead of a filter file and the account")
+}
+
+type diffCommand struct {
+	output string
+	local  bool
+}
+
+func (cmd *diffCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+	if err := validateOutput(cmd.output); err != nil {
+		return err
+	}
+
+	if cmd.local {
+		return cmd.diffLocal(ctx, args)
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	diff, newLabels, names, err := planSync(ctx, ff)
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return writeDiffJSON(os.Stdout, "", diff, newLabels, names)
+	}
+
+	printDiffSections(os.Stdout, "account", "file", diff, nil, newLabels, names)
+
+	return nil
+}
+
+// diffLocal compares two filter files, the first in place of the account.
+func (cmd *diffCommand) diffLocal(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("must pass the paths to the two gmail filter configuration files to compare")
+	}
+
+	var files [2]filterfile
+	for i, file := range args {
+		ff, err := loadFilterFiles([]string{file})
+		if err != nil {
+			return err
+		}
+		files[i] = ff
+	}
+
+	diff, oldLabels, newLabels, err := diffFilterFiles(ctx, files[0], files[1])
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		return writeDiffJSON(os.Stdout, "", diff, newLabels, labelMap{})
+	}
+
+	printDiffSections(os.Stdout, args[0], args[1], diff, oldLabels, newLabels, labelMap{})
+
+	return nil
+}
+
+// diffFilterFiles compares the filters of two filter files, after expanding
+// and normalizing them like canonicalize does. It also returns the labels
+// only in the old file and only in the new one. The label IDs of the filters
+// are the label names.
+func diffFilterFiles(ctx context.Context, old, new filterfile) (filterDiff, []string, []string, error) {
+	var (
+		filters [2][]gmail.Filter
+		labels  [2]labelMap
+	)
+	for i, ff := range []filterfile{old, new} {
+		var err error
+		labels[i], _, err = labelMap{}.pendingLabels(ff)
+		if err != nil {
+			return filterDiff{}, nil, nil, err
+		}
+		for _, f := range ff.Filter {
+			c, err := f.canonical()
+			if err != nil {
+				return filterDiff{}, nil, nil, err
+			}
+			gf, err := c.toGmailFilters(ctx, &labels[i])
+			if err != nil {
+				return filterDiff{}, nil, nil, err
+			}
+			filters[i] = append(filters[i], gf...)
+		}
+	}
+
+	// only returns the names of the labels in a that are not in b, in order.
+	only := func(a, b labelMap) []string {
+		names := []string{}
+		for key, name := range a {
+			if _, ok := b[key]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	return computeDiff(filters[1], filters[0]), only(labels[0], labels[1]), only(labels[1], labels[0]), nil
+}
+
+// printDiffSections writes the diff grouped by where each filter lives, the
+// old and new sources being named after what is compared.
+func printDiffSections(w io.Writer, old, new string, diff filterDiff, oldLabels, newLabels []string, names labelMap) {
+	if diff.empty() && len(oldLabels) < 1 && len(newLabels) < 1 {
+		fmt.Fprintf(w, "No differences, %d filters match.\n", len(diff.Unchanged))
+		return
+	}
+
+	for _, section := range []struct {
+		source string
+		prefix string
+		labels []string
+	}{
+		{old, "-", oldLabels},
+		{new, "+", newLabels},
+	} {
+		if len(section.labels) < 1 {
+			continue
+		}
+		fmt.Fprintf(w, "Labels only in %s (%d):\n", section.source, len(section.labels))
+		for _, name := range section.labels {
+			fmt.Fprintf(w, "%s label %s\n", section.prefix, name)
+		}
+		fmt.Fprintln(w)
+	}
+
+	printFilterSection(w, "Filters only in "+old, "-", diff.Delete, names)
+	printFilterSection(w, "Filters only in "+new, "+", diff.Create, names)
+
+	if len(diff.Update) > 0 {
+		fmt.Fprintf(w, "Filters with different actions (%d):\n", len(diff.Update))
+		for _, u := range diff.Update {
+			fmt.Fprintln(w)
+			printUpdate(w, u, names)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "%d filters match.\n", len(diff.Unchanged))
+}
+
+// printFilterSection writes a titled list of filters.
+func printFilterSection(w io.Writer, title, prefix string, filters []gmail.Filter, names labelMap) {
+	if len(filters) < 1 {
+		return
+	}
+
+	fmt.Fprintf(w, "%s (%d):\n", title, len(filters))
+	for _, f := range filters {
+		fmt.Fprintln(w)
+		printFilter(w, prefix, f, names)
+	}
+	fmt.Fprintln(w)
+}
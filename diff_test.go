@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffFilterFiles(t *testing.T) {
+	decode := func(s string) filterfile {
+		var ff filterfile
+		if _, err := toml.Decode(s, &ff); err != nil {
+			t.Fatal(err)
+		}
+		return ff
+	}
+
+	old := decode(`
+[[filter]]
+queryOr = ["from:a@example.com", "from:b@example.com"]
+archive = true
+
+[[filter]]
+query = "list:dev.example.com"
+label = "Dev"
+
+[[filter]]
+from = "c@example.com"
+read = true
+`)
+	new := decode(`
+[[filter]]
+query = "FROM:a@example.com  OR  from:b@example.com"
+archive = true
+
+[[filter]]
+query = "list:dev.example.com"
+label = "Lists/Dev"
+
+[[filter]]
+from = "d@example.com"
+star = true
+`)
+
+	diff, oldLabels, newLabels, err := diffFilterFiles(context.Background(), old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"Dev"}, oldLabels); len(diff) > 1 {
+		t.Fatalf("got diff in old labels: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"Lists/Dev"}, newLabels); len(diff) > 1 {
+		t.Fatalf("got diff in new labels: %s", diff)
+	}
+
+	var buf bytes.Buffer
+	printDiffSections(&buf, "work.toml", "personal.toml", diff, oldLabels, newLabels, labelMap{})
+	expected := `Labels only in work.toml (1):
+- label Dev
+
+Labels only in personal.toml (1):
++ label Lists/Dev
+
+Filters only in work.toml (1):
+
+@@ filter (fingerprint 56982a7749d4d2cd) @@
+-[[filter]]
+-from = "c@example.com"
+-removeLabels = ["UNREAD"]
+
+Filters only in personal.toml (1):
+
+@@ filter (fingerprint 30afebc8214ee66d) @@
++[[filter]]
++from = "d@example.com"
++addLabels = ["STARRED"]
+
+Filters with different actions (1):
+
+@@ filter  (fingerprint d166fdc9e3a4aa63 -> 487aa5dd11264c0f) @@
+ [[filter]]
+ query = "list:dev.example.com"
+-addLabels = ["Dev"]
++addLabels = ["Lists/Dev"]
+
+1 filters match.
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const docsHelp = `Render the filters in a filter file as a Markdown or HTML reference.`
+
+const docsLongHelp = docsHelp + `
+
+The filters are grouped by the label they apply, each described in plain
+English, so a team's standard filter set can be shared with the people using
+it. The reference is written to stdout.`
+
+func (cmd *docsCommand) Name() string      { return "docs" }
+func (cmd *docsCommand) Args() string      { return "<file>..." }
+func (cmd *docsCommand) ShortHelp() string { return docsHelp }
+func (cmd *docsCommand) LongHelp() string  { return docsLongHelp }
+func (cmd *docsCommand) Hidden() bool      { return false }
+
+func (cmd *docsCommand) Register(fs *flag.FlagSet) {
+	registerSelectFlags(fs)
+
+	fs.StringVar(&cmd.format, "format", "markdown", "output format: markdown or html")
+	fs.StringVar(&cmd.title, "title", "Gmail filters", "title of the reference")
+}
+
+type docsCommand struct {
+	format string
+	title  string
+}
+
+func (cmd *docsCommand) Run(ctx context.Context, args []string) error {
+	switch cmd.format {
+	case "markdown", "html":
+	default:
+		return fmt.Errorf("invalid format %q, must be markdown or html", cmd.format)
+	}
+
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	sections, err := docSections(ctx, ff)
+	if err != nil {
+		return err
+	}
+
+	if cmd.format == "html" {
+		return writeHTMLDocs(os.Stdout, cmd.title, sections)
+	}
+	return writeMarkdownDocs(os.Stdout, cmd.title, sections)
+}
+
+// docSection is the label and the descriptions of the filters applying it,
+// or of the filters applying no label if the label is empty.
+type docSection struct {
+	Label   string
+	Filters []string
+}
+
+// docSections describes the filters in the file grouped by their label, in
+// the order of the labels, with the filters applying no label last. Labels
+// the file defines without a filter applying them are listed too.
+func docSections(ctx context.Context, ff filterfile) ([]docSection, error) {
+	// The placeholder IDs of the labels are their names, so nothing needs to
+	// be looked up in the account.
+	labels, names, err := labelMap{}.pendingLabels(ff)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	byLabel := map[string][]string{}
+	for _, f := range ff.Filter {
+		gf, err := f.toGmailFilters(ctx, &labels)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(f.Label)
+		for _, g := range gf {
+			byLabel[key] = append(byLabel[key], explainFilter(g, labelMap{}))
+		}
+	}
+
+	var sections []docSection
+	for _, name := range names {
+		sections = append(sections, docSection{Label: name, Filters: byLabel[strings.ToLower(name)]})
+	}
+	if unlabeled := byLabel[""]; len(unlabeled) > 0 {
+		sections = append(sections, docSection{Filters: unlabeled})
+	}
+	return sections, nil
+}
+
+// markdownEscaper escapes the characters Markdown would format.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+	`<`, `\<`, `>`, `\>`, `#`, `\#`, `|`, `\|`,
+)
+
+// writeMarkdownDocs writes the sections as a Markdown document.
+func writeMarkdownDocs(w io.Writer, title string, sections []docSection) error {
+	fmt.Fprintf(w, "# %s\n", markdownEscaper.Replace(title))
+	for _, s := range sections {
+		heading := "No label"
+		if len(s.Label) > 0 {
+			heading = markdownEscaper.Replace(s.Label)
+		}
+		fmt.Fprintf(w, "\n## %s\n\n", heading)
+
+		if len(s.Filters) < 1 {
+			fmt.Fprintln(w, "No filters apply this label.")
+			continue
+		}
+		for _, f := range s.Filters {
+			fmt.Fprintf(w, "- %s\n", markdownEscaper.Replace(f))
+		}
+	}
+
+	return nil
+}
+
+// docsHTMLTemplate is the HTML document of the sections.
+var docsHTMLTemplate = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{- range .Sections}}
+<h2>{{if .Label}}{{.Label}}{{else}}No label{{end}}</h2>
+{{- if .Filters}}
+<ul>
+{{- range .Filters}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- else}}
+<p>No filters apply this label.</p>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+// writeHTMLDocs writes the sections as an HTML document.
+func writeHTMLDocs(w io.Writer, title string, sections []docSection) error {
+	return docsHTMLTemplate.Execute(w, struct {
+		Title    string
+		Sections []docSection
+	}{title, sections})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDocSections(t *testing.T) {
+	ff := filterfile{
+		Label: []labelDefinition{{Name: "receipts"}},
+		Filter: []filter{
+			{From: stringList{"github.com"}, Label: "code/notifications", ArchiveUnlessToMe: true},
+			{Query: "list:dev", Read: true},
+			{Subject: "invoice", Label: "Code", Star: true},
+		},
+	}
+
+	sections, err := docSections(context.Background(), ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []docSection{
+		{Label: "Code", Filters: []string{`Mail with subject "invoice": apply label 'Code', star it`}},
+		{Label: "code/notifications", Filters: []string{
+			"Mail from github.com addressed to me: apply label 'code/notifications'",
+			"Mail from github.com not addressed to me: skip the inbox, apply label 'code/notifications'",
+		}},
+		{Label: "receipts"},
+		{Filters: []string{`Mail matching "list:dev": mark as read`}},
+	}
+	if diff := cmp.Diff(expected, sections); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := writeMarkdownDocs(&buf, "Team filters", sections); err != nil {
+		t.Fatal(err)
+	}
+	expectedMarkdown := `# Team filters
+
+## Code
+
+- Mail with subject "invoice": apply label 'Code', star it
+
+## code/notifications
+
+- Mail from github.com addressed to me: apply label 'code/notifications'
+- Mail from github.com not addressed to me: skip the inbox, apply label 'code/notifications'
+
+## receipts
+
+No filters apply this label.
+
+## No label
+
+- Mail matching "list:dev": mark as read
+`
+	if diff := cmp.Diff(expectedMarkdown, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	buf.Reset()
+	if err := writeHTMLDocs(&buf, "Team <filters>", sections[2:]); err != nil {
+		t.Fatal(err)
+	}
+	expectedHTML := `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Team &lt;filters&gt;</title>
+</head>
+<body>
+<h1>Team &lt;filters&gt;</h1>
+<h2>receipts</h2>
+<p>No filters apply this label.</p>
+<h2>No label</h2>
+<ul>
+<li>Mail matching &#34;list:dev&#34;: mark as read</li>
+</ul>
+</body>
+</html>
+`
+	if diff := cmp.Diff(expectedHTML, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
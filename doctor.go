@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+const doctorHelp = `Check the setup and the account for problems.`
+
+const doctorLongHelp = doctorHelp + `
+
+Checks the credentials, the token and the scopes it was granted, the number of
+filters against the Gmail limit, the API quota a sync needs and the
+forwarding addresses of the filters, and prints how to fix what is wrong. If
+filter files are passed the checks are about the account once they are
+applied.`
+
+func (cmd *doctorCommand) Name() string      { return "doctor" }
+func (cmd *doctorCommand) Args() string      { return "[<file>...]" }
+func (cmd *doctorCommand) ShortHelp() string { return doctorHelp }
+func (cmd *doctorCommand) LongHelp() string  { return doctorLongHelp }
+func (cmd *doctorCommand) Hidden() bool      { return false }
+
+func (cmd *doctorCommand) Register(fs *flag.FlagSet) {}
+
+type doctorCommand struct{}
+
+// tokenInfoURL is the endpoint returning the scopes granted to a token.
+var tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+// The Gmail API allows each user 250 quota units per second, and creating
+// or deleting a filter costs 5 units while getting one costs 1.
+const (
+	quotaUnitsPerSecond = 250
+	filterWriteCost     = 5
+	filterReadCost      = 1
+)
+
+// doctorCheck is the outcome of a check, along with how to fix it if it
+// failed or warned.
+type doctorCheck struct {
+	name   string
+	status string
+	msg    string
+	fix    string
+}
+
+// The statuses of a check.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+func (cmd *doctorCommand) Run(ctx context.Context, args []string) error {
+	checks := runDoctorChecks(ctx, args)
+	printDoctorChecks(os.Stdout, checks)
+
+	failed := 0
+	for _, c := range checks {
+		if c.status == checkFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("found %d problems", failed)
+	}
+	return nil
+}
+
+// runDoctorChecks runs the checks in order, stopping at the first failure
+// the rest depend on.
+func runDoctorChecks(ctx context.Context, files []string) []doctorCheck {
+	var checks []doctorCheck
+
+	if useADC {
+		ts, scopes, msg, err := adcTokenSource(ctx)
+		if err != nil {
+			return append(checks, doctorCheck{name: "credentials", status: checkFail, msg: err.Error(), fix: "run gcloud auth application-default login with the Gmail scopes, or set GOOGLE_APPLICATION_CREDENTIALS"})
+		}
+		checks = append(checks, doctorCheck{name: "credentials", status: checkOK, msg: msg})
+
+		fresh, err := ts.Token()
+		if err != nil {
+			return append(checks, doctorCheck{name: "token", status: checkFail, msg: fmt.Sprintf("getting a token failed: %v", err)})
+		}
+		return append(checks, runAPIChecks(ctx, scopes, ts, fresh, files)...)
+	}
+
+	creds, err := readCredentials(ctx)
+	if err == nil && isServiceAccount(creds) {
+		return append(checks, runServiceAccountChecks(ctx, creds, files)...)
+	}
+
+	config, err := oauthConfig(ctx)
+	if err != nil {
+		return append(checks, doctorCheck{
+			name:   "credentials",
+			status: checkFail,
+			msg:    err.Error(),
+			fix:    "download OAuth client credentials for a desktop application from the Google API Console and pass them with -f, or run gmailfilters init",
+		})
+	}
+	checks = append(checks, doctorCheck{name: "credentials", status: checkOK, msg: credentialsLocation()})
+
+	tok, err := readToken(ctx)
+	if err != nil {
+		return append(checks, doctorCheck{name: "token", status: checkFail, msg: fmt.Sprintf("reading %s failed: %v", tokenLocation(), err), fix: "run gmailfilters auth"})
+	}
+	checks = append(checks, tokenExpiryCheck(tok, time.Now()))
+
+	ts := config.TokenSource(ctx, tok)
+	fresh, err := ts.Token()
+	if err != nil {
+		return append(checks, doctorCheck{name: "token", status: checkFail, msg: fmt.Sprintf("refreshing the token failed: %v", err), fix: "the access was revoked or the token is for other credentials, run gmailfilters auth"})
+	}
+
+	return append(checks, runAPIChecks(ctx, config.Scopes, ts, fresh, files)...)
+}
+
+// runServiceAccountChecks runs the checks of a service account key, which
+// has no token file but needs domain-wide delegation.
+func runServiceAccountChecks(ctx context.Context, creds []byte, files []string) []doctorCheck {
+	config, err := serviceAccountConfig(creds)
+	if err != nil {
+		return []doctorCheck{{name: "credentials", status: checkFail, msg: err.Error()}}
+	}
+	checks := []doctorCheck{{name: "credentials", status: checkOK, msg: fmt.Sprintf("%s, service account impersonating %s", credentialsLocation(), impersonate)}}
+
+	ts := config.TokenSource(ctx)
+	fresh, err := ts.Token()
+	if err != nil {
+		return append(checks, doctorCheck{name: "token", status: checkFail, msg: fmt.Sprintf("getting a token failed: %v", err), fix: "give the client ID of the service account domain-wide delegation for the Gmail scopes in the Google Workspace Admin console"})
+	}
+
+	return append(checks, runAPIChecks(ctx, config.Scopes, ts, fresh, files)...)
+}
+
+// runAPIChecks runs the checks needing a token, stopping at the first failure
+// the rest depend on.
+func runAPIChecks(ctx context.Context, scopes []string, ts oauth2.TokenSource, fresh *oauth2.Token, files []string) []doctorCheck {
+	var checks []doctorCheck
+
+	granted, err := tokenScopes(ctx, fresh.AccessToken)
+	if err != nil {
+		checks = append(checks, doctorCheck{name: "scopes", status: checkWarn, msg: err.Error()})
+	} else {
+		checks = append(checks, scopesCheck(scopes, granted))
+	}
+
+	if err := newService(oauth2.NewClient(ctx, ts)); err != nil {
+		return append(checks, doctorCheck{name: "api", status: checkFail, msg: err.Error()})
+	}
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return append(checks, doctorCheck{name: "api", status: checkFail, msg: err.Error(), fix: "make sure the Gmail API is enabled for the project of the credentials"})
+	}
+
+	// The filters the account ends up with and the changes it takes. Without
+	// filter files that is recreating the filters already there.
+	filters := remote
+	diff := filterDiff{Create: remote}
+	if len(files) > 0 {
+		ff, err := loadFilterFiles(files)
+		if err != nil {
+			return append(checks, doctorCheck{name: "filter files", status: checkFail, msg: err.Error(), fix: "run gmailfilters validate on them"})
+		}
+		if diff, _, _, err = planSync(ctx, ff); err != nil {
+			return append(checks, doctorCheck{name: "filter files", status: checkFail, msg: err.Error()})
+		}
+		state, err := loadState(stateFile)
+		if err != nil {
+			return append(checks, doctorCheck{name: "state", status: checkFail, msg: err.Error()})
+		}
+		diff = diff.scoped(state, ff.Protect)
+		filters = append(append(append(append([]gmail.Filter{}, diff.Unchanged...), diff.Kept...), diff.Protected...), diff.Create...)
+		for _, u := range diff.Update {
+			filters = append(filters, u.New)
+		}
+		for _, c := range diff.Conflicts {
+			filters = append(filters, c.Old)
+		}
+	}
+	checks = append(checks, filterCountCheck(len(filters)))
+	checks = append(checks, quotaCheck(diff))
+
+	verified, err := verifiedForwardingAddresses(ctx)
+	if err != nil {
+		return append(checks, doctorCheck{name: "forwarding", status: checkWarn, msg: err.Error()})
+	}
+	return append(checks, forwardingCheck(filters, verified))
+}
+
+// tokenExpiryCheck checks the token can still be used, either because it
+// has not expired or because it can be refreshed.
+func tokenExpiryCheck(tok *oauth2.Token, now time.Time) doctorCheck {
+	c := doctorCheck{name: "token", status: checkOK, msg: tokenLocation()}
+	switch {
+	case len(tok.RefreshToken) > 0:
+		c.msg += ", refreshed automatically"
+	case tok.Expiry.IsZero():
+	case tok.Expiry.Before(now):
+		c.status = checkFail
+		c.msg = fmt.Sprintf("expired at %s and cannot be refreshed", tok.Expiry.Local().Format(time.RFC1123))
+		c.fix = "run gmailfilters auth"
+	default:
+		c.status = checkWarn
+		c.msg = fmt.Sprintf("expires at %s and cannot be refreshed", tok.Expiry.Local().Format(time.RFC1123))
+		c.fix = "run gmailfilters auth to get a token that can be refreshed"
+	}
+	return c
+}
+
+// tokenScopes returns the scopes granted to the access token.
+func tokenScopes(ctx context.Context, accessToken string) ([]string, error) {
+	req, err := http.NewRequest("GET", tokenInfoURL+"?access_token="+url.QueryEscape(accessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("getting the scopes of the token failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting the scopes of the token failed: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decoding the scopes of the token failed: %v", err)
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// scopesCheck checks all the scopes we need were granted.
+func scopesCheck(wanted, granted []string) doctorCheck {
+	if missing := missingScopes(wanted, granted); len(missing) > 0 {
+		return doctorCheck{name: "scopes", status: checkFail, msg: "missing " + strings.Join(missing, ", "), fix: "run gmailfilters auth and grant all the permissions asked for"}
+	}
+	return doctorCheck{name: "scopes", status: checkOK, msg: strings.Join(wanted, ", ")}
+}
+
+// filterCountCheck checks the number of filters against the Gmail limit.
+func filterCountCheck(n int) doctorCheck {
+	c := doctorCheck{name: "filter count", status: checkOK, msg: fmt.Sprintf("%d of the %d filters Gmail allows", n, maxFilters)}
+	switch {
+	case n > maxFilters:
+		c.status = checkFail
+		c.fix = "combine filters with the same actions using queryOr, or export with --combine"
+	case n >= filterCountWarning:
+		c.status = checkWarn
+		c.fix = "combine filters with the same actions using queryOr to make room"
+	}
+	return c
+}
+
+// quotaCheck estimates the quota the changes in the diff use, every filter
+// being created, verified and deleted if it replaces another.
+func quotaCheck(d filterDiff) doctorCheck {
+	creates := len(d.Create) + len(d.Update)
+	units := creates*(filterWriteCost+filterReadCost) + (len(d.Update)+len(d.Delete))*filterWriteCost
+	seconds := (units + quotaUnitsPerSecond - 1) / quotaUnitsPerSecond
+
+	c := doctorCheck{name: "quota", status: checkOK, msg: fmt.Sprintf("a sync uses about %d quota units, %d seconds of the %d units per second Gmail allows", units, seconds, quotaUnitsPerSecond)}
+	if seconds > 10 {
+		c.status = checkWarn
+		c.fix = "the sync will be rate limited, pass --continue-on-error and run it again with --resume if it fails"
+	}
+	return c
+}
+
+// forwardingCheck checks the filters only forward to verified addresses.
+func forwardingCheck(filters []gmail.Filter, verified map[string]bool) doctorCheck {
+	seen := map[string]bool{}
+	var unverified []string
+	for _, f := range filters {
+		if f.Action == nil || len(f.Action.Forward) < 1 {
+			continue
+		}
+		addr := strings.ToLower(f.Action.Forward)
+		if !verified[addr] && !seen[addr] {
+			seen[addr] = true
+			unverified = append(unverified, f.Action.Forward)
+		}
+	}
+	sort.Strings(unverified)
+
+	if len(unverified) > 0 {
+		return doctorCheck{name: "forwarding", status: checkFail, msg: "not verified: " + strings.Join(unverified, ", "), fix: "add them in Gmail under Settings > Forwarding and POP/IMAP and follow the link in the confirmation email"}
+	}
+	return doctorCheck{name: "forwarding", status: checkOK, msg: "all the forwarding addresses are verified"}
+}
+
+// printDoctorChecks writes the outcome of the checks along with the fixes.
+func printDoctorChecks(w io.Writer, checks []doctorCheck) {
+	for _, c := range checks {
+		fmt.Fprintf(w, "[%s] %s: %s\n", c.status, c.name, c.msg)
+		if c.status != checkOK && len(c.fix) > 0 {
+			fmt.Fprintf(w, "       fix: %s\n", c.fix)
+		}
+	}
+}
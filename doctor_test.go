@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDoctorChecks(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		tok    *oauth2.Token
+		status string
+	}{
+		{&oauth2.Token{RefreshToken: "r", Expiry: now.Add(-time.Hour)}, checkOK},
+		{&oauth2.Token{Expiry: now.Add(-time.Hour)}, checkFail},
+		{&oauth2.Token{Expiry: now.Add(time.Hour)}, checkWarn},
+	} {
+		if c := tokenExpiryCheck(tc.tok, now); c.status != tc.status {
+			t.Fatalf("%+v: expected %s, got %+v", tc.tok, tc.status, c)
+		}
+	}
+
+	if c := scopesCheck([]string{"a", "b"}, []string{"b", "c"}); c.status != checkFail || c.msg != "missing a" {
+		t.Fatalf("expected the missing scope to fail, got %+v", c)
+	}
+	if c := scopesCheck([]string{"a"}, []string{"a"}); c.status != checkOK {
+		t.Fatalf("expected the scopes to be ok, got %+v", c)
+	}
+
+	for n, status := range map[int]string{10: checkOK, filterCountWarning: checkWarn, maxFilters + 1: checkFail} {
+		if c := filterCountCheck(n); c.status != status {
+			t.Fatalf("%d filters: expected %s, got %+v", n, status, c)
+		}
+	}
+
+	if c := quotaCheck(filterDiff{Create: make([]gmail.Filter, 100)}); c.status != checkOK {
+		t.Fatalf("expected creating 100 filters to be ok, got %+v", c)
+	}
+	if c := quotaCheck(filterDiff{Create: make([]gmail.Filter, 1000)}); c.status != checkWarn {
+		t.Fatalf("expected creating 1000 filters to warn, got %+v", c)
+	}
+
+	forward := func(addr string) gmail.Filter {
+		return gmail.Filter{Action: &gmail.FilterAction{Forward: addr}}
+	}
+	c := forwardingCheck([]gmail.Filter{forward("b@example.com"), forward("A@example.com"), forward("b@example.com"), {}}, map[string]bool{"a@example.com": true})
+	if c.status != checkFail || c.msg != "not verified: b@example.com" {
+		t.Fatalf("expected the unverified address to fail, got %+v", c)
+	}
+
+	var buf bytes.Buffer
+	printDoctorChecks(&buf, []doctorCheck{{name: "credentials", status: checkOK, msg: "creds.json", fix: "unused"}, c})
+	expected := `[ok] credentials: creds.json
+[fail] forwarding: not verified: b@example.com
+       fix: add them in Gmail under Settings > Forwarding and POP/IMAP and follow the link in the confirmation email
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+const editHelp = `Edit the filters in the account in your editor.`
+
+const editLongHelp = editHelp + `
+
+The filters are exported to a temporary filter file which is opened in
+$VISUAL or $EDITOR. Once the editor exits the file is validated, the changes
+are printed and they are applied to the account after confirmation.`
+
+func (cmd *editCommand) Name() string      { return "edit" }
+func (cmd *editCommand) Args() string      { return "" }
+func (cmd *editCommand) ShortHelp() string { return editHelp }
+func (cmd *editCommand) LongHelp() string  { return editLongHelp }
+func (cmd *editCommand) Hidden() bool      { return false }
+
+func (cmd *editCommand) Register(fs *flag.FlagSet) {}
+
+type editCommand struct{}
+
+func (cmd *editCommand) Run(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("edit does not take any arguments")
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	names, err := getLabelMapOnID(ctx)
+	if err != nil {
+		return err
+	}
+	labels, err := getLabelMap(ctx)
+	if err != nil {
+		return err
+	}
+
+	var exported []filter
+	for _, g := range remote {
+		exported = append(exported, exportFilter(g, names))
+	}
+	sortExportedFilters(exported)
+	exported = mergeExportedFilters(exported)
+	sortExportedFilters(exported)
+
+	// The filters as exported, to tell what was edited from what the filter
+	// file cannot represent.
+	before, err := editedFilters(ctx, exported, labels)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "gmailfilters-*.toml")
+	if err != nil {
+		return err
+	}
+	file := tmp.Name()
+	tmp.Close()
+	defer os.Remove(file)
+
+	if err := writeFiltersToFile(filterfile{Filter: exported}, file); err != nil {
+		return err
+	}
+
+	for {
+		if err := runEditor(file); err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, p := range validateFile(ctx, file, nil) {
+			fmt.Fprintln(os.Stderr, p)
+			if !p.warning {
+				failed++
+			}
+		}
+		if failed == 0 {
+			break
+		}
+		if assumeYes {
+			return fmt.Errorf("found %d problems", failed)
+		}
+		ok, err := confirm(fmt.Sprintf("Found %d problems, edit the file again?", failed))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errAborted
+		}
+	}
+
+	ff, err := loadFilterFiles([]string{file})
+	if err != nil {
+		return err
+	}
+
+	pending, newLabels, err := labels.pendingLabels(ff)
+	if err != nil {
+		return err
+	}
+	// The placeholder IDs of the pending labels are their names.
+	for _, name := range newLabels {
+		names[name] = name
+	}
+	after, err := editedFilters(ctx, ff.Filter, pending)
+	if err != nil {
+		return err
+	}
+
+	diff := editDiff(before, after, remote)
+	for _, name := range newLabels {
+		fmt.Fprintf(promptOut(), "+ label %s\n", name)
+	}
+	printDiff(promptOut(), diff, names)
+	if diff.empty() && len(newLabels) < 1 {
+		return nil
+	}
+	if err := checkForwardingAddresses(ctx, diff); err != nil {
+		return err
+	}
+
+	ok, err := confirm("Apply the changes?")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAborted
+	}
+
+	if err := reconcileLabels(ctx, ff, &labels); err != nil {
+		return err
+	}
+	// Compute the diff again with the IDs of the labels just created.
+	after, err = editedFilters(ctx, ff.Filter, labels)
+	if err != nil {
+		return err
+	}
+	diff = editDiff(before, after, remote)
+
+	backup, err := writeSnapshot(ctx, backupDir)
+	if err != nil {
+		return err
+	}
+	infof("Backed up existing filters to %s\n", backup)
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+	_, err = applyDiff(ctx, diff, state, nil)
+	if serr := state.save(stateFile); serr != nil {
+		logrus.Warn(serr)
+	}
+
+	return err
+}
+
+// editedFilters converts the entries of the edited file to Gmail filters.
+func editedFilters(ctx context.Context, filters []filter, labels labelMap) ([]gmail.Filter, error) {
+	var gf []gmail.Filter
+	for _, f := range filters {
+		g, err := f.toGmailFilters(ctx, &labels)
+		if err != nil {
+			return nil, err
+		}
+		gf = append(gf, g...)
+	}
+	return gf, nil
+}
+
+// editDiff returns the changes to make to the remote filters for the edits
+// that turned the exported filters before into the filters after. Filters
+// the export cannot represent exactly, like ones applying several labels,
+// are left alone unless their entry was edited, and copies of a filter are
+// only deleted along with the filter itself.
+func editDiff(before, after, remote []gmail.Filter) filterDiff {
+	exported := map[string]bool{}
+	for _, f := range before {
+		exported[fingerprint(f)] = true
+	}
+	wanted := map[string]bool{}
+	for _, f := range after {
+		wanted[fingerprint(f)] = true
+	}
+
+	d := computeDiff(after, remote)
+	diff := filterDiff{Unchanged: d.Unchanged}
+	for _, f := range d.Create {
+		// An unedited entry for a filter the export could not represent.
+		if exported[fingerprint(f)] {
+			continue
+		}
+		diff.Create = append(diff.Create, f)
+	}
+	for _, u := range d.Update {
+		if exported[fingerprint(u.New)] && !exported[fingerprint(u.Old)] {
+			diff.Kept = append(diff.Kept, u.Old)
+			continue
+		}
+		diff.Update = append(diff.Update, u)
+	}
+	for _, f := range d.Delete {
+		if exported[fingerprint(f)] && !wanted[fingerprint(f)] {
+			diff.Delete = append(diff.Delete, f)
+			continue
+		}
+		diff.Kept = append(diff.Kept, f)
+	}
+
+	return diff
+}
+
+// runEditor opens the file in the editor of the user and waits for it to
+// exit.
+func runEditor(file string) error {
+	editor := os.Getenv("VISUAL")
+	if len(editor) < 1 {
+		editor = os.Getenv("EDITOR")
+	}
+	if len(editor) < 1 {
+		editor = "vi"
+	}
+
+	// The editor may come with arguments, like "code --wait".
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], file)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running editor %s failed: %v", editor, err)
+	}
+	return nil
+}
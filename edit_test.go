@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestEditDiff(t *testing.T) {
+	kept := gmail.Filter{Id: "a", Criteria: &gmail.FilterCriteria{Query: "list:a"}, Action: &gmail.FilterAction{AddLabelIds: []string{"L1"}}}
+	edited := gmail.Filter{Id: "b", Criteria: &gmail.FilterCriteria{Query: "list:b"}, Action: &gmail.FilterAction{AddLabelIds: []string{"L1"}}}
+	removed := gmail.Filter{Id: "c", Criteria: &gmail.FilterCriteria{Query: "list:c"}, Action: &gmail.FilterAction{AddLabelIds: []string{"L1"}}}
+	// The export only keeps one of the labels of this filter.
+	lossy := gmail.Filter{Id: "d", Criteria: &gmail.FilterCriteria{Query: "list:d"}, Action: &gmail.FilterAction{AddLabelIds: []string{"L1", "L2"}}}
+	lossyExport := gmail.Filter{Criteria: lossy.Criteria, Action: &gmail.FilterAction{AddLabelIds: []string{"L1"}}}
+	copied := kept
+	copied.Id = "e"
+
+	strip := func(f gmail.Filter) gmail.Filter {
+		f.Id = ""
+		return f
+	}
+	newEdited := strip(edited)
+	newEdited.Action = &gmail.FilterAction{AddLabelIds: []string{"L2"}}
+	created := gmail.Filter{Criteria: &gmail.FilterCriteria{From: "x@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"UNREAD"}}}
+
+	remote := []gmail.Filter{kept, edited, removed, lossy, copied}
+	before := []gmail.Filter{strip(kept), strip(edited), strip(removed), lossyExport}
+	after := []gmail.Filter{strip(kept), newEdited, lossyExport, created}
+
+	diff := editDiff(before, after, remote)
+	if len(diff.Create) != 1 || diff.Create[0].Criteria.From != "x@example.com" {
+		t.Fatalf("expected only the new filter to be created, got %v", diff.Create)
+	}
+	if len(diff.Update) != 1 || diff.Update[0].Old.Id != "b" {
+		t.Fatalf("expected only the edited filter to be updated, got %v", diff.Update)
+	}
+	if len(diff.Delete) != 1 || diff.Delete[0].Id != "c" {
+		t.Fatalf("expected only the removed filter to be deleted, got %v", diff.Delete)
+	}
+	if len(diff.Kept) != 2 {
+		t.Fatalf("expected the lossy filter and the copy to be kept, got %v", diff.Kept)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// ageIdentity is the age identity file decrypting filter files, passed with
+// --age-identity.
+var ageIdentity string
+
+// encryption returns the tool the contents were encrypted with, age or gpg,
+// or an empty string if they are not encrypted.
+func encryption(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("age-encryption.org/")),
+		bytes.HasPrefix(b, []byte("-----BEGIN AGE ENCRYPTED FILE-----")):
+		return "age"
+	case bytes.HasPrefix(b, []byte("-----BEGIN PGP MESSAGE-----")):
+		return "gpg"
+	case len(b) > 0 && b[0]&0x80 != 0 && !utf8.Valid(b):
+		// Binary OpenPGP messages start with a packet tag, which has the
+		// high bit set, while TOML is UTF-8 text.
+		return "gpg"
+	}
+	return ""
+}
+
+// decryptFile decrypts the contents of the file if they were encrypted with
+// age or gpg, by running them through the tool. gpg finds the key in its
+// keyring, asking for the passphrase as usual, and age uses the identity
+// passed with --age-identity.
+func decryptFile(file string, b []byte) ([]byte, error) {
+	var args []string
+	switch encryption(b) {
+	case "":
+		return b, nil
+	case "age":
+		if len(ageIdentity) < 1 {
+			return nil, fmt.Errorf("%s is encrypted with age, pass the identity to decrypt it with --age-identity", file)
+		}
+		args = []string{"age", "--decrypt", "--identity", ageIdentity}
+	case "gpg":
+		args = []string{"gpg", "--quiet", "--decrypt"}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("decrypting %s with %s failed: %v: %s", file, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	for in, expected := range map[string]string{
+		"[[filter]]\nquery = \"from:a@example.com\"\n":                 "",
+		"\xef\xbb\xbf# filters with a byte order mark\n":               "",
+		"age-encryption.org/v1\n-> X25519 abc\n":                       "age",
+		"-----BEGIN AGE ENCRYPTED FILE-----\nYWdl\n":                   "age",
+		"-----BEGIN PGP MESSAGE-----\n\nhQEMA\n":                       "gpg",
+		"\x84\x5e\x03\xe1\x0b\x2d\xff\x9a\xc3\x41\x12\x12\x01\x07\x40": "gpg",
+	} {
+		if got := encryption([]byte(in)); got != expected {
+			t.Fatalf("%q: expected %q, got %q", in, expected, got)
+		}
+	}
+
+	ageIdentity = ""
+	if _, err := decryptFile("filters.toml.age", []byte("age-encryption.org/v1\n")); err == nil || !strings.Contains(err.Error(), "--age-identity") {
+		t.Fatalf("expected an error asking for the identity, got %v", err)
+	}
+}
+
+func TestDecryptFileGPG(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A throwaway keyring with a key without a passphrase.
+	home := filepath.Join(dir, "gnupg")
+	if err := os.Mkdir(home, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GNUPGHOME", home)
+	defer os.Unsetenv("GNUPGHOME")
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+	gpg := func(args ...string) {
+		if out, err := exec.Command("gpg", append([]string{"--batch", "--yes", "--quiet"}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("gpg %s failed: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	gpg("--passphrase", "", "--quick-gen-key", "test@example.com", "default", "default", "never")
+
+	plain := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(plain, []byte("[[filter]]\nquery = \"from:secret@example.com\"\narchive = true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, armor := range []bool{false, true} {
+		encrypted := plain + ".gpg"
+		args := []string{"--trust-model", "always", "--recipient", "test@example.com", "--output", encrypted, "--encrypt", plain}
+		if armor {
+			args = append([]string{"--armor"}, args...)
+		}
+		gpg(args...)
+
+		ff, err := decodeFile(encrypted, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ff.Filter) != 1 || ff.Filter[0].Query != "from:secret@example.com" {
+			t.Fatalf("armor %t: expected the decrypted filter, got %#v", armor, ff.Filter)
+		}
+	}
+}
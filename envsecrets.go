@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// credentialsEnv is the environment variable the contents of the
+	// credential file can be passed in, so containers need no secret files.
+	credentialsEnv = "GMAILFILTERS_CREDENTIALS"
+	// tokenEnv is the environment variable the token, or just its refresh
+	// token, can be passed in.
+	tokenEnv = "GMAILFILTERS_TOKEN"
+)
+
+// decodeSecret returns the JSON in the secret from source, passed as is or
+// base64 encoded.
+func decodeSecret(source, v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "{") {
+		return []byte(v), nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither JSON nor base64: %v", source, err)
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+// parseCredentials returns the credentials in the secret from source.
+func parseCredentials(source, v string) ([]byte, error) {
+	b, err := decodeSecret(source, v)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("%s does not hold JSON credentials", source)
+	}
+	return b, nil
+}
+
+// parseToken returns the token in the secret from source. Anything that is
+// not a JSON token is taken as a refresh token, which is all that is needed
+// to get the others.
+func parseToken(source, v string) (*oauth2.Token, error) {
+	b, err := decodeSecret(source, v)
+	if err != nil || !bytes.HasPrefix(b, []byte("{")) {
+		return &oauth2.Token{RefreshToken: strings.TrimSpace(v)}, nil
+	}
+
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("decoding the token in %s failed: %v", source, err)
+	}
+	return tok, nil
+}
+
+// credentialsFromEnv returns the credentials in GMAILFILTERS_CREDENTIALS, if
+// it is set.
+func credentialsFromEnv() ([]byte, bool, error) {
+	v := os.Getenv(credentialsEnv)
+	if len(strings.TrimSpace(v)) < 1 {
+		return nil, false, nil
+	}
+	b, err := parseCredentials(credentialsEnv, v)
+	return b, true, err
+}
+
+// tokenFromEnv returns the token in GMAILFILTERS_TOKEN, if it is set.
+func tokenFromEnv() (*oauth2.Token, bool, error) {
+	v := os.Getenv(tokenEnv)
+	if len(strings.TrimSpace(v)) < 1 {
+		return nil, false, nil
+	}
+	tok, err := parseToken(tokenEnv, v)
+	return tok, true, err
+}
+
+// externalToken returns where the token comes from if it is managed outside
+// of gmailfilters, in GMAILFILTERS_TOKEN or a secret store, so it can be read
+// but not saved.
+func externalToken() (string, bool) {
+	if len(strings.TrimSpace(os.Getenv(tokenEnv))) > 0 {
+		return tokenEnv, true
+	}
+	if isSecretRef(tokenFile) {
+		return tokenFile, true
+	}
+	return "", false
+}
+
+// credentialsLocation returns where the credentials are read from, for
+// display.
+func credentialsLocation() string {
+	if len(os.Getenv(credentialsEnv)) > 0 {
+		return credentialsEnv
+	}
+	return credsFile
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenFromEnv(t *testing.T) {
+	defer os.Unsetenv(tokenEnv)
+
+	raw := `{"access_token":"a","refresh_token":"r"}`
+	for value, expected := range map[string]*oauth2.Token{
+		raw: {AccessToken: "a", RefreshToken: "r"},
+		base64.StdEncoding.EncodeToString([]byte(raw)): {AccessToken: "a", RefreshToken: "r"},
+		"1//0refresh-token":                            {RefreshToken: "1//0refresh-token"},
+	} {
+		os.Setenv(tokenEnv, value)
+		tok, ok, err := tokenFromEnv()
+		if err != nil || !ok {
+			t.Fatalf("%s: expected a token, got %v, %v", value, ok, err)
+		}
+		if tok.AccessToken != expected.AccessToken || tok.RefreshToken != expected.RefreshToken {
+			t.Fatalf("%s: expected %+v, got %+v", value, expected, tok)
+		}
+	}
+
+	os.Setenv(tokenEnv, `{"access_token":`)
+	if _, _, err := tokenFromEnv(); err == nil {
+		t.Fatal("expected invalid JSON to fail")
+	}
+
+	os.Unsetenv(tokenEnv)
+	if _, ok, _ := tokenFromEnv(); ok {
+		t.Fatal("expected no token without the environment variable")
+	}
+}
+
+func TestCredentialsFromEnv(t *testing.T) {
+	defer os.Unsetenv(credentialsEnv)
+
+	raw := `{"installed":{"client_id":"id"}}`
+	for _, value := range []string{raw, base64.StdEncoding.EncodeToString([]byte(raw))} {
+		os.Setenv(credentialsEnv, value)
+		b, ok, err := credentialsFromEnv()
+		if err != nil || !ok {
+			t.Fatalf("%s: expected credentials, got %v, %v", value, ok, err)
+		}
+		if diff := cmp.Diff(raw, string(b)); len(diff) > 1 {
+			t.Fatalf("got diff: %s", diff)
+		}
+	}
+
+	os.Setenv(credentialsEnv, "not credentials")
+	if _, _, err := credentialsFromEnv(); err == nil {
+		t.Fatal("expected credentials that are not JSON to fail")
+	}
+}
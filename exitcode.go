@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+)
+
+// The exit codes, so scripts can tell the failures apart. Anything else
+// exits with 1.
+const (
+	exitAuth       = 3
+	exitValidation = 4
+	exitPartial    = 5
+	exitDrift      = 6
+	exitQuota      = 7
+)
+
+// exitError is an error exiting with a specific code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode returns the error exiting with the code, or nil if there is no
+// error.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// The API errors seen, as they are formatted into the errors returned and
+// cannot be told apart from them anymore.
+var (
+	quotaExhausted int32
+	unauthorized   int32
+)
+
+// recordAPIStatus notes the response of the API if it means we are out of
+// quota or not allowed in. The Gmail API tells rate limits from missing
+// permissions in forbidden responses by the reason in the body.
+func recordAPIStatus(resp *http.Response) {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		atomic.StoreInt32(&quotaExhausted, 1)
+	case http.StatusUnauthorized:
+		atomic.StoreInt32(&unauthorized, 1)
+	case http.StatusForbidden:
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		lower := bytes.ToLower(b)
+		if bytes.Contains(lower, []byte("ratelimitexceeded")) || bytes.Contains(lower, []byte("quotaexceeded")) {
+			atomic.StoreInt32(&quotaExhausted, 1)
+			return
+		}
+		atomic.StoreInt32(&unauthorized, 1)
+	}
+}
+
+// exitCode returns the code to exit with for the error. Running out of quota
+// or being refused by the API explains any failure that follows.
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case atomic.LoadInt32(&quotaExhausted) == 1:
+		return exitQuota
+	case atomic.LoadInt32(&unauthorized) == 1:
+		return exitAuth
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, errDrift):
+		return exitDrift
+	}
+	return 1
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	defer func() {
+		quotaExhausted = 0
+		unauthorized = 0
+	}()
+
+	for _, tc := range []struct {
+		name     string
+		status   int
+		body     string
+		err      error
+		expected int
+	}{
+		{name: "plain", err: errors.New("boom"), expected: 1},
+		{name: "drift", err: errDrift, expected: exitDrift},
+		{name: "validation", err: withExitCode(exitValidation, errors.New("bad filter")), expected: exitValidation},
+		{name: "wrapped", err: fmt.Errorf("apply: %w", withExitCode(exitPartial, errors.New("1 of 2 failed"))), expected: exitPartial},
+		{name: "unauthorized", status: http.StatusUnauthorized, err: errors.New("listing filters failed"), expected: exitAuth},
+		{name: "forbidden", status: http.StatusForbidden, body: `{"error": {"errors": [{"reason": "insufficientPermissions"}]}}`, err: errors.New("listing filters failed"), expected: exitAuth},
+		{name: "rate limited", status: http.StatusForbidden, body: `{"error": {"errors": [{"reason": "userRateLimitExceeded"}]}}`, err: withExitCode(exitPartial, errors.New("1 of 2 failed")), expected: exitQuota},
+		{name: "too many requests", status: http.StatusTooManyRequests, err: errors.New("creating filter failed"), expected: exitQuota},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			quotaExhausted = 0
+			unauthorized = 0
+			if tc.status > 0 {
+				resp := &http.Response{StatusCode: tc.status, Body: ioutil.NopCloser(strings.NewReader(tc.body))}
+				recordAPIStatus(resp)
+				// The body can still be read after being looked at.
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != tc.body {
+					t.Fatalf("expected the body %q, got %q", tc.body, b)
+				}
+			}
+
+			if got := exitCode(tc.err); got != tc.expected {
+				t.Fatalf("expected exit code %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const explainHelp = `Describe what the filters in a filter file do in plain English.`
+
+func (cmd *explainCommand) Name() string      { return "explain" }
+func (cmd *explainCommand) Args() string      { return "<file>..." }
+func (cmd *explainCommand) ShortHelp() string { return explainHelp }
+func (cmd *explainCommand) LongHelp() string  { return explainHelp }
+func (cmd *explainCommand) Hidden() bool      { return false }
+
+func (cmd *explainCommand) Register(fs *flag.FlagSet) {
+	registerSelectFlags(fs)
+}
+
+type explainCommand struct{}
+
+func (cmd *explainCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	// The placeholder IDs of the labels are their names, so nothing needs to
+	// be looked up in the account.
+	labels, _, err := labelMap{}.pendingLabels(ff)
+	if err != nil {
+		return err
+	}
+
+	return explainFilters(ctx, os.Stdout, ff.Filter, labels)
+}
+
+// explainFilters writes a sentence describing each of the Gmail filters the
+// entries are converted to, given a map of label names to placeholder IDs
+// that are the names themselves.
+func explainFilters(ctx context.Context, w io.Writer, filters []filter, labels labelMap) error {
+	for _, f := range filters {
+		gf, err := f.toGmailFilters(ctx, &labels)
+		if err != nil {
+			return err
+		}
+		for _, g := range gf {
+			fmt.Fprintln(w, explainFilter(g, labelMap{}))
+		}
+	}
+
+	return nil
+}
+
+// explainFilter describes the filter as a sentence, given a map of label IDs
+// to names.
+func explainFilter(f gmail.Filter, names labelMap) string {
+	return fmt.Sprintf("%s: %s", explainCriteria(f.Criteria), explainAction(f.Action, names))
+}
+
+// explainCriteria describes the mail the criteria match.
+func explainCriteria(c *gmail.FilterCriteria) string {
+	if c == nil {
+		return "All mail"
+	}
+
+	var parts []string
+	if len(c.From) > 0 {
+		parts = append(parts, "from "+c.From)
+	}
+	switch c.To {
+	case "":
+	case "me":
+		parts = append(parts, "addressed to me")
+	default:
+		parts = append(parts, "to "+c.To)
+	}
+	if len(c.Subject) > 0 {
+		parts = append(parts, fmt.Sprintf("with subject %q", c.Subject))
+	}
+	if len(c.Query) > 0 {
+		parts = append(parts, fmt.Sprintf("matching %q", normalizeQuery(c.Query)))
+	}
+	switch c.NegatedQuery {
+	case "":
+	case "to:me":
+		parts = append(parts, "not addressed to me")
+	case toOrCcMeQuery:
+		parts = append(parts, "not addressed or copied to me")
+	default:
+		parts = append(parts, fmt.Sprintf("not matching %q", normalizeQuery(c.NegatedQuery)))
+	}
+	if c.HasAttachment {
+		parts = append(parts, "with an attachment")
+	}
+	if c.Size > 0 {
+		parts = append(parts, fmt.Sprintf("%s than %d bytes", c.SizeComparison, c.Size))
+	}
+	if c.ExcludeChats {
+		parts = append(parts, "excluding chats")
+	}
+
+	if len(parts) < 1 {
+		return "All mail"
+	}
+	return "Mail " + strings.Join(parts, " ")
+}
+
+// explainAction describes what the action does to the mail, given a map of
+// label IDs to names.
+func explainAction(a *gmail.FilterAction, names labelMap) string {
+	if a == nil {
+		return "do nothing"
+	}
+
+	var parts []string
+	for _, id := range a.RemoveLabelIds {
+		switch id {
+		case "INBOX":
+			parts = append(parts, "skip the inbox")
+		case "UNREAD":
+			parts = append(parts, "mark as read")
+		case "IMPORTANT":
+			parts = append(parts, "never mark as important")
+		case "SPAM":
+			parts = append(parts, "never send to spam")
+		default:
+			parts = append(parts, fmt.Sprintf("remove label '%s'", labelNames([]string{id}, names)[0]))
+		}
+	}
+	for _, id := range a.AddLabelIds {
+		switch id {
+		case "TRASH":
+			parts = append(parts, "delete it")
+		case "STARRED":
+			parts = append(parts, "star it")
+		case "IMPORTANT":
+			parts = append(parts, "mark as important")
+		default:
+			parts = append(parts, fmt.Sprintf("apply label '%s'", labelNames([]string{id}, names)[0]))
+		}
+	}
+	if len(a.Forward) > 0 {
+		parts = append(parts, "forward to "+a.Forward)
+	}
+
+	if len(parts) < 1 {
+		return "do nothing"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExplainFilters(t *testing.T) {
+	ff := filterfile{Filter: []filter{
+		{From: stringList{"github.com"}, Label: "code/notifications", ArchiveUnlessToMe: true},
+		{Query: "list:dev", Read: true, Star: true, ForwardTo: "me@example.com"},
+		{Subject: "invoice", HasAttachment: true, Size: 1000, SizeComparison: "larger", NeverSpam: true},
+	}}
+	labels, _, err := labelMap{}.pendingLabels(ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := explainFilters(context.Background(), &buf, ff.Filter, labels); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `Mail from github.com addressed to me: apply label 'code/notifications'
+Mail from github.com not addressed to me: skip the inbox, apply label 'code/notifications'
+Mail matching "list:dev": mark as read, star it, forward to me@example.com
+Mail with subject "invoice" with an attachment larger than 1000 bytes: never send to spam
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const exportHelp = `Export the filters in the account to a filter file.`
+
+const exportLongHelp = exportHelp + `
+
+Pass - as the file to write the filters to stdout. With --format csv the
+filters are written as a spreadsheet with a column for each criteria and
+action, to review them with people who do not read TOML.`
+
+func (cmd *exportCommand) Name() string      { return "export" }
+func (cmd *exportCommand) Args() string      { return "<file>" }
+func (cmd *exportCommand) ShortHelp() string { return exportHelp }
+func (cmd *exportCommand) LongHelp() string  { return exportLongHelp }
+func (cmd *exportCommand) Hidden() bool      { return false }
+
+func (cmd *exportCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&mergeExport, "merge", false, "merge exported filters into the existing file, preserving its comments")
+	fs.BoolVar(&combineExport, "combine", false, "combine exported filters with the same actions into one entry with an OR'd query")
+	fs.BoolVar(&verifyExport, "verify", false, "check the exported file reproduces the filters in the account")
+	fs.StringVar(&exportFormat, "format", "toml", "format of the exported file: toml or csv")
+}
+
+type exportCommand struct{}
+
+func (cmd *exportCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) != 1 {
+		return errors.New("must pass the path to the gmail filter configuration file to export to")
+	}
+	switch exportFormat {
+	case "toml":
+	case "csv":
+		if mergeExport || verifyExport {
+			return errors.New("cannot merge into or verify filters exported as csv")
+		}
+	default:
+		return fmt.Errorf("invalid format %q, must be toml or csv", exportFormat)
+	}
+	if isRemote(args[0]) {
+		return errors.New("cannot export to a URL or git repository, pass the path of a file or - for stdout")
+	}
+	if args[0] == stdio {
+		if mergeExport || verifyExport {
+			return errors.New("cannot merge into or verify filters exported to stdout")
+		}
+		stdoutTaken = true
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	return exportExistingFilters(ctx, args[0])
+}
+
+// csvColumns are the columns of the filters exported as csv, named after the
+// filter file settings, the criteria first and then the actions.
+var csvColumns = []string{
+	"query", "from", "to", "subject", "negatedQuery", "hasAttachment", "excludeChats", "size", "sizeComparison", "toMe",
+	"label", "archive", "archiveUnlessToMe", "archiveUnlessCcMe", "read", "delete", "star", "important", "neverImportant", "neverSpam", "forwardTo",
+}
+
+// writeFiltersCSV writes the filters as csv with a header row, with "yes"
+// for the actions they take and lists OR'd together.
+func writeFiltersCSV(w io.Writer, filters []filter) error {
+	yes := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return ""
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		query := f.Query
+		if len(f.QueryOr) > 0 {
+			query = strings.Join(f.QueryOr, " OR ")
+		}
+		size := ""
+		if f.Size > 0 {
+			size = strconv.FormatInt(f.Size, 10)
+		}
+		if err := cw.Write([]string{
+			query, f.From.orQuery(), f.To.orQuery(), f.Subject, f.NegatedQuery, yes(f.HasAttachment), yes(f.ExcludeChats), size, f.SizeComparison, yes(f.ToMe),
+			f.Label, yes(f.Archive), yes(f.ArchiveUnlessToMe), yes(f.ArchiveUnlessCcMe), yes(f.Read), yes(f.Delete), yes(f.Star), yes(f.Important), yes(f.NeverImportant), yes(f.NeverSpam), f.ForwardTo,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
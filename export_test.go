@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteFiltersCSV(t *testing.T) {
+	filters := []filter{
+		{From: stringList{"a@example.com", "b@example.com"}, Label: "friends, family", Star: true},
+		{QueryOr: []string{"list:dev", `subject:"weekly digest"`}, Archive: true, Read: true},
+		{Size: 5000000, SizeComparison: "larger", HasAttachment: true, Label: "big"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeFiltersCSV(&buf, filters); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `query,from,to,subject,negatedQuery,hasAttachment,excludeChats,size,sizeComparison,toMe,label,archive,archiveUnlessToMe,archiveUnlessCcMe,read,delete,star,important,neverImportant,neverSpam,forwardTo
+,a@example.com OR b@example.com,,,,,,,,,"friends, family",,,,,,yes,,,,
+"list:dev OR subject:""weekly digest""",,,,,,,,,,,yes,,,yes,,,,,,
+,,,,,yes,,5000000,larger,,big,,,,,,,,,,
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -13,37 +17,173 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
+// toOrCcMeQuery matches mail where we are either a direct or a copied recipient.
+const toOrCcMeQuery = "{to:me cc:me}"
+
 // filterfile defines a set of filter objects.
 type filterfile struct {
-	Filter []filter
+	Suppress []string
+	Snippets map[string]string
+	Protect  []protectRule
+	Label    []labelDefinition
+	Filter   []filter
 }
 
 // filter defines a filter object.
 type filter struct {
-	Query             string
-	QueryOr           []string
-	Archive           bool
-	Read              bool
-	Delete            bool
-	ToMe              bool
-	ArchiveUnlessToMe bool
-	Label             string
-	ForwardTo         string
+	Query                 string
+	QueryOr               []string
+	Match                 *match
+	Archive               bool
+	Read                  bool
+	Delete                bool
+	Star                  bool `toml:",omitempty"`
+	Important             bool `toml:",omitempty"`
+	NeverImportant        bool `toml:",omitempty"`
+	NeverSpam             bool `toml:",omitempty"`
+	ToMe                  bool
+	ArchiveUnlessToMe     bool
+	ArchiveUnlessCcMe     bool
+	From                  stringList
+	To                    stringList
+	Subject               string `toml:",omitempty"`
+	NegatedQuery          string `toml:",omitempty"`
+	HasAttachment         bool   `toml:",omitempty"`
+	ExcludeChats          bool   `toml:",omitempty"`
+	Size                  int64  `toml:",omitzero"`
+	SizeComparison        string `toml:",omitempty"`
+	Label                 string
+	LabelColor            *labelColor
+	LabelListVisibility   string
+	MessageListVisibility string
+	ForwardTo             string
+	Group                 string `toml:",omitempty"`
+}
+
+// labelColor defines the background and text colors of a label.
+type labelColor struct {
+	Background string
+	Text       string
+}
+
+// labelSettings returns the settings to apply to the label of the filter or
+// nil if there are none.
+func (f filter) labelSettings() *gmail.Label {
+	if f.LabelColor == nil && len(f.LabelListVisibility) < 1 && len(f.MessageListVisibility) < 1 {
+		return nil
+	}
+
+	settings := &gmail.Label{
+		LabelListVisibility:   f.LabelListVisibility,
+		MessageListVisibility: f.MessageListVisibility,
+	}
+	if f.LabelColor != nil {
+		settings.Color = &gmail.LabelColor{
+			BackgroundColor: f.LabelColor.Background,
+			TextColor:       f.LabelColor.Text,
+		}
+	}
+
+	return settings
 }
 
-func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
+// stringList is a list of strings that can be decoded from either a single
+// TOML string or an array of strings.
+type stringList []string
+
+// UnmarshalTOML implements the toml.Unmarshaler interface.
+func (l *stringList) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*l = stringList{v}
+	case []interface{}:
+		list := make(stringList, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a list of strings, got item %#v", item)
+			}
+			list = append(list, s)
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected a string or a list of strings, got %#v", data)
+	}
+
+	return nil
+}
+
+// orQuery joins the list into a single OR'd criteria clause.
+func (l stringList) orQuery() string {
+	return strings.Join(l, " OR ")
+}
+
+func (f filter) toGmailFilters(ctx context.Context, labels *labelMap) ([]gmail.Filter, error) {
 	// Convert the filter into a gmail filters.
 	if len(f.Query) > 0 && len(f.QueryOr) > 0 {
 		return nil, errors.New("cannot have both a query and a queryOr")
 	}
 
+	if f.Match != nil && (len(f.Query) > 0 || len(f.QueryOr) > 0) {
+		return nil, errors.New("cannot have both a match block and a query or queryOr")
+	}
+
 	if len(f.QueryOr) > 0 {
 		// Create the OR query.
 		f.Query = strings.Join(f.QueryOr, " OR ")
 	}
 
-	if len(f.Query) < 1 {
-		return nil, errors.New("query or queryOr cannot be empty")
+	if f.Match != nil {
+		// Compile the structured criteria into a query.
+		q, err := f.Match.compile()
+		if err != nil {
+			return nil, err
+		}
+		f.Query = q
+	}
+
+	if len(f.Query) < 1 && len(f.From) < 1 && len(f.To) < 1 && len(f.Subject) < 1 &&
+		len(f.NegatedQuery) < 1 && !f.HasAttachment && f.Size == 0 {
+		return nil, errors.New("query, queryOr, match, from, to, subject, negatedQuery, hasAttachment or size cannot all be empty")
+	}
+
+	// Catch syntax errors before Gmail does, its errors are cryptic.
+	if len(f.Query) > 0 {
+		if _, err := parseQuery(f.Query); err != nil {
+			return nil, fmt.Errorf("invalid query %q: %v", f.Query, err)
+		}
+	}
+
+	if len(f.To) > 0 && (f.ToMe || f.ArchiveUnlessToMe) {
+		return nil, errors.New("cannot have both to and toMe or archiveUnlessToMe")
+	}
+
+	if len(f.NegatedQuery) > 0 {
+		if f.ArchiveUnlessToMe || f.ArchiveUnlessCcMe {
+			return nil, errors.New("cannot have both a negatedQuery and archiveUnlessToMe or archiveUnlessCcMe")
+		}
+		if _, err := parseQuery(f.NegatedQuery); err != nil {
+			return nil, fmt.Errorf("invalid negatedQuery %q: %v", f.NegatedQuery, err)
+		}
+	}
+
+	switch {
+	case f.Size < 0:
+		return nil, errors.New("size cannot be negative")
+	case f.Size > 0 && f.SizeComparison != "larger" && f.SizeComparison != "smaller":
+		return nil, fmt.Errorf("invalid sizeComparison %q, must be larger or smaller", f.SizeComparison)
+	case f.Size == 0 && len(f.SizeComparison) > 0:
+		return nil, errors.New("cannot have a sizeComparison without a size")
+	}
+
+	if err := validateLabelVisibility(f.LabelListVisibility, f.MessageListVisibility); err != nil {
+		return nil, err
+	}
+
+	for _, c := range f.conflictingActions() {
+		if c.fatal {
+			return nil, errors.New(c.String())
+		}
 	}
 
 	action := gmail.FilterAction{
@@ -52,7 +192,7 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 	}
 	if len(f.Label) > 0 {
 		// Create the label if it does not exist.
-		labelID, err := labels.createLabelIfDoesNotExist(f.Label)
+		labelID, err := labels.createLabelIfDoesNotExist(ctx, f.Label, f.labelSettings())
 		if err != nil {
 			return nil, err
 		}
@@ -60,7 +200,7 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 	}
 
 	action.RemoveLabelIds = []string{}
-	if f.Archive && !f.ArchiveUnlessToMe {
+	if f.Archive && !f.ArchiveUnlessToMe && !f.ArchiveUnlessCcMe {
 		action.RemoveLabelIds = append(action.RemoveLabelIds, "INBOX")
 	}
 
@@ -72,12 +212,36 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 		action.AddLabelIds = append(action.AddLabelIds, "TRASH")
 	}
 
+	if f.Star {
+		action.AddLabelIds = append(action.AddLabelIds, "STARRED")
+	}
+
+	if f.Important {
+		action.AddLabelIds = append(action.AddLabelIds, "IMPORTANT")
+	}
+
+	if f.NeverImportant {
+		action.RemoveLabelIds = append(action.RemoveLabelIds, "IMPORTANT")
+	}
+
+	if f.NeverSpam {
+		action.RemoveLabelIds = append(action.RemoveLabelIds, "SPAM")
+	}
+
 	if len(f.ForwardTo) > 0 {
 		action.Forward = f.ForwardTo
 	}
 
 	criteria := gmail.FilterCriteria{
-		Query: f.Query,
+		Query:          f.Query,
+		NegatedQuery:   f.NegatedQuery,
+		From:           f.From.orQuery(),
+		To:             f.To.orQuery(),
+		Subject:        f.Subject,
+		HasAttachment:  f.HasAttachment,
+		ExcludeChats:   f.ExcludeChats,
+		Size:           f.Size,
+		SizeComparison: f.SizeComparison,
 	}
 	if f.ToMe || f.ArchiveUnlessToMe {
 		criteria.To = "me"
@@ -95,11 +259,10 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 	if f.ArchiveUnlessToMe {
 		// Copy the filter.
 		archiveIfNotToMeFilter := filter
-		archiveIfNotToMeFilter.Criteria = &gmail.FilterCriteria{
-			Query:        f.Query,
-			To:           "",
-			NegatedQuery: "to:me",
-		}
+		archiveIfNotToMeCriteria := criteria
+		archiveIfNotToMeCriteria.To = ""
+		archiveIfNotToMeCriteria.NegatedQuery = "to:me"
+		archiveIfNotToMeFilter.Criteria = &archiveIfNotToMeCriteria
 
 		// Copy the action.
 		archiveAction := action
@@ -111,173 +274,573 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 		filters = append(filters, archiveIfNotToMeFilter)
 	}
 
-	return filters, nil
+	// If we need to archive unless we are in To or Cc, then the first filter
+	// keeps the mail in the inbox for everything and the additional filter
+	// archives whatever is not addressed or copied to us.
+	if f.ArchiveUnlessCcMe {
+		// Copy the filter.
+		archiveIfNotCcMeFilter := filter
+		archiveIfNotCcMeCriteria := criteria
+		archiveIfNotCcMeCriteria.NegatedQuery = toOrCcMeQuery
+		archiveIfNotCcMeFilter.Criteria = &archiveIfNotCcMeCriteria
+
+		// Copy the action.
+		archiveAction := action
+		// Archive it.
+		archiveAction.RemoveLabelIds = append(action.RemoveLabelIds, "INBOX")
+		archiveIfNotCcMeFilter.Action = &archiveAction
+
+		// Append the extra filter.
+		filters = append(filters, archiveIfNotCcMeFilter)
+	}
+
+	// Gmail rejects criteria that are too long, split them if we can.
+	return splitLongFilters(filters)
 }
 
-func (f filter) addFilter(labels *labelMap) error {
-	// Convert the filter into a gmail filter.
-	filters, err := f.toGmailFilters(labels)
+// loadFilterFile decodes the filter file with the template values and
+// environment variable expansion requested on the command line.
+func loadFilterFile(file string) (filterfile, error) {
+	values, err := flagTemplateValues()
 	if err != nil {
-		return err
+		return filterfile{}, err
+	}
+
+	noticef("Decoding filters from file %s\n", file)
+	ff, err := decodeFile(file, values)
+	if err != nil {
+		return ff, err
 	}
 
-	// Add the filters.
-	for _, fltr := range filters {
-		logrus.WithFields(logrus.Fields{
-			"action":   fmt.Sprintf("%#v", fltr.Action),
-			"criteria": fmt.Sprintf("%#v", fltr.Criteria),
-		}).Debug("adding Gmail filter")
-		if _, err := api.Users.Settings.Filters.Create(gmailUser, &fltr).Do(); err != nil {
-			return fmt.Errorf("creating filter [%#v] failed: %v", fltr, err)
+	if expandEnvVars {
+		ff.Filter, err = expandFilterEnv(ff.Filter)
+		if err != nil {
+			return ff, err
 		}
 	}
 
-	return nil
+	// Filters are in the group named after their file unless they say
+	// otherwise.
+	for i := range ff.Filter {
+		if len(ff.Filter[i].Group) < 1 {
+			ff.Filter[i].Group = fileGroup(file)
+		}
+	}
+
+	return ff, nil
 }
 
-func decodeFile(file string) ([]filter, error) {
-	b, err := ioutil.ReadFile(file)
+// loadFilterFiles decodes the filter files and merges them into one, keeping
+// only the filters selected on the command line. Its errors are validation
+// errors.
+func loadFilterFiles(files []string) (filterfile, error) {
+	var ff filterfile
+	for _, file := range files {
+		f, err := loadFilterFile(file)
+		if err != nil {
+			return ff, withExitCode(exitValidation, err)
+		}
+		// A file suppresses the filters of the files before it, so it can
+		// replace them with its own.
+		if ff.Filter, err = suppressFilters(ff.Filter, f.Suppress); err != nil {
+			return ff, withExitCode(exitValidation, fmt.Errorf("%s: %v", file, err))
+		}
+		if ff, err = ff.merge(f); err != nil {
+			return ff, withExitCode(exitValidation, fmt.Errorf("merging filter file %s failed: %v", file, err))
+		}
+	}
+
+	var err error
+	if len(syncGroup) > 0 {
+		ff.Filter, err = groupFilters(ff.Filter, syncGroup)
+		if err != nil {
+			return ff, withExitCode(exitValidation, err)
+		}
+		noticef("Only syncing the %d filters in group %s\n", len(ff.Filter), syncGroup)
+	}
+
+	if len(only) > 0 {
+		ff.Filter, err = selectFilters(ff.Filter, only)
+		if err != nil {
+			return ff, withExitCode(exitValidation, err)
+		}
+		noticef("Only syncing the %d filters matching %q\n", len(ff.Filter), only)
+	}
+
+	return ff, nil
+}
+
+// merge returns the filter file with the snippets, protect rules, labels and
+// filters of other added. A snippet defined differently in both is an error.
+func (ff filterfile) merge(other filterfile) (filterfile, error) {
+	for name, snippet := range other.Snippets {
+		if existing, ok := ff.Snippets[name]; ok && existing != snippet {
+			return ff, fmt.Errorf("snippet %s is already defined as %q", name, existing)
+		}
+		if ff.Snippets == nil {
+			ff.Snippets = map[string]string{}
+		}
+		ff.Snippets[name] = snippet
+	}
+
+	ff.Protect = append(ff.Protect, other.Protect...)
+	ff.Label = append(ff.Label, other.Label...)
+	ff.Filter = append(ff.Filter, other.Filter...)
+
+	return ff, nil
+}
+
+// flagTemplateValues returns the template values passed on the command line,
+// or nil if the filter files are not templates.
+func flagTemplateValues() (templateValues, error) {
+	if renderTemplates || len(valuesFile) > 0 || len(setValues) > 0 {
+		return loadTemplateValues(valuesFile, setValues)
+	}
+	return nil, nil
+}
+
+// readFilterFile reads the filter file, verifying its signature if we were
+// given a key, decrypting it if it is encrypted and rendering it as a
+// template first if we were given values.
+func readFilterFile(file string, values templateValues) ([]byte, error) {
+	b, err := readFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("reading filter file %s failed: %v", file, err)
 	}
+	if err := verifyFileSignature(file, b); err != nil {
+		return nil, err
+	}
+	if b, err = decryptFile(file, b); err != nil {
+		return nil, err
+	}
+
+	if values != nil {
+		return renderTemplate(file, b, values)
+	}
+	return b, nil
+}
 
+func decodeFile(file string, values templateValues) (filterfile, error) {
 	var ff filterfile
+
+	b, err := readFilterFile(file, values)
+	if err != nil {
+		return ff, err
+	}
+
 	if _, err := toml.Decode(string(b), &ff); err != nil {
-		return nil, fmt.Errorf("decoding toml failed: %v", err)
+		return ff, fmt.Errorf("decoding toml failed: %v", err)
 	}
 
-	return ff.Filter, nil
+	// Compile the protect rules.
+	if ff.Protect, err = compileProtectRules(ff.Protect); err != nil {
+		return ff, err
+	}
+
+	// Expand any snippet references in the queries.
+	ff.Filter, err = expandFilterSnippets(ff.Filter, ff.Snippets)
+	return ff, err
+}
+
+// envVarRegexp matches ${ENV_VAR} references.
+var envVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${ENV_VAR} references in s with the value of the
+// environment variable. It returns an error if a variable is not set.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envVarRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envVarRegexp.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v
+	})
+	return expanded, err
 }
 
-func exportExistingFilters(file string) error {
-	fmt.Print("exporting existing filters...\n")
+// expandFilterEnv expands environment variable references in the queries,
+// senders, recipients and forwarding addresses of the filters.
+func expandFilterEnv(filters []filter) ([]filter, error) {
+	var err error
+	for i := range filters {
+		f := &filters[i]
 
-	filters, err := getExistingFilters()
+		if f.Query, err = expandEnv(f.Query); err != nil {
+			return nil, err
+		}
+		for _, list := range [][]string{f.QueryOr, f.From, f.To} {
+			for j := range list {
+				if list[j], err = expandEnv(list[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if f.ForwardTo, err = expandEnv(f.ForwardTo); err != nil {
+			return nil, err
+		}
+	}
+
+	return filters, nil
+}
+
+func exportExistingFilters(ctx context.Context, file string) error {
+	infof("exporting existing filters...\n")
+
+	filters, err := getExistingFilters(ctx)
 	if err != nil {
 		return fmt.Errorf("error downloading existing filters: %v", err)
 	}
 
+	// Keep the snippets from the file we are exporting to, if it exists, so we
+	// can substitute them back into the exported queries.
 	var ff filterfile
-	for _, f := range filters {
-		// We could get duplicate filters, so it's best to remove them.
-		existingFilter := findExistingFilter(ff.Filter, f.Query)
-
-		// Since we can't return nil on a struct or compary it to something empty,
-		// check if the query exists. If not then consider it not found.
-		if existingFilter.Query != "" {
-			// Duplicate filters can only exist if the ArchiveUnlessToMe is set.
-			// So we can simply reset everything and just set the ArchiveUnlessToMe flag to true.
-			existingFilter.Archive = false
-			existingFilter.Delete = false
-			existingFilter.ToMe = false
-			existingFilter.ArchiveUnlessToMe = true
-		} else {
-			ff.Filter = append(ff.Filter, f)
+	if _, err := os.Stat(file); err == nil && file != stdio && exportFormat != "csv" {
+		if _, err := toml.DecodeFile(file, &ff); err != nil {
+			logrus.Warnf("Decoding snippets from existing file %s failed: %v", file, err)
 		}
+		ff.Filter = nil
+	}
+
+	for i := range filters {
+		filters[i].Query = collapseSnippets(filters[i].Query, ff.Snippets)
+	}
+	// The API returns the filters in no particular order, sort them so
+	// exporting again only changes what changed in the account.
+	sortExportedFilters(filters)
+	ff.Filter = mergeExportedFilters(filters)
+	if combineExport {
+		ff.Filter = combineExportedFilters(ff.Filter)
+	}
+	sortExportedFilters(ff.Filter)
+
+	// Merge the filters into the existing file to keep its comments.
+	_, serr := os.Stat(file)
+	if mergeExport && serr == nil && file != stdio {
+		err = mergeFiltersIntoFile(ff.Filter, file)
+	} else {
+		err = writeFiltersToFile(ff, file)
+	}
+	if err != nil || !verifyExport {
+		return err
 	}
 
-	return writeFiltersToFile(ff, file)
+	return verifyExportedFile(ctx, file)
 }
 
-func deleteExistingFilters() error {
-	// Get current filters for the user.
-	l, err := api.Users.Settings.Filters.List(gmailUser).Do()
+// verifyExportedFile makes sure applying the exported file would leave the
+// account as it is, reporting the filters that would change if not.
+func verifyExportedFile(ctx context.Context, file string) error {
+	ff, err := decodeFile(file, nil)
+	if err != nil {
+		return err
+	}
+
+	diff, _, names, err := planSync(ctx, ff)
 	if err != nil {
-		return fmt.Errorf("listing filters failed: %v", err)
+		return err
+	}
+	if diff.empty() {
+		infof("Verified the %d exported filters match the account\n", len(diff.Unchanged))
+		return nil
 	}
 
-	// Iterate over the filters.
-	for _, f := range l.Filter {
-		// Delete the filter.
-		if err := api.Users.Settings.Filters.Delete(gmailUser, f.Id).Do(); err != nil {
-			return fmt.Errorf("deleting filter id %s failed: %v", f.Id, err)
+	noticef("Applying %s would not reproduce the account:\n", file)
+	printDiff(noticeOut(), diff, names)
+	return fmt.Errorf("the exported file does not round trip, applying it would create %d, change %d and lose %d filters",
+		len(diff.Create), len(diff.Update), len(diff.Delete))
+}
+
+// mergeExportedFilters combines the exported filters with the same criteria
+// into a single entry with all of their actions. Gmail often ends up with one
+// filter per action, and archiveUnlessToMe and archiveUnlessCcMe are two
+// filters each. Filters adding different labels or forwarding to different
+// addresses cannot be expressed as one entry and are left apart.
+func mergeExportedFilters(filters []filter) []filter {
+	merged, _ := mergeExportedFilterSources(filters)
+	return merged
+}
+
+// mergeExportedFilterSources merges the exported filters like
+// mergeExportedFilters, also returning the indexes of the filters each
+// entry was merged from.
+func mergeExportedFilterSources(filters []filter) ([]filter, [][]int) {
+	var (
+		merged  []filter
+		sources [][]int
+	)
+	for k, f := range filters {
+		i := -1
+		for j, m := range merged {
+			if f.exportCriteria() != (filter{}).exportCriteria() && m.exportCriteria() == f.exportCriteria() &&
+				mergeableString(m.Label, f.Label) && mergeableString(m.ForwardTo, f.ForwardTo) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			merged = append(merged, f)
+			sources = append(sources, []int{k})
+			continue
+		}
+		sources[i] = append(sources[i], k)
+
+		m := &merged[i]
+		m.Archive = m.Archive || f.Archive
+		m.Read = m.Read || f.Read
+		m.Delete = m.Delete || f.Delete
+		m.Star = m.Star || f.Star
+		m.Important = m.Important || f.Important
+		m.NeverImportant = m.NeverImportant || f.NeverImportant
+		m.NeverSpam = m.NeverSpam || f.NeverSpam
+		m.ArchiveUnlessToMe = m.ArchiveUnlessToMe || f.ArchiveUnlessToMe
+		m.ArchiveUnlessCcMe = m.ArchiveUnlessCcMe || f.ArchiveUnlessCcMe
+		if len(m.Label) < 1 {
+			m.Label = f.Label
+		}
+		if len(m.ForwardTo) < 1 {
+			m.ForwardTo = f.ForwardTo
 		}
 	}
 
-	return nil
+	// The archiving and the to:me criteria are implied by the pairs.
+	for i := range merged {
+		if merged[i].ArchiveUnlessToMe || merged[i].ArchiveUnlessCcMe {
+			merged[i].Archive = false
+			merged[i].ToMe = false
+		}
+	}
+
+	return merged, sources
 }
 
-func getExistingFilters() ([]filter, error) {
-	gmailFilters, err := api.Users.Settings.Filters.List(gmailUser).Do()
-	if err != nil {
-		return nil, err
+// combineExportedFilters combines the exported filters with the same actions
+// into a single entry with the sorted queries in queryOr.
+func combineExportedFilters(filters []filter) []filter {
+	var (
+		combined []filter
+		queries  [][]string
+	)
+	for _, f := range filters {
+		if len(f.Query) < 1 {
+			combined = append(combined, f)
+			queries = append(queries, nil)
+			continue
+		}
+
+		actions := f
+		actions.Query = ""
+		i := -1
+		for j, c := range combined {
+			c.Query = ""
+			c.QueryOr = nil
+			if queries[j] != nil && reflect.DeepEqual(c, actions) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			combined = append(combined, f)
+			queries = append(queries, []string{f.Query})
+			continue
+		}
+		queries[i] = append(queries[i], f.Query)
 	}
 
-	labels, err := getLabelMapOnID()
-	if err != nil {
-		return nil, err
+	for i, q := range queries {
+		if len(q) < 2 {
+			continue
+		}
+		combined[i].Query = ""
+		sort.Strings(q)
+		for _, query := range q {
+			combined[i].QueryOr = append(combined[i].QueryOr, orOperand(query))
+		}
 	}
 
-	var filters []filter
+	return combined
+}
 
-	for _, gmailFilter := range gmailFilters.Filter {
-		var f filter
+// orOperand returns the query wrapped in parentheses unless it is a single
+// term or already a group, since Gmail binds OR tighter than the terms around
+// it and x y OR z would otherwise match x (y OR z).
+func orOperand(q string) string {
+	n, err := parseQuery(q)
+	if err != nil || (n.kind != termNode && n.kind != notNode && !n.grouped) {
+		return "(" + q + ")"
+	}
+	return q
+}
 
-		if gmailFilter.Criteria.Query > "" {
-			f.Query = gmailFilter.Criteria.Query
+// exportFilter converts the Gmail filter to an entry of the filter file,
+// given a map of label IDs to names. The criteria are kept as they are,
+// except for the halves of archiveUnlessToMe and archiveUnlessCcMe which are
+// turned back into those settings.
+func exportFilter(g gmail.Filter, labels labelMap) filter {
+	c := g.Criteria
+	if c == nil {
+		c = &gmail.FilterCriteria{}
+	}
+	a := g.Action
+	if a == nil {
+		a = &gmail.FilterAction{}
+	}
 
-			if gmailFilter.Criteria.To == "me" {
-				f.ToMe = true
-			}
+	f := filter{
+		Query:          c.Query,
+		NegatedQuery:   c.NegatedQuery,
+		Subject:        c.Subject,
+		HasAttachment:  c.HasAttachment,
+		ExcludeChats:   c.ExcludeChats,
+		Size:           c.Size,
+		SizeComparison: c.SizeComparison,
+		ForwardTo:      a.Forward,
+	}
+	if len(c.From) > 0 {
+		f.From = stringList{c.From}
+	}
+	switch c.To {
+	case "":
+	case "me":
+		f.ToMe = true
+	default:
+		f.To = stringList{c.To}
+	}
 
-			if len(gmailFilter.Action.AddLabelIds) > 0 {
-				labelID := gmailFilter.Action.AddLabelIds[0]
-				if labelID == "TRASH" {
-					f.Delete = true
-				} else {
-					labelName, ok := labels[labelID]
-					if ok {
-						f.Label = labelName
-					}
-				}
+	for _, labelID := range a.AddLabelIds {
+		switch labelID {
+		case "TRASH":
+			f.Delete = true
+		case "STARRED":
+			f.Star = true
+		case "IMPORTANT":
+			f.Important = true
+		default:
+			// Only one label can be exported, pick the same one whatever
+			// order the API returns them in.
+			labelName, ok := labels[labelID]
+			if ok && (len(f.Label) < 1 || labelName < f.Label) {
+				f.Label = labelName
 			}
+		}
+	}
 
-			if len(gmailFilter.Action.RemoveLabelIds) > 0 {
-				for _, labelID := range gmailFilter.Action.RemoveLabelIds {
-					if labelID == "UNREAD" {
-						f.Read = true
-					} else if labelID == "INBOX" {
-						if gmailFilter.Criteria.NegatedQuery == "to:me" {
-							f.ArchiveUnlessToMe = true
-						} else {
-							f.Archive = true
-						}
-					}
-				}
+	for _, labelID := range a.RemoveLabelIds {
+		switch labelID {
+		case "UNREAD":
+			f.Read = true
+		case "IMPORTANT":
+			f.NeverImportant = true
+		case "SPAM":
+			f.NeverSpam = true
+		case "INBOX":
+			switch {
+			case c.NegatedQuery == "to:me" && len(c.To) < 1:
+				f.ArchiveUnlessToMe = true
+				f.NegatedQuery = ""
+			case c.NegatedQuery == toOrCcMeQuery:
+				f.ArchiveUnlessCcMe = true
+				f.NegatedQuery = ""
+			default:
+				f.Archive = true
 			}
 		}
+	}
+
+	return f
+}
 
-		filters = append(filters, f)
+// sortExportedFilters sorts the exported filters by label, then by query.
+func sortExportedFilters(filters []filter) {
+	sort.SliceStable(filters, func(i, j int) bool {
+		return exportSortKey(filters[i]) < exportSortKey(filters[j])
+	})
+}
+
+// exportSortKey returns the key exported filters are sorted on.
+func exportSortKey(f filter) string {
+	q := f.Query
+	if len(f.QueryOr) > 0 {
+		q = strings.Join(f.QueryOr, " OR ")
 	}
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%t\x00%s", f.Label, q, f.From.orQuery(), f.To.orQuery(), f.Subject, f.ToMe, f.ForwardTo)
+}
 
-	return filters, nil
+// exportCriteria returns what an exported filter matches, with both halves of
+// archiveUnlessToMe treated as matching to:me so they end up together.
+func (f filter) exportCriteria() string {
+	return strings.Join([]string{
+		"query=" + f.Query,
+		"negatedQuery=" + f.NegatedQuery,
+		"from=" + f.From.orQuery(),
+		"to=" + f.To.orQuery(),
+		"subject=" + f.Subject,
+		fmt.Sprintf("toMe=%t", f.ToMe || f.ArchiveUnlessToMe),
+		fmt.Sprintf("hasAttachment=%t", f.HasAttachment),
+		fmt.Sprintf("excludeChats=%t", f.ExcludeChats),
+		fmt.Sprintf("size=%s%d", f.SizeComparison, f.Size),
+	}, "\n")
 }
 
-func writeFiltersToFile(ff filterfile, file string) error {
-	exportFile, err := os.Create(file)
+// mergeableString returns true if the values are the same or one is unset.
+func mergeableString(a, b string) bool {
+	return a == b || len(a) < 1 || len(b) < 1
+}
+
+func getExistingFilters(ctx context.Context) ([]filter, error) {
+	gmailFilters, err := api.Users.Settings.Filters.List(gmailUser).Context(ctx).Do()
 	if err != nil {
-		return fmt.Errorf("error exporting filters: %v", err)
+		return nil, err
 	}
 
-	writer := bufio.NewWriter(exportFile)
-	encoder := toml.NewEncoder(writer)
-	encoder.Indent = ""
-
-	if err := encoder.Encode(ff); err != nil {
-		return fmt.Errorf("error writing file: %v", err)
+	labels, err := getLabelMapOnID(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Exported %d filters\n", len(ff.Filter))
+	var filters []filter
 
-	return nil
+	for _, gmailFilter := range gmailFilters.Filter {
+		filters = append(filters, exportFilter(*gmailFilter, labels))
+	}
+
+	return filters, nil
 }
 
-func findExistingFilter(filters []filter, query string) filter {
-	for _, f := range filters {
-		if f.Query == query {
-			return f
+// writeFiltersToFile writes the filters to the file, stdout if it is named -
+// or the object in S3 or Google Cloud Storage.
+func writeFiltersToFile(ff filterfile, file string) error {
+	var buf bytes.Buffer
+	if exportFormat == "csv" {
+		if err := writeFiltersCSV(&buf, ff.Filter); err != nil {
+			return fmt.Errorf("error writing file: %v", err)
+		}
+	} else {
+		encoder := toml.NewEncoder(&buf)
+		encoder.Indent = ""
+
+		if err := encoder.Encode(ff); err != nil {
+			return fmt.Errorf("error writing file: %v", err)
 		}
 	}
 
-	return filter{}
+	switch {
+	case file == stdio:
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("error writing file: %v", err)
+		}
+	case isObjectURL(file):
+		if err := writeObject(context.Background(), file, buf.Bytes()); err != nil {
+			return fmt.Errorf("error exporting filters: %v", err)
+		}
+	default:
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("error exporting filters: %v", err)
+		}
+	}
+
+	infof("Exported %d filters\n", len(ff.Filter))
+
+	return nil
 }
@@ -1,13 +1,39 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/BurntSushi/toml"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/api/gmail/v1"
 )
 
+func TestDecodeStringList(t *testing.T) {
+	var ff filterfile
+	if _, err := toml.Decode(`
+[[filter]]
+from = "notifications@github.com"
+to = ["plans@tripit.com", "receipts@expensify.com"]
+`, &ff); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []filter{
+		{
+			From: stringList{"notifications@github.com"},
+			To:   stringList{"plans@tripit.com", "receipts@expensify.com"},
+		},
+	}
+	if diff := cmp.Diff(expected, ff.Filter); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
 func TestFilterToGmailFilters(t *testing.T) {
 	testCases := map[string]struct {
 		orig     filter
@@ -71,6 +97,51 @@ func TestFilterToGmailFilters(t *testing.T) {
 				},
 			},
 		},
+		"archive unless cc me": {
+			orig: filter{
+				Query:             "list:kubernetes-dev@googlegroups.com",
+				Label:             "Mailing Lists/coreos-dev",
+				ArchiveUnlessCcMe: true,
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{"1"},
+						RemoveLabelIds: []string{},
+					},
+					Criteria: &gmail.FilterCriteria{
+						Query: "list:kubernetes-dev@googlegroups.com",
+					},
+				},
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{"1"},
+						RemoveLabelIds: []string{"INBOX"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						NegatedQuery: "{to:me cc:me}",
+						Query:        "list:kubernetes-dev@googlegroups.com",
+					},
+				},
+			},
+		},
+		"from list": {
+			orig: filter{
+				From:    stringList{"notifications@github.com", "noreply@github.com"},
+				Archive: true,
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{},
+						RemoveLabelIds: []string{"INBOX"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						From: "notifications@github.com OR noreply@github.com",
+					},
+				},
+			},
+		},
 		"delete": {
 			orig: filter{
 				QueryOr: []string{"to:plans@tripit.com", "to:receipts@expensify.com"},
@@ -115,7 +186,7 @@ func TestFilterToGmailFilters(t *testing.T) {
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			filters, err := tc.orig.toGmailFilters(labels)
+			filters, err := tc.orig.toGmailFilters(context.Background(), labels)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -126,3 +197,427 @@ func TestFilterToGmailFilters(t *testing.T) {
 		})
 	}
 }
+
+func TestExpandFilterEnv(t *testing.T) {
+	os.Setenv("GMAILFILTERS_TEST_FORWARD", "me@example.com")
+	defer os.Unsetenv("GMAILFILTERS_TEST_FORWARD")
+
+	filters, err := expandFilterEnv([]filter{
+		{
+			Query:     "to:${GMAILFILTERS_TEST_FORWARD} $notavar",
+			ForwardTo: "${GMAILFILTERS_TEST_FORWARD}",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []filter{
+		{
+			Query:     "to:me@example.com $notavar",
+			ForwardTo: "me@example.com",
+		},
+	}
+	if diff := cmp.Diff(expected, filters); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if _, err := expandFilterEnv([]filter{{Query: "${GMAILFILTERS_TEST_UNSET}"}}); err == nil {
+		t.Fatal("expected an error for an unset environment variable")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	values, err := loadTemplateValues("", []string{"account=work", "domain=example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := renderTemplate("test", []byte(`
+[[filter]]
+query = "from:*@{{ .domain }}"
+{{ if eq .account "work" }}label = "work"{{ else }}archive = true{{ end }}
+`), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ff filterfile
+	if _, err := toml.Decode(string(b), &ff); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []filter{{Query: "from:*@example.com", Label: "work"}}
+	if diff := cmp.Diff(expected, ff.Filter); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if _, err := renderTemplate("test", []byte("{{ .missing }}"), values); err == nil {
+		t.Fatal("expected an error for a missing template value")
+	}
+}
+
+func TestSelectFilters(t *testing.T) {
+	filters := []filter{
+		{Query: "from:notifications@github.com", Label: "github/mentions"},
+		{Query: "list:dev@example.com", Label: "Mailing Lists", Group: "lists"},
+		{From: stringList{"builds@travis-ci.org"}, Label: "ci"},
+		{Match: &match{Subject: "invoice"}, Archive: true},
+	}
+
+	testCases := map[string][]filter{
+		"github":        {filters[0]},
+		"mailing lists": {filters[1]},
+		"lists":         {filters[1]},
+		"travis-ci":     {filters[2]},
+		"invoice":       {filters[3]},
+	}
+
+	for selector, expected := range testCases {
+		got, err := selectFilters(filters, selector)
+		if err != nil {
+			t.Fatalf("%s: %v", selector, err)
+		}
+		if diff := cmp.Diff(expected, got); len(diff) > 1 {
+			t.Fatalf("%s: got diff: %s", selector, diff)
+		}
+	}
+
+	if _, err := selectFilters(filters, "nothing"); err == nil {
+		t.Fatal("expected an error when no filters match")
+	}
+}
+
+func TestFilterfileMerge(t *testing.T) {
+	a := filterfile{
+		Snippets: map[string]string{"github": "from:notifications@github.com"},
+		Filter:   []filter{{Query: "@github", Group: "github"}},
+	}
+	b := filterfile{
+		Snippets: map[string]string{"github": "from:notifications@github.com", "ci": "from:builds@travis-ci.org"},
+		Filter:   []filter{{Query: "@ci", Group: "ci"}},
+	}
+
+	got, err := a.merge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := filterfile{
+		Snippets: map[string]string{"github": "from:notifications@github.com", "ci": "from:builds@travis-ci.org"},
+		Filter:   []filter{{Query: "@github", Group: "github"}, {Query: "@ci", Group: "ci"}},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	grouped, err := groupFilters(got.Filter, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]filter{{Query: "@ci", Group: "ci"}}, grouped); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	b.Snippets["github"] = "from:github.com"
+	if _, err := a.merge(b); err == nil {
+		t.Fatal("expected an error for a snippet defined differently")
+	}
+}
+
+func TestSuppressFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.toml")
+	if err := ioutil.WriteFile(base, []byte(`
+[[filter]]
+query = "list:golang-nuts"
+label = "Lists/golang"
+
+[[filter]]
+query = "from:newsletter@example.com"
+archive = true
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	override := filepath.Join(dir, "alice@example.com.toml")
+	if err := ioutil.WriteFile(override, []byte(`
+suppress = ["Lists/golang"]
+
+[[filter]]
+query = "list:golang-nuts"
+label = "golang"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ff, err := loadFilterFiles([]string{base, override})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []filter{
+		{Query: "from:newsletter@example.com", Archive: true, Group: "base"},
+		{Query: "list:golang-nuts", Label: "golang", Group: "alice@example.com"},
+	}
+	if diff := cmp.Diff(expected, ff.Filter); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// The override does not suppress its own filters, and the files before
+	// it must have a filter for each of its selectors.
+	if _, err := loadFilterFiles([]string{override}); err == nil {
+		t.Fatal("expected an error for a suppress matching no filters")
+	}
+}
+
+func TestConflictingActions(t *testing.T) {
+	testCases := []struct {
+		f        filter
+		expected []string
+	}{
+		{f: filter{Label: "github", Star: true, Important: true}},
+		{f: filter{Delete: true, Archive: true, Star: true}, expected: []string{
+			"delete and archive make no sense together, deleted mail is not in the inbox anyway",
+			"delete and star make no sense together, starring mail that is deleted is pointless",
+		}},
+		{f: filter{Important: true, NeverImportant: true}, expected: []string{
+			"cannot have both important and neverImportant, they contradict each other",
+		}},
+	}
+
+	for _, tc := range testCases {
+		var got []string
+		for _, c := range tc.f.conflictingActions() {
+			got = append(got, c.String())
+		}
+		if diff := cmp.Diff(tc.expected, got); len(diff) > 1 {
+			t.Fatalf("%#v: got diff: %s", tc.f, diff)
+		}
+	}
+
+	if _, err := (filter{Query: "from:a", Important: true, NeverImportant: true}).toGmailFilters(context.Background(), &labelMap{}); err == nil {
+		t.Fatal("expected an error for contradicting actions")
+	}
+}
+
+func TestMergeExportedFilters(t *testing.T) {
+	got := mergeExportedFilters([]filter{
+		{Query: "from:a@example.com", Label: "a"},
+		{Query: "from:a@example.com", Archive: true},
+		{Query: "from:a@example.com", Read: true, Star: true},
+		{Query: "from:a@example.com", ForwardTo: "me@example.com"},
+		// A different label needs its own entry.
+		{Query: "from:a@example.com", Label: "b"},
+		// The two halves of archiveUnlessToMe.
+		{Query: "list:dev", ToMe: true, Label: "dev"},
+		{Query: "list:dev", ArchiveUnlessToMe: true, Label: "dev"},
+		// The two halves of archiveUnlessCcMe.
+		{Query: "list:ops"},
+		{Query: "list:ops", ArchiveUnlessCcMe: true},
+		// Matching to:me is not the same criteria.
+		{Query: "from:b@example.com", ToMe: true, Read: true},
+		{Query: "from:b@example.com", Archive: true},
+	})
+
+	expected := []filter{
+		{Query: "from:a@example.com", Label: "a", Archive: true, Read: true, Star: true, ForwardTo: "me@example.com"},
+		{Query: "from:a@example.com", Label: "b"},
+		{Query: "list:dev", ArchiveUnlessToMe: true, Label: "dev"},
+		{Query: "list:ops", ArchiveUnlessCcMe: true},
+		{Query: "from:b@example.com", ToMe: true, Read: true},
+		{Query: "from:b@example.com", Archive: true},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestCombineExportedFilters(t *testing.T) {
+	got := combineExportedFilters([]filter{
+		{Query: "from:a@example.com", Label: "news", Archive: true},
+		{Query: "from:b@example.com", Read: true},
+		{Query: "from:c@example.com list:x", Label: "news", Archive: true},
+		{Query: "from:d@example.com", Label: "news", Archive: true},
+		{Query: "from:e@example.com", Label: "other"},
+	})
+
+	expected := []filter{
+		{QueryOr: []string{"from:a@example.com", "(from:c@example.com list:x)", "from:d@example.com"}, Label: "news", Archive: true},
+		{Query: "from:b@example.com", Read: true},
+		{Query: "from:e@example.com", Label: "other"},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Gmail reads x y OR z as x (y OR z), so queries with an OR are kept in
+	// parentheses as well.
+	got = combineExportedFilters([]filter{
+		{Query: "list:dev from:a@example.com OR from:b@example.com", Archive: true},
+		{Query: "from:c@example.com OR from:d@example.com", Archive: true},
+		{Query: "(list:ops has:attachment)", Archive: true},
+		{Query: "-from:e@example.com", Archive: true},
+	})
+
+	expected = []filter{
+		{QueryOr: []string{"(list:ops has:attachment)", "-from:e@example.com", "(from:c@example.com OR from:d@example.com)", "(list:dev from:a@example.com OR from:b@example.com)"}, Archive: true},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestSortExportedFilters(t *testing.T) {
+	filters := []filter{
+		{Query: "from:b@example.com", Label: "b"},
+		{Query: "from:z@example.com"},
+		{QueryOr: []string{"from:c@example.com", "from:d@example.com"}, Label: "a"},
+		{Query: "from:a@example.com", Label: "b"},
+	}
+	sortExportedFilters(filters)
+
+	expected := []filter{
+		{Query: "from:z@example.com"},
+		{QueryOr: []string{"from:c@example.com", "from:d@example.com"}, Label: "a"},
+		{Query: "from:a@example.com", Label: "b"},
+		{Query: "from:b@example.com", Label: "b"},
+	}
+	if diff := cmp.Diff(expected, filters); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	labels := &labelMap{"news": "Label_1"}
+	names := labelMap{"Label_1": "news"}
+
+	for _, f := range []filter{
+		{From: stringList{"a@example.com OR b@example.com"}, Subject: "invoice", Label: "news"},
+		{To: stringList{"team@example.com"}, HasAttachment: true, Star: true},
+		{Query: "list:dev", NegatedQuery: "from:boss@example.com", Archive: true},
+		{Query: "list:dev", ExcludeChats: true, Size: 1000000, SizeComparison: "larger", Delete: true},
+		{From: stringList{"c@example.com"}, ArchiveUnlessToMe: true},
+		{Query: "list:ops", ArchiveUnlessCcMe: true, Read: true},
+	} {
+		gf, err := f.toGmailFilters(context.Background(), labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var exported []filter
+		for _, g := range gf {
+			exported = append(exported, exportFilter(g, names))
+		}
+		exported = mergeExportedFilters(exported)
+
+		if diff := cmp.Diff([]filter{f}, exported); len(diff) > 1 {
+			t.Fatalf("got diff: %s", diff)
+		}
+	}
+
+	for _, f := range []filter{
+		{Query: "x", Size: 10},
+		{Query: "x", SizeComparison: "larger"},
+		{Query: "x", NegatedQuery: "to:me", ArchiveUnlessToMe: true},
+	} {
+		if _, err := f.toGmailFilters(context.Background(), labels); err == nil {
+			t.Fatalf("expected an error for %#v", f)
+		}
+	}
+}
+
+func TestStdio(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = oldStdin }()
+	w.WriteString("[[filter]]\nquery = \"from:a@example.com\"\nlabel = \"a\"\n")
+	w.Close()
+
+	// Stdin can be read more than once.
+	for i := 0; i < 2; i++ {
+		ff, err := loadFilterFile(stdio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []filter{{Query: "from:a@example.com", Label: "a", Group: "stdin"}}
+		if diff := cmp.Diff(expected, ff.Filter); len(diff) > 1 {
+			t.Fatalf("got diff: %s", diff)
+		}
+	}
+
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = w
+	stdoutTaken = true
+	defer func() {
+		os.Stdout = oldStdout
+		stdoutTaken = false
+	}()
+	err = writeFiltersToFile(filterfile{Filter: []filter{{Query: "from:b@example.com", Archive: true}}}, stdio)
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "[[Filter]]\nQuery = \"from:b@example.com\"\nArchive = true\n") {
+		t.Fatalf("expected the filters on stdout, got %q", b)
+	}
+	var ff filterfile
+	if _, err := toml.Decode(string(b), &ff); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]filter{{Query: "from:b@example.com", Archive: true}}, ff.Filter); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestLoadFilterFilesQuiet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte("[[filter]]\nquery = \"list:golang-nuts\"\nlabel = \"golang\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout, oldStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	defer func(old bool, oldOnly string) {
+		os.Stdout, os.Stderr = oldStdout, oldStderr
+		quiet, only = old, oldOnly
+	}(quiet, only)
+	quiet, only = true, "golang"
+
+	_, err = loadFilterFiles([]string{file})
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > 0 {
+		t.Fatalf("expected nothing to be printed with --quiet, got %q", b)
+	}
+}
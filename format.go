@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const fmtHelp = `Rewrite filter files in the canonical format.`
+
+const fmtLongHelp = fmtHelp + `
+
+Keys are put in the same order in every table, the whitespace is normalized,
+the label definitions are sorted by name and long queries are wrapped over
+several lines, so diffs of the files only show what changed. Comments are
+kept with the key or table they are written above.
+
+Pass - as the file to format stdin to stdout.`
+
+func (cmd *fmtCommand) Name() string      { return "fmt" }
+func (cmd *fmtCommand) Args() string      { return "<file>..." }
+func (cmd *fmtCommand) ShortHelp() string { return fmtHelp }
+func (cmd *fmtCommand) LongHelp() string  { return fmtLongHelp }
+func (cmd *fmtCommand) Hidden() bool      { return false }
+
+func (cmd *fmtCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.check, "check", false, "only list the files that are not formatted, exiting with 4 if there are any")
+}
+
+type fmtCommand struct {
+	check bool
+}
+
+func (cmd *fmtCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	var unformatted []string
+	for _, file := range args {
+		if isRemote(file) || isObjectURL(file) {
+			return fmt.Errorf("cannot format %s, pass the path of a file or - for stdin", file)
+		}
+
+		b, err := readFile(file)
+		if err != nil {
+			return fmt.Errorf("reading filter file %s failed: %v", file, err)
+		}
+		formatted, err := formatFilterFile(b)
+		if err != nil {
+			return withExitCode(exitValidation, fmt.Errorf("formatting %s failed: %v", file, err))
+		}
+
+		switch {
+		case file == stdio && !cmd.check:
+			if _, err := os.Stdout.Write(formatted); err != nil {
+				return err
+			}
+		case bytes.Equal(b, formatted):
+		case cmd.check:
+			fmt.Println(file)
+			unformatted = append(unformatted, file)
+		default:
+			if err := ioutil.WriteFile(file, formatted, 0644); err != nil {
+				return fmt.Errorf("writing filter file %s failed: %v", file, err)
+			}
+			infof("Formatted %s\n", file)
+		}
+	}
+
+	if len(unformatted) > 0 {
+		return withExitCode(exitValidation, fmt.Errorf("%d files are not formatted, run gmailfilters fmt on them", len(unformatted)))
+	}
+	return nil
+}
+
+// fmtWidth is the width lists and queries are wrapped at.
+const fmtWidth = 80
+
+// fmtKey is a key/value statement with the comments written above it.
+type fmtKey struct {
+	comments []statement
+	statement
+}
+
+// fmtTable is a table with the comments above it and its keys. The root
+// table has no header.
+type fmtTable struct {
+	leading []statement
+	header  *statement
+	keys    []fmtKey
+}
+
+// name returns the lower cased name of the table.
+func (t fmtTable) name() string {
+	if t.header == nil {
+		return ""
+	}
+	return strings.ToLower(t.header.key)
+}
+
+// isArray returns true if the table is an entry of an array of tables.
+func (t fmtTable) isArray() bool {
+	return t.header != nil && strings.HasPrefix(strings.TrimSpace(t.header.text), "[[")
+}
+
+// formatFilterFile returns the filter file in the canonical format, making
+// sure it still decodes to the same filters.
+func formatFilterFile(b []byte) ([]byte, error) {
+	var before filterfile
+	if _, err := toml.Decode(string(b), &before); err != nil {
+		return nil, fmt.Errorf("decoding toml failed: %v", err)
+	}
+
+	statements, err := splitStatements(string(b))
+	if err != nil {
+		return nil, err
+	}
+	tables := sortLabelTables(fmtTables(statements), "label")
+
+	var out bytes.Buffer
+	for _, t := range tables {
+		if len(t.leading) < 1 && t.header == nil && len(t.keys) < 1 {
+			continue
+		}
+		// Tables nested in an entry, like [filter.labelColor], stay right
+		// below it.
+		if out.Len() > 0 && !strings.Contains(t.name(), ".") {
+			out.WriteString("\n")
+		}
+		for _, s := range t.leading {
+			out.WriteString(s.text)
+		}
+		if t.header != nil {
+			out.WriteString(strings.TrimSpace(t.header.text) + "\n")
+		}
+
+		order, alphabetical := tableKeyOrder(t.name())
+		keys := append([]fmtKey{}, t.keys...)
+		sort.SliceStable(keys, func(i, j int) bool {
+			if alphabetical {
+				return strings.ToLower(keys[i].key) < strings.ToLower(keys[j].key)
+			}
+			return keyRank(order, keys[i].key) < keyRank(order, keys[j].key)
+		})
+		for _, k := range keys {
+			for _, s := range k.comments {
+				out.WriteString(s.text)
+			}
+			out.WriteString(formatKeyValue(k.statement))
+		}
+	}
+
+	// Formatting must not change what the file means.
+	var after filterfile
+	if _, err := toml.Decode(out.String(), &after); err != nil {
+		return nil, fmt.Errorf("the formatted file does not decode: %v", err)
+	}
+	before.Label, after.Label = sortedLabelDefinitions(before.Label), sortedLabelDefinitions(after.Label)
+	if !reflect.DeepEqual(before, after) {
+		return nil, errors.New("the formatted file does not decode to the same filters")
+	}
+
+	return out.Bytes(), nil
+}
+
+// fmtTables groups the statements into tables. Comments go with the key or
+// header right below them, and blank lines are dropped except between
+// paragraphs of comments above a table.
+func fmtTables(statements []statement) []fmtTable {
+	tables := []fmtTable{{}}
+	var pending []statement
+	for _, s := range statements {
+		switch s.kind {
+		case blankStatement, commentStatement:
+			pending = append(pending, s)
+		case headerStatement:
+			header := s
+			tables = append(tables, fmtTable{leading: commentParagraphs(pending), header: &header})
+			pending = nil
+		case keyValueStatement:
+			t := &tables[len(tables)-1]
+			t.keys = append(t.keys, fmtKey{comments: commentParagraphs(pending), statement: s})
+			pending = nil
+		}
+	}
+
+	// Comments at the end of the file stay there.
+	if comments := commentParagraphs(pending); len(comments) > 0 {
+		tables = append(tables, fmtTable{leading: comments})
+	}
+	return tables
+}
+
+// commentParagraphs returns the comments without the blank lines before
+// them, keeping a single blank line between paragraphs and after them.
+func commentParagraphs(statements []statement) []statement {
+	var comments []statement
+	blank := false
+	for _, s := range statements {
+		if s.kind == blankStatement {
+			blank = true
+			continue
+		}
+		if blank && len(comments) > 0 {
+			comments = append(comments, statement{kind: blankStatement, text: "\n"})
+		}
+		blank = false
+		comments = append(comments, statement{kind: commentStatement, text: strings.TrimSpace(s.text) + "\n"})
+	}
+	// Comments set apart from what follows them, like the one at the top of
+	// the file, stay apart.
+	if blank && len(comments) > 0 {
+		comments = append(comments, statement{kind: blankStatement, text: "\n"})
+	}
+	return comments
+}
+
+// sortLabelTables sorts the consecutive entries of the array of tables named
+// name by their name key, along with the tables nested in them, and does the
+// same for the labels nested in each entry.
+func sortLabelTables(tables []fmtTable, name string) []fmtTable {
+	type entry struct {
+		name   string
+		tables []fmtTable
+	}
+
+	var (
+		sorted []fmtTable
+		run    []entry
+	)
+	flush := func() {
+		sort.SliceStable(run, func(i, j int) bool {
+			return strings.ToLower(run[i].name) < strings.ToLower(run[j].name)
+		})
+		for _, e := range run {
+			sorted = append(sorted, e.tables...)
+		}
+		run = nil
+	}
+
+	for i := 0; i < len(tables); {
+		t := tables[i]
+		if !t.isArray() || t.name() != name {
+			flush()
+			sorted = append(sorted, t)
+			i++
+			continue
+		}
+
+		// The entry goes on until a table that is not nested in it.
+		j := i + 1
+		for j < len(tables) && strings.HasPrefix(tables[j].name(), name+".") {
+			j++
+		}
+		e := entry{tables: append([]fmtTable{t}, sortLabelTables(tables[i+1:j], name+".label")...)}
+		for _, k := range t.keys {
+			if strings.EqualFold(k.key, "name") {
+				var v struct{ Name string }
+				toml.Decode(k.text, &v)
+				e.name = v.Name
+			}
+		}
+		run = append(run, e)
+		i = j
+	}
+	flush()
+
+	return sorted
+}
+
+// sortedLabelDefinitions returns the label definitions sorted by name, with
+// their nested labels sorted too.
+func sortedLabelDefinitions(defs []labelDefinition) []labelDefinition {
+	if defs == nil {
+		return nil
+	}
+	sorted := append([]labelDefinition{}, defs...)
+	for i := range sorted {
+		sorted[i].Label = sortedLabelDefinitions(sorted[i].Label)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].Name) < strings.ToLower(sorted[j].Name)
+	})
+	return sorted
+}
+
+// tableKeyOrder returns the keys of the table in the order of the fields of
+// the struct it decodes to, or whether its keys are sorted alphabetically
+// for tables decoding to a map like the snippets. The keys of tables not in
+// the filter file format keep their order.
+func tableKeyOrder(name string) ([]string, bool) {
+	if len(name) < 1 {
+		return nil, false
+	}
+
+	typ := reflect.TypeOf(filterfile{})
+	for _, part := range strings.Split(name, ".") {
+		if typ.Kind() != reflect.Struct {
+			return nil, false
+		}
+		field, ok := typ.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, strings.Trim(part, ` "'`)) })
+		if !ok {
+			return nil, false
+		}
+		typ = field.Type
+		for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+			typ = typ.Elem()
+		}
+	}
+
+	switch typ.Kind() {
+	case reflect.Map:
+		return nil, true
+	case reflect.Struct:
+		var order []string
+		for i := 0; i < typ.NumField(); i++ {
+			if f := typ.Field(i); len(f.PkgPath) < 1 {
+				order = append(order, strings.ToLower(f.Name))
+			}
+		}
+		return order, false
+	}
+	return nil, false
+}
+
+// keyRank returns the position of the key in the order, with unknown keys
+// last.
+func keyRank(order []string, key string) int {
+	for i, k := range order {
+		if k == strings.ToLower(key) {
+			return i
+		}
+	}
+	return len(order)
+}
+
+// formatKeyValue returns the key/value statement with normalized whitespace,
+// lists that do not fit on a line written one item per line and long queries
+// wrapped. Values it does not know how to write, like inline tables, are kept
+// as they are.
+func formatKeyValue(s statement) string {
+	eq := strings.IndexByte(s.text, '=')
+	key := strings.TrimSpace(s.text[:eq])
+	end, err := scanValue(s.text, eq+1)
+	if err != nil {
+		return s.text
+	}
+	raw := strings.TrimSpace(s.text[eq+1 : end])
+	comment := ""
+	if c := strings.TrimSpace(s.text[end:]); len(c) > 0 {
+		comment = " " + c
+	}
+
+	var decoded map[string]interface{}
+	if _, err := toml.Decode(s.text, &decoded); err != nil || len(decoded) != 1 {
+		return key + " = " + raw + comment + "\n"
+	}
+	var v interface{}
+	for _, value := range decoded {
+		v = value
+	}
+
+	value := raw
+	switch v := v.(type) {
+	case bool, int64:
+		value = fmt.Sprint(v)
+	case string:
+		switch {
+		case (strings.EqualFold(key, "query") || strings.EqualFold(key, "negatedQuery")) &&
+			(len(key)+len(" = ")+len(tomlString(v)) > fmtWidth || strings.Contains(v, "\n")):
+			value = wrapQuery(v)
+		case !strings.Contains(v, "\n"):
+			value = tomlString(v)
+		}
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				items = nil
+				break
+			}
+			items = append(items, tomlString(s))
+		}
+		switch {
+		case items == nil:
+		case len(key)+len(" = [")+len(strings.Join(items, ", "))+len("]") <= fmtWidth:
+			value = "[" + strings.Join(items, ", ") + "]"
+		default:
+			value = "[\n" + strings.Join(items, ",\n") + "\n]"
+		}
+	}
+
+	return key + " = " + value + comment + "\n"
+}
+
+// wrapQuery writes the query as a multi-line string, breaking the lines
+// after spaces with a line ending backslash so the value does not change.
+// Quotes are only escaped if they could end the string.
+func wrapQuery(q string) string {
+	var (
+		buf  strings.Builder
+		line int
+	)
+	quotes := strings.Contains(q, `""`) || strings.HasSuffix(q, `"`)
+	buf.WriteString("\"\"\"\n")
+	for i, word := range splitAfterSpaces(q) {
+		if i > 0 && line > 0 && line+len(word) > fmtWidth-len(" \\") {
+			buf.WriteString("\\\n")
+			line = 0
+		}
+		escaped := escapeMultiline(word, quotes)
+		buf.WriteString(escaped)
+		if nl := strings.LastIndexByte(escaped, '\n'); nl >= 0 {
+			line = len(escaped) - nl - 1
+		} else {
+			line += len(escaped)
+		}
+	}
+	buf.WriteString(`"""`)
+	return buf.String()
+}
+
+// splitAfterSpaces splits s into words that keep the spaces following them,
+// so a line can only be broken where the next line starts with something
+// other than whitespace, which a line ending backslash would trim.
+func splitAfterSpaces(s string) []string {
+	var words []string
+	start := 0
+	for i := 1; i < len(s); i++ {
+		if s[i-1] == ' ' && s[i] != ' ' && s[i] != '\t' && s[i] != '\n' {
+			words = append(words, s[start:i])
+			start = i
+		}
+	}
+	return append(words, s[start:])
+}
+
+// escapeMultiline escapes s for a multi-line basic string, keeping the new
+// lines and the quotes unless told otherwise.
+func escapeMultiline(s string, quotes bool) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(strings.TrimPrefix(tomlString(line), `"`), `"`)
+		if !quotes {
+			line = strings.Replace(line, `\"`, `"`, -1)
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
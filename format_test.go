@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormatFilterFile(t *testing.T) {
+	in := `# My filters.
+
+
+[snippets]
+work   =   "from:*@example.com"
+github = "from:notifications@github.com"
+[[label]]
+name = "zebra"
+
+# Lists.
+[[label]]
+messageListVisibility = "hide"
+name = "Lists"
+[[label.label]]
+name = "b"
+[[label.label]]
+name = "a"
+[label.label.color]
+text = "#000000"
+background = "#cccccc"
+
+
+[[filter]]
+label="github"   # the label
+# Only the team.
+query = "@github -subject:\"weekly digest\" from:(alice@example.com OR bob@example.com OR carol@example.com)"
+archive=true
+[filter.labelColor]
+text = "#ffffff"
+background = "#16a766"
+[[filter]]
+from = [
+"a@example.com",
+"b@example.com"
+]
+label = "friends"
+# The end.
+`
+	expected := `# My filters.
+
+[snippets]
+github = "from:notifications@github.com"
+work = "from:*@example.com"
+
+# Lists.
+[[label]]
+name = "Lists"
+messageListVisibility = "hide"
+[[label.label]]
+name = "a"
+[label.label.color]
+background = "#cccccc"
+text = "#000000"
+[[label.label]]
+name = "b"
+
+[[label]]
+name = "zebra"
+
+[[filter]]
+# Only the team.
+query = """
+@github -subject:"weekly digest" from:(alice@example.com OR bob@example.com \
+OR carol@example.com)"""
+archive = true
+label = "github" # the label
+[filter.labelColor]
+background = "#16a766"
+text = "#ffffff"
+
+[[filter]]
+from = ["a@example.com", "b@example.com"]
+label = "friends"
+
+# The end.
+`
+
+	got, err := formatFilterFile([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expected, string(got)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Formatting again changes nothing.
+	again, err := formatFilterFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expected, string(again)); len(diff) > 1 {
+		t.Fatalf("formatting twice got diff: %s", diff)
+	}
+}
+
+func TestWrapQuery(t *testing.T) {
+	for _, q := range []string{
+		strings.Repeat("from:someone@example.com ", 10),
+		`subject:"a  b" ` + strings.Repeat("x", 100) + ` "ending"`,
+		"before\n  indented " + strings.Repeat("list:dev@example.com OR ", 5),
+	} {
+		got, err := formatFilterFile([]byte("[[filter]]\nquery = " + tomlString(q) + "\n"))
+		if err != nil {
+			t.Fatalf("%q: %v", q, err)
+		}
+		for _, line := range strings.Split(string(got), "\n") {
+			if len(line) > fmtWidth && !strings.Contains(line, strings.Repeat("x", 100)) {
+				t.Fatalf("%q: line longer than %d: %q", q, fmtWidth, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// verifiedForwardingAddresses returns the lower cased forwarding addresses of
+// the account that have been verified and can be forwarded to.
+func verifiedForwardingAddresses(ctx context.Context) (map[string]bool, error) {
+	l, err := api.Users.Settings.ForwardingAddresses.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing forwarding addresses failed: %v", err)
+	}
+
+	verified := map[string]bool{}
+	for _, a := range l.ForwardingAddresses {
+		if a.VerificationStatus == "accepted" {
+			verified[strings.ToLower(a.ForwardingEmail)] = true
+		}
+	}
+	return verified, nil
+}
+
+// checkForwardingAddresses makes sure the filters the diff creates only
+// forward to verified addresses, Gmail refuses to create them otherwise.
+func checkForwardingAddresses(ctx context.Context, d filterDiff) error {
+	if len(forwardedTo(d)) < 1 {
+		return nil
+	}
+
+	verified, err := verifiedForwardingAddresses(ctx)
+	if err != nil {
+		return err
+	}
+	return checkForwarding(d, verified)
+}
+
+// checkForwarding returns an error listing the addresses the diff forwards to
+// that are not in the verified set.
+func checkForwarding(d filterDiff, verified map[string]bool) error {
+	var unverified []string
+	for _, addr := range forwardedTo(d) {
+		if !verified[strings.ToLower(addr)] {
+			unverified = append(unverified, addr)
+		}
+	}
+	if len(unverified) < 1 {
+		return nil
+	}
+
+	return fmt.Errorf("filters forward to addresses that are not verified for forwarding: %s. Add them in Gmail under Settings > Forwarding and POP/IMAP and follow the link in the confirmation email first",
+		strings.Join(unverified, ", "))
+}
+
+// forwardedTo returns the sorted addresses forwarded to by the filters the
+// diff creates.
+func forwardedTo(d filterDiff) []string {
+	filters := append([]gmail.Filter{}, d.Create...)
+	for _, u := range d.Update {
+		filters = append(filters, u.New)
+	}
+
+	seen := map[string]bool{}
+	var addrs []string
+	for _, f := range filters {
+		if f.Action == nil || len(f.Action.Forward) < 1 || seen[f.Action.Forward] {
+			continue
+		}
+		seen[f.Action.Forward] = true
+		addrs = append(addrs, f.Action.Forward)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/api/gmail/v1"
+)
+
+const getHelp = `Show a filter in the account as a filter file entry and as returned by the API.`
+
+const getLongHelp = getHelp + `
+
+The filter is looked up by its Gmail filter ID, or else by a part of its
+query. This helps finding out why a filter in the account does not match the
+one in the filter file.`
+
+func (cmd *getCommand) Name() string      { return "get" }
+func (cmd *getCommand) Args() string      { return "<id or query>" }
+func (cmd *getCommand) ShortHelp() string { return getHelp }
+func (cmd *getCommand) LongHelp() string  { return getLongHelp }
+func (cmd *getCommand) Hidden() bool      { return false }
+
+func (cmd *getCommand) Register(fs *flag.FlagSet) {}
+
+type getCommand struct{}
+
+func (cmd *getCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("must pass the ID of the filter or a part of its query")
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	filters, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	names, err := getLabelMapOnID(ctx)
+	if err != nil {
+		return err
+	}
+
+	f, err := findFilter(filters, args[0])
+	if err != nil {
+		return err
+	}
+
+	return printFilterDetails(os.Stdout, f, names)
+}
+
+// findFilter returns the filter with the given ID, or else the only filter
+// whose query contains it, ignoring case.
+func findFilter(filters []gmail.Filter, s string) (gmail.Filter, error) {
+	for _, f := range filters {
+		if f.Id == s {
+			return f, nil
+		}
+	}
+
+	var matches []gmail.Filter
+	for _, f := range filters {
+		if f.Criteria == nil {
+			continue
+		}
+		if strings.Contains(strings.ToLower(f.Criteria.Query), strings.ToLower(s)) {
+			matches = append(matches, f)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return gmail.Filter{}, fmt.Errorf("no filter has the ID %q or a query containing it", s)
+	case 1:
+		return matches[0], nil
+	}
+
+	ids := make([]string, 0, len(matches))
+	for _, f := range matches {
+		ids = append(ids, f.Id)
+	}
+	return gmail.Filter{}, fmt.Errorf("%d filters have a query containing %q, pass one of their IDs: %s", len(matches), s, strings.Join(ids, ", "))
+}
+
+// printFilterDetails writes the filter as it would be exported to a filter
+// file and as returned by the API.
+func printFilterDetails(w io.Writer, f gmail.Filter, names labelMap) error {
+	fmt.Fprintf(w, "# filter %s (fingerprint %s)\n", f.Id, fingerprint(f))
+	encoder := toml.NewEncoder(w)
+	encoder.Indent = ""
+	if err := encoder.Encode(filterfile{Filter: []filter{exportFilter(f, names)}}); err != nil {
+		return fmt.Errorf("encoding filter failed: %v", err)
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding filter failed: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "\n# as returned by the API\n%s\n", b)
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestFindFilter(t *testing.T) {
+	filters := []gmail.Filter{
+		{Id: "a", Criteria: &gmail.FilterCriteria{Query: "list:dev.example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}},
+		{Id: "b", Criteria: &gmail.FilterCriteria{Query: "list:ops.example.com"}},
+		{Id: "c", Criteria: &gmail.FilterCriteria{From: "a@example.com"}},
+	}
+
+	for s, id := range map[string]string{"b": "b", "DEV": "a", "list:ops": "b"} {
+		f, err := findFilter(filters, s)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if f.Id != id {
+			t.Fatalf("%q: expected filter %s, got %s", s, id, f.Id)
+		}
+	}
+
+	for _, s := range []string{"example.com", "missing"} {
+		if _, err := findFilter(filters, s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := printFilterDetails(&buf, filters[0], labelMap{"Label_1": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`Query = "list:dev.example.com"`, `Label = "dev"`, `"id": "a"`, `"Label_1"`} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected the output to contain %s, got:\n%s", s, buf.String())
+		}
+	}
+}
@@ -1,79 +1,252 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/oauth2"
 )
 
 // getClient retrieves a token, saves the token, then returns the generated client.
-func getClient(ctx context.Context, tokenFile string, config *oauth2.Config) (*http.Client, error) {
-	// Try reading the token from the file.
-	tok, err := tokenFromFile(tokenFile)
+func getClient(ctx context.Context, config *oauth2.Config) (*http.Client, error) {
+	// Try reading the token from the keyring or the file.
+	tok, err := readToken(ctx)
 	if err != nil {
-		logrus.Warnf("Getting token from file failed: %v", err)
-
-		// Could not get the token from the file, try reading it from the web.
-		tok, err = getTokenFromWeb(ctx, config)
-		if err != nil {
-			return nil, err
+		logrus.Warnf("Getting token failed: %v", err)
+	} else {
+		// Refresh the token now rather than halfway through the command, so
+		// a revoked or expired one is replaced before anything is changed.
+		ts := config.TokenSource(ctx, tok)
+		_, err := ts.Token()
+		if err == nil {
+			return oauth2.NewClient(ctx, ts), nil
 		}
-
-		// Save the token from the web.
-		if err := saveToken(tokenFile, tok); err != nil {
+		if !isInvalidGrant(err) {
+			return nil, fmt.Errorf("refreshing the token failed: %v", err)
+		}
+		if source, ok := externalToken(); ok {
+			return nil, fmt.Errorf("the token in %s was revoked or has expired, run gmailfilters auth --print to get a new one", source)
+		}
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errors.New("the token was revoked or has expired, run gmailfilters auth to authorize again")
+		}
+		logrus.Warn("The token was revoked or has expired, authorizing again")
+		if err := removeToken(); err != nil {
 			return nil, err
 		}
 	}
 
+	// Could not get the token, try reading it from the web.
+	if deviceAuth {
+		tok, err = getTokenFromDevice(ctx, config)
+	} else {
+		tok, err = getTokenFromWeb(ctx, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Save the token from the web.
+	if err := writeToken(tok); err != nil {
+		return nil, err
+	}
+
 	return config.Client(ctx, tok), nil
 }
 
-// getTokenFromWeb requests a token from the web, then returns the retrieved token.
-func getTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+// isInvalidGrant returns true if the error is Google refusing to refresh the
+// token, because it was revoked, expired unused or the password changed.
+func isInvalidGrant(err error) bool {
+	rErr, ok := err.(*oauth2.RetrieveError)
+	return ok && bytes.Contains(rErr.Body, []byte("invalid_grant"))
+}
+
+// apiCalls counts the requests made to the Gmail API.
+var apiCalls int64
+
+// countingTransport counts the requests made through it in apiCalls, and
+// records the responses telling we are out of quota or not allowed in.
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&apiCalls, 1)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	recordAPIStatus(resp)
+	return resp, nil
+}
+
+// rateLimitTransport spaces the requests made through it at least interval
+// apart, with --rate-limit, so syncing many accounts at the same time stays
+// under the quota of the project.
+type rateLimitTransport struct {
+	base     http.RoundTripper
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.mu.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// readOnlyTransport refuses the requests changing anything, with
+// --read-only, so a command does not fail halfway through for lack of scopes.
+type readOnlyTransport struct {
+	base http.RoundTripper
+}
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		return nil, fmt.Errorf("unable to read authorization code: %v", err)
+func (t *readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, fmt.Errorf("refusing to %s %s with --read-only", req.Method, req.URL.Path)
 	}
+	return t.base.RoundTrip(req)
+}
+
+// maxTracePayload is the length payloads are cut to in the trace.
+const maxTracePayload = 500
 
-	tok, err := config.Exchange(ctx, authCode)
+// tracingTransport logs every request made through it along with a summary
+// of its payload, the response status and the latency. The response is
+// logged too when it is an error, since that is where the API says what it
+// did not like.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fields := logrus.Fields{
+		"method": req.Method,
+		"path":   req.URL.Path,
+	}
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		if len(b) > 0 {
+			fields["payload"] = tracePayload(b)
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	fields["latency"] = time.Since(start).Round(time.Millisecond).String()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+		logrus.WithFields(fields).WithError(err).Info("Gmail API request failed")
+		return nil, err
+	}
+
+	fields["status"] = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		fields["response"] = tracePayload(b)
 	}
+	logrus.WithFields(fields).Info("Gmail API request")
 
-	return tok, nil
+	return resp, nil
 }
 
-// tokenFromFile retrieves a token from a local file.
+// tracePayload returns the JSON payload on a single line, cut to
+// maxTracePayload.
+func tracePayload(b []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err == nil {
+		b = buf.Bytes()
+	}
+	s := string(b)
+	if len(s) > maxTracePayload {
+		s = s[:maxTracePayload] + "..."
+	}
+	return s
+}
+
+// tokenFromFile retrieves a token from a local file, decrypting it if it
+// was encrypted.
 func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+
+	if isEncryptedToken(b) {
+		passphrase, err := tokenPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		return decryptToken(b, passphrase)
+	}
 
 	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
+	err = json.Unmarshal(b, tok)
 	return tok, err
 }
 
-// saveToken saves a token to a file path.
+// saveToken saves a token to a file path, encrypted with --token-store
+// encrypted.
 func saveToken(path string, token *oauth2.Token) error {
 	logrus.Infof("Saving credential file to: %s", path)
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	var (
+		b   []byte
+		err error
+	)
+	if tokenStore == "encrypted" {
+		passphrase, perr := tokenPassphrase(true)
+		if perr != nil {
+			return perr
+		}
+		b, err = encryptToken(token, passphrase)
+	} else {
+		b, err = json.Marshal(token)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to cache oauth token: %v", err)
+		return err
 	}
-	defer f.Close()
 
-	return json.NewEncoder(f).Encode(token)
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0600); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	return nil
 }
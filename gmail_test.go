@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+func TestTracingTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			http.Error(w, `{"error": {"message": "Invalid criteria"}}`, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"filter": []}`))
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(&logrus.JSONFormatter{DisableTimestamp: true})
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}()
+
+	client := &http.Client{Transport: &tracingTransport{base: http.DefaultTransport}}
+	resp, err := client.Get(srv.URL + "/me/settings/filters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Post(srv.URL+"/me/settings/filters", "application/json", strings.NewReader(`{
+  "criteria": {"query": "`+strings.Repeat("x", maxTracePayload)+`"}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The response can still be read after being traced.
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(body.String(), "Invalid criteria") {
+		t.Fatalf("expected the error response, got %q", body.String())
+	}
+
+	var got []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := entry["latency"]; !ok {
+			t.Fatalf("expected a latency in %s", line)
+		}
+		delete(entry, "latency")
+		got = append(got, entry)
+	}
+
+	payload := `{"criteria":{"query":"` + strings.Repeat("x", maxTracePayload)
+	expected := []map[string]interface{}{
+		{"level": "info", "msg": "Gmail API request", "method": "GET", "path": "/me/settings/filters", "status": float64(200)},
+		{"level": "info", "msg": "Gmail API request", "method": "POST", "path": "/me/settings/filters", "status": float64(400),
+			"payload":  payload[:maxTracePayload] + "...",
+			"response": `{"error":{"message":"Invalid criteria"}}`},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestGetClientRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	revoked := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if revoked {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "fresh", "token_type": "Bearer", "expires_in": 3599}`))
+	}))
+	defer srv.Close()
+
+	defer func(file, store string) { tokenFile, tokenStore = file, store }(tokenFile, tokenStore)
+	tokenFile = filepath.Join(dir, "token.json")
+	tokenStore = "file"
+	config := &oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+
+	if err := saveToken(tokenFile, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getClient(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	// A revoked token is not used, and without a terminal to authorize again
+	// in the error says how to.
+	revoked = true
+	_, err = getClient(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "run gmailfilters auth") {
+		t.Fatalf("expected an error asking to authorize again, got %v", err)
+	}
+}
+
+func TestReadOnlyTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"filter": []}`))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &readOnlyTransport{base: http.DefaultTransport}}
+	resp, err := client.Get(srv.URL + "/me/settings/filters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, err = client.Post(srv.URL+"/me/settings/filters", "application/json", strings.NewReader(`{}`))
+	if err == nil || !strings.Contains(err.Error(), "refusing to POST /me/settings/filters with --read-only") {
+		t.Fatalf("expected the request to be refused, got %v", err)
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"filter": []}`))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &rateLimitTransport{base: http.DefaultTransport, interval: 50 * time.Millisecond}}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/me/settings/filters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected the requests to be spaced 50ms apart, took %s", elapsed)
+	}
+
+	// A request waiting for its turn gives up when it is canceled.
+	client.Transport.(*rateLimitTransport).interval = time.Hour
+	resp, err := client.Get(srv.URL + "/me/settings/filters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/me/settings/filters", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("expected the canceled request to fail")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const graphHelp = `Draw the filters in a filter file as a Graphviz or Mermaid diagram.`
+
+const graphLongHelp = graphHelp + `
+
+Each filter points at the actions it takes and the labels it applies, so
+labels fed by many filters stand out, and filters that do nothing are drawn
+dashed in red. Render it with Graphviz or paste it in Markdown:
+
+  $ gmailfilters graph filters.toml | dot -Tsvg > filters.svg
+  $ gmailfilters graph --format mermaid filters.toml`
+
+func (cmd *graphCommand) Name() string      { return "graph" }
+func (cmd *graphCommand) Args() string      { return "<file>..." }
+func (cmd *graphCommand) ShortHelp() string { return graphHelp }
+func (cmd *graphCommand) LongHelp() string  { return graphLongHelp }
+func (cmd *graphCommand) Hidden() bool      { return false }
+
+func (cmd *graphCommand) Register(fs *flag.FlagSet) {
+	registerSelectFlags(fs)
+
+	fs.StringVar(&cmd.format, "format", "dot", "output format: dot or mermaid")
+}
+
+type graphCommand struct {
+	format string
+}
+
+func (cmd *graphCommand) Run(ctx context.Context, args []string) error {
+	switch cmd.format {
+	case "dot", "mermaid":
+	default:
+		return fmt.Errorf("invalid format %q, must be dot or mermaid", cmd.format)
+	}
+
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	g, err := filterGraph(ctx, ff)
+	if err != nil {
+		return err
+	}
+
+	if cmd.format == "mermaid" {
+		return writeMermaidGraph(os.Stdout, g)
+	}
+	return writeDotGraph(os.Stdout, g)
+}
+
+// graphFilter is a Gmail filter in the graph, with the actions it takes and
+// the labels it applies, named like in list.
+type graphFilter struct {
+	criteria string
+	actions  []string
+	labels   []string
+}
+
+// graph is the filters with every action and label they point at, sorted.
+type graph struct {
+	filters []graphFilter
+	actions []string
+	labels  []string
+}
+
+// filterGraph converts the filters in the file to Gmail filters and collects
+// what they point at.
+func filterGraph(ctx context.Context, ff filterfile) (graph, error) {
+	var g graph
+
+	// The placeholder IDs of the labels are their names, so nothing needs to
+	// be looked up in the account.
+	labels, _, err := labelMap{}.pendingLabels(ff)
+	if err != nil {
+		return g, err
+	}
+
+	actions, labelNodes := map[string]bool{}, map[string]bool{}
+	for _, f := range ff.Filter {
+		gf, err := f.toGmailFilters(ctx, &labels)
+		if err != nil {
+			return g, err
+		}
+		for _, gmailFilter := range gf {
+			a, l := filterActions(gmailFilter.Action, labelMap{})
+			g.filters = append(g.filters, graphFilter{
+				criteria: explainCriteria(gmailFilter.Criteria),
+				actions:  a,
+				labels:   l,
+			})
+			for _, name := range a {
+				actions[name] = true
+			}
+			for _, name := range l {
+				labelNodes[name] = true
+			}
+		}
+	}
+
+	g.actions, g.labels = sortedKeys(actions), sortedKeys(labelNodes)
+	return g, nil
+}
+
+// sortedKeys returns the keys of the set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dotQuote quotes the string as a Graphviz ID.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// writeDotGraph writes the graph in the Graphviz dot language.
+func writeDotGraph(w io.Writer, g graph) error {
+	fmt.Fprintln(w, "digraph filters {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	for i, f := range g.filters {
+		style := ""
+		if len(f.actions) < 1 && len(f.labels) < 1 {
+			style = ", style=dashed, color=red"
+		}
+		fmt.Fprintf(w, "  f%d [label=%s%s];\n", i+1, dotQuote(f.criteria), style)
+	}
+	for _, a := range g.actions {
+		fmt.Fprintf(w, "  %s [label=%s, shape=ellipse];\n", dotQuote("action:"+a), dotQuote(a))
+	}
+	for _, l := range g.labels {
+		fmt.Fprintf(w, "  %s [label=%s, shape=folder];\n", dotQuote("label:"+l), dotQuote(l))
+	}
+	for i, f := range g.filters {
+		for _, a := range f.actions {
+			fmt.Fprintf(w, "  f%d -> %s;\n", i+1, dotQuote("action:"+a))
+		}
+		for _, l := range f.labels {
+			fmt.Fprintf(w, "  f%d -> %s;\n", i+1, dotQuote("label:"+l))
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// mermaidQuote quotes the string as the text of a Mermaid node.
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s) + `"`
+}
+
+// writeMermaidGraph writes the graph as a Mermaid flowchart. Mermaid IDs
+// cannot hold any character, so the actions and labels are numbered in
+// their sorted order.
+func writeMermaidGraph(w io.Writer, g graph) error {
+	actionIDs, labelIDs := map[string]string{}, map[string]string{}
+
+	fmt.Fprintln(w, "flowchart LR")
+	fmt.Fprintln(w, "  classDef noEffect stroke:#d00,stroke-dasharray:5 5;")
+	for i, f := range g.filters {
+		class := ""
+		if len(f.actions) < 1 && len(f.labels) < 1 {
+			class = ":::noEffect"
+		}
+		fmt.Fprintf(w, "  f%d[%s]%s\n", i+1, mermaidQuote(f.criteria), class)
+	}
+	for i, a := range g.actions {
+		actionIDs[a] = fmt.Sprintf("a%d", i+1)
+		fmt.Fprintf(w, "  %s([%s])\n", actionIDs[a], mermaidQuote(a))
+	}
+	for i, l := range g.labels {
+		labelIDs[l] = fmt.Sprintf("l%d", i+1)
+		fmt.Fprintf(w, "  %s>%s]\n", labelIDs[l], mermaidQuote(l))
+	}
+	for i, f := range g.filters {
+		for _, a := range f.actions {
+			fmt.Fprintf(w, "  f%d --> %s\n", i+1, actionIDs[a])
+		}
+		for _, l := range f.labels {
+			fmt.Fprintf(w, "  f%d --> %s\n", i+1, labelIDs[l])
+		}
+	}
+
+	return nil
+}
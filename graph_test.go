@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilterGraph(t *testing.T) {
+	ff := filterfile{Filter: []filter{
+		{From: stringList{"github.com"}, Label: "code", Archive: true},
+		{Query: "list:dev", Label: "code", Read: true},
+		{Subject: `say "hi"`},
+	}}
+
+	g, err := filterGraph(context.Background(), ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeDotGraph(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	expected := `digraph filters {
+  rankdir=LR;
+  node [shape=box];
+  f1 [label="Mail from github.com"];
+  f2 [label="Mail matching \"list:dev\""];
+  f3 [label="Mail with subject \"say \\\"hi\\\"\"", style=dashed, color=red];
+  "action:archive" [label="archive", shape=ellipse];
+  "action:read" [label="read", shape=ellipse];
+  "label:code" [label="code", shape=folder];
+  f1 -> "action:archive";
+  f1 -> "label:code";
+  f2 -> "action:read";
+  f2 -> "label:code";
+}
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	buf.Reset()
+	if err := writeMermaidGraph(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	expected = `flowchart LR
+  classDef noEffect stroke:#d00,stroke-dasharray:5 5;
+  f1["Mail from github.com"]
+  f2["Mail matching #quot;list:dev#quot;"]
+  f3["Mail with subject #quot;say \#quot;hi\#quot;#quot;"]:::noEffect
+  a1(["archive"])
+  a2(["read"])
+  l1>"code"]
+  f1 --> a1
+  f1 --> l1
+  f2 --> a2
+  f2 --> l1
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+const initHelp = `Set up gmailfilters and create a starter filter file.`
+
+const initLongHelp = initHelp + `
+
+Walks through getting the OAuth client credentials, authorizes gmailfilters
+to access the account, checks it can read the labels and filters, and writes
+a starter filter file, optionally with the filters already in the account.`
+
+func (cmd *initCommand) Name() string      { return "init" }
+func (cmd *initCommand) Args() string      { return "[<file>]" }
+func (cmd *initCommand) ShortHelp() string { return initHelp }
+func (cmd *initCommand) LongHelp() string  { return initLongHelp }
+func (cmd *initCommand) Hidden() bool      { return false }
+
+func (cmd *initCommand) Register(fs *flag.FlagSet) {}
+
+type initCommand struct{}
+
+// starterFilterFile is the filter file written when not seeding it from the
+// account.
+const starterFilterFile = `# Filters synced to Gmail by gmailfilters, see
+# https://github.com/jessfraz/gmailfilters for all the settings.
+#
+# Preview the changes with:     gmailfilters diff filters.toml
+# Apply them to the account:    gmailfilters apply filters.toml
+
+# [[filter]]
+# query = "list:dev.example.com"
+# label = "Mailing Lists/dev"
+# archiveUnlessToMe = true
+
+# [[filter]]
+# from = ["notifications@github.com"]
+# label = "GitHub"
+# read = true
+`
+
+func (cmd *initCommand) Run(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("must pass at most the path of the filter file to create")
+	}
+	file := "filters.toml"
+	if len(args) == 1 {
+		file = args[0]
+	}
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s already exists, pass the path of a new filter file", file)
+	}
+
+	// Step 1: the OAuth client credentials.
+	b, fromEnv, err := credentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	if !fromEnv {
+		if _, err := os.Stat(credsFile); len(credsFile) < 1 || err != nil {
+			fmt.Print(`gmailfilters needs OAuth client credentials to talk to the Gmail API:
+
+  1. Create a project in the Google API Console, https://console.developers.google.com
+  2. Enable the Gmail API for it.
+  3. Create OAuth client ID credentials for a desktop application.
+  4. Download them as a JSON file.
+
+`)
+			path, err := ask("Path to the downloaded credentials file", "credentials.json")
+			if err != nil {
+				return err
+			}
+			credsFile = path
+		}
+		b, err = ioutil.ReadFile(credsFile)
+		if err != nil {
+			return fmt.Errorf("reading client secret file %s failed: %v", credsFile, err)
+		}
+	}
+	if _, err := google.ConfigFromJSON(b); err != nil {
+		return fmt.Errorf("%s is not an OAuth client credentials file: %v", credentialsLocation(), err)
+	}
+	if !fromEnv {
+		infof("Using the credentials in %s, pass them with -f or set GMAIL_CREDENTIAL_FILE next time\n", credsFile)
+	}
+
+	// Step 2: authorize, reusing the token if there is one.
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	// Step 3: check we were granted the scopes we need by using them.
+	if _, err := getLabelMap(ctx); err != nil {
+		return fmt.Errorf("the token cannot read the labels, run auth to authorize again: %v", err)
+	}
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return fmt.Errorf("the token cannot read the filters, run auth to authorize again: %v", err)
+	}
+	infof("Authorized, the token is saved to %s\n", tokenFile)
+
+	// Step 4: the starter filter file.
+	seed := false
+	if len(remote) > 0 {
+		answer, err := ask(fmt.Sprintf("Start %s with the %d filters in the account? (y/n)", file, len(remote)), "n")
+		if err != nil {
+			return err
+		}
+		seed = strings.HasPrefix(strings.ToLower(answer), "y")
+	}
+	if seed {
+		if err := exportExistingFilters(ctx, file); err != nil {
+			return err
+		}
+	} else if err := ioutil.WriteFile(file, []byte(starterFilterFile), 0644); err != nil {
+		return fmt.Errorf("writing %s failed: %v", file, err)
+	}
+
+	infof("Created %s, preview the changes it makes with: gmailfilters diff %s\n", file, file)
+
+	return nil
+}
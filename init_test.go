@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStarterFilterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(starterFilterFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problems := validateFile(context.Background(), file, nil); len(problems) > 0 {
+		t.Fatalf("expected the starter file to be valid, got %v", problems)
+	}
+
+	// The examples are valid once uncommented.
+	examples := starterFilterFile[strings.Index(starterFilterFile, "# [[filter]]"):]
+	uncommented := strings.Replace("\n"+examples, "\n# ", "\n", -1)
+	if err := ioutil.WriteFile(file, []byte(uncommented), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problems := validateFile(context.Background(), file, nil); len(problems) > 0 {
+		t.Fatalf("expected the uncommented examples to be valid, got %v", problems)
+	}
+}
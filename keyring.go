@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// keyringService is the service the tokens are stored under in the keyring.
+const keyringService = "gmailfilters"
+
+// keyring is the secret store of the OS, driven by its command line tool
+// since there is no portable API for it. The secrets are passed on stdin so
+// they do not show in the process list.
+type keyring struct {
+	tool   string
+	lookup func(key string) *exec.Cmd
+	store  func(key, secret string) (*exec.Cmd, string)
+	clear  func(key string) *exec.Cmd
+}
+
+// windowsVault loads the Windows Credential Manager in PowerShell, the key
+// being in the GMAILFILTERS_KEYRING_KEY environment variable.
+const windowsVault = `[void][Windows.Security.Credentials.PasswordVault,Windows.Security.Credentials,ContentType=WindowsRuntime];` +
+	`$v = New-Object Windows.Security.Credentials.PasswordVault;` +
+	`$k = $env:GMAILFILTERS_KEYRING_KEY;`
+
+// keyrings are the keyrings by OS: the macOS Keychain, the Secret Service of
+// libsecret and the Windows Credential Manager.
+var keyrings = map[string]keyring{
+	"darwin": {
+		tool: "security",
+		lookup: func(key string) *exec.Cmd {
+			return exec.Command("security", "find-generic-password", "-s", keyringService, "-a", key, "-w")
+		},
+		store: func(key, secret string) (*exec.Cmd, string) {
+			return exec.Command("security", "-i"), fmt.Sprintf("add-generic-password -U -s %s -a %q -w %s\n", keyringService, key, secret)
+		},
+		clear: func(key string) *exec.Cmd {
+			return exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", key)
+		},
+	},
+	"linux": {
+		tool: "secret-tool",
+		lookup: func(key string) *exec.Cmd {
+			return exec.Command("secret-tool", "lookup", "service", keyringService, "account", key)
+		},
+		store: func(key, secret string) (*exec.Cmd, string) {
+			return exec.Command("secret-tool", "store", "--label=gmailfilters token", "service", keyringService, "account", key), secret
+		},
+		clear: func(key string) *exec.Cmd {
+			return exec.Command("secret-tool", "clear", "service", keyringService, "account", key)
+		},
+	},
+	"windows": {
+		tool: "powershell",
+		lookup: func(key string) *exec.Cmd {
+			return keyringEnv(exec.Command("powershell", "-NoProfile", "-Command", windowsVault+
+				`$c = $v.Retrieve('`+keyringService+`', $k); $c.RetrievePassword(); $c.Password`), key)
+		},
+		store: func(key, secret string) (*exec.Cmd, string) {
+			return keyringEnv(exec.Command("powershell", "-NoProfile", "-Command", windowsVault+
+				`$v.Add((New-Object Windows.Security.Credentials.PasswordCredential('`+keyringService+`', $k, [Console]::In.ReadLine())))`), key), secret + "\n"
+		},
+		clear: func(key string) *exec.Cmd {
+			return keyringEnv(exec.Command("powershell", "-NoProfile", "-Command", windowsVault+
+				`$v.Remove($v.Retrieve('`+keyringService+`', $k))`), key)
+		},
+	},
+}
+
+// keyringEnv passes the key to the command in GMAILFILTERS_KEYRING_KEY.
+func keyringEnv(cmd *exec.Cmd, key string) *exec.Cmd {
+	cmd.Env = append(os.Environ(), "GMAILFILTERS_KEYRING_KEY="+key)
+	return cmd
+}
+
+// osKeyring returns the keyring of the OS, if its tool is installed.
+func osKeyring() (keyring, error) {
+	k, ok := keyrings[runtime.GOOS]
+	if !ok {
+		return k, fmt.Errorf("there is no keyring support on %s", runtime.GOOS)
+	}
+	if _, err := exec.LookPath(k.tool); err != nil {
+		return k, fmt.Errorf("the keyring needs %s: %v", k.tool, err)
+	}
+	return k, nil
+}
+
+// useKeyring returns true if the token is kept in the keyring, as set with
+// --token-store.
+func useKeyring() (keyring, bool, error) {
+	switch tokenStore {
+	case "file", "encrypted":
+		return keyring{}, false, nil
+	case "keyring":
+		k, err := osKeyring()
+		if err != nil {
+			return k, false, fmt.Errorf("%v, pass --token-store file to keep the token in a file", err)
+		}
+		return k, true, nil
+	case "auto":
+		k, err := osKeyring()
+		if err != nil {
+			logrus.Debugf("Keeping the token in %s: %v", tokenFile, err)
+			return k, false, nil
+		}
+		return k, true, nil
+	}
+	return keyring{}, false, fmt.Errorf("invalid --token-store %q, must be auto, keyring, file or encrypted", tokenStore)
+}
+
+// readToken reads the token from GMAILFILTERS_TOKEN, a secret store, the
+// keyring or the token file. A token still in the token file is moved to the keyring.
+func readToken(ctx context.Context) (*oauth2.Token, error) {
+	if tok, ok, err := tokenFromEnv(); ok {
+		return tok, err
+	}
+	if isSecretRef(tokenFile) {
+		v, err := fetchSecret(ctx, tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseToken(tokenFile, v)
+	}
+
+	k, ok, err := useKeyring()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return tokenFromFile(tokenFile)
+	}
+
+	// The tokens are keyed by the token file, which is already different for
+	// each profile and account.
+	out, err := k.lookup(tokenFile).Output()
+	if err != nil {
+		tok, ferr := tokenFromFile(tokenFile)
+		if ferr != nil {
+			return nil, fmt.Errorf("no token in the keyring for %s", tokenFile)
+		}
+		if err := storeInKeyring(k, tok); err != nil {
+			logrus.Debugf("Keeping the token in %s: %v", tokenFile, err)
+			return tok, nil
+		}
+		logrus.Infof("Moved the token in %s to the keyring", tokenFile)
+		return tok, os.Remove(tokenFile)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding the token in the keyring failed: %v", err)
+	}
+	tok := &oauth2.Token{}
+	return tok, json.Unmarshal(b, tok)
+}
+
+// writeToken saves the token to the keyring or the token file. With
+// --token-store auto, a keyring that fails, like one with no session to
+// unlock it in on a headless machine, falls back to the token file.
+func writeToken(tok *oauth2.Token) error {
+	if source, ok := externalToken(); ok {
+		return fmt.Errorf("cannot save the token to %s, update it there with the output of gmailfilters auth --print", source)
+	}
+
+	k, ok, err := useKeyring()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return saveToken(tokenFile, tok)
+	}
+
+	if err := storeInKeyring(k, tok); err != nil {
+		if tokenStore == "auto" {
+			logrus.Warnf("%v, saving it to %s instead", err, tokenFile)
+			return saveToken(tokenFile, tok)
+		}
+		return err
+	}
+	logrus.Infof("Saved the token to the keyring")
+	return nil
+}
+
+// storeInKeyring saves the token to the keyring, base64 encoded so it needs
+// no quoting.
+func storeInKeyring(k keyring, tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	cmd, stdin := k.store(tokenFile, base64.StdEncoding.EncodeToString(b))
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("saving the token to the keyring failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// removeToken removes the token from the keyring and the token file.
+func removeToken() error {
+	if _, ok := externalToken(); ok {
+		return nil
+	}
+
+	if err := os.Remove(tokenFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing token file %s failed: %v", tokenFile, err)
+	}
+
+	k, ok, err := useKeyring()
+	if err != nil || !ok {
+		return err
+	}
+	// There is nothing to clear if the token is not in the keyring.
+	if err := k.lookup(tokenFile).Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil
+		}
+		return err
+	}
+	if out, err := k.clear(tokenFile).CombinedOutput(); err != nil {
+		return fmt.Errorf("removing the token from the keyring failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// tokenLocation returns where the token is kept, for display.
+func tokenLocation() string {
+	if source, ok := externalToken(); ok {
+		return source
+	}
+	if _, ok, _ := useKeyring(); ok {
+		return "the keyring entry for " + tokenFile
+	}
+	return tokenFile
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestKeyringToken(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the fake keyring is a secret-tool script")
+	}
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake secret-tool keeps the secret of the last account argument in
+	// a file.
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secrets, 0700); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+cmd=$1
+for last; do :; done
+file="` + secrets + `/$(echo "$last" | tr / _)"
+case "$cmd" in
+store) cat > "$file" ;;
+lookup) cat "$file" 2>/dev/null ;;
+clear) rm -f "$file" ;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	defer func(file, store string) { tokenFile, tokenStore = file, store }(tokenFile, tokenStore)
+	tokenFile = filepath.Join(dir, "token.json")
+	tokenStore = "auto"
+
+	// A token in the token file is moved to the keyring.
+	if err := saveToken(tokenFile, &oauth2.Token{AccessToken: "file", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := readToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "file" || tok.RefreshToken != "refresh" {
+		t.Fatalf("expected the token from the file, got %+v", tok)
+	}
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the token file to be removed, got %v", err)
+	}
+
+	if err := writeToken(&oauth2.Token{AccessToken: "keyring"}); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err = readToken(context.Background()); err != nil || tok.AccessToken != "keyring" {
+		t.Fatalf("expected the token from the keyring, got %+v (%v)", tok, err)
+	}
+	if tokenLocation() != "the keyring entry for "+tokenFile {
+		t.Fatalf("got unexpected location %q", tokenLocation())
+	}
+
+	if err := removeToken(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readToken(context.Background()); err == nil {
+		t.Fatal("expected no token after removing it")
+	}
+
+	// With --token-store file, the keyring is left alone.
+	tokenStore = "file"
+	if err := writeToken(&oauth2.Token{AccessToken: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := tokenFromFile(tokenFile); err != nil || tok.AccessToken != "plain" {
+		t.Fatalf("expected the token in the file, got %+v (%v)", tok, err)
+	}
+}
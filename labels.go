@@ -1,22 +1,145 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/gmail/v1"
 )
 
+const labelsHelp = `List the labels in the account.`
+
+func (cmd *labelsCommand) Name() string      { return "labels" }
+func (cmd *labelsCommand) Args() string      { return "" }
+func (cmd *labelsCommand) ShortHelp() string { return labelsHelp }
+func (cmd *labelsCommand) LongHelp() string  { return labelsHelp }
+func (cmd *labelsCommand) Hidden() bool      { return false }
+
+func (cmd *labelsCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.system, "system", false, "include the system labels")
+	fs.StringVar(&cmd.output, "output", "text", "output format: text or json")
+}
+
+type labelsCommand struct {
+	system bool
+	output string
+}
+
+func (cmd *labelsCommand) Run(ctx context.Context, args []string) error {
+	if err := validateOutput(cmd.output); err != nil {
+		return err
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	l, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("listing labels failed: %v", err)
+	}
+	cacheLabelNames(l.Labels)
+
+	var labels []*gmail.Label
+	for _, label := range l.Labels {
+		if label.Type == "system" && !cmd.system {
+			continue
+		}
+		labels = append(labels, label)
+	}
+
+	if cmd.output == "json" {
+		return writeLabelsJSON(os.Stdout, labels)
+	}
+	return printLabels(os.Stdout, labels)
+}
+
+// exportLabels returns the user labels in the account as label definitions,
+// with their colors and visibility, sorted by name.
+func exportLabels(ctx context.Context) ([]labelDefinition, error) {
+	l, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing labels failed: %v", err)
+	}
+
+	var defs []labelDefinition
+	for _, label := range l.Labels {
+		if label.Type == "system" {
+			continue
+		}
+		d := labelDefinition{
+			Name:                  label.Name,
+			LabelListVisibility:   label.LabelListVisibility,
+			MessageListVisibility: label.MessageListVisibility,
+		}
+		if label.Color != nil {
+			d.Color = &labelColor{Background: label.Color.BackgroundColor, Text: label.Color.TextColor}
+		}
+		defs = append(defs, d)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs, nil
+}
+
+// printLabels writes a table of the labels sorted by name.
+func printLabels(w io.Writer, labels []*gmail.Label) error {
+	sort.Slice(labels, func(i, j int) bool {
+		return strings.ToLower(labels[i].Name) < strings.ToLower(labels[j].Name)
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tLABEL LIST\tMESSAGE LIST")
+	for _, l := range labels {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Name, l.Id, orDash(l.LabelListVisibility), orDash(l.MessageListVisibility))
+	}
+	return tw.Flush()
+}
+
+// writeLabelsJSON writes the labels sorted by name as a JSON array.
+func writeLabelsJSON(w io.Writer, labels []*gmail.Label) error {
+	sort.Slice(labels, func(i, j int) bool {
+		return strings.ToLower(labels[i].Name) < strings.ToLower(labels[j].Name)
+	})
+	if labels == nil {
+		labels = []*gmail.Label{}
+	}
+
+	b, err := json.MarshalIndent(labels, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding labels failed: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// orDash returns s, or a dash if it is empty.
+func orDash(s string) string {
+	if len(s) < 1 {
+		return "-"
+	}
+	return s
+}
+
 type labelMap map[string]string
 
-func getLabelMap() (labelMap, error) {
+func getLabelMap(ctx context.Context) (labelMap, error) {
 	// Get the labels for the user and map its name to its ID.
-	l, err := api.Users.Labels.List(gmailUser).Do()
+	l, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
 	if err != nil {
 		return nil, fmt.Errorf("listing labels failed: %v", err)
 	}
 
+	cacheLabelNames(l.Labels)
+
 	labels := labelMap{}
 	for _, label := range l.Labels {
 		labels[strings.ToLower(label.Name)] = label.Id
@@ -25,13 +148,15 @@ func getLabelMap() (labelMap, error) {
 	return labels, nil
 }
 
-func getLabelMapOnID() (labelMap, error) {
+func getLabelMapOnID(ctx context.Context) (labelMap, error) {
 	// Get the labels for the user and map its name to its ID.
-	l, err := api.Users.Labels.List(gmailUser).Do()
+	l, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
 	if err != nil {
 		return nil, fmt.Errorf("listing labels failed: %v", err)
 	}
 
+	cacheLabelNames(l.Labels)
+
 	labels := labelMap{}
 	for _, label := range l.Labels {
 		labels[label.Id] = label.Name
@@ -40,7 +165,7 @@ func getLabelMapOnID() (labelMap, error) {
 	return labels, nil
 }
 
-func (m *labelMap) createLabelIfDoesNotExist(name string) (string, error) {
+func (m *labelMap) createLabelIfDoesNotExist(ctx context.Context, name string, settings *gmail.Label) (string, error) {
 	// De reference the pointer so we can index.
 	labels := *m
 
@@ -51,8 +176,18 @@ func (m *labelMap) createLabelIfDoesNotExist(name string) (string, error) {
 		return id, nil
 	}
 
-	// Create the label if it does not exist.
-	label, err := api.Users.Labels.Create(gmailUser, &gmail.Label{Name: name}).Do()
+	// Create the label if it does not exist, making sure Gmail will take
+	// the name first since its errors are not very helpful.
+	if err := validateLabelName(name); err != nil {
+		return "", err
+	}
+	l := &gmail.Label{Name: name}
+	if settings != nil {
+		l.Color = settings.Color
+		l.LabelListVisibility = settings.LabelListVisibility
+		l.MessageListVisibility = settings.MessageListVisibility
+	}
+	label, err := api.Users.Labels.Create(gmailUser, l).Context(ctx).Do()
 	if err != nil {
 		return "", fmt.Errorf("creating label %s failed: %v", name, err)
 	}
@@ -63,3 +198,240 @@ func (m *labelMap) createLabelIfDoesNotExist(name string) (string, error) {
 	m = &labels
 	return label.Id, nil
 }
+
+// maxLabelNameLength is the longest label name Gmail allows, including the
+// names of its parents.
+const maxLabelNameLength = 225
+
+// reservedLabelNames are the names of the system labels, which cannot be used
+// for user labels regardless of case.
+var reservedLabelNames = map[string]bool{
+	"inbox":     true,
+	"spam":      true,
+	"trash":     true,
+	"unread":    true,
+	"starred":   true,
+	"important": true,
+	"sent":      true,
+	"draft":     true,
+	"drafts":    true,
+	"chat":      true,
+	"chats":     true,
+	"all mail":  true,
+	"snoozed":   true,
+	"scheduled": true,
+	"outbox":    true,
+}
+
+// validateLabelName makes sure Gmail accepts the name for a new label.
+func validateLabelName(name string) error {
+	if len(name) > maxLabelNameLength {
+		return fmt.Errorf("label name %q is %d characters long, Gmail allows at most %d", name, len(name), maxLabelNameLength)
+	}
+
+	if reservedLabelNames[strings.ToLower(name)] || strings.HasPrefix(strings.ToUpper(name), "CATEGORY_") {
+		return fmt.Errorf("label name %q is reserved by Gmail", name)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if len(part) < 1 {
+			return fmt.Errorf("label name %q has an empty level, nested labels are written as parent/child", name)
+		}
+		if strings.TrimSpace(part) != part {
+			return fmt.Errorf("label name %q has a level starting or ending with whitespace", name)
+		}
+		for _, r := range part {
+			if r < 0x20 || r == 0x7f {
+				return fmt.Errorf("label name %q contains a control character", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// labelDefinition declares a label and its settings independently of the
+// filters. Nested labels are named relative to their parent.
+type labelDefinition struct {
+	Name                  string
+	Color                 *labelColor
+	LabelListVisibility   string
+	MessageListVisibility string
+	Label                 []labelDefinition
+}
+
+// settings returns the settings to apply to the label or nil if there are
+// none.
+func (d labelDefinition) settings() *gmail.Label {
+	return filter{
+		LabelColor:            d.Color,
+		LabelListVisibility:   d.LabelListVisibility,
+		MessageListVisibility: d.MessageListVisibility,
+	}.labelSettings()
+}
+
+// flatten returns the label definition and all of its nested definitions
+// with their full names.
+func (d labelDefinition) flatten(parent string) ([]labelDefinition, error) {
+	if len(strings.TrimSpace(d.Name)) < 1 {
+		return nil, errors.New("label name cannot be empty")
+	}
+
+	if err := validateLabelVisibility(d.LabelListVisibility, d.MessageListVisibility); err != nil {
+		return nil, fmt.Errorf("label %s: %v", d.Name, err)
+	}
+
+	if len(parent) > 0 {
+		d.Name = parent + "/" + d.Name
+	}
+
+	defs := []labelDefinition{d}
+	for _, child := range d.Label {
+		children, err := child.flatten(d.Name)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, children...)
+	}
+
+	return defs, nil
+}
+
+// parentLabels returns the names of the parents of a nested label, from the
+// outermost parent inwards.
+func parentLabels(name string) []string {
+	parts := strings.Split(name, "/")
+	parents := make([]string, 0, len(parts)-1)
+	for i := 1; i < len(parts); i++ {
+		parents = append(parents, strings.Join(parts[:i], "/"))
+	}
+	return parents
+}
+
+// reconcileLabels makes sure every label declared in the [[label]] section
+// exists and applies the label settings declared by the label definitions and
+// the filters to the labels in the account. Labels only referenced by filters
+// that do not exist yet get their settings when they are created.
+func reconcileLabels(ctx context.Context, ff filterfile, labels *labelMap) error {
+	// Make sure Gmail takes the names of all the labels to create before
+	// creating any of them.
+	if _, _, err := labels.pendingLabels(ff); err != nil {
+		return err
+	}
+
+	// Collect the wanted settings for each label.
+	wanted := map[string]*gmail.Label{}
+	names := map[string]string{}
+	want := func(name string, settings *gmail.Label) error {
+		key := strings.ToLower(name)
+		if _, ok := names[key]; !ok {
+			names[key] = name
+		}
+		if settings == nil {
+			return nil
+		}
+		if existing, ok := wanted[key]; ok && !labelSettingsEqual(existing, settings) {
+			return fmt.Errorf("label %s has conflicting settings", name)
+		}
+		wanted[key] = settings
+		return nil
+	}
+
+	// Declared labels are always reconciled, along with their parents.
+	var declared []string
+	for _, d := range ff.Label {
+		defs, err := d.flatten("")
+		if err != nil {
+			return err
+		}
+		for _, def := range defs {
+			if err := want(def.Name, def.settings()); err != nil {
+				return err
+			}
+			declared = append(declared, parentLabels(def.Name)...)
+			declared = append(declared, def.Name)
+		}
+	}
+
+	// Labels referenced by filters are only reconciled if they have settings.
+	for _, f := range ff.Filter {
+		if len(f.Label) < 1 {
+			continue
+		}
+		if err := want(f.Label, f.labelSettings()); err != nil {
+			return err
+		}
+	}
+
+	if len(declared) < 1 && len(wanted) < 1 {
+		return nil
+	}
+
+	l, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("listing labels failed: %v", err)
+	}
+
+	for _, label := range l.Labels {
+		settings, ok := wanted[strings.ToLower(label.Name)]
+		if !ok || labelSettingsEqual(label, settings) {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"label": label.Name,
+		}).Debug("updating label settings")
+		if _, err := api.Users.Labels.Patch(gmailUser, label.Id, settings).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("updating label %s failed: %v", label.Name, err)
+		}
+		logrus.Infof("Updated label: %s", label.Name)
+	}
+
+	// Create the declared labels that do not exist yet.
+	for _, name := range declared {
+		if _, err := labels.createLabelIfDoesNotExist(ctx, name, wanted[strings.ToLower(name)]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labelSettingsEqual returns true if the label has the given settings.
+func labelSettingsEqual(label, settings *gmail.Label) bool {
+	if settings.Color != nil {
+		if label.Color == nil ||
+			!strings.EqualFold(label.Color.BackgroundColor, settings.Color.BackgroundColor) ||
+			!strings.EqualFold(label.Color.TextColor, settings.Color.TextColor) {
+			return false
+		}
+	}
+
+	if len(settings.LabelListVisibility) > 0 && label.LabelListVisibility != settings.LabelListVisibility {
+		return false
+	}
+
+	if len(settings.MessageListVisibility) > 0 && label.MessageListVisibility != settings.MessageListVisibility {
+		return false
+	}
+
+	return true
+}
+
+// validateLabelVisibility makes sure the visibility settings are ones Gmail
+// accepts.
+func validateLabelVisibility(labelList, messageList string) error {
+	switch labelList {
+	case "", "labelShow", "labelShowIfUnread", "labelHide":
+	default:
+		return fmt.Errorf("labelListVisibility %q must be one of labelShow, labelShowIfUnread or labelHide", labelList)
+	}
+
+	switch messageList {
+	case "", "show", "hide":
+	default:
+		return fmt.Errorf("messageListVisibility %q must be one of show or hide", messageList)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestLabelDefinitionFlatten(t *testing.T) {
+	var ff filterfile
+	if _, err := toml.Decode(`
+[[label]]
+name = "Mailing Lists"
+[[label.label]]
+name = "coreos-dev"
+messageListVisibility = "hide"
+[[label.label.label]]
+name = "archive"
+`, &ff); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, err := ff.Label[0].flatten("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, d := range defs {
+		names = append(names, d.Name)
+	}
+
+	expected := []string{"Mailing Lists", "Mailing Lists/coreos-dev", "Mailing Lists/coreos-dev/archive"}
+	if diff := cmp.Diff(expected, names); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"a", "a/b"}, parentLabels("a/b/c")); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if _, err := (labelDefinition{Name: "x", MessageListVisibility: "sometimes"}).flatten(""); err == nil {
+		t.Fatal("expected an error for an invalid visibility")
+	}
+}
+
+func TestValidateLabelName(t *testing.T) {
+	for _, name := range []string{"github", "Mailing Lists/coreos-dev", "Sent by me"} {
+		if err := validateLabelName(name); err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{
+		"inbox",
+		"Sent",
+		"All Mail",
+		"CATEGORY_SOCIAL",
+		"/github",
+		"github/",
+		"a//b",
+		"a/ b",
+		strings.Repeat("a", maxLabelNameLength+1),
+	} {
+		if err := validateLabelName(name); err == nil {
+			t.Fatalf("expected an error for %q", name)
+		}
+	}
+
+	if _, _, err := (labelMap{}).pendingLabels(filterfile{Filter: []filter{{Query: "x", Label: "Trash"}}}); err == nil {
+		t.Fatal("expected an error for a reserved label name")
+	}
+}
+
+func TestReconcileLabelsInvalidName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	// The valid label must not be created as the file has an invalid one
+	// further down.
+	ff := filterfile{
+		Label: []labelDefinition{{Name: "Lists"}},
+		Filter: []filter{
+			{Query: "list:golang-nuts", Label: "Lists/golang"},
+			{Query: "list:dev", Label: "Lists//dev"},
+		},
+	}
+	labels := labelMap{"inbox": "INBOX"}
+	if err := reconcileLabels(context.Background(), ff, &labels); err == nil || !strings.Contains(err.Error(), "Lists//dev") {
+		t.Fatalf("expected an error for the invalid label name, got %v", err)
+	}
+}
+
+func TestWriteLabelsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeLabelsJSON(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("[]\n", buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	buf.Reset()
+	if err := writeLabelsJSON(&buf, []*gmail.Label{{Id: "Label_2", Name: "ops"}, {Id: "Label_1", Name: "Dev"}}); err != nil {
+		t.Fatal(err)
+	}
+	var got []gmail.Label
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "Dev" || got[1].Id != "Label_2" {
+		t.Fatalf("expected the labels sorted by name, got %s", buf.String())
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxCriteriaLength is the longest query, from or to criteria Gmail accepts.
+const maxCriteriaLength = 1500
+
+// splitLongFilters returns the filters with any criteria longer than Gmail
+// allows split into several equivalent filters. Only criteria that are a list
+// of alternatives joined with OR, alone or in parentheses next to other terms,
+// can be split, each of the new filters matching some of them along with the
+// other terms.
+func splitLongFilters(filters []gmail.Filter) ([]gmail.Filter, error) {
+	var split []gmail.Filter
+	for _, f := range filters {
+		parts, err := splitLongFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		split = append(split, parts...)
+	}
+	return split, nil
+}
+
+// splitLongFilter splits a single filter, see splitLongFilters.
+func splitLongFilter(f gmail.Filter) ([]gmail.Filter, error) {
+	c := f.Criteria
+	if c == nil {
+		return []gmail.Filter{f}, nil
+	}
+
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"query", &c.Query},
+		{"from", &c.From},
+		{"to", &c.To},
+	}
+	for _, fld := range fields {
+		if len(*fld.value) <= maxCriteriaLength {
+			continue
+		}
+
+		shared, alternatives, err := orAlternatives(*fld.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is %d characters long, more than the %d Gmail allows, and cannot be split: %v", fld.name, len(*fld.value), maxCriteriaLength, err)
+		}
+		limit := maxCriteriaLength
+		if len(shared) > 0 {
+			limit -= len(shared) + len(" ()")
+		}
+		chunks, err := chunkAlternatives(alternatives, limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s is %d characters long, more than the %d Gmail allows: %v", fld.name, len(*fld.value), maxCriteriaLength, err)
+		}
+		if len(shared) > 0 {
+			for i, chunk := range chunks {
+				chunks[i] = shared + " (" + chunk + ")"
+			}
+		}
+
+		var split []gmail.Filter
+		for _, chunk := range chunks {
+			criteria := *c
+			part := f
+			part.Criteria = &criteria
+			switch fld.name {
+			case "query":
+				criteria.Query = chunk
+			case "from":
+				criteria.From = chunk
+			case "to":
+				criteria.To = chunk
+			}
+
+			// The other criteria might be too long as well.
+			parts, err := splitLongFilter(part)
+			if err != nil {
+				return nil, err
+			}
+			split = append(split, parts...)
+		}
+		return split, nil
+	}
+
+	return []gmail.Filter{f}, nil
+}
+
+// orAlternatives returns the alternatives of a query that is a list of terms
+// joined with OR, or just the query if it is not. A query that is a group of
+// alternatives next to other terms, like label:work (from:a OR from:b), is
+// split on the alternatives of the group, the other terms are returned as
+// shared, to be kept in each of the split queries. Only alternatives that are
+// single terms or groups in parentheses are split, as Gmail binds OR tighter
+// than the terms next to it.
+func orAlternatives(q string) (string, []string, error) {
+	n, err := parseQuery(q)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkOrPrecedence(n); err != nil {
+		return "", nil, err
+	}
+
+	var shared []string
+	if n.kind == andNode {
+		var group *queryNode
+		for _, child := range n.children {
+			if child.kind == orNode && group == nil {
+				group = child
+				continue
+			}
+			shared = append(shared, child.String())
+		}
+		if group == nil {
+			return "", []string{q}, nil
+		}
+		n = group
+	}
+	if n.kind != orNode {
+		return "", []string{q}, nil
+	}
+
+	alternatives := make([]string, 0, len(n.children))
+	for _, child := range n.children {
+		if child.kind != termNode && child.kind != notNode && !child.grouped {
+			return "", nil, fmt.Errorf("%q is not a single term or a group in parentheses", child.String())
+		}
+		alternatives = append(alternatives, child.String())
+	}
+	return strings.Join(shared, " "), alternatives, nil
+}
+
+// chunkAlternatives joins the alternatives with OR into as few queries as
+// possible that fit in the length limit.
+func chunkAlternatives(alternatives []string, limit int) ([]string, error) {
+	var (
+		chunks  []string
+		current []string
+		length  int
+	)
+	for _, a := range alternatives {
+		if len(a) > limit {
+			return nil, errors.New("it cannot be split into shorter alternatives joined with OR")
+		}
+
+		if length+len(" OR ")+len(a) > limit && len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, " OR "))
+			current, length = nil, 0
+		}
+		if len(current) > 0 {
+			length += len(" OR ")
+		}
+		current = append(current, a)
+		length += len(a)
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, " OR "))
+	}
+	return chunks, nil
+}
+
+// maxFilters is the most filters Gmail allows in an account.
+const maxFilters = 1000
+
+// filterCountWarning is the number of filters from which we warn that the
+// account is getting close to the limit.
+const filterCountWarning = 900
+
+// filterCount returns the number of filters in the account once the diff is
+// applied.
+func (d filterDiff) filterCount() int {
+	n := len(d.Unchanged) + len(d.Create) + len(d.Update) + len(d.Kept) + len(d.Protected)
+	for _, c := range d.Conflicts {
+		// Filters deleted in the account are not recreated.
+		if len(c.Old.Id) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// checkFilterCount makes sure applying the diff does not leave the account
+// with more filters than Gmail allows, warning when it gets close.
+func checkFilterCount(d filterDiff) error {
+	n := d.filterCount()
+	if n > maxFilters {
+		suggestions := []string{
+			"filters with the same actions can be combined into one with queryOr or a from list",
+			"archiveUnlessToMe and archiveUnlessCcMe create two filters each",
+		}
+		if len(d.Kept) > 0 {
+			suggestions = append(suggestions, fmt.Sprintf("%d filters in the account are not in the file, --prune deletes the ones created by gmailfilters", len(d.Kept)))
+		}
+		return fmt.Errorf("the account would have %d filters, more than the %d Gmail allows:\n  - %s", n, maxFilters, strings.Join(suggestions, "\n  - "))
+	}
+
+	if n >= filterCountWarning {
+		logrus.Warnf("The account will have %d filters, Gmail allows at most %d", n, maxFilters)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestSplitLongFilters(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 200; i++ {
+		addresses = append(addresses, fmt.Sprintf("from:sender%03d@example.com", i))
+	}
+	action := &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}
+
+	got, err := splitLongFilters([]gmail.Filter{{
+		Criteria: &gmail.FilterCriteria{Query: strings.Join(addresses, " OR ")},
+		Action:   action,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 4 {
+		t.Fatalf("expected 4 filters, got %d", len(got))
+	}
+	var split []string
+	for _, f := range got {
+		if len(f.Criteria.Query) > maxCriteriaLength {
+			t.Fatalf("expected queries of at most %d characters, got %d", maxCriteriaLength, len(f.Criteria.Query))
+		}
+		if f.Action != action {
+			t.Fatal("expected the split filters to keep the action")
+		}
+		split = append(split, strings.Split(f.Criteria.Query, " OR ")...)
+	}
+	if diff := cmp.Diff(addresses, split); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// A long query that is not a list of alternatives cannot be split.
+	if _, err := splitLongFilters([]gmail.Filter{{
+		Criteria: &gmail.FilterCriteria{Query: strings.Join(addresses, " ")},
+	}}); err == nil {
+		t.Fatal("expected an error for a long query that cannot be split")
+	}
+}
+
+func TestSplitLongFiltersSharedTerms(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 200; i++ {
+		addresses = append(addresses, fmt.Sprintf("from:sender%03d@example.com", i))
+	}
+
+	got, err := splitLongFilters([]gmail.Filter{{
+		Criteria: &gmail.FilterCriteria{Query: "label:work (" + strings.Join(addresses, " OR ") + ") -is:chat"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) < 2 {
+		t.Fatalf("expected the query to be split, got %d filters", len(got))
+	}
+	var split []string
+	for _, f := range got {
+		q := f.Criteria.Query
+		if len(q) > maxCriteriaLength {
+			t.Fatalf("expected queries of at most %d characters, got %d", maxCriteriaLength, len(q))
+		}
+		if !strings.HasPrefix(q, "label:work -is:chat (") || !strings.HasSuffix(q, ")") {
+			t.Fatalf("expected every split query to keep the shared terms, got %q", q)
+		}
+		split = append(split, strings.Split(strings.TrimSuffix(strings.TrimPrefix(q, "label:work -is:chat ("), ")"), " OR ")...)
+	}
+	if diff := cmp.Diff(addresses, split); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Gmail reads label:work from:a OR from:b as label:work (from:a OR
+	// from:b), which the parser does not, so it is not split.
+	if _, err := splitLongFilters([]gmail.Filter{{
+		Criteria: &gmail.FilterCriteria{Query: "label:work " + strings.Join(addresses, " OR ")},
+	}}); err == nil {
+		t.Fatal("expected an error for an OR next to other terms without parentheses")
+	}
+}
+
+func TestCheckFilterCount(t *testing.T) {
+	filters := make([]gmail.Filter, maxFilters)
+
+	if err := checkFilterCount(filterDiff{Unchanged: filters}); err != nil {
+		t.Fatalf("expected %d filters to be allowed, got %v", maxFilters, err)
+	}
+
+	d := filterDiff{Unchanged: filters, Kept: []gmail.Filter{{Id: "1"}}}
+	if d.filterCount() != maxFilters+1 {
+		t.Fatalf("expected %d filters, got %d", maxFilters+1, d.filterCount())
+	}
+	if err := checkFilterCount(d); err == nil || !strings.Contains(err.Error(), "--prune") {
+		t.Fatalf("expected an error suggesting --prune, got %v", err)
+	}
+}
+
+func TestSyncFilterFileOverLimit(t *testing.T) {
+	// A fake Gmail API with as many filters as Gmail allows, none of them
+	// created by gmailfilters.
+	remote := make([]*gmail.Filter, maxFilters)
+	for i := range remote {
+		remote[i] = &gmail.Filter{Id: fmt.Sprint(i), Criteria: &gmail.FilterCriteria{From: fmt.Sprintf("sender%d@example.com", i)}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/me/labels":
+			json.NewEncoder(w).Encode(gmail.ListLabelsResponse{Labels: []*gmail.Label{
+				{Id: "INBOX", Name: "INBOX", Type: "system"},
+			}})
+		case "/me/settings/filters":
+			json.NewEncoder(w).Encode(gmail.ListFiltersResponse{Filter: remote})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { stateFile = old }(stateFile)
+	stateFile = filepath.Join(dir, "state.json")
+
+	// The new filter needs a label, which must not be created as the
+	// account would go over the limit.
+	ff := filterfile{Filter: []filter{{Query: "list:golang-nuts", Label: "Lists/golang"}}}
+	if err := syncFilterFile(context.Background(), ff, "text"); err == nil || !strings.Contains(err.Error(), "more than the") {
+		t.Fatalf("expected an error for going over the filter limit, got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// lintFilter is a Gmail filter along with the entry in the file it was
+// converted from.
+type lintFilter struct {
+	filter gmail.Filter
+	// entry is the index of the [[filter]] entry.
+	entry int
+	// line is the line of the entry, 0 if it is unknown.
+	line int
+}
+
+// lintProblem is a warning about a filter in the file.
+type lintProblem struct {
+	line int
+	msg  string
+}
+
+// lintOverlaps warns about filters that are dead weight: filters with the same
+// criteria as another, and filters only matching mail another filter also
+// matches while repeating some of its actions. Filters matching a subset of
+// another one with different actions are how labels get nested, so those are
+// fine. Exact duplicates are errors reported elsewhere.
+func lintOverlaps(filters []lintFilter) []lintProblem {
+	var problems []lintProblem
+
+	terms := make([]map[string]bool, len(filters))
+	for i, f := range filters {
+		terms[i] = criteriaTerms(f.filter.Criteria)
+	}
+
+	for i, b := range filters {
+		for j, a := range filters {
+			// The filters of a single entry overlap on purpose.
+			if i == j || a.entry == b.entry || fingerprint(a.filter) == fingerprint(b.filter) {
+				continue
+			}
+
+			switch {
+			case canonicalCriteria(a.filter.Criteria) == canonicalCriteria(b.filter.Criteria):
+				// Only report the pair once.
+				if j < i {
+					problems = append(problems, lintProblem{line: b.line, msg: fmt.Sprintf("has the same criteria as the filter on line %d, they can be combined", a.line)})
+				}
+			case strictSubset(terms[j], terms[i]):
+				if actionSubset(b.filter.Action, a.filter.Action) {
+					problems = append(problems, lintProblem{line: b.line, msg: fmt.Sprintf("is redundant, the filter on line %d matches all of its mail and does the same", a.line)})
+					continue
+				}
+				if common := commonLabels(a.filter.Action, b.filter.Action); len(common) > 0 {
+					problems = append(problems, lintProblem{line: b.line, msg: fmt.Sprintf("label %s is already added by the filter on line %d, which matches all of its mail", strings.Join(common, ", "), a.line)})
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// criteriaTerms returns the terms of the criteria that must all match. A
+// filter whose terms include all of the terms of another one only matches
+// mail the other one matches.
+func criteriaTerms(c *gmail.FilterCriteria) map[string]bool {
+	terms := map[string]bool{}
+	if c == nil {
+		return terms
+	}
+
+	if len(c.Query) > 0 {
+		n, err := parseQuery(c.Query)
+		if err != nil {
+			terms[normalizeQuery(c.Query)] = true
+		} else if n.kind == andNode {
+			for _, child := range n.children {
+				terms[child.String()] = true
+			}
+		} else {
+			terms[n.String()] = true
+		}
+	}
+
+	for _, t := range []struct {
+		name  string
+		value string
+	}{
+		{"negatedQuery", normalizeQuery(c.NegatedQuery)},
+		{"from", c.From},
+		{"to", c.To},
+		{"subject", c.Subject},
+	} {
+		if len(t.value) > 0 {
+			terms[t.name+"="+t.value] = true
+		}
+	}
+	if c.HasAttachment {
+		terms["hasAttachment"] = true
+	}
+	if c.ExcludeChats {
+		terms["excludeChats"] = true
+	}
+	if c.Size > 0 {
+		terms[fmt.Sprintf("size=%s%d", c.SizeComparison, c.Size)] = true
+	}
+
+	return terms
+}
+
+// strictSubset returns true if a has fewer terms than b and all of them are
+// in b.
+func strictSubset(a, b map[string]bool) bool {
+	if len(a) >= len(b) {
+		return false
+	}
+	for t := range a {
+		if !b[t] {
+			return false
+		}
+	}
+	return true
+}
+
+// actionSubset returns true if everything b does is also done by a.
+func actionSubset(b, a *gmail.FilterAction) bool {
+	if b == nil {
+		return true
+	}
+	if a == nil {
+		a = &gmail.FilterAction{}
+	}
+	if len(b.Forward) > 0 && b.Forward != a.Forward {
+		return false
+	}
+	return stringsSubset(b.AddLabelIds, a.AddLabelIds) && stringsSubset(b.RemoveLabelIds, a.RemoveLabelIds)
+}
+
+// stringsSubset returns true if all of a is in b.
+func stringsSubset(a, b []string) bool {
+	in := map[string]bool{}
+	for _, s := range b {
+		in[s] = true
+	}
+	for _, s := range a {
+		if !in[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// commonLabels returns the user labels added by both actions.
+func commonLabels(a, b *gmail.FilterAction) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+
+	var common []string
+	for _, id := range sortedStrings(b.AddLabelIds) {
+		if id == "TRASH" {
+			continue
+		}
+		if stringsSubset([]string{id}, a.AddLabelIds) {
+			common = append(common, id)
+		}
+	}
+	return common
+}
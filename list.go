@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const listHelp = `List the filters in the account.`
+
+func (cmd *listCommand) Name() string      { return "list" }
+func (cmd *listCommand) Args() string      { return "" }
+func (cmd *listCommand) ShortHelp() string { return listHelp }
+func (cmd *listCommand) LongHelp() string  { return listHelp }
+func (cmd *listCommand) Hidden() bool      { return false }
+
+func (cmd *listCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.output, "output", "text", "output format: text, json or yaml")
+}
+
+type listCommand struct {
+	output string
+}
+
+func (cmd *listCommand) Run(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("list does not take any arguments")
+	}
+	switch cmd.output {
+	case "text", "json", "yaml":
+	default:
+		return fmt.Errorf("invalid output format %q, must be text, json or yaml", cmd.output)
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	filters, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	names := labelNamesByID(ctx)
+
+	// The API returns the filters in no particular order.
+	sort.SliceStable(filters, func(i, j int) bool {
+		return canonicalCriteria(filters[i].Criteria) < canonicalCriteria(filters[j].Criteria)
+	})
+
+	switch cmd.output {
+	case "json":
+		return writeFiltersJSON(os.Stdout, filters, names)
+	case "yaml":
+		return writeFiltersYAML(os.Stdout, filters, names)
+	}
+	return printFilterTable(os.Stdout, filters, names)
+}
+
+// printFilterTable writes a table of the filters with their criteria, the
+// actions they take, named after the filter file settings, and the labels
+// they add or remove.
+func printFilterTable(w io.Writer, filters []gmail.Filter, names labelMap) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCRITERIA\tACTIONS\tLABELS")
+	for _, f := range filters {
+		var criteria []string
+		for _, fld := range filterFields(gmail.Filter{Criteria: f.Criteria}, names) {
+			criteria = append(criteria, fmt.Sprintf("%s=%s", fld.name, fld.value))
+		}
+		actions, labels := filterActions(f.Action, names)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", orDash(f.Id), orDash(strings.Join(criteria, " ")), orDash(strings.Join(actions, ", ")), orDash(strings.Join(labels, ", ")))
+	}
+	return tw.Flush()
+}
+
+// filterActions returns the actions of the filter named after the filter
+// file settings and the names of the labels it adds, and removes prefixed
+// with a "-".
+func filterActions(a *gmail.FilterAction, names labelMap) ([]string, []string) {
+	if a == nil {
+		return nil, nil
+	}
+
+	var actions, labels []string
+	for _, id := range a.RemoveLabelIds {
+		switch id {
+		case "INBOX":
+			actions = append(actions, "archive")
+		case "UNREAD":
+			actions = append(actions, "read")
+		case "IMPORTANT":
+			actions = append(actions, "neverImportant")
+		case "SPAM":
+			actions = append(actions, "neverSpam")
+		default:
+			labels = append(labels, "-"+labelNames([]string{id}, names)[0])
+		}
+	}
+	for _, id := range a.AddLabelIds {
+		switch id {
+		case "TRASH":
+			actions = append(actions, "delete")
+		case "STARRED":
+			actions = append(actions, "star")
+		case "IMPORTANT":
+			actions = append(actions, "important")
+		default:
+			labels = append(labels, labelNames([]string{id}, names)[0])
+		}
+	}
+	if len(a.Forward) > 0 {
+		actions = append(actions, "forwardTo="+a.Forward)
+	}
+	sort.Strings(labels)
+
+	return actions, labels
+}
+
+// writeFiltersJSON writes the filters as a JSON array, with label IDs
+// replaced by their names.
+func writeFiltersJSON(w io.Writer, filters []gmail.Filter, names labelMap) error {
+	list := []jsonFilter{}
+	for _, f := range filters {
+		list = append(list, toJSONFilter(f, names))
+	}
+
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding filters failed: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// writeFiltersYAML writes the filters as a YAML sequence with the same
+// fields as the JSON output. Strings are written double quoted, which YAML
+// reads the same as JSON does.
+func writeFiltersYAML(w io.Writer, filters []gmail.Filter, names labelMap) error {
+	if len(filters) < 1 {
+		_, err := fmt.Fprintln(w, "[]")
+		return err
+	}
+
+	for _, f := range filters {
+		jf := toJSONFilter(f, names)
+
+		// The first field of an item starts the item.
+		start := "- "
+		field := func(indent, name, value string) {
+			fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("%s%s%s: %s", start, indent, name, value), " "))
+			start = "  "
+		}
+		list := func(name string, values []string) {
+			if len(values) < 1 {
+				return
+			}
+			field("", name, "")
+			for _, v := range values {
+				fmt.Fprintf(w, "    - %s\n", strconv.Quote(v))
+			}
+		}
+
+		if len(jf.ID) > 0 {
+			field("", "id", strconv.Quote(jf.ID))
+		}
+		field("", "fingerprint", strconv.Quote(jf.Fingerprint))
+		if c := jf.Criteria; c != nil {
+			field("", "criteria", "")
+			for _, kv := range [][2]string{
+				{"from", c.From},
+				{"to", c.To},
+				{"subject", c.Subject},
+				{"query", c.Query},
+				{"negatedQuery", c.NegatedQuery},
+				{"sizeComparison", c.SizeComparison},
+			} {
+				if len(kv[1]) > 0 {
+					field("  ", kv[0], strconv.Quote(kv[1]))
+				}
+			}
+			if c.HasAttachment {
+				field("  ", "hasAttachment", "true")
+			}
+			if c.ExcludeChats {
+				field("  ", "excludeChats", "true")
+			}
+			if c.Size > 0 {
+				field("  ", "size", strconv.FormatInt(c.Size, 10))
+			}
+		}
+		list("addLabels", jf.AddLabels)
+		list("removeLabels", jf.RemoveLabels)
+		if len(jf.Forward) > 0 {
+			field("", "forward", strconv.Quote(jf.Forward))
+		}
+	}
+
+	return nil
+}
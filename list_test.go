@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestListOutput(t *testing.T) {
+	filters := []gmail.Filter{
+		{
+			Id:       "a",
+			Criteria: &gmail.FilterCriteria{From: "a@example.com", Query: "list:dev"},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{"Label_1", "STARRED"}, RemoveLabelIds: []string{"INBOX"}},
+		},
+		{
+			Id:       "b",
+			Criteria: &gmail.FilterCriteria{Size: 1000, SizeComparison: "larger"},
+			Action:   &gmail.FilterAction{Forward: "b@example.com"},
+		},
+	}
+	names := labelMap{"Label_1": "dev"}
+
+	var buf bytes.Buffer
+	if err := printFilterTable(&buf, filters, names); err != nil {
+		t.Fatal(err)
+	}
+	expected := `ID  CRITERIA                               ACTIONS                  LABELS
+a   query="list:dev" from="a@example.com"  archive, star            dev
+b   size="larger 1000"                     forwardTo=b@example.com  -
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	buf.Reset()
+	if err := writeFiltersYAML(&buf, filters[:1], names); err != nil {
+		t.Fatal(err)
+	}
+	expected = `- id: "a"
+  fingerprint: "` + fingerprint(filters[0]) + `"
+  criteria:
+    from: "a@example.com"
+    query: "list:dev"
+  addLabels:
+    - "STARRED"
+    - "dev"
+  removeLabels:
+    - "INBOX"
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
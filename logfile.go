@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// logFileBackups is the number of rotated log files kept around.
+const logFileBackups = 5
+
+// fileLog writes the log to the file passed with --log-file, if one was.
+var fileLog *logrus.Logger
+
+// openLogFile starts writing the log to the file, along with a record of
+// every filter created or deleted. The file is rotated once it grows past
+// maxSize bytes.
+func openLogFile(path string, maxSize int64) error {
+	if maxSize <= 0 {
+		return fmt.Errorf("invalid --log-max-size %d, must be positive", maxSize)
+	}
+
+	w, err := newRotatingFile(path, maxSize, logFileBackups)
+	if err != nil {
+		return err
+	}
+
+	fileLog = logrus.New()
+	fileLog.Out = w
+	fileLog.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	if logFormat == "json" {
+		fileLog.Formatter = &logrus.JSONFormatter{}
+	}
+	fileLog.Level = logrus.InfoLevel
+	if logrus.GetLevel() == logrus.DebugLevel {
+		fileLog.Level = logrus.DebugLevel
+	}
+
+	logrus.AddHook(fileHook{})
+	return nil
+}
+
+// fileHook copies the entries of the standard logger to the log file.
+type fileHook struct{}
+
+func (h fileHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h fileHook) Fire(e *logrus.Entry) error {
+	entry := fileLog.WithFields(e.Data).WithTime(e.Time)
+	switch e.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		entry.Error(e.Message)
+	case logrus.WarnLevel:
+		entry.Warn(e.Message)
+	case logrus.InfoLevel:
+		entry.Info(e.Message)
+	default:
+		entry.Debug(e.Message)
+	}
+	return nil
+}
+
+// auditFilter records a change to a filter in the log file, if there is one.
+func auditFilter(msg string, f gmail.Filter) {
+	if fileLog == nil {
+		return
+	}
+
+	criteria, _ := json.Marshal(f.Criteria)
+	action, _ := json.Marshal(f.Action)
+	fileLog.WithFields(logrus.Fields{
+		"id":          f.Id,
+		"fingerprint": fingerprint(f),
+		"criteria":    string(criteria),
+		"action":      string(action),
+	}).Info(msg)
+}
+
+// rotatingFile is a file that is rotated once it grows past its maximum
+// size, keeping the given number of old files named after it with a .1, .2,
+// and so on suffix, the lowest being the most recent.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+// newRotatingFile opens the file for appending.
+func newRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening log file %s failed: %v", r.path, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening log file %s failed: %v", r.path, err)
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file out of the way, dropping the oldest one, and starts
+// a new one.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	for i := r.backups - 1; i > 0; i-- {
+		old := fmt.Sprintf("%s.%d", r.path, i)
+		if _, err := os.Stat(old); err == nil {
+			if err := os.Rename(old, fmt.Sprintf("%s.%d", r.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if r.backups > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
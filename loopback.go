@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// authResult is what the OAuth redirect brought back to the loopback server.
+type authResult struct {
+	code string
+	err  error
+}
+
+// getTokenFromWeb runs the OAuth flow with a redirect to a temporary
+// HTTP server on the loopback interface, so the authorization code is
+// captured without having to copy it from the browser.
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listening for the authorization redirect failed: %v", err)
+	}
+	defer l.Close()
+
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+
+	// The redirect has to be the same when exchanging the code, so work on a
+	// copy of the config.
+	c := *config
+	c.RedirectURL = fmt.Sprintf("http://%s/", l.Addr())
+
+	results := make(chan authResult, 1)
+	srv := &http.Server{Handler: loopbackHandler(state, results)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+	if len(account) > 0 {
+		// Have Google pick the account to authorize.
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", account))
+	}
+	authURL := c.AuthCodeURL(state, opts...)
+	fmt.Printf("Opening the following link in your browser to authorize gmailfilters, "+
+		"open it yourself if it does not open:\n%v\n", authURL)
+	if err := openBrowser(authURL); err != nil {
+		logrus.Debugf("Opening the browser failed: %v", err)
+	}
+
+	var r authResult
+	select {
+	case r = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	tok, err := c.Exchange(ctx, r.code)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+	}
+
+	return tok, nil
+}
+
+// loopbackHandler handles the OAuth redirect, sending the authorization code
+// or the error to results once. Requests with another state are refused, as
+// they did not come from our authorization request.
+func loopbackHandler(state string, results chan<- authResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "The state does not match the authorization request.", http.StatusBadRequest)
+			return
+		}
+
+		var result authResult
+		switch {
+		case len(q.Get("error")) > 0:
+			result.err = fmt.Errorf("authorization failed: %s", q.Get("error"))
+			fmt.Fprintln(w, "Authorization failed, you can close this window and try again.")
+		case len(q.Get("code")) < 1:
+			http.Error(w, "The redirect has no authorization code.", http.StatusBadRequest)
+			return
+		default:
+			result.code = q.Get("code")
+			fmt.Fprintln(w, "Authorized gmailfilters, you can close this window.")
+		}
+
+		select {
+		case results <- result:
+		default:
+			// The flow already got its result.
+		}
+	})
+}
+
+// randomState returns a random state for the authorization request, so the
+// redirect can be told apart from requests forged by other pages.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating the authorization state failed: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// openBrowser opens the URL in the default browser.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoopbackHandler(t *testing.T) {
+	results := make(chan authResult, 1)
+	srv := httptest.NewServer(loopbackHandler("abc", results))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"?state=xyz&code=forged", http.StatusBadRequest},
+		{"?state=abc", http.StatusBadRequest},
+		{"?state=abc&code=4%2F0Ab", http.StatusOK},
+		// Only the first result is kept.
+		{"?state=abc&code=other", http.StatusOK},
+	} {
+		resp, err := http.Get(srv.URL + "/" + tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.query, tc.status, resp.StatusCode)
+		}
+	}
+
+	r := <-results
+	if r.err != nil || r.code != "4/0Ab" {
+		t.Fatalf("expected the code 4/0Ab, got %q (%v)", r.code, r.err)
+	}
+
+	results = make(chan authResult, 1)
+	denied := httptest.NewServer(loopbackHandler("abc", results))
+	defer denied.Close()
+	resp, err := http.Get(denied.URL + "/?state=abc&error=access_denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if r := <-results; r.err == nil || r.err.Error() != "authorization failed: access_denied" {
+		t.Fatalf("expected the access to be denied, got %v", r.err)
+	}
+}
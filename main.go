@@ -6,32 +6,70 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/genuinetools/pkg/cli"
 	"github.com/jessfraz/gmailfilters/version"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 )
 
-const (
-	gmailUser = "me"
-)
+// gmailUser is the user the Gmail API calls are for, the authorized user
+// unless --account is passed.
+var gmailUser = "me"
 
 var (
 	credsFile string
 
-	tokenFile string
+	tokenFile   string
+	tokenStore  string
+	readOnly    bool
+	account     string
+	deviceAuth  bool
+	impersonate string
+	useADC      bool
+
+	stateFile string
+	backupDir string
 
-	api *gmail.Service
+	api       *gmail.Service
+	rateLimit float64
 
 	debug bool
 
-	export bool
+	mergeExport   bool
+	combineExport bool
+	verifyExport  bool
+	exportFormat  string
+
+	expandEnvVars bool
+
+	dryRun          bool
+	prune           bool
+	dedupe          bool
+	overwrite       bool
+	only            string
+	syncGroup       string
+	assumeYes       bool
+	continueOnError bool
+	colorMode       string
+	quiet           bool
+	logFormat       string
+	logLevel        string
+	trace           bool
+	logFile         string
+	logMaxSize      int64
+	resume          bool
+
+	renderTemplates bool
+	valuesFile      string
+	setValues       setFlag
 )
 
 func main() {
@@ -43,116 +81,380 @@ func main() {
 	p.GitCommit = version.GITCOMMIT
 	p.Version = version.VERSION
 
+	// Setup the commands.
+	completion := &completionCommand{}
+	p.Commands = []cli.Command{
+		&applyCommand{},
+		&applyAllCommand{},
+		&authCommand{},
+		&browseCommand{},
+		&canonicalizeCommand{},
+		&checkCommand{},
+		&cloneCommand{},
+		completion,
+		&deleteCommand{},
+		&diffCommand{},
+		&docsCommand{},
+		&doctorCommand{},
+		&editCommand{},
+		&explainCommand{},
+		&exportCommand{},
+		&fmtCommand{},
+		&getCommand{},
+		&graphCommand{},
+		&initCommand{},
+		&labelsCommand{},
+		&listCommand{},
+		&migrateCommand{},
+		&newCommand{},
+		&orgApplyCommand{},
+		&restoreCommand{},
+		&rmCommand{},
+		&schemaCommand{},
+		&searchCommand{},
+		&statsCommand{},
+		&undoCommand{},
+		&validateCommand{},
+		&labelsCompletionCommand{},
+	}
+	for i, c := range p.Commands {
+		p.Commands[i] = interruptible{c}
+	}
+
 	// Setup the global flags.
 	p.FlagSet = flag.NewFlagSet("gmailfilters", flag.ExitOnError)
 	p.FlagSet.BoolVar(&debug, "d", false, "enable debug logging")
 	p.FlagSet.BoolVar(&debug, "debug", false, "enable debug logging")
+	p.FlagSet.StringVar(&logLevel, "log-level", "info", "log level: debug, info, warn or error")
+
+	p.FlagSet.StringVar(&configDir, "config-dir", defaultConfigDir(), "directory the config file, the token, the state and the backups are kept in")
+	p.FlagSet.StringVar(&configFile, "config", configDirFile("config"), "config file with default settings")
+	p.FlagSet.StringVar(&profile, "profile", "", "profile of the config file to use, with its own credentials, token and filter files")
+
+	p.FlagSet.BoolVar(&quiet, "q", false, "only print warnings, errors and the output of the command")
+	p.FlagSet.BoolVar(&quiet, "quiet", false, "only print warnings, errors and the output of the command")
+
+	p.FlagSet.BoolVar(&trace, "trace", false, "log every Gmail API request with its payload, response status and latency")
+
+	p.FlagSet.StringVar(&logFormat, "log-format", "text", "format of the log messages: text or json")
+
+	p.FlagSet.StringVar(&logFile, "log-file", "", "also write the log and every filter created or deleted to this file")
+	p.FlagSet.Int64Var(&logMaxSize, "log-max-size", 10, "size in megabytes the log file is rotated at")
+
+	p.FlagSet.StringVar(&colorMode, "color", "auto", "when to color diffs: auto, always or never")
+
+	p.FlagSet.BoolVar(&assumeYes, "y", false, "do not ask for confirmation before deleting filters")
+	p.FlagSet.BoolVar(&assumeYes, "yes", false, "do not ask for confirmation before deleting filters")
+	p.FlagSet.BoolVar(&assumeYes, "force", false, "do not ask for confirmation before deleting filters")
 
-	p.FlagSet.BoolVar(&export, "e", false, "export existing filters")
-	p.FlagSet.BoolVar(&export, "export", false, "export existing filters")
+	p.FlagSet.StringVar(&verifyKey, "verify-key", "", "minisign or signify public key, or its file, the filter files must be signed with")
+
+	p.FlagSet.StringVar(&ageIdentity, "age-identity", "", "age identity file to decrypt filter files encrypted with age")
+
+	p.FlagSet.BoolVar(&expandEnvVars, "expand-env", false, "expand ${ENV_VAR} references in queries and forwarding addresses")
+
+	p.FlagSet.BoolVar(&renderTemplates, "template", false, "render the filter file as a Go template")
+	p.FlagSet.StringVar(&valuesFile, "values", "", "TOML file with values for the filter file template")
+	p.FlagSet.Var(&setValues, "set", "set a template value as key=val (can be repeated)")
 
 	p.FlagSet.StringVar(&credsFile, "creds-file", os.Getenv("GMAIL_CREDENTIAL_FILE"), "Gmail credential file (or env var GMAIL_CREDENTIAL_FILE)")
 	p.FlagSet.StringVar(&credsFile, "f", os.Getenv("GMAIL_CREDENTIAL_FILE"), "Gmail credential file (or env var GMAIL_CREDENTIAL_FILE)")
 
-	p.FlagSet.StringVar(&tokenFile, "token-file", filepath.Join(os.TempDir(), "token.json"), "Gmail oauth token file")
-	p.FlagSet.StringVar(&tokenFile, "t", filepath.Join(os.TempDir(), "token.json"), "Gmail oauth token file")
+	p.FlagSet.StringVar(&tokenFile, "token-file", configDirFile("token-file"), "Gmail oauth token file")
+	p.FlagSet.StringVar(&tokenFile, "t", configDirFile("token-file"), "Gmail oauth token file")
+
+	p.FlagSet.StringVar(&tokenStore, "token-store", "auto", "where to keep the token: keyring, file, encrypted for a file encrypted with a passphrase, or auto for the keyring when there is one")
+
+	p.FlagSet.StringVar(&tokenKeyFile, "token-key-file", "", "file with the key encrypting the token, instead of a passphrase")
+
+	p.FlagSet.BoolVar(&readOnly, "read-only", false, "only ask for read access, with a token of its own, and refuse to change anything")
+
+	p.FlagSet.Float64Var(&rateLimit, "rate-limit", 0, "most requests a second to make to the Gmail API, 0 for no limit")
+
+	p.FlagSet.StringVar(&account, "account", "", "Gmail address of the account to manage, keeping a token for each account")
+
+	p.FlagSet.BoolVar(&deviceAuth, "device-auth", false, "authorize by entering a code on another device, for machines without a browser")
+
+	p.FlagSet.StringVar(&impersonate, "impersonate", "", "user to manage the filters of, when the credentials are a service account key with domain-wide delegation")
+
+	p.FlagSet.BoolVar(&useADC, "adc", false, "use the Google application default credentials instead of the credential file")
+
+	p.FlagSet.StringVar(&stateFile, "state-file", configDirFile("state-file"), "file recording the filters managed by gmailfilters")
+
+	p.FlagSet.StringVar(&backupDir, "backup-dir", configDirFile("backup-dir"), "directory, or s3:// or gs:// prefix, to write snapshots of the account to before deleting filters")
+
+	completion.commands = p.Commands
+	completion.global = p.FlagSet
+
+	// The names of all the flags, to tell settings for the flags of other
+	// commands from unknown ones in the config file.
+	knownFlags := map[string]bool{}
+	p.FlagSet.VisitAll(func(f *flag.Flag) {
+		knownFlags[canonicalFlag(f.Name)] = true
+	})
+	for _, c := range p.Commands {
+		fs := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+		c.Register(fs)
+		fs.VisitAll(func(f *flag.Flag) {
+			knownFlags[f.Name] = true
+		})
+	}
 
 	// Set the before function.
 	p.Before = func(ctx context.Context) error {
-		// Set the log level.
-		if debug {
-			logrus.SetLevel(logrus.DebugLevel)
+		// Fill in the flags not passed from the environment, the config
+		// directory and then the config file.
+		if err := loadEnv(p.FlagSet); err != nil {
+			return err
 		}
-
-		if len(credsFile) < 1 {
-			return errors.New("the Gmail credential file cannot be empty")
+		if err := applyConfigDir(p.FlagSet); err != nil {
+			return err
 		}
-
-		// Make sure the file exists.
-		if _, err := os.Stat(credsFile); os.IsNotExist(err) {
-			return fmt.Errorf("credential file %s does not exist", credsFile)
+		if err := loadConfig(p.FlagSet, knownFlags); err != nil {
+			return err
 		}
+		if err := applyAccount(p.FlagSet); err != nil {
+			return err
+		}
+		applyReadOnly(p.FlagSet)
 
-		// Read the credentials file.
-		b, err := ioutil.ReadFile(credsFile)
+		// Set the log level.
+		level, err := logrus.ParseLevel(logLevel)
 		if err != nil {
-			return fmt.Errorf("reading client secret file %s failed: %v", credsFile, err)
+			return fmt.Errorf("invalid --log-level %q, must be debug, info, warn or error", logLevel)
+		}
+		switch {
+		case debug:
+			level = logrus.DebugLevel
+		case quiet && level > logrus.WarnLevel:
+			level = logrus.WarnLevel
 		}
+		// The trace is logged at info level.
+		if trace && level < logrus.InfoLevel {
+			level = logrus.InfoLevel
+		}
+		logrus.SetLevel(level)
 
-		// If modifying these scopes, delete your previously saved token.json.
-		config, err := google.ConfigFromJSON(b,
-			// Manage labels.
-			gmail.GmailLabelsScope,
-			// Read, modify, and manage your settings.
-			gmail.GmailSettingsBasicScope)
-		if err != nil {
-			return fmt.Errorf("parsing client secret file to config failed: %v", err)
+		switch logFormat {
+		case "text":
+		case "json":
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		default:
+			return fmt.Errorf("invalid --log-format %q, must be text or json", logFormat)
+		}
+		switch tokenStore {
+		case "auto", "keyring", "file", "encrypted":
+		default:
+			return fmt.Errorf("invalid --token-store %q, must be auto, keyring, file or encrypted", tokenStore)
+		}
+		if len(logFile) > 0 {
+			if err := openLogFile(logFile, logMaxSize*1024*1024); err != nil {
+				return err
+			}
 		}
 
-		// Get the client from the config.
-		client, err := getClient(ctx, tokenFile, config)
-		if err != nil {
-			return fmt.Errorf("creating client failed: %v", err)
+		switch colorMode {
+		case "auto", "always", "never":
+		default:
+			return fmt.Errorf("invalid --color %q, must be auto, always or never", colorMode)
+		}
+		if rateLimit < 0 {
+			return fmt.Errorf("invalid --rate-limit %v, must not be negative", rateLimit)
 		}
 
-		// Create the service for the Gmail client.
-		api, err = gmail.New(client)
-		if err != nil {
-			return fmt.Errorf("creating Gmail client failed: %v", err)
+		// The other filters are not in the file as far as we know, so
+		// they must not be pruned.
+		if len(only) > 0 && prune {
+			logrus.Warn("Not pruning since only some of the filters are synced")
+			prune = false
 		}
 
 		return nil
 	}
 
-	p.Action = func(ctx context.Context, args []string) error {
-		if len(args) < 1 {
-			return errors.New("must pass a path to a gmail filter configuration file")
-		}
+	// Run our program.
+	p.Run()
+}
 
-		// On ^C, or SIGTERM handle exit.
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		signal.Notify(c, syscall.SIGTERM)
-		go func() {
-			for sig := range c {
-				logrus.Infof("Received %s, exiting.", sig.String())
-				os.Exit(0)
-			}
-		}()
+// interruptible wraps a command so ^C, or SIGTERM, cancels its context and
+// it can stop cleanly, without leaving the account in an unknown state. A
+// second ^C exits right away. It also exits with the code for the error the
+// command failed with.
+type interruptible struct {
+	cli.Command
+}
 
-		if export {
-			return exportExistingFilters(args[0])
-		}
+func (c interruptible) Run(ctx context.Context, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		sig := <-sigs
+		logrus.Warnf("Received %s, stopping, press ^C again to exit right away", sig.String())
+		cancel()
+		<-sigs
+		os.Exit(1)
+	}()
 
-		labels, err := getLabelMap()
+	if err := c.Command.Run(ctx, args); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(exitCode(err))
+	}
+	return nil
+}
+
+// registerSelectFlags adds the flags picking the filters of the files to
+// work on.
+func registerSelectFlags(fs *flag.FlagSet) {
+	fs.StringVar(&only, "only", "", "only sync the filters with this label, in this group or with a query containing this text")
+
+	fs.StringVar(&syncGroup, "group", "", "only sync the filters in this group or file, pruning only filters previously synced from it")
+}
+
+// registerSyncFlags adds the flags deciding which changes a sync makes.
+func registerSyncFlags(fs *flag.FlagSet) {
+	registerSelectFlags(fs)
+
+	fs.BoolVar(&prune, "prune", false, "delete filters in the account that are not in the file")
+
+	fs.BoolVar(&dedupe, "dedupe", false, "delete filters in the account that are exact copies of another filter")
+
+	fs.BoolVar(&overwrite, "overwrite", false, "replace filters that were changed in the account since the last sync")
+}
+
+// connect creates the Gmail client from the credentials, for the commands
+// that talk to the API.
+func connect(ctx context.Context) error {
+	if useADC {
+		ts, _, _, err := adcTokenSource(ctx)
 		if err != nil {
-			return err
+			return withExitCode(exitAuth, err)
 		}
+		return newService(oauth2.NewClient(ctx, ts))
+	}
+
+	creds, err := readCredentials(ctx)
+	if err != nil {
+		return withExitCode(exitAuth, err)
+	}
 
-		fmt.Printf("Decoding filters from file %s\n", args[0])
-		filters, err := decodeFile(args[0])
+	// Service accounts get their own tokens, there is nothing to authorize.
+	if isServiceAccount(creds) {
+		config, err := serviceAccountConfig(creds)
 		if err != nil {
-			return err
+			return withExitCode(exitAuth, err)
 		}
+		return newService(config.Client(ctx))
+	}
 
-		// Delete our existing filters.
-		if err := deleteExistingFilters(); err != nil {
-			return err
-		}
+	config, err := oauthConfig(ctx)
+	if err != nil {
+		return withExitCode(exitAuth, err)
+	}
 
-		// Convert our filters into gmail filters and add them.
-		fmt.Printf("Updating %d filters, this might take a bit...\n", len(filters))
-		for _, f := range filters {
-			if err := f.addFilter(&labels); err != nil {
-				return err
-			}
+	// Get the client from the config.
+	client, err := getClient(ctx, config)
+	if err != nil {
+		return withExitCode(exitAuth, fmt.Errorf("creating client failed: %v", err))
+	}
+
+	return newService(client)
+}
+
+// newService creates the Gmail client, counting the API calls it makes.
+func newService(client *http.Client) error {
+	if t, ok := client.Transport.(*oauth2.Transport); ok {
+		apiTokens = t.Source
+	}
+	client.Transport = &countingTransport{base: client.Transport}
+	if rateLimit > 0 {
+		client.Transport = &rateLimitTransport{base: client.Transport, interval: time.Duration(float64(time.Second) / rateLimit)}
+	}
+	if readOnly {
+		client.Transport = &readOnlyTransport{base: client.Transport}
+	}
+	if trace {
+		client.Transport = &tracingTransport{base: client.Transport}
+	}
+
+	// Create the service for the Gmail client.
+	var err error
+	api, err = gmail.New(client)
+	if err != nil {
+		return fmt.Errorf("creating Gmail client failed: %v", err)
+	}
+
+	return nil
+}
+
+// gmailScopes are the scopes gmailfilters asks for. If modifying these
+// scopes, delete your previously saved token.json.
+var gmailScopes = []string{
+	// Manage labels.
+	gmail.GmailLabelsScope,
+	// Read, modify, and manage your settings.
+	gmail.GmailSettingsBasicScope,
+}
+
+// readOnlyScopes are the scopes asked for with --read-only, which allow
+// reading the filters and labels but not changing them.
+var readOnlyScopes = []string{
+	gmail.GmailReadonlyScope,
+}
+
+// oauthScopes returns the scopes to ask for.
+func oauthScopes() []string {
+	if readOnly {
+		return readOnlyScopes
+	}
+	return gmailScopes
+}
+
+// readCredentials reads the credentials file.
+func readCredentials(ctx context.Context) ([]byte, error) {
+	if b, ok, err := credentialsFromEnv(); ok {
+		return b, err
+	}
+	if isSecretRef(credsFile) {
+		v, err := fetchSecret(ctx, credsFile)
+		if err != nil {
+			return nil, err
 		}
+		return parseCredentials(credsFile, v)
+	}
 
-		fmt.Printf("Successfully updated %d filters\n", len(filters))
+	if len(credsFile) < 1 {
+		return nil, errors.New("the Gmail credential file cannot be empty")
+	}
 
-		return nil
+	// Make sure the file exists.
+	if _, err := os.Stat(credsFile); os.IsNotExist(err) {
+		return nil, fmt.Errorf("credential file %s does not exist", credsFile)
 	}
 
-	// Run our program.
-	p.Run()
+	// Read the credentials file.
+	b, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client secret file %s failed: %v", credsFile, err)
+	}
+
+	return b, nil
+}
+
+// oauthConfig reads the OAuth client configuration from the credentials file.
+func oauthConfig(ctx context.Context) (*oauth2.Config, error) {
+	b, err := readCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := google.ConfigFromJSON(b, oauthScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing client secret file to config failed: %v", err)
+	}
+
+	return config, nil
 }
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// statementKind defines the kind of a top-level statement in a TOML file.
+type statementKind int
+
+const (
+	blankStatement statementKind = iota
+	commentStatement
+	headerStatement
+	keyValueStatement
+)
+
+// statement is a single, possibly multi-line, statement in a TOML file.
+type statement struct {
+	kind statementKind
+	// key is the bare key for key/value statements and the table name for
+	// headers.
+	key string
+	// text is the raw text of the statement, including the trailing newline.
+	text string
+}
+
+// filterBlock is the text of a single [[filter]] entry along with the
+// comments directly preceding it.
+type filterBlock struct {
+	statements []statement
+	filter     filter
+}
+
+// mergeFiltersIntoFile merges the exported filters into the existing filter
+// file, keeping the comments, field order and formatting of the entries that
+// are still present. Entries are matched on their criteria. Entries that no longer
+// exist in the account are removed and new filters are appended to the end.
+func mergeFiltersIntoFile(exported []filter, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("reading filter file %s failed: %v", file, err)
+	}
+
+	var existing filterfile
+	if _, err := toml.Decode(string(b), &existing); err != nil {
+		return fmt.Errorf("decoding toml failed: %v", err)
+	}
+
+	statements, err := splitStatements(string(b))
+	if err != nil {
+		return fmt.Errorf("parsing filter file %s failed: %v", file, err)
+	}
+
+	preamble, blocks, err := splitFilterBlocks(statements)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	for _, s := range preamble {
+		out.WriteString(s.text)
+	}
+
+	used := make([]bool, len(blocks))
+	var added []filter
+	for _, f := range exported {
+		i := findFilterBlock(blocks, used, f, existing.Snippets)
+		if i < 0 {
+			added = append(added, f)
+			continue
+		}
+		used[i] = true
+
+		for _, s := range blocks[i].updated(f) {
+			out.WriteString(s.text)
+		}
+	}
+
+	// Append the filters we have never seen before.
+	if len(added) > 0 {
+		if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n\n")) {
+			out.WriteString("\n")
+		}
+		for i, f := range added {
+			if i > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString(newFilterEntry(f))
+		}
+	}
+
+	if err := ioutil.WriteFile(file, out.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+
+	infof("Merged %d filters (%d new)\n", len(exported), len(added))
+
+	return nil
+}
+
+// findFilterBlock returns the index of the first unused block with the same
+// criteria as the given filter, or -1 if there is none.
+func findFilterBlock(blocks []filterBlock, used []bool, f filter, snippets map[string]string) int {
+	// The query could have had snippets substituted back in already.
+	expanded, err := expandSnippets(f.Query, snippets)
+	if err != nil {
+		return -1
+	}
+
+	for i, b := range blocks {
+		if used[i] || !sameCriteria(b.filter, f) {
+			continue
+		}
+
+		q, err := b.filter.compiledQuery(snippets)
+		if err != nil {
+			continue
+		}
+
+		if normalizeQuery(q) == normalizeQuery(expanded) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// sameCriteria returns whether the filters match the same messages, other
+// than by their query.
+func sameCriteria(a, b filter) bool {
+	return a.From.orQuery() == b.From.orQuery() &&
+		a.To.orQuery() == b.To.orQuery() &&
+		a.ToMe == b.ToMe &&
+		a.Subject == b.Subject &&
+		a.HasAttachment == b.HasAttachment &&
+		a.Size == b.Size &&
+		a.SizeComparison == b.SizeComparison
+}
+
+// normalizeQuery collapses whitespace so queries differing only in formatting
+// compare equal.
+func normalizeQuery(q string) string {
+	return strings.Join(strings.Fields(strings.Replace(q, "\\\n", " ", -1)), " ")
+}
+
+// compiledQuery returns the query the filter sends to Gmail.
+func (f filter) compiledQuery(snippets map[string]string) (string, error) {
+	q := f.Query
+	if len(f.QueryOr) > 0 {
+		q = strings.Join(f.QueryOr, " OR ")
+	}
+
+	if f.Match != nil {
+		var err error
+		if q, err = f.Match.compile(); err != nil {
+			return "", err
+		}
+	}
+
+	return expandSnippets(q, snippets)
+}
+
+// exportedFields are the filter fields the export knows about, other than the
+// query.
+var exportedFields = []string{
+	"Archive",
+	"Read",
+	"Delete",
+	"Star",
+	"Important",
+	"NeverImportant",
+	"NeverSpam",
+	"ToMe",
+	"ArchiveUnlessToMe",
+	"ArchiveUnlessCcMe",
+	"From",
+	"To",
+	"Subject",
+	"NegatedQuery",
+	"HasAttachment",
+	"ExcludeChats",
+	"Size",
+	"SizeComparison",
+	"Label",
+	"ForwardTo",
+}
+
+// updated returns the statements of the block with the exported fields set to
+// the values of f. Keys are updated in place, keys whose value became empty
+// are removed and new keys are added after the last key of the entry.
+func (b filterBlock) updated(f filter) []statement {
+	statements := append([]statement{}, b.statements...)
+
+	have := reflect.ValueOf(b.filter)
+	want := reflect.ValueOf(f)
+	for _, field := range exportedFields {
+		hv, wv := have.FieldByName(field), want.FieldByName(field)
+		if reflect.DeepEqual(hv.Interface(), wv.Interface()) {
+			continue
+		}
+
+		// Find the key in the top-level table of the entry, which ends at
+		// the first sub-table like [filter.labelColor].
+		idx, last := -1, -1
+		for i, s := range statements {
+			if s.kind == headerStatement {
+				if last >= 0 {
+					break
+				}
+				last = i
+				continue
+			}
+			if s.kind == keyValueStatement && last >= 0 {
+				last = i
+				if strings.EqualFold(s.key, field) {
+					idx = i
+				}
+			}
+		}
+
+		empty := isEmptyValue(wv)
+		switch {
+		case idx >= 0 && empty:
+			statements = append(statements[:idx], statements[idx+1:]...)
+		case idx >= 0:
+			statements[idx].text = fmt.Sprintf("%s = %s\n", statements[idx].key, tomlValue(wv))
+		case !empty:
+			s := statement{
+				kind: keyValueStatement,
+				key:  lowerFirst(field),
+				text: fmt.Sprintf("%s = %s\n", lowerFirst(field), tomlValue(wv)),
+			}
+			statements = append(statements[:last+1], append([]statement{s}, statements[last+1:]...)...)
+		}
+	}
+
+	return statements
+}
+
+// newFilterEntry returns a [[filter]] entry for f with the keys of the fields
+// that are set, in the same format as updated writes them.
+func newFilterEntry(f filter) string {
+	var buf bytes.Buffer
+	buf.WriteString("[[filter]]\n")
+
+	v := reflect.ValueOf(f)
+	for _, field := range append([]string{"Query", "QueryOr"}, exportedFields...) {
+		fv := v.FieldByName(field)
+		if isEmptyValue(fv) {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s = %s\n", lowerFirst(field), tomlValue(fv))
+	}
+	return buf.String()
+}
+
+// isEmptyValue returns true if v is the zero value for its type.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int64:
+		return v.Int() == 0
+	}
+	return false
+}
+
+// tomlValue encodes a string, bool, integer or string list as a TOML value.
+func tomlValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		return fmt.Sprintf("%t", v.Bool())
+	case reflect.Int64:
+		return fmt.Sprintf("%d", v.Int())
+	case reflect.Slice:
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, tomlString(v.Index(i).String()))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return tomlString(v.String())
+}
+
+// tomlString encodes s as a TOML basic string.
+func tomlString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&buf, `\u%04X`, r)
+				continue
+			}
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// lowerFirst lower cases the first letter of a field name to get its key.
+func lowerFirst(s string) string {
+	if len(s) < 1 {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// splitFilterBlocks splits the statements into the preamble before the first
+// [[filter]] entry and the filter entries. Comments directly preceding an
+// entry are kept with it.
+func splitFilterBlocks(statements []statement) ([]statement, []filterBlock, error) {
+	var (
+		preamble []statement
+		blocks   []filterBlock
+		current  []statement
+	)
+
+	// attached returns the trailing comments of ss that belong to the next
+	// entry and the statements before them.
+	attached := func(ss []statement) ([]statement, []statement) {
+		i := len(ss)
+		for i > 0 && ss[i-1].kind == commentStatement {
+			i--
+		}
+		return ss[:i], ss[i:]
+	}
+
+	flush := func(ss []statement) error {
+		var ff filterfile
+		var text strings.Builder
+		for _, s := range ss {
+			text.WriteString(s.text)
+		}
+		if _, err := toml.Decode(text.String(), &ff); err != nil {
+			return fmt.Errorf("decoding filter entry failed: %v", err)
+		}
+		if len(ff.Filter) != 1 {
+			return fmt.Errorf("expected a single filter entry, got %d", len(ff.Filter))
+		}
+		blocks = append(blocks, filterBlock{statements: ss, filter: ff.Filter[0]})
+		return nil
+	}
+
+	inFilter := false
+	for _, s := range statements {
+		isHeader := s.kind == headerStatement
+		switch {
+		case isHeader && strings.EqualFold(s.key, "filter") && strings.HasPrefix(strings.TrimSpace(s.text), "[["):
+			// A new entry starts, the comments right before it belong to it.
+			var comments []statement
+			if inFilter {
+				var rest []statement
+				rest, comments = attached(current)
+				if err := flush(rest); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				preamble, comments = attached(preamble)
+			}
+			current = append([]statement{}, comments...)
+			inFilter = true
+		case isHeader && inFilter && !strings.EqualFold(s.key, "filter") && !strings.HasPrefix(strings.ToLower(s.key), "filter."):
+			// Another top-level table after the filters is not part of any
+			// filter, so keep it in the preamble.
+			if err := flush(current); err != nil {
+				return nil, nil, err
+			}
+			current = nil
+			inFilter = false
+		}
+
+		if inFilter {
+			current = append(current, s)
+		} else {
+			preamble = append(preamble, s)
+		}
+	}
+
+	if inFilter {
+		if err := flush(current); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return preamble, blocks, nil
+}
+
+// splitStatements splits the TOML text into its top-level statements. It only
+// understands enough of TOML to find where each statement ends, including
+// multi-line strings and arrays.
+func splitStatements(text string) ([]statement, error) {
+	var statements []statement
+
+	for pos := 0; pos < len(text); {
+		end := strings.IndexByte(text[pos:], '\n')
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += pos + 1
+		}
+		line := strings.TrimSpace(text[pos:end])
+
+		switch {
+		case len(line) < 1:
+			statements = append(statements, statement{kind: blankStatement, text: text[pos:end]})
+		case strings.HasPrefix(line, "#"):
+			statements = append(statements, statement{kind: commentStatement, text: text[pos:end]})
+		case strings.HasPrefix(line, "["):
+			name := strings.TrimSpace(strings.Trim(strings.SplitN(line, "#", 2)[0], " \t[]"))
+			statements = append(statements, statement{kind: headerStatement, key: name, text: text[pos:end]})
+		default:
+			eq := strings.IndexByte(text[pos:], '=')
+			if eq < 0 || pos+eq >= end {
+				return nil, fmt.Errorf("expected a key/value pair: %q", line)
+			}
+			key := strings.Trim(strings.TrimSpace(text[pos:pos+eq]), `"'`)
+
+			valueEnd, err := scanValue(text, pos+eq+1)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", key, err)
+			}
+
+			// Consume the rest of the line, including any trailing comment.
+			end = strings.IndexByte(text[valueEnd:], '\n')
+			if end < 0 {
+				end = len(text)
+			} else {
+				end += valueEnd + 1
+			}
+			statements = append(statements, statement{kind: keyValueStatement, key: key, text: text[pos:end]})
+		}
+
+		pos = end
+	}
+
+	return statements, nil
+}
+
+// scanValue returns the offset just past the TOML value starting at pos.
+func scanValue(text string, pos int) (int, error) {
+	for pos < len(text) && (text[pos] == ' ' || text[pos] == '\t') {
+		pos++
+	}
+	if pos >= len(text) {
+		return 0, fmt.Errorf("missing value")
+	}
+
+	switch {
+	case strings.HasPrefix(text[pos:], `"""`), strings.HasPrefix(text[pos:], `'''`):
+		delim := text[pos : pos+3]
+		i := pos + 3
+		for {
+			j := strings.Index(text[i:], delim)
+			if j < 0 {
+				return 0, fmt.Errorf("unterminated multi-line string")
+			}
+			i += j
+			if delim == `"""` && escaped(text, i) {
+				i++
+				continue
+			}
+			// Allow up to two extra quotes right before the closing delimiter.
+			for i+3 < len(text) && text[i+3] == delim[0] {
+				i++
+			}
+			return i + 3, nil
+		}
+	case text[pos] == '"':
+		for i := pos + 1; i < len(text) && text[i] != '\n'; i++ {
+			if text[i] == '"' && !escaped(text, i) {
+				return i + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("unterminated string")
+	case text[pos] == '\'':
+		i := strings.IndexAny(text[pos+1:], "'\n")
+		if i < 0 || text[pos+1+i] != '\'' {
+			return 0, fmt.Errorf("unterminated string")
+		}
+		return pos + i + 2, nil
+	case text[pos] == '[' || text[pos] == '{':
+		open, close := text[pos], byte(']')
+		if open == '{' {
+			close = '}'
+		}
+		depth := 0
+		for i := pos; i < len(text); {
+			switch c := text[i]; {
+			case c == '"' || c == '\'':
+				end, err := scanValue(text, i)
+				if err != nil {
+					return 0, err
+				}
+				i = end
+				continue
+			case c == '#':
+				nl := strings.IndexByte(text[i:], '\n')
+				if nl < 0 {
+					return 0, fmt.Errorf("unterminated array")
+				}
+				i += nl
+			case c == open:
+				depth++
+			case c == close:
+				depth--
+				if depth == 0 {
+					return i + 1, nil
+				}
+			}
+			i++
+		}
+		return 0, fmt.Errorf("unterminated array")
+	}
+
+	// Bare values end at whitespace, a comment or the end of the line.
+	i := strings.IndexAny(text[pos:], " \t#\n")
+	if i < 0 {
+		return len(text), nil
+	}
+	return pos + i, nil
+}
+
+// escaped returns true if the character at i is preceded by an odd number of
+// backslashes.
+func escaped(text string, i int) bool {
+	n := 0
+	for i > 0 && text[i-1] == '\\' {
+		n++
+		i--
+	}
+	return n%2 == 1
+}
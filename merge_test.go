@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeFiltersIntoFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(`[snippets]
+github = "from:notifications@github.com"
+
+# My activity on GitHub.
+[[filter]]
+query = "to:your_activity@noreply.github.com"
+archive = true # no need to see these
+read = true
+
+# Code reviews, keep the label colored.
+[[filter]]
+query = """
+@github \
+LGTM"""
+label = "github/LGTM"
+[filter.labelColor]
+background = "#16a766"
+text = "#ffffff"
+
+# Gone from the account.
+[[filter]]
+queryOr = ["to:plans@tripit.com", "to:receipts@expensify.com"]
+delete = true
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := []filter{
+		{Query: "to:your_activity@noreply.github.com", Read: true},
+		{Query: "from:notifications@github.com LGTM", Label: "github/LGTM", Archive: true},
+		{Query: "list:coreos-dev@googlegroups.com", Label: "Mailing Lists/coreos-dev"},
+	}
+	if err := mergeFiltersIntoFile(exported, file); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[snippets]
+github = "from:notifications@github.com"
+
+# My activity on GitHub.
+[[filter]]
+query = "to:your_activity@noreply.github.com"
+read = true
+
+# Code reviews, keep the label colored.
+[[filter]]
+query = """
+@github \
+LGTM"""
+label = "github/LGTM"
+archive = true
+[filter.labelColor]
+background = "#16a766"
+text = "#ffffff"
+
+[[filter]]
+query = "list:coreos-dev@googlegroups.com"
+label = "Mailing Lists/coreos-dev"
+`
+	if diff := cmp.Diff(expected, string(b)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestMergeFiltersIntoFileCriteria(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(`# Alice.
+[[filter]]
+from = "alice@example.com"
+label = "alice"
+
+# Bob.
+[[filter]]
+from = "bob@example.com"
+label = "bob"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := []filter{
+		{From: stringList{"bob@example.com"}, Label: "bob", Star: true},
+	}
+	if err := mergeFiltersIntoFile(exported, file); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# Bob.
+[[filter]]
+from = "bob@example.com"
+label = "bob"
+star = true
+`
+	if diff := cmp.Diff(expected, string(b)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestMergeFiltersIntoFileDecodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(`[[filter]]
+query = "list:golang-nuts@googlegroups.com"
+label = "Lists/golang"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := []filter{
+		{Query: "list:golang-nuts@googlegroups.com", Label: "Lists/golang"},
+		{From: stringList{"alice@example.com"}, Label: "alice", Star: true},
+		{Query: "has:attachment \"invoice\"", Size: 1000000, SizeComparison: "larger", Archive: true, Read: true},
+		{To: stringList{"team@example.com"}, ForwardTo: "me@example.com"},
+	}
+	if err := mergeFiltersIntoFile(exported, file); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged filterfile
+	if _, err := toml.Decode(string(b), &merged); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(exported, merged.Filter); len(diff) > 1 {
+		t.Fatalf("got diff: %s\nof file:\n%s", diff, b)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+const migrateHelp = `Move the filters, labels and settings of an account to another.`
+
+const migrateLongHelp = migrateHelp + `
+
+Copies the label tree, with the colors and visibility of the labels, the
+filters and the settings picked with --settings from the first account to
+the second one. Nothing in the second account is deleted: labels and
+settings are updated to match and missing filters are created. Every item
+is tried even if another failed, and the status of each is reported at the
+end. Pass --dry-run to only print the plan.
+
+The settings are imap, pop, signature (of the primary address) and
+vacation. Auto-forwarding cannot be migrated as it needs another scope.`
+
+func (cmd *migrateCommand) Name() string      { return "migrate" }
+func (cmd *migrateCommand) Args() string      { return "<from> <to>" }
+func (cmd *migrateCommand) ShortHelp() string { return migrateHelp }
+func (cmd *migrateCommand) LongHelp() string  { return migrateLongHelp }
+func (cmd *migrateCommand) Hidden() bool      { return false }
+
+func (cmd *migrateCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&dryRun, "dry-run", false, "print the plan without changing anything")
+	fs.StringVar(&cmd.settings, "settings", "imap,pop,signature,vacation", "comma separated settings to migrate, none if empty")
+
+	cmd.fs = fs
+}
+
+type migrateCommand struct {
+	fs       *flag.FlagSet
+	settings string
+}
+
+func (cmd *migrateCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("must pass the account to migrate from and the account to migrate to")
+	}
+	if flagPassed(cmd.fs, "token-file") || flagPassed(cmd.fs, "impersonate") {
+		return errors.New("cannot migrate with --token-file or --impersonate, each account needs its own")
+	}
+	var settings []string
+	for _, s := range strings.Split(cmd.settings, ",") {
+		if s = strings.TrimSpace(s); len(s) < 1 {
+			continue
+		}
+		if _, ok := accountSettings[s]; !ok {
+			return fmt.Errorf("unknown setting %q, must be one of imap, pop, signature or vacation", s)
+		}
+		settings = append(settings, s)
+	}
+
+	// Read everything from the first account.
+	if err := useAccount(cmd.fs, args[0]); err != nil {
+		return err
+	}
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	src, err := readMigrationSource(ctx, settings)
+	if err != nil {
+		return err
+	}
+
+	// Plan and make the changes in the second one.
+	if err := useAccount(cmd.fs, args[1]); err != nil {
+		return err
+	}
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	items, err := planMigration(ctx, src)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return reportMigration(os.Stdout, items, false)
+	}
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, item := range items {
+		if item.action == "unchanged" {
+			continue
+		}
+		if ctx.Err() != nil {
+			items[i].err = ctx.Err()
+		} else {
+			items[i].err = item.apply(ctx)
+		}
+		if items[i].err != nil {
+			failed++
+		}
+		items[i].done = true
+	}
+	if err := reportMigration(os.Stdout, items, true); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return withExitCode(exitPartial, fmt.Errorf("migrating %d of %d items failed", failed, len(items)))
+	}
+	return nil
+}
+
+// migrationSource is what is migrated from the first account.
+type migrationSource struct {
+	labels   []labelDefinition
+	filters  []gmail.Filter
+	names    labelMap
+	settings map[string]interface{}
+}
+
+// readMigrationSource reads the labels, filters and settings to migrate from
+// the account.
+func readMigrationSource(ctx context.Context, settings []string) (migrationSource, error) {
+	var (
+		src = migrationSource{settings: map[string]interface{}{}}
+		err error
+	)
+	if src.labels, err = exportLabels(ctx); err != nil {
+		return src, err
+	}
+	if src.names, err = getLabelMapOnID(ctx); err != nil {
+		return src, err
+	}
+	if src.filters, err = listRemoteFilters(ctx); err != nil {
+		return src, err
+	}
+	for _, name := range settings {
+		v, err := accountSettings[name].get(ctx)
+		if err != nil {
+			return src, fmt.Errorf("reading setting %s failed: %v", name, err)
+		}
+		src.settings[name] = v
+	}
+	infof("Read %d labels, %d filters and %d settings\n", len(src.labels), len(src.filters), len(src.settings))
+	return src, nil
+}
+
+// migrationItem is a label, filter or setting to migrate, with what to do to
+// it and how it went.
+type migrationItem struct {
+	kind   string
+	name   string
+	action string
+	apply  func(ctx context.Context) error
+	done   bool
+	err    error
+}
+
+// planMigration compares what is migrated with the account, returning the
+// items in the order they have to be applied: the labels first, parents
+// before their children, so the filters can use them.
+func planMigration(ctx context.Context, src migrationSource) ([]migrationItem, error) {
+	l, err := api.Users.Labels.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing labels failed: %v", err)
+	}
+	existing := map[string]*gmail.Label{}
+	labels := labelMap{}
+	for _, label := range l.Labels {
+		existing[strings.ToLower(label.Name)] = label
+		labels[strings.ToLower(label.Name)] = label.Id
+	}
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []migrationItem
+	for _, d := range src.labels {
+		name, settings := d.Name, d.settings()
+		item := migrationItem{kind: "label", name: name, action: "unchanged"}
+		label, ok := existing[strings.ToLower(name)]
+		switch {
+		case !ok:
+			item.action = "create"
+			item.apply = func(ctx context.Context) error {
+				_, err := labels.createLabelIfDoesNotExist(ctx, name, settings)
+				return err
+			}
+		case settings != nil && !labelSettingsEqual(label, settings):
+			item.action = "update"
+			id := label.Id
+			item.apply = func(ctx context.Context) error {
+				_, err := api.Users.Labels.Patch(gmailUser, id, settings).Context(ctx).Do()
+				return err
+			}
+		}
+		items = append(items, item)
+	}
+
+	have := map[string]bool{}
+	for _, f := range remote {
+		have[fingerprint(f)] = true
+	}
+	for _, f := range src.filters {
+		f := f
+		item := migrationItem{kind: "filter", name: filterName(f), action: "unchanged"}
+		if t, err := translateFilter(f, src.names, labels); err != nil || !have[fingerprint(t)] {
+			item.action = "create"
+			// The labels are known once they were created.
+			item.apply = func(ctx context.Context) error {
+				t, err := translateFilter(f, src.names, labels)
+				if err != nil {
+					return err
+				}
+				_, err = createFilter(ctx, t)
+				return err
+			}
+		}
+		items = append(items, item)
+	}
+
+	names := make([]string, 0, len(src.settings))
+	for name := range src.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s, want := accountSettings[name], src.settings[name]
+		got, err := s.get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading setting %s failed: %v", name, err)
+		}
+		item := migrationItem{kind: "setting", name: name, action: "unchanged"}
+		if !sameSetting(want, got) {
+			item.action = "update"
+			item.apply = func(ctx context.Context) error {
+				return s.set(ctx, want)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// translateFilter returns the filter with the IDs of its labels in the first
+// account replaced by the IDs of the labels with the same names in the second.
+func translateFilter(f gmail.Filter, from, to labelMap) (gmail.Filter, error) {
+	if f.Action == nil {
+		return f, nil
+	}
+	translate := func(ids []string) ([]string, error) {
+		var out []string
+		for _, id := range ids {
+			name, ok := from[id]
+			if !ok {
+				name = id
+			}
+			newID, ok := to[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("there is no label %s", name)
+			}
+			out = append(out, newID)
+		}
+		return out, nil
+	}
+
+	a := *f.Action
+	var err error
+	if a.AddLabelIds, err = translate(a.AddLabelIds); err != nil {
+		return f, err
+	}
+	if a.RemoveLabelIds, err = translate(a.RemoveLabelIds); err != nil {
+		return f, err
+	}
+	f.Id = ""
+	f.Action = &a
+	return f, nil
+}
+
+// filterName returns the criteria of the filter, to tell it apart in the
+// report.
+func filterName(f gmail.Filter) string {
+	var parts []string
+	for _, fld := range filterFields(gmail.Filter{Criteria: f.Criteria}, nil) {
+		parts = append(parts, fld.name+" = "+fld.value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// accountSetting is a setting migrate copies, read and written as a whole.
+type accountSetting struct {
+	get func(ctx context.Context) (interface{}, error)
+	set func(ctx context.Context, v interface{}) error
+}
+
+// accountSettings are the settings migrate can copy, the ones the
+// gmail.settings.basic scope lets us change.
+var accountSettings = map[string]accountSetting{
+	"imap": {
+		get: func(ctx context.Context) (interface{}, error) {
+			return api.Users.Settings.GetImap(gmailUser).Context(ctx).Do()
+		},
+		set: func(ctx context.Context, v interface{}) error {
+			_, err := api.Users.Settings.UpdateImap(gmailUser, v.(*gmail.ImapSettings)).Context(ctx).Do()
+			return err
+		},
+	},
+	"pop": {
+		get: func(ctx context.Context) (interface{}, error) {
+			return api.Users.Settings.GetPop(gmailUser).Context(ctx).Do()
+		},
+		set: func(ctx context.Context, v interface{}) error {
+			_, err := api.Users.Settings.UpdatePop(gmailUser, v.(*gmail.PopSettings)).Context(ctx).Do()
+			return err
+		},
+	},
+	"signature": {
+		get: func(ctx context.Context) (interface{}, error) {
+			s, err := primarySendAs(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return s.Signature, nil
+		},
+		set: func(ctx context.Context, v interface{}) error {
+			s, err := primarySendAs(ctx)
+			if err != nil {
+				return err
+			}
+			patch := &gmail.SendAs{Signature: v.(string), ForceSendFields: []string{"Signature"}}
+			_, err = api.Users.Settings.SendAs.Patch(gmailUser, s.SendAsEmail, patch).Context(ctx).Do()
+			return err
+		},
+	},
+	"vacation": {
+		get: func(ctx context.Context) (interface{}, error) {
+			return api.Users.Settings.GetVacation(gmailUser).Context(ctx).Do()
+		},
+		set: func(ctx context.Context, v interface{}) error {
+			_, err := api.Users.Settings.UpdateVacation(gmailUser, v.(*gmail.VacationSettings)).Context(ctx).Do()
+			return err
+		},
+	},
+}
+
+// primarySendAs returns the primary address of the account.
+func primarySendAs(ctx context.Context) (*gmail.SendAs, error) {
+	l, err := api.Users.Settings.SendAs.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range l.SendAs {
+		if s.IsPrimary {
+			return s, nil
+		}
+	}
+	return nil, errors.New("the account has no primary address")
+}
+
+// sameSetting returns true if the settings are the same, comparing them as
+// they are sent to the API.
+func sameSetting(a, b interface{}) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+// reportMigration writes the plan, or how each item went once applied, as a
+// table, followed by the errors. With --log-format json every item is logged
+// instead.
+func reportMigration(w io.Writer, items []migrationItem, applied bool) error {
+	status := func(item migrationItem) string {
+		switch {
+		case item.err != nil:
+			return "failed"
+		case item.done:
+			return "ok"
+		}
+		return "-"
+	}
+
+	if logFormat == "json" {
+		for _, item := range items {
+			fields := logrus.Fields{"kind": item.kind, "name": item.name, "action": item.action}
+			if applied {
+				fields["status"] = status(item)
+			}
+			if item.err != nil {
+				fields["error"] = item.err.Error()
+			}
+			logrus.WithFields(fields).Info("Migration item")
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if applied {
+		fmt.Fprintln(tw, "KIND\tNAME\tACTION\tSTATUS")
+	} else {
+		fmt.Fprintln(tw, "KIND\tNAME\tACTION")
+	}
+	for _, item := range items {
+		if applied {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", item.kind, item.name, item.action, status(item))
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", item.kind, item.name, item.action)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	failed := false
+	for _, item := range items {
+		if item.err != nil {
+			fmt.Fprintf(w, "\n%s %s: %v", item.kind, item.name, item.err)
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Fprintln(w)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestMigrate(t *testing.T) {
+	// A fake Gmail API for the account migrated to, which has the parent
+	// label with another color, one of the filters and the IMAP settings
+	// disabled.
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method + " " + r.URL.Path {
+		case "GET /me/labels":
+			json.NewEncoder(w).Encode(gmail.ListLabelsResponse{Labels: []*gmail.Label{
+				{Id: "INBOX", Name: "INBOX", Type: "system"},
+				{Id: "Label_9", Name: "Lists", Type: "user", Color: &gmail.LabelColor{BackgroundColor: "#ffffff", TextColor: "#000000"}},
+			}})
+		case "GET /me/settings/filters":
+			json.NewEncoder(w).Encode(gmail.ListFiltersResponse{Filter: []*gmail.Filter{
+				{Id: "1", Criteria: &gmail.FilterCriteria{From: "a@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+			}})
+		case "GET /me/settings/imap":
+			json.NewEncoder(w).Encode(gmail.ImapSettings{})
+		case "POST /me/labels":
+			json.NewEncoder(w).Encode(gmail.Label{Id: "Label_10", Name: "Lists/golang"})
+		case "PATCH /me/labels/Label_9", "PUT /me/settings/imap":
+			w.Write([]byte("{}"))
+		case "POST /me/settings/filters":
+			var f gmail.Filter
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"Label_10"}, f.Action.AddLabelIds); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+			f.Id = "2"
+			json.NewEncoder(w).Encode(f)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	// Listing the labels caches their names next to the state.
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { stateFile = old }(stateFile)
+	stateFile = filepath.Join(dir, "state.json")
+
+	src := migrationSource{
+		labels: []labelDefinition{
+			{Name: "Lists", Color: &labelColor{Background: "#000000", Text: "#ffffff"}},
+			{Name: "Lists/golang"},
+		},
+		filters: []gmail.Filter{
+			{Id: "a", Criteria: &gmail.FilterCriteria{From: "a@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+			{Id: "b", Criteria: &gmail.FilterCriteria{Query: "list:golang-nuts"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_2"}}},
+		},
+		names:    labelMap{"INBOX": "INBOX", "Label_1": "Lists", "Label_2": "Lists/golang"},
+		settings: map[string]interface{}{"imap": &gmail.ImapSettings{Enabled: true}},
+	}
+	ctx := context.Background()
+	items, err := planMigration(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := reportMigration(&buf, items, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := `KIND     NAME                        ACTION
+label    Lists                       update
+label    Lists/golang                create
+filter   from = "a@example.com"      unchanged
+filter   query = "list:golang-nuts"  create
+setting  imap                        update
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	requests = nil
+	for i, item := range items {
+		if item.apply != nil {
+			items[i].err = item.apply(ctx)
+			items[i].done = true
+		}
+	}
+	for _, item := range items {
+		if item.err != nil {
+			t.Fatalf("%s %s: %v", item.kind, item.name, item.err)
+		}
+	}
+	expectedRequests := []string{"PATCH /me/labels/Label_9", "POST /me/labels", "POST /me/settings/filters", "PUT /me/settings/imap"}
+	if diff := cmp.Diff(expectedRequests, requests); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
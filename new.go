@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+const newHelp = `Generate filter entries for common patterns.`
+
+func (cmd *newCommand) Name() string      { return "new" }
+func (cmd *newCommand) Args() string      { return "<template> [<file>]" }
+func (cmd *newCommand) ShortHelp() string { return newHelp }
+func (cmd *newCommand) LongHelp() string  { return newLongHelp() }
+func (cmd *newCommand) Hidden() bool      { return false }
+
+func (cmd *newCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.label, "label", "", "label the filters apply, each template has its own default")
+	fs.StringVar(&cmd.list, "list", "", "ID of the mailing list for the list template, like dev@googlegroups.com")
+}
+
+type newCommand struct {
+	label string
+	list  string
+}
+
+func (cmd *newCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("must pass one of the templates %s, and optionally the filter file to append to", strings.Join(scaffoldNames(), ", "))
+	}
+
+	entries, err := renderScaffold(args[0], cmd.label, cmd.list)
+	if err != nil {
+		return err
+	}
+
+	if len(args) < 2 || args[1] == stdio {
+		_, err := os.Stdout.Write(entries)
+		return err
+	}
+	return appendScaffold(args[1], entries)
+}
+
+// newLongHelp returns the help of new with the list of templates.
+func newLongHelp() string {
+	var b strings.Builder
+	b.WriteString(newHelp + `
+
+The entries are printed, or appended to the filter file if one is passed.
+The templates are:
+
+`)
+	for _, name := range scaffoldNames() {
+		fmt.Fprintf(&b, "  %-10s %s\n", name, scaffolds[name].description)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// scaffold is a template of filter entries.
+type scaffold struct {
+	description string
+	// label is the default label of the filters.
+	label string
+	text  string
+}
+
+// scaffolds are the templates of new, by name. The templates are given the
+// label and the mailing list, and a toml function quoting strings.
+var scaffolds = map[string]scaffold{
+	"github": {
+		description: "GitHub notifications, in the inbox only when they need you",
+		label:       "GitHub",
+		text: `# GitHub notifications.
+[[filter]]
+from = "notifications@github.com"
+label = {{toml .Label}}
+
+# Skip the inbox unless you are mentioned, assigned or asked for a review.
+[[filter]]
+query = "from:notifications@github.com -{cc:mention@noreply.github.com cc:assign@noreply.github.com cc:review_requested@noreply.github.com}"
+archive = true
+`,
+	},
+	"list": {
+		description: "a mailing list, in the inbox only when sent to you, needs --list",
+		text: `# The {{.List}} mailing list, in the inbox only when sent to you.
+[[filter]]
+query = {{toml (print "list:" .List)}}
+label = {{toml .Label}}
+archiveUnlessToMe = true
+`,
+	},
+	"calendar": {
+		description: "calendar invitations and the replies to them",
+		label:       "Calendar",
+		text: `# Calendar invitations and the replies to them.
+[[filter]]
+query = "has:attachment {filename:ics filename:vcs}"
+label = {{toml .Label}}
+`,
+	},
+	"receipts": {
+		description: "receipts, invoices and order confirmations, starred",
+		label:       "Receipts",
+		text: `# Receipts, invoices and order confirmations.
+[[filter]]
+query = "subject:(receipt OR invoice OR \"order confirmation\" OR \"your order\")"
+label = {{toml .Label}}
+star = true
+`,
+	},
+}
+
+// scaffoldNames returns the names of the templates in order.
+func scaffoldNames() []string {
+	names := make([]string, 0, len(scaffolds))
+	for name := range scaffolds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderScaffold renders the template named name, with the label or its
+// default, and checks the entries are valid.
+func renderScaffold(name, label, list string) ([]byte, error) {
+	s, ok := scaffolds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q, must be one of %s", name, strings.Join(scaffoldNames(), ", "))
+	}
+
+	if name == "list" {
+		if len(list) < 1 {
+			return nil, errors.New("the list template needs the ID of the mailing list passed with --list")
+		}
+		list = strings.TrimPrefix(list, "list:")
+		s.label = "Mailing Lists/" + strings.SplitN(list, "@", 2)[0]
+	}
+	if len(label) < 1 {
+		label = s.label
+	}
+	if err := validateLabelName(label); err != nil {
+		return nil, err
+	}
+
+	t, err := template.New(name).Funcs(template.FuncMap{"toml": tomlString}).Parse(s.text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, struct{ Label, List string }{label, list}); err != nil {
+		return nil, err
+	}
+
+	var ff filterfile
+	if _, err := toml.Decode(buf.String(), &ff); err != nil {
+		return nil, fmt.Errorf("the %s template is invalid: %v", name, err)
+	}
+	for _, f := range ff.Filter {
+		if _, err := f.toGmailFilters(context.Background(), &labelMap{strings.ToLower(label): label}); err != nil {
+			return nil, fmt.Errorf("the %s template is invalid: %v", name, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// appendScaffold appends the entries to the filter file, creating it if it
+// does not exist.
+func appendScaffold(file string, entries []byte) error {
+	if isRemote(file) || isObjectURL(file) {
+		return fmt.Errorf("cannot append to %s, pass the path of a file", file)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading filter file %s failed: %v", file, err)
+	}
+	if len(b) > 0 {
+		if !bytes.HasSuffix(b, []byte("\n")) {
+			b = append(b, '\n')
+		}
+		b = append(b, '\n')
+	}
+	b = append(b, entries...)
+
+	if _, err := toml.Decode(string(b), &filterfile{}); err != nil {
+		return fmt.Errorf("%s would not be valid TOML with the new entries: %v", file, err)
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		return fmt.Errorf("writing filter file %s failed: %v", file, err)
+	}
+
+	infof("Added the entries to %s, preview the changes they make with: gmailfilters diff %s\n", file, file)
+	return nil
+}
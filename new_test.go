@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderScaffold(t *testing.T) {
+	for _, name := range scaffoldNames() {
+		b, err := renderScaffold(name, `Team "A"/inbox`, "dev@googlegroups.com")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var ff filterfile
+		if _, err := toml.Decode(string(b), &ff); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(ff.Filter) < 1 || ff.Filter[0].Label != `Team "A"/inbox` {
+			t.Fatalf("%s: expected the filters to apply the label, got %+v", name, ff.Filter)
+		}
+	}
+
+	b, err := renderScaffold("list", "", "list:dev@googlegroups.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# The dev@googlegroups.com mailing list, in the inbox only when sent to you.
+[[filter]]
+query = "list:dev@googlegroups.com"
+label = "Mailing Lists/dev"
+archiveUnlessToMe = true
+`
+	if diff := cmp.Diff(expected, string(b)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	for _, tc := range []struct {
+		name, list, expected string
+	}{
+		{"list", "", "--list"},
+		{"newsletters", "", "unknown template"},
+	} {
+		if _, err := renderScaffold(tc.name, "", tc.list); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s: expected an error containing %q, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestAppendScaffold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	for _, name := range []string{"calendar", "receipts"} {
+		b, err := renderScaffold(name, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appendScaffold(file, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ff filterfile
+	if _, err := toml.DecodeFile(file, &ff); err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, f := range ff.Filter {
+		labels = append(labels, f.Label)
+	}
+	if diff := cmp.Diff([]string{"Calendar", "Receipts"}, labels); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// isObjectURL returns true if the file is an object in S3 or Google Cloud
+// Storage, as s3://bucket/key or gs://bucket/key.
+func isObjectURL(file string) bool {
+	return strings.HasPrefix(file, "s3://") || strings.HasPrefix(file, "gs://")
+}
+
+// objectURL is an object in S3 or Google Cloud Storage.
+type objectURL struct {
+	scheme string
+	bucket string
+	key    string
+}
+
+func (o objectURL) String() string {
+	return o.scheme + "://" + o.bucket + "/" + o.key
+}
+
+// parseObjectURL splits the object URL into its bucket and key.
+func parseObjectURL(file string) (objectURL, error) {
+	i := strings.Index(file, "://")
+	o := objectURL{scheme: file[:i]}
+	parts := strings.SplitN(file[i+len("://"):], "/", 2)
+	if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+		return o, fmt.Errorf("%s: must be in the form %s://bucket/key", file, o.scheme)
+	}
+	o.bucket, o.key = parts[0], parts[1]
+	return o, nil
+}
+
+// joinObjectURL returns the URL of the object named name under the prefix.
+func joinObjectURL(prefix, name string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
+
+// readObject downloads the object.
+func readObject(ctx context.Context, file string) ([]byte, error) {
+	o, err := parseObjectURL(file)
+	if err != nil {
+		return nil, err
+	}
+	req, client, err := objectRequest(ctx, "GET", o, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s failed: %v", o, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("downloading %s failed: %v", o, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s failed: %s: %s", o, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// writeObject uploads the object, replacing it if it exists.
+func writeObject(ctx context.Context, file string, b []byte) error {
+	o, err := parseObjectURL(file)
+	if err != nil {
+		return err
+	}
+	req, client, err := objectRequest(ctx, "PUT", o, b)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading %s failed: %v", o, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("uploading %s failed: %s: %s", o, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// objectRequest returns the request downloading or uploading the object, and
+// the client to send it with.
+func objectRequest(ctx context.Context, method string, o objectURL, body []byte) (*http.Request, *http.Client, error) {
+	if o.scheme == "gs" {
+		return gcsRequest(ctx, method, o, body)
+	}
+	return s3Request(ctx, method, o, body)
+}
+
+// gcsEndpoint is the Google Cloud Storage JSON API.
+var gcsEndpoint = "https://storage.googleapis.com"
+
+// gcsClient returns the client for Google Cloud Storage, with the
+// application default credentials.
+var gcsClient = func(ctx context.Context) (*http.Client, error) {
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, fmt.Errorf("finding Google Cloud credentials failed, run gcloud auth application-default login or set GOOGLE_APPLICATION_CREDENTIALS: %v", err)
+	}
+	return client, nil
+}
+
+// gcsRequest returns the request downloading or uploading the object in
+// Google Cloud Storage.
+func gcsRequest(ctx context.Context, method string, o objectURL, body []byte) (*http.Request, *http.Client, error) {
+	client, err := gcsClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u := gcsEndpoint + "/storage/v1/b/" + url.PathEscape(o.bucket) + "/o/" + url.PathEscape(o.key) + "?alt=media"
+	if method == "PUT" {
+		method = "POST"
+		u = gcsEndpoint + "/upload/storage/v1/b/" + url.PathEscape(o.bucket) + "/o?uploadType=media&name=" + url.QueryEscape(o.key)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	return req.WithContext(ctx), client, nil
+}
+
+// s3Request returns the request downloading or uploading the object in S3,
+// signed with the credentials in the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+// AWS_ENDPOINT_URL points it at an S3 compatible store instead.
+func s3Request(ctx context.Context, method string, o objectURL, body []byte) (*http.Request, *http.Client, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if len(accessKey) < 1 || len(secretKey) < 1 {
+		return nil, nil, fmt.Errorf("accessing %s needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set", o)
+	}
+	region := os.Getenv("AWS_REGION")
+	if len(region) < 1 {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if len(region) < 1 {
+		region = "us-east-1"
+	}
+
+	// Buckets are addressed by host on AWS, and by path elsewhere.
+	u := "https://" + o.bucket + ".s3." + region + ".amazonaws.com/" + s3EscapePath(o.key)
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); len(endpoint) > 0 {
+		u = strings.TrimSuffix(endpoint, "/") + "/" + o.bucket + "/" + s3EscapePath(o.key)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); len(token) > 0 {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signS3Request(req, body, accessKey, secretKey, region, time.Now().UTC())
+
+	return req.WithContext(ctx), http.DefaultClient, nil
+}
+
+// signS3Request signs the request with AWS signature version 4.
+func signS3Request(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// The host and the x-amz- headers are signed, along with the others
+	// set on the request.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath escapes the key the way S3 expects, every byte but the
+// unreserved characters and the slashes.
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// selected returns true if the filter matches the selector passed to --only.
+// A filter matches if it adds the label, or a label nested under it, is in
+// the group, or has a query containing the selector.
+func (f filter) selected(selector string) (bool, error) {
+	if strings.EqualFold(f.Label, selector) || strings.HasPrefix(strings.ToLower(f.Label), strings.ToLower(selector)+"/") {
+		return true, nil
+	}
+
+	if f.Group == selector {
+		return true, nil
+	}
+
+	q, err := f.compiledQuery(nil)
+	if err != nil {
+		return false, err
+	}
+	if len(f.From) > 0 {
+		q += " " + f.From.orQuery()
+	}
+	if len(f.To) > 0 {
+		q += " " + f.To.orQuery()
+	}
+	return strings.Contains(q, selector), nil
+}
+
+// selectFilters returns the filters matching the selector.
+func selectFilters(filters []filter, selector string) ([]filter, error) {
+	var selected []filter
+	for _, f := range filters {
+		ok, err := f.selected(selector)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, f)
+		}
+	}
+
+	if len(selected) < 1 {
+		return nil, fmt.Errorf("no filters match %q", selector)
+	}
+
+	return selected, nil
+}
+
+// suppressFilters returns the filters without the ones matching any of the
+// selectors, which match like --only. A selector matching none of the filters
+// is an error, it is most likely a typo.
+func suppressFilters(filters []filter, selectors []string) ([]filter, error) {
+	if len(selectors) < 1 {
+		return filters, nil
+	}
+
+	matched := map[string]bool{}
+	var kept []filter
+	for _, f := range filters {
+		suppressed := false
+		for _, s := range selectors {
+			ok, err := f.selected(s)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched[s] = true
+				suppressed = true
+			}
+		}
+		if !suppressed {
+			kept = append(kept, f)
+		}
+	}
+
+	for _, s := range selectors {
+		if !matched[s] {
+			return nil, fmt.Errorf("no filters to suppress match %q", s)
+		}
+	}
+
+	return kept, nil
+}
+
+// groupFilters returns the filters in the group.
+func groupFilters(filters []filter, group string) ([]filter, error) {
+	var grouped []filter
+	for _, f := range filters {
+		if f.Group == group {
+			grouped = append(grouped, f)
+		}
+	}
+
+	if len(grouped) < 1 {
+		return nil, fmt.Errorf("no filters in group %s", group)
+	}
+
+	return grouped, nil
+}
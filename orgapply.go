@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+)
+
+const orgApplyHelp = `Sync the filters of every user in a Google Workspace domain.`
+
+const orgApplyLongHelp = orgApplyHelp + `
+
+The credentials must be a service account key with domain-wide delegation
+for the Gmail scopes and for
+https://www.googleapis.com/auth/admin.directory.user.readonly, the users
+are listed with the Directory API as the admin passed with --admin. Pass
+--org-unit to only sync the users in an organizational unit and the ones
+below it. Suspended and archived users are skipped.
+
+Each user is synced with the files by running apply with --account, so it
+impersonates the user and keeps their own state, --concurrency users at a
+time. As the users cannot be asked for confirmation, pass --yes along with
+--prune or --dedupe, and --rate-limit to cap the requests of each user so
+the ones synced at the same time stay under the quota of the project. A
+summary of what was done to each user is printed at the end.
+
+Pass --overrides with a directory of files named after the users, like
+alice@example.com.toml, to sync a user with their file after the others.
+Besides adding filters, it can leave out filters of the other files with a
+top-level suppress list, matching them like --only:
+
+  suppress = ["Lists/golang", "newsletters"]`
+
+func (cmd *orgApplyCommand) Name() string      { return "org-apply" }
+func (cmd *orgApplyCommand) Args() string      { return "<file>..." }
+func (cmd *orgApplyCommand) ShortHelp() string { return orgApplyHelp }
+func (cmd *orgApplyCommand) LongHelp() string  { return orgApplyLongHelp }
+func (cmd *orgApplyCommand) Hidden() bool      { return false }
+
+func (cmd *orgApplyCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.admin, "admin", "", "admin of the domain to list the users as")
+	fs.StringVar(&cmd.orgUnit, "org-unit", "", "path of the organizational unit to sync the users of, like /Sales")
+	fs.IntVar(&cmd.concurrency, "concurrency", 10, "number of users to sync at the same time")
+	fs.StringVar(&cmd.overrides, "overrides", "", "directory of filter files named after the users, synced after the others")
+
+	registerSyncFlags(fs)
+
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes that would be made without making them")
+
+	fs.BoolVar(&continueOnError, "continue-on-error", false, "keep going when a filter fails and report all failures at the end")
+
+	fs.BoolVar(&resume, "resume", false, "resume an interrupted or partially failed sync from its checkpoint")
+
+	cmd.fs = fs
+}
+
+type orgApplyCommand struct {
+	fs          *flag.FlagSet
+	admin       string
+	orgUnit     string
+	concurrency int
+	overrides   string
+}
+
+// orgApplyFlags are the flags of org-apply that apply does not have.
+var orgApplyFlags = []string{"admin", "org-unit", "concurrency", "overrides"}
+
+// directoryUsersURL is where the users of the domain are listed, a var for
+// the tests.
+var directoryUsersURL = "https://admin.googleapis.com/admin/directory/v1/users"
+
+const directoryScope = "https://www.googleapis.com/auth/admin.directory.user.readonly"
+
+func (cmd *orgApplyCommand) Run(ctx context.Context, args []string) error {
+	files := filterFileArgs(args)
+	if len(files) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+	if len(cmd.admin) < 1 {
+		return errors.New("must pass the admin to list the users as with --admin")
+	}
+	if cmd.concurrency < 1 {
+		return errors.New("--concurrency must be at least 1")
+	}
+	overrides, err := overrideFiles(cmd.overrides)
+	if err != nil {
+		return withExitCode(exitValidation, err)
+	}
+	if flagPassed(cmd.fs, "account") || flagPassed(cmd.fs, "token-file") || flagPassed(cmd.fs, "impersonate") {
+		return errors.New("cannot org-apply with --account, --token-file or --impersonate, each user is impersonated in turn")
+	}
+
+	creds, err := readCredentials(ctx)
+	if err != nil {
+		return withExitCode(exitAuth, err)
+	}
+	if !isServiceAccount(creds) {
+		return withExitCode(exitAuth, errors.New("org-apply needs the credentials to be a service account key with domain-wide delegation"))
+	}
+	config, err := google.JWTConfigFromJSON(creds, directoryScope)
+	if err != nil {
+		return withExitCode(exitAuth, fmt.Errorf("parsing the service account key failed: %v", err))
+	}
+	config.Subject = cmd.admin
+
+	users, err := listDomainUsers(ctx, config.Client(ctx), cmd.orgUnit)
+	if err != nil {
+		return withExitCode(exitAuth, fmt.Errorf("listing the users of the domain as %s failed: %v", cmd.admin, err))
+	}
+	if len(users) < 1 {
+		infof("No users to sync\n")
+		return nil
+	}
+	infof("Syncing %d users, %d at a time\n", len(users), cmd.concurrency)
+
+	accounts := make([]manifestAccount, 0, len(users))
+	for _, u := range users {
+		a := manifestAccount{Address: u, Files: files}
+		if f, ok := overrides[strings.ToLower(u)]; ok {
+			a.Files = append(append([]string{}, files...), f)
+			delete(overrides, strings.ToLower(u))
+		}
+		accounts = append(accounts, a)
+	}
+	for u := range overrides {
+		logrus.Warnf("%s has overrides but is not a user being synced", u)
+	}
+
+	// The flags are passed on to apply, they come between the command and
+	// the files.
+	flags := withoutFlags(cmd.fs, os.Args[2:len(os.Args)-len(args)], orgApplyFlags...)
+
+	return reportAccountResults(runAccounts(ctx, accounts, flags, cmd.concurrency))
+}
+
+// listDomainUsers returns the primary addresses of the users of the domain
+// that are neither suspended nor archived, in the organizational unit if one
+// is passed.
+func listDomainUsers(ctx context.Context, client *http.Client, orgUnit string) ([]string, error) {
+	q := url.Values{}
+	q.Set("customer", "my_customer")
+	q.Set("maxResults", "500")
+	q.Set("orderBy", "email")
+	q.Set("projection", "basic")
+	if len(orgUnit) > 0 {
+		if !strings.HasPrefix(orgUnit, "/") {
+			orgUnit = "/" + orgUnit
+		}
+		q.Set("query", "orgUnitPath='"+orgUnit+"'")
+	}
+
+	var users []string
+	for {
+		req, err := http.NewRequest(http.MethodGet, directoryUsersURL+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Users []struct {
+				PrimaryEmail string `json:"primaryEmail"`
+				Suspended    bool   `json:"suspended"`
+				Archived     bool   `json:"archived"`
+			} `json:"users"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := getJSON(ctx, client, req, &resp); err != nil {
+			return nil, err
+		}
+		for _, u := range resp.Users {
+			if u.Suspended || u.Archived {
+				continue
+			}
+			users = append(users, u.PrimaryEmail)
+		}
+		if len(resp.NextPageToken) < 1 {
+			return users, nil
+		}
+		q.Set("pageToken", resp.NextPageToken)
+	}
+}
+
+// overrideFiles returns the override files in the directory by the lower
+// case address of their user, none if there is no directory.
+func overrideFiles(dir string) (map[string]string, error) {
+	overrides := map[string]string{}
+	if len(dir) < 1 {
+		return overrides, nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading the overrides failed: %v", err)
+	}
+	for _, e := range entries {
+		user := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		if e.IsDir() || !strings.Contains(user, "@") {
+			continue
+		}
+		if existing, ok := overrides[strings.ToLower(user)]; ok {
+			return nil, fmt.Errorf("%s has overrides in both %s and %s", user, existing, e.Name())
+		}
+		overrides[strings.ToLower(user)] = filepath.Join(dir, e.Name())
+	}
+	return overrides, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListDomainUsers(t *testing.T) {
+	// A fake Directory API with the users in two pages.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users" {
+			http.NotFound(w, r)
+			return
+		}
+		if q := r.URL.Query().Get("query"); q != "orgUnitPath='/Sales'" {
+			t.Errorf("got query %q", q)
+		}
+		switch r.URL.Query().Get("pageToken") {
+		case "":
+			w.Write([]byte(`{"users": [
+				{"primaryEmail": "alice@example.com"},
+				{"primaryEmail": "bob@example.com", "suspended": true}
+			], "nextPageToken": "2"}`))
+		case "2":
+			w.Write([]byte(`{"users": [
+				{"primaryEmail": "carol@example.com", "archived": true},
+				{"primaryEmail": "dave@example.com"}
+			]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(old string) { directoryUsersURL = old }(directoryUsersURL)
+	directoryUsersURL = srv.URL + "/users"
+
+	users, err := listDomainUsers(context.Background(), srv.Client(), "Sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alice@example.com", "dave@example.com"}
+	if diff := cmp.Diff(expected, users); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	directoryUsersURL = srv.URL + "/missing"
+	if _, err := listDomainUsers(context.Background(), srv.Client(), "Sales"); err == nil {
+		t.Fatal("expected an error from the Directory API")
+	}
+}
+
+func TestOverrideFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"Alice@example.com.toml", "bob@example.com.yaml", "README.md"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := overrideFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"alice@example.com": filepath.Join(dir, "Alice@example.com.toml"),
+		"bob@example.com":   filepath.Join(dir, "bob@example.com.yaml"),
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice@example.com.json"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := overrideFiles(dir); err == nil {
+		t.Fatal("expected an error for a user with two override files")
+	}
+}
+
+func TestWithoutFlags(t *testing.T) {
+	fs := flag.NewFlagSet("org-apply", flag.ContinueOnError)
+	cmd := &orgApplyCommand{}
+	fs.StringVar(&cmd.admin, "admin", "", "")
+	fs.IntVar(&cmd.concurrency, "concurrency", 4, "")
+	fs.Bool("prune", false, "")
+
+	testCases := map[string]struct {
+		args     []string
+		expected []string
+	}{
+		"none": {
+			args:     []string{"--prune", "--yes"},
+			expected: []string{"--prune", "--yes"},
+		},
+		"separate values": {
+			args:     []string{"--admin", "admin@example.com", "--prune", "-concurrency", "8"},
+			expected: []string{"--prune"},
+		},
+		"joined values": {
+			args:     []string{"--admin=admin@example.com", "--dry-run", "--concurrency=8"},
+			expected: []string{"--dry-run"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := withoutFlags(fs, tc.args, orgApplyFlags...)
+			if diff := cmp.Diff(tc.expected, got); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// jsonPlan is the machine readable form of a diff.
+type jsonPlan struct {
+	Status    string         `json:"status,omitempty"`
+	Labels    []string       `json:"labels"`
+	Create    []jsonFilter   `json:"create"`
+	Update    []jsonUpdate   `json:"update"`
+	Delete    []jsonFilter   `json:"delete"`
+	Conflicts []jsonConflict `json:"conflicts"`
+	Counts    map[string]int `json:"counts"`
+}
+
+// jsonFilter is the machine readable form of a filter, with label IDs
+// replaced by their names.
+type jsonFilter struct {
+	ID           string                `json:"id,omitempty"`
+	Fingerprint  string                `json:"fingerprint"`
+	Criteria     *gmail.FilterCriteria `json:"criteria,omitempty"`
+	AddLabels    []string              `json:"addLabels,omitempty"`
+	RemoveLabels []string              `json:"removeLabels,omitempty"`
+	Forward      string                `json:"forward,omitempty"`
+}
+
+// jsonUpdate is the machine readable form of an update.
+type jsonUpdate struct {
+	Old jsonFilter `json:"old"`
+	New jsonFilter `json:"new"`
+}
+
+// jsonConflict is the machine readable form of a conflict.
+type jsonConflict struct {
+	Old  *jsonFilter `json:"old,omitempty"`
+	New  jsonFilter  `json:"new"`
+	Both bool        `json:"both"`
+}
+
+// toJSONFilter converts the filter to its machine readable form.
+func toJSONFilter(f gmail.Filter, names labelMap) jsonFilter {
+	jf := jsonFilter{
+		ID:          f.Id,
+		Fingerprint: fingerprint(f),
+		Criteria:    f.Criteria,
+	}
+	if a := f.Action; a != nil {
+		jf.AddLabels = labelNames(a.AddLabelIds, names)
+		jf.RemoveLabels = labelNames(a.RemoveLabelIds, names)
+		jf.Forward = a.Forward
+	}
+	return jf
+}
+
+// writeDiffJSON writes the diff and the labels that would be created as
+// JSON, with the status if there is one.
+func writeDiffJSON(w io.Writer, status string, diff filterDiff, newLabels []string, names labelMap) error {
+	plan := jsonPlan{
+		Status:    status,
+		Labels:    append([]string{}, newLabels...),
+		Create:    []jsonFilter{},
+		Update:    []jsonUpdate{},
+		Delete:    []jsonFilter{},
+		Conflicts: []jsonConflict{},
+		Counts: map[string]int{
+			"labels":    len(newLabels),
+			"create":    len(diff.Create),
+			"update":    len(diff.Update),
+			"delete":    len(diff.Delete),
+			"unchanged": len(diff.Unchanged),
+			"kept":      len(diff.Kept),
+			"protected": len(diff.Protected),
+			"conflicts": len(diff.Conflicts),
+		},
+	}
+
+	for _, f := range diff.Create {
+		plan.Create = append(plan.Create, toJSONFilter(f, names))
+	}
+	for _, u := range diff.Update {
+		plan.Update = append(plan.Update, jsonUpdate{Old: toJSONFilter(u.Old, names), New: toJSONFilter(u.New, names)})
+	}
+	for _, f := range diff.Delete {
+		plan.Delete = append(plan.Delete, toJSONFilter(f, names))
+	}
+	for _, c := range diff.Conflicts {
+		jc := jsonConflict{New: toJSONFilter(c.New, names), Both: c.Both}
+		if len(c.Old.Id) > 0 {
+			old := toJSONFilter(c.Old, names)
+			jc.Old = &old
+		}
+		plan.Conflicts = append(plan.Conflicts, jc)
+	}
+
+	b, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding plan failed: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// infof writes an informational message to stdout, unless --quiet was
+// passed. With --log-format json it is logged instead. It is written to the
+// log file too, if there is one.
+func infof(format string, a ...interface{}) {
+	writeInfo(infoOut(), fmt.Sprintf(format, a...))
+}
+
+// noticef is infof for the messages of commands that may be writing their
+// result to stdout, it writes them to stderr instead.
+func noticef(format string, a ...interface{}) {
+	writeInfo(noticeOut(), fmt.Sprintf(format, a...))
+}
+
+// writeInfo writes the message to w, and to the log file if there is one.
+func writeInfo(w io.Writer, msg string) {
+	fmt.Fprint(w, msg)
+	// Logged messages already make it to the log file.
+	if fileLog != nil && (quiet || logFormat != "json") {
+		(&logWriter{logger: fileLog}).Write([]byte(msg))
+	}
+}
+
+// stdoutTaken is set when the command writes its result to stdout, so the
+// informational output goes to stderr instead.
+var stdoutTaken bool
+
+// infoOut returns where to write informational output, stdout unless
+// --quiet was passed in which case it is discarded. With --log-format json
+// every line written is logged instead.
+func infoOut() io.Writer {
+	switch {
+	case quiet:
+		return ioutil.Discard
+	case logFormat == "json":
+		return &logWriter{}
+	case stdoutTaken:
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// noticeOut returns where to write the messages of noticef, like infoOut but
+// stderr rather than stdout.
+func noticeOut() io.Writer {
+	if w := infoOut(); w != os.Stdout {
+		return w
+	}
+	return os.Stderr
+}
+
+// infoErr returns where to draw progress, stderr unless --quiet or
+// --log-format json was passed in which case it is discarded.
+func infoErr() io.Writer {
+	if quiet || logFormat == "json" {
+		return ioutil.Discard
+	}
+	return os.Stderr
+}
+
+// logWriter logs every line written to it at the info level, to the logger
+// or the standard logger if it is nil. A last line without a newline is
+// logged as well.
+type logWriter struct {
+	logger *logrus.Logger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	logger := w.logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if len(strings.TrimSpace(line)) > 0 {
+			logger.Info(line)
+		}
+	}
+	return len(p), nil
+}
+
+// promptOut returns where to write the changes the user is asked to
+// confirm. With --quiet they are only written if the user is actually asked.
+func promptOut() io.Writer {
+	if quiet && assumeYes {
+		return ioutil.Discard
+	}
+	return os.Stdout
+}
+
+// validateOutput makes sure the output format is one we know.
+func validateOutput(output string) error {
+	switch output {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid output format %q, must be text or json", output)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// queryOperators are the search operators Gmail understands.
+var queryOperators = map[string]bool{
+	"from":        true,
+	"to":          true,
+	"cc":          true,
+	"bcc":         true,
+	"subject":     true,
+	"label":       true,
+	"has":         true,
+	"list":        true,
+	"filename":    true,
+	"in":          true,
+	"is":          true,
+	"after":       true,
+	"before":      true,
+	"older":       true,
+	"newer":       true,
+	"older_than":  true,
+	"newer_than":  true,
+	"deliveredto": true,
+	"category":    true,
+	"size":        true,
+	"larger":      true,
+	"smaller":     true,
+	"rfc822msgid": true,
+}
+
+// operatorRegexp matches the operator part of an operator:value term.
+var operatorRegexp = regexp.MustCompile(`^([A-Za-z_0-9]+):`)
+
+// queryNodeKind defines the kind of a node in a parsed query.
+type queryNodeKind int
+
+const (
+	// termNode is a single search term, with an operator or not.
+	termNode queryNodeKind = iota
+	// andNode matches if all its children match.
+	andNode
+	// orNode matches if any of its children match.
+	orNode
+	// notNode matches if its only child does not match.
+	notNode
+)
+
+// queryNode is a node in a parsed Gmail query.
+type queryNode struct {
+	kind queryNodeKind
+	// operator is the lower cased operator of a term, if it has one.
+	operator string
+	// value is the text of a term, or the value of its operator. A value
+	// that is a group is kept in children instead.
+	value    string
+	children []*queryNode
+	// grouped is set for groups written in parentheses.
+	grouped bool
+}
+
+// String returns the query the node was parsed from, normalized.
+func (n *queryNode) String() string {
+	switch n.kind {
+	case andNode, orNode:
+		sep := " "
+		if n.kind == orNode {
+			sep = " OR "
+		}
+		parts := make([]string, 0, len(n.children))
+		for _, c := range n.children {
+			parts = append(parts, c.String())
+		}
+		return "(" + strings.Join(parts, sep) + ")"
+	case notNode:
+		return "-" + n.children[0].String()
+	}
+
+	value := n.value
+	if len(n.children) > 0 {
+		value = n.children[0].String()
+	}
+	if len(n.operator) > 0 {
+		return n.operator + ":" + value
+	}
+	return value
+}
+
+// canonicalQuery returns the query with its operators lower cased, OR upper
+// cased, single spaces between the terms, nested groups of the same kind
+// flattened and parentheses around every group but the outermost one. It
+// returns an error for an OR next to other terms without parentheses, which
+// Gmail reads differently from this parser, as OR binds tighter in Gmail.
+func canonicalQuery(q string) (string, error) {
+	n, err := parseQuery(q)
+	if err != nil {
+		return "", err
+	}
+	if err := checkOrPrecedence(n); err != nil {
+		return "", err
+	}
+
+	s := n.canonical()
+	if (n.kind == andNode || n.kind == orNode) && strings.HasPrefix(s, "(") {
+		s = s[1 : len(s)-1]
+	}
+	return s, nil
+}
+
+// checkOrPrecedence returns an error if an OR has terms next to it that are
+// not grouped in parentheses.
+func checkOrPrecedence(n *queryNode) error {
+	for _, c := range n.children {
+		if n.kind == orNode && c.kind == andNode && !c.grouped {
+			return fmt.Errorf("add parentheses to %q, Gmail binds OR tighter than the terms next to it", n.String())
+		}
+		if err := checkOrPrecedence(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonical returns the node like String, with nested groups of the same
+// kind flattened.
+func (n *queryNode) canonical() string {
+	switch n.kind {
+	case andNode, orNode:
+		sep := " "
+		if n.kind == orNode {
+			sep = " OR "
+		}
+		var parts []string
+		var add func(*queryNode)
+		add = func(c *queryNode) {
+			if c.kind == n.kind {
+				for _, cc := range c.children {
+					add(cc)
+				}
+				return
+			}
+			parts = append(parts, c.canonical())
+		}
+		for _, c := range n.children {
+			add(c)
+		}
+		return "(" + strings.Join(parts, sep) + ")"
+	case notNode:
+		return "-" + n.children[0].canonical()
+	}
+
+	value := n.value
+	if len(n.children) > 0 {
+		value = n.children[0].canonical()
+		// Keep the parentheses of a negated value, like from:(-me).
+		if n.children[0].kind == notNode {
+			value = "(" + value + ")"
+		}
+	}
+	if len(n.operator) > 0 {
+		return n.operator + ":" + value
+	}
+	return value
+}
+
+// queryTokenKind defines the kind of a token in a query.
+type queryTokenKind int
+
+const (
+	wordToken queryTokenKind = iota
+	quotedToken
+	negateToken
+	openParenToken
+	closeParenToken
+	openBraceToken
+	closeBraceToken
+	orToken
+	andToken
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+}
+
+// tokenizeQuery splits the query into tokens.
+func tokenizeQuery(q string) ([]queryToken, error) {
+	var tokens []queryToken
+	start := true
+
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			start = true
+			continue
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: openParenToken, text: "("})
+			i++
+			start = true
+			continue
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: closeParenToken, text: ")"})
+			i++
+			start = true
+			continue
+		case c == '{':
+			tokens = append(tokens, queryToken{kind: openBraceToken, text: "{"})
+			i++
+			start = true
+			continue
+		case c == '}':
+			tokens = append(tokens, queryToken{kind: closeBraceToken, text: "}"})
+			i++
+			start = true
+			continue
+		case c == '-' && start && i+1 < len(q) && !strings.ContainsRune(" \t\n\r)}", rune(q[i+1])):
+			tokens = append(tokens, queryToken{kind: negateToken, text: "-"})
+			i++
+			continue
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			tokens = append(tokens, queryToken{kind: quotedToken, text: q[i : i+end+2]})
+			i += end + 2
+			start = false
+			continue
+		}
+
+		j := i
+		for j < len(q) && !strings.ContainsRune(" \t\n\r(){}\"", rune(q[j])) {
+			j++
+		}
+		word := q[i:j]
+		switch word {
+		case "OR", "|":
+			tokens = append(tokens, queryToken{kind: orToken, text: word})
+		case "AND":
+			tokens = append(tokens, queryToken{kind: andToken, text: word})
+		default:
+			tokens = append(tokens, queryToken{kind: wordToken, text: word})
+		}
+		i = j
+		start = false
+	}
+
+	return tokens, nil
+}
+
+// queryParser is a recursive descent parser for Gmail queries.
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// parseQuery parses the Gmail query, returning an error for unbalanced
+// parentheses, unknown operators and other syntax Gmail does not support.
+func parseQuery(q string) (*queryNode, error) {
+	tokens, err := tokenizeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) < 1 {
+		return nil, errors.New("query is empty")
+	}
+
+	p := &queryParser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		if t.kind == closeParenToken || t.kind == closeBraceToken {
+			return nil, fmt.Errorf("unbalanced %q", t.text)
+		}
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+
+	return n, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+// parseOr parses terms separated by OR.
+func (p *queryParser) parseOr() (*queryNode, error) {
+	if t, ok := p.peek(); ok && t.kind == orToken {
+		return nil, fmt.Errorf("%s must be between two search terms", t.text)
+	}
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &queryNode{kind: orNode, children: []*queryNode{left}}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != orToken {
+			break
+		}
+		p.next()
+
+		if t, ok := p.peek(); !ok || t.kind == orToken || t.kind == andToken || t.kind == closeParenToken || t.kind == closeBraceToken {
+			return nil, fmt.Errorf("OR must be between two search terms")
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, right)
+	}
+
+	if len(n.children) == 1 {
+		return left, nil
+	}
+	return n, nil
+}
+
+// parseAnd parses terms that must all match, with or without AND between
+// them.
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	n := &queryNode{kind: andNode}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == orToken || t.kind == closeParenToken || t.kind == closeBraceToken {
+			break
+		}
+		if t.kind == andToken {
+			if len(n.children) < 1 {
+				return nil, errors.New("AND must be between two search terms")
+			}
+			p.next()
+			if t, ok := p.peek(); !ok || t.kind == orToken || t.kind == andToken || t.kind == closeParenToken || t.kind == closeBraceToken {
+				return nil, errors.New("AND must be between two search terms")
+			}
+			continue
+		}
+
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		n.children = append(n.children, c)
+	}
+
+	switch len(n.children) {
+	case 0:
+		return nil, errors.New("expected a search term")
+	case 1:
+		return n.children[0], nil
+	}
+	return n, nil
+}
+
+// parseUnary parses a possibly negated term.
+func (p *queryParser) parseUnary() (*queryNode, error) {
+	if t, _ := p.peek(); t.kind == negateToken {
+		p.next()
+		if _, ok := p.peek(); !ok {
+			return nil, errors.New("expected a search term after -")
+		}
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNode{kind: notNode, children: []*queryNode{c}}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a term or a group of terms.
+func (p *queryParser) parsePrimary() (*queryNode, error) {
+	t := p.next()
+	switch t.kind {
+	case openParenToken:
+		if t, ok := p.peek(); ok && t.kind == closeParenToken {
+			return nil, errors.New("empty parentheses")
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != closeParenToken {
+			return nil, errors.New("unbalanced \"(\"")
+		}
+		p.next()
+		n.grouped = true
+		return n, nil
+	case openBraceToken:
+		// Terms in braces are OR'd together.
+		n := &queryNode{kind: orNode}
+		for {
+			t, ok := p.peek()
+			if !ok {
+				return nil, errors.New("unbalanced \"{\"")
+			}
+			if t.kind == closeBraceToken {
+				p.next()
+				break
+			}
+			if t.kind == orToken || t.kind == andToken {
+				p.next()
+				continue
+			}
+			c, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, c)
+		}
+		if len(n.children) < 1 {
+			return nil, errors.New("empty braces")
+		}
+		return n, nil
+	case closeParenToken, closeBraceToken:
+		return nil, fmt.Errorf("unbalanced %q", t.text)
+	case quotedToken:
+		return &queryNode{kind: termNode, value: t.text}, nil
+	}
+
+	m := operatorRegexp.FindStringSubmatch(t.text)
+	if m == nil {
+		return &queryNode{kind: termNode, value: t.text}, nil
+	}
+
+	operator := strings.ToLower(m[1])
+	if !queryOperators[operator] {
+		return nil, fmt.Errorf("unknown operator %q, quote the term if it is not an operator", m[1]+":")
+	}
+
+	n := &queryNode{kind: termNode, operator: operator, value: t.text[len(m[0]):]}
+	if len(n.value) > 0 {
+		return n, nil
+	}
+
+	// The value is a quoted string or a group.
+	next, ok := p.peek()
+	if !ok || (next.kind != quotedToken && next.kind != openParenToken && next.kind != openBraceToken) {
+		return nil, fmt.Errorf("operator %q has no value", m[0])
+	}
+	if next.kind == quotedToken {
+		n.value = p.next().text
+		return n, nil
+	}
+	v, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	n.children = []*queryNode{v}
+	return n, nil
+}
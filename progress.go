@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// progressWidth is the number of characters of the progress bar.
+const progressWidth = 30
+
+// progress draws a progress bar for the filter operations of a sync on a
+// terminal. It draws nothing if the output is not a terminal, so logs and
+// pipes are not filled with it.
+type progress struct {
+	w       io.Writer
+	total   int
+	done    int
+	enabled bool
+}
+
+// newProgress returns a progress bar for the number of operations, drawn
+// to w.
+func newProgress(w io.Writer, total int) *progress {
+	return &progress{w: w, total: total, enabled: total > 0 && isTerminal(w)}
+}
+
+// step records an operation as done and redraws the bar.
+func (p *progress) step(op string) {
+	p.done++
+	if !p.enabled {
+		return
+	}
+
+	done := p.done
+	if done > p.total {
+		done = p.total
+	}
+	filled := progressWidth * done / p.total
+	fmt.Fprintf(p.w, "\r\x1b[K[%s%s] %d/%d %s", strings.Repeat("#", filled), strings.Repeat(" ", progressWidth-filled), done, p.total, op)
+}
+
+// finish clears the bar so the output that follows starts on a clean line.
+// The bar is not drawn again after.
+func (p *progress) finish() {
+	if p.enabled {
+		fmt.Fprint(p.w, "\r\x1b[K")
+		p.enabled = false
+	}
+}
+
+// syncSummary counts what a sync did.
+type syncSummary struct {
+	created   int
+	updated   int
+	deleted   int
+	unchanged int
+	failed    int
+	duration  time.Duration
+	apiCalls  int64
+}
+
+// fields returns the summary as log fields.
+func (s syncSummary) fields() logrus.Fields {
+	return logrus.Fields{
+		"created":   s.created,
+		"updated":   s.updated,
+		"deleted":   s.deleted,
+		"unchanged": s.unchanged,
+		"failed":    s.failed,
+		"duration":  s.duration.Round(time.Millisecond).String(),
+		"apiCalls":  s.apiCalls,
+	}
+}
+
+// printSyncSummary writes the summary as a table.
+func printSyncSummary(w io.Writer, s syncSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Created\t%d\n", s.created)
+	fmt.Fprintf(tw, "Updated\t%d\n", s.updated)
+	fmt.Fprintf(tw, "Deleted\t%d\n", s.deleted)
+	fmt.Fprintf(tw, "Unchanged\t%d\n", s.unchanged)
+	fmt.Fprintf(tw, "Failed\t%d\n", s.failed)
+	fmt.Fprintf(tw, "Duration\t%s\n", s.duration.Round(time.Millisecond))
+	fmt.Fprintf(tw, "API calls\t%d\n", s.apiCalls)
+	return tw.Flush()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestProgress(t *testing.T) {
+	// Nothing is drawn to something that is not a terminal.
+	var buf bytes.Buffer
+	p := newProgress(&buf, 2)
+	p.step("creating filters")
+	p.finish()
+	if buf.Len() > 0 {
+		t.Fatalf("expected no progress output, got %q", buf.String())
+	}
+
+	p = &progress{w: &buf, total: 4, enabled: true}
+	p.step("creating filters")
+	p.finish()
+	p.step("deleting filters")
+	expected := "\r\x1b[K[#######                       ] 1/4 creating filters\r\x1b[K"
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestPrintSyncSummary(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printSyncSummary(&buf, syncSummary{created: 3, updated: 1, unchanged: 10, failed: 1, duration: 1500 * time.Millisecond, apiCalls: 12}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Created    3
+Updated    1
+Deleted    0
+Unchanged  10
+Failed     1
+Duration   1.5s
+API calls  12
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(&logrus.JSONFormatter{DisableTimestamp: true})
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}()
+
+	fmt.Fprintf(&logWriter{}, "Backed up existing filters to %s\n\nExported %d filters", "/tmp/x.json", 2)
+	expected := `{"level":"info","msg":"Backed up existing filters to /tmp/x.json"}
+{"level":"info","msg":"Exported 2 filters"}
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
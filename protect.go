@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// protectRule defines filters in the account that must never be deleted or
+// modified, either by their fingerprint or by a regular expression matching
+// their query.
+type protectRule struct {
+	Fingerprint string
+	Query       string
+
+	query *regexp.Regexp
+}
+
+// compileProtectRules validates the rules and compiles their patterns.
+func compileProtectRules(rules []protectRule) ([]protectRule, error) {
+	compiled := make([]protectRule, 0, len(rules))
+	for _, r := range rules {
+		if len(r.Fingerprint) < 1 && len(r.Query) < 1 {
+			return nil, errors.New("protect rule must have a fingerprint or a query")
+		}
+
+		if len(r.Query) > 0 {
+			re, err := regexp.Compile(r.Query)
+			if err != nil {
+				return nil, fmt.Errorf("protect rule query %q is not a valid regular expression: %v", r.Query, err)
+			}
+			r.query = re
+		}
+
+		compiled = append(compiled, r)
+	}
+
+	return compiled, nil
+}
+
+// protected returns true if the filter matches any of the rules.
+func protected(f gmail.Filter, rules []protectRule) bool {
+	for _, r := range rules {
+		if len(r.Fingerprint) > 0 && r.Fingerprint == fingerprint(f) {
+			return true
+		}
+		if r.query != nil && f.Criteria != nil && r.query.MatchString(normalizeQuery(f.Criteria.Query)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withoutProtected returns the diff without any deletions or updates of
+// protected filters. The replacement of a protected filter is not created
+// either, since that would change what happens to the matching mail.
+func (d filterDiff) withoutProtected(rules []protectRule) filterDiff {
+	if len(rules) < 1 {
+		return d
+	}
+
+	var deletes []gmail.Filter
+	for _, f := range d.Delete {
+		if protected(f, rules) {
+			d.Protected = append(d.Protected, f)
+			continue
+		}
+		deletes = append(deletes, f)
+	}
+	d.Delete = deletes
+
+	var updates []filterUpdate
+	for _, u := range d.Update {
+		if protected(u.Old, rules) {
+			d.Protected = append(d.Protected, u.Old)
+			continue
+		}
+		updates = append(updates, u)
+	}
+	d.Update = updates
+
+	return d
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// match defines a structured criteria block that compiles into a Gmail
+// query. Leaves within a single block are AND'd together.
+type match struct {
+	All     []match
+	Any     []match
+	Not     *match
+	From    string
+	To      string
+	Subject string
+	Has     string
+}
+
+// compile converts the match block into a Gmail query string.
+func (m match) compile() (string, error) {
+	var terms []string
+
+	// Add the leaves.
+	for _, leaf := range []struct {
+		operator string
+		value    string
+	}{
+		{"from", m.From},
+		{"to", m.To},
+		{"subject", m.Subject},
+		{"has", m.Has},
+	} {
+		if len(leaf.value) > 0 {
+			terms = append(terms, fmt.Sprintf("%s:%s", leaf.operator, quoteQueryValue(leaf.value)))
+		}
+	}
+
+	// Add the nested blocks.
+	if len(m.All) > 0 {
+		q, err := compileBlocks(m.All, " ")
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, q)
+	}
+
+	if len(m.Any) > 0 {
+		q, err := compileBlocks(m.Any, " OR ")
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, q)
+	}
+
+	if m.Not != nil {
+		q, err := m.Not.compile()
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, "-"+group(q))
+	}
+
+	if len(terms) < 1 {
+		return "", errors.New("match block cannot be empty")
+	}
+
+	return strings.Join(terms, " "), nil
+}
+
+// compileBlocks compiles each block and joins them with sep.
+func compileBlocks(blocks []match, sep string) (string, error) {
+	queries := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		q, err := b.compile()
+		if err != nil {
+			return "", err
+		}
+		queries = append(queries, group(q))
+	}
+
+	return group(strings.Join(queries, sep)), nil
+}
+
+// group wraps q in parentheses if it contains more than one term.
+func group(q string) string {
+	if !strings.Contains(q, " ") || (strings.HasPrefix(q, "(") && strings.HasSuffix(q, ")") && balanced(q[1:len(q)-1])) {
+		return q
+	}
+	return "(" + q + ")"
+}
+
+// balanced reports whether the parentheses in q are balanced, ignoring any
+// inside of quotes.
+func balanced(q string) bool {
+	depth := 0
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	return depth == 0
+}
+
+// quoteQueryValue quotes the value if it contains whitespace.
+func quoteQueryValue(v string) string {
+	if strings.ContainsAny(v, " \t") && !strings.HasPrefix(v, "\"") && !strings.HasPrefix(v, "(") {
+		return fmt.Sprintf("%q", v)
+	}
+	return v
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMatchCompile(t *testing.T) {
+	testCases := map[string]struct {
+		orig     string
+		expected string
+	}{
+		"single leaf": {
+			orig: `
+from = "notifications@github.com"
+`,
+			expected: "from:notifications@github.com",
+		},
+		"leaves are and'd": {
+			orig: `
+from = "notifications@github.com"
+subject = "review requested"
+`,
+			expected: `from:notifications@github.com subject:"review requested"`,
+		},
+		"any with not": {
+			orig: `
+[[any]]
+from = "notifications@github.com"
+[[any]]
+from = "noreply@github.com"
+[[any]]
+to = "mention@noreply.github.com"
+has = "attachment"
+
+[not]
+to = "team_mention@noreply.github.com"
+`,
+			expected: "(from:notifications@github.com OR from:noreply@github.com OR (to:mention@noreply.github.com has:attachment)) -to:team_mention@noreply.github.com",
+		},
+		"nested all in any": {
+			orig: `
+[[any]]
+[[any.all]]
+from = "me"
+[[any.all]]
+to = "reply@reply.github.com"
+[[any]]
+subject = "LGTM"
+`,
+			expected: "((from:me to:reply@reply.github.com) OR subject:LGTM)",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var m match
+			if _, err := toml.Decode(tc.orig, &m); err != nil {
+				t.Fatal(err)
+			}
+
+			q, err := m.compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if q != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, q)
+			}
+		})
+	}
+
+	if _, err := (match{}).compile(); err == nil {
+		t.Fatal("expected an error for an empty match block")
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	snippets := map[string]string{
+		"github":   "from:notifications@github.com",
+		"mentions": "(@github to:mention@noreply.github.com)",
+	}
+
+	q, err := expandSnippets("@mentions -@github @jessfraz list:dev@googlegroups.com", snippets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "(from:notifications@github.com to:mention@noreply.github.com) -from:notifications@github.com @jessfraz list:dev@googlegroups.com"
+	if q != expected {
+		t.Fatalf("expected %q, got %q", expected, q)
+	}
+
+	if collapsed := collapseSnippets(expected, snippets); collapsed != "@mentions -@github @jessfraz list:dev@googlegroups.com" {
+		t.Fatalf("expected %q, got %q", "@mentions -@github @jessfraz list:dev@googlegroups.com", collapsed)
+	}
+
+	// Only whole terms are collapsed, from:a is not a snippet in from:alice.
+	snippets = map[string]string{"a": "from:a", "dev": "list:dev"}
+	q = "from:alice (from:a OR list:dev) -from:a list:dev@googlegroups.com"
+	if collapsed := collapseSnippets(q, snippets); collapsed != "from:alice (@a OR @dev) -@a list:dev@googlegroups.com" {
+		t.Fatalf("expected %q, got %q", "from:alice (@a OR @dev) -@a list:dev@googlegroups.com", collapsed)
+	}
+
+	if _, err := expandSnippets("@loop", map[string]string{"loop": "a @loop"}); err == nil {
+		t.Fatal("expected an error for a recursive snippet")
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	valid := map[string]string{
+		"from:a@example.com":                                      "from:a@example.com",
+		"from:a@example.com to:me":                                "(from:a@example.com to:me)",
+		"from:a OR from:b":                                        "(from:a OR from:b)",
+		"from:a AND -subject:\"weekly digest\"":                   "(from:a -subject:\"weekly digest\")",
+		"{to:me cc:me}":                                           "(to:me OR cc:me)",
+		"from:(notifications@github.com) LGTM":                    "(from:notifications@github.com LGTM)",
+		"list:coreos-dev@googlegroups.com":                        "list:coreos-dev@googlegroups.com",
+		"(from:(-me) {filename:vcs filename:ics} has:attachment)": "(from:-me (filename:vcs OR filename:ics) has:attachment)",
+		"Subject:(invitation OR accepted)":                        "subject:(invitation OR accepted)",
+	}
+	for q, expected := range valid {
+		n, err := parseQuery(q)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if n.String() != expected {
+			t.Fatalf("%s: expected %s, got %s", q, expected, n.String())
+		}
+	}
+
+	invalid := map[string]string{
+		"":                   "query is empty",
+		"(from:a":            `unbalanced "("`,
+		"from:a)":            `unbalanced ")"`,
+		"{to:me cc:me":       `unbalanced "{"`,
+		"()":                 "empty parentheses",
+		"OR from:a":          "OR must be between two search terms",
+		"from:a OR":          "OR must be between two search terms",
+		"from:a AND OR to:b": "AND must be between two search terms",
+		"sender:a":           `unknown operator "sender:", quote the term if it is not an operator`,
+		"from: a":            `operator "from:" has no value`,
+		"subject:\"open":     "unterminated quote",
+	}
+	for q, expected := range invalid {
+		_, err := parseQuery(q)
+		if err == nil || err.Error() != expected {
+			t.Fatalf("%s: expected error %q, got %v", q, expected, err)
+		}
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	for q, expected := range map[string]string{
+		"from:a@example.com": "from:a@example.com",
+		"  FROM:a   to:me ":  "from:a to:me",
+		"from:a | from:b":    "from:a OR from:b",
+		"(from:a AND (to:b -subject:\"weekly  digest\"))":         "from:a to:b -subject:\"weekly  digest\"",
+		"from:a OR (from:b OR {from:c from:d})":                   "from:a OR from:b OR from:c OR from:d",
+		"(from:a to:b) OR list:dev":                               "(from:a to:b) OR list:dev",
+		"(from:(-me) {filename:vcs filename:ics} has:attachment)": "from:(-me) (filename:vcs OR filename:ics) has:attachment",
+		"Subject:(invitation OR accepted)":                        "subject:(invitation OR accepted)",
+	} {
+		got, err := canonicalQuery(q)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		if got != expected {
+			t.Fatalf("%s: expected %s, got %s", q, expected, got)
+		}
+	}
+
+	for _, q := range []string{"from:a to:b OR list:dev", "from:a (to:b list:c OR list:dev)"} {
+		if _, err := canonicalQuery(q); err == nil || !strings.Contains(err.Error(), "Gmail binds OR tighter") {
+			t.Fatalf("%s: expected an error about OR, got %v", q, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const restoreHelp = `Restore the filters and labels from a backup snapshot.`
+
+const restoreLongHelp = restoreHelp + `
+
+The filters and labels of the snapshot are recreated, winning over any
+changes made since. Pass --prune to also delete the filters created by
+gmailfilters since the snapshot, and --dry-run to print what would change.
+A snapshot taken with --account is only restored to that account.`
+
+func (cmd *restoreCommand) Name() string      { return "restore" }
+func (cmd *restoreCommand) Args() string      { return "<snapshot>" }
+func (cmd *restoreCommand) ShortHelp() string { return restoreHelp }
+func (cmd *restoreCommand) LongHelp() string  { return restoreLongHelp }
+func (cmd *restoreCommand) Hidden() bool      { return false }
+
+func (cmd *restoreCommand) Register(fs *flag.FlagSet) {
+	registerSyncFlags(fs)
+
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes that would be made without making them")
+}
+
+type restoreCommand struct{}
+
+func (cmd *restoreCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass a path to a snapshot file")
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+
+	s, err := readSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+	if err := checkSnapshotAccount(s); err != nil {
+		return err
+	}
+
+	// The snapshot wins over any changes made since the last sync.
+	overwrite = true
+
+	// Only print what would change if we are doing a dry run.
+	if dryRun {
+		return planRestore(ctx, s)
+	}
+
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+	infof("Restoring %d filters from snapshot taken at %s\n", len(s.Filters), s.Time)
+
+	labels, err := getLabelMap(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Recreate the labels, the IDs of the labels in the snapshot might not
+	// match the IDs in the account anymore.
+	ids, err := restoreLabels(ctx, s.Labels, &labels)
+	if err != nil {
+		return err
+	}
+
+	wanted := make([]gmail.Filter, 0, len(s.Filters))
+	for _, f := range s.Filters {
+		wanted = append(wanted, remapFilterLabels(*f, ids))
+	}
+
+	return syncFilters(ctx, wanted, nil, nil)
+}
+
+// planRestore prints the changes restoring the snapshot would make, without
+// creating the missing labels.
+func planRestore(ctx context.Context, s snapshot) error {
+	labels, err := getLabelMap(ctx)
+	if err != nil {
+		return err
+	}
+	names := labelNamesByID(ctx)
+
+	// The filters adding missing labels keep the IDs from the snapshot,
+	// named after them.
+	ids := map[string]string{}
+	var newLabels []string
+	for _, l := range s.Labels {
+		// System labels have the same ID in every account.
+		if l.Type == "system" {
+			continue
+		}
+		if id, ok := labels[strings.ToLower(l.Name)]; ok {
+			ids[l.Id] = id
+			continue
+		}
+		newLabels = append(newLabels, l.Name)
+		names[l.Id] = l.Name
+	}
+
+	wanted := make([]gmail.Filter, 0, len(s.Filters))
+	for _, f := range s.Filters {
+		wanted = append(wanted, remapFilterLabels(*f, ids))
+	}
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+	diff := computeDiff(wanted, remote).scoped(state, nil)
+
+	for _, name := range newLabels {
+		fmt.Printf("+ label %s\n", name)
+	}
+	printDiff(os.Stdout, diff, names)
+	return nil
+}
+
+// restoreLabels makes sure the user labels exist in the account with their
+// settings. It returns a map of the label IDs in the snapshot to the label IDs
+// in the account.
+func restoreLabels(ctx context.Context, snapshotLabels []*gmail.Label, labels *labelMap) (map[string]string, error) {
+	ids := map[string]string{}
+	for _, l := range snapshotLabels {
+		// System labels have the same ID in every account.
+		if l.Type == "system" {
+			ids[l.Id] = l.Id
+			continue
+		}
+
+		id, err := labels.createLabelIfDoesNotExist(ctx, l.Name, &gmail.Label{
+			Color:                 l.Color,
+			LabelListVisibility:   l.LabelListVisibility,
+			MessageListVisibility: l.MessageListVisibility,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ids[l.Id] = id
+	}
+
+	return ids, nil
+}
+
+// remapFilterLabels returns a copy of the filter without its ID and with the
+// label IDs in its action mapped to new IDs. IDs without a mapping are kept.
+func remapFilterLabels(f gmail.Filter, ids map[string]string) gmail.Filter {
+	f.Id = ""
+	if f.Action == nil {
+		return f
+	}
+
+	remap := func(list []string) []string {
+		mapped := make([]string, 0, len(list))
+		for _, id := range list {
+			if newID, ok := ids[id]; ok {
+				id = newID
+			}
+			mapped = append(mapped, id)
+		}
+		return mapped
+	}
+
+	action := *f.Action
+	action.AddLabelIds = remap(action.AddLabelIds)
+	action.RemoveLabelIds = remap(action.RemoveLabelIds)
+	f.Action = &action
+
+	return f
+}
+
+// checkSnapshotAccount makes sure a snapshot of an account taken with
+// --account is only restored to that account.
+func checkSnapshotAccount(s snapshot) error {
+	if len(s.Account) < 1 || strings.EqualFold(s.Account, gmailUser) {
+		return nil
+	}
+	if gmailUser == "me" {
+		return fmt.Errorf("the snapshot is of %s, pass --account %s to restore it", s.Account, s.Account)
+	}
+	return fmt.Errorf("the snapshot is of %s, not of %s", s.Account, gmailUser)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestPlanRestore(t *testing.T) {
+	// A fake Gmail API with one of the labels of the snapshot and no
+	// filters.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/me/labels":
+			json.NewEncoder(w).Encode(gmail.ListLabelsResponse{Labels: []*gmail.Label{
+				{Id: "INBOX", Name: "INBOX", Type: "system"},
+				{Id: "Label_7", Name: "Lists", Type: "user"},
+			}})
+		case "/me/settings/filters":
+			json.NewEncoder(w).Encode(gmail.ListFiltersResponse{})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { stateFile = old }(stateFile)
+	stateFile = filepath.Join(dir, "state.json")
+
+	s := snapshot{
+		Labels: []*gmail.Label{
+			{Id: "INBOX", Name: "INBOX", Type: "system"},
+			{Id: "Label_1", Name: "Lists", Type: "user"},
+			{Id: "Label_2", Name: "Lists/golang", Type: "user"},
+		},
+		Filters: []*gmail.Filter{
+			{Id: "1", Criteria: &gmail.FilterCriteria{Query: "list:golang-nuts"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_2"}, RemoveLabelIds: []string{"INBOX"}}},
+			{Id: "2", Criteria: &gmail.FilterCriteria{Query: "list:dev"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}},
+		},
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = w
+	err = planRestore(context.Background(), s)
+	w.Close()
+	os.Stdout = oldStdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the missing label would be created, and the filters add the
+	// labels by name.
+	out := string(b)
+	if !strings.Contains(out, "+ label Lists/golang\n") || strings.Contains(out, "+ label Lists\n") {
+		t.Fatalf("expected only Lists/golang to be created, got %q", out)
+	}
+	if !strings.Contains(out, "Lists/golang") || strings.Contains(out, "Label_") {
+		t.Fatalf("expected the filters to add the labels by name, got %q", out)
+	}
+}
+
+func TestCheckSnapshotAccount(t *testing.T) {
+	defer func(old string) { gmailUser = old }(gmailUser)
+
+	testCases := map[string]struct {
+		user, account string
+		ok            bool
+	}{
+		"authorized user":     {user: "me", ok: true},
+		"same account":        {user: "Alice@example.com", account: "alice@example.com", ok: true},
+		"account of another":  {user: "bob@example.com", account: "alice@example.com"},
+		"account without one": {user: "me", account: "alice@example.com"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			gmailUser = tc.user
+			err := checkSnapshotAccount(snapshot{Account: tc.account})
+			if tc.ok && err != nil {
+				t.Fatalf("expected the snapshot to be restored, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected an error for a snapshot of another account")
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+const rmHelp = `Delete the filters in the account whose query or labels match a pattern.`
+
+const rmLongHelp = rmHelp + `
+
+The pattern is a regular expression, matched ignoring case against the query
+of each filter and the names of the labels it adds or removes. Filters
+protected by the filter files, if any are passed, are left alone. The
+filters are backed up first, pass the snapshot to restore to bring them
+back, as undo only undoes the last sync.`
+
+func (cmd *rmCommand) Name() string      { return "rm" }
+func (cmd *rmCommand) Args() string      { return "<pattern> [<file>...]" }
+func (cmd *rmCommand) ShortHelp() string { return rmHelp }
+func (cmd *rmCommand) LongHelp() string  { return rmLongHelp }
+func (cmd *rmCommand) Hidden() bool      { return false }
+
+func (cmd *rmCommand) Register(fs *flag.FlagSet) {}
+
+type rmCommand struct{}
+
+func (cmd *rmCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass the pattern of the filters to delete")
+	}
+
+	re, err := regexp.Compile("(?i)" + args[0])
+	if err != nil {
+		return fmt.Errorf("parsing pattern %q failed: %v", args[0], err)
+	}
+
+	// The filter files are only needed for their protect rules.
+	var rules []protectRule
+	if len(args) > 1 {
+		ff, err := loadFilterFiles(args[1:])
+		if err != nil {
+			return err
+		}
+		rules = ff.Protect
+	}
+
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	names := labelNamesByID(ctx)
+
+	diff := filterDiff{Delete: matchingFilters(remote, re, names)}.withoutProtected(rules)
+	printDiffNotes(infoOut(), diff)
+	if diff.empty() {
+		infof("No filters match %s\n", args[0])
+		return nil
+	}
+
+	printDiff(promptOut(), diff, names)
+	ok, err := confirm(fmt.Sprintf("Delete %d filters?", len(diff.Delete)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAborted
+	}
+
+	file, err := writeSnapshot(ctx, backupDir)
+	if err != nil {
+		return err
+	}
+	infof("Backed up existing filters to %s\n", file)
+
+	_, err = applyDiff(ctx, diff, state, nil)
+	if serr := state.save(stateFile); serr != nil {
+		logrus.Warn(serr)
+	}
+	if err != nil {
+		return err
+	}
+
+	infof("Successfully deleted %d filters\n", len(diff.Delete))
+
+	return nil
+}
+
+// matchingFilters returns the filters whose query or the name of a label
+// they add or remove matches the regular expression, given a map of label
+// IDs to names.
+func matchingFilters(filters []gmail.Filter, re *regexp.Regexp, names labelMap) []gmail.Filter {
+	var matches []gmail.Filter
+	for _, f := range filters {
+		var values []string
+		if f.Criteria != nil {
+			values = append(values, f.Criteria.Query)
+		}
+		if f.Action != nil {
+			values = append(values, labelNames(f.Action.AddLabelIds, names)...)
+			values = append(values, labelNames(f.Action.RemoveLabelIds, names)...)
+		}
+
+		for _, v := range values {
+			if len(v) > 0 && re.MatchString(v) {
+				matches = append(matches, f)
+				break
+			}
+		}
+	}
+	return matches
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestMatchingFilters(t *testing.T) {
+	filters := []gmail.Filter{
+		{Id: "a", Criteria: &gmail.FilterCriteria{Query: "list:dev.example.com"}},
+		{Id: "b", Criteria: &gmail.FilterCriteria{From: "a@example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}},
+		{Id: "c", Criteria: &gmail.FilterCriteria{From: "b@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+	}
+	names := labelMap{"Label_1": "Dev/Releases"}
+
+	for pattern, expected := range map[string]string{
+		"^list:dev":  "a",
+		"releases":   "b",
+		"^inbox$":    "c",
+		"example":    "a",
+		"dev":        "ab",
+		"missing":    "",
+		"@example.c": "",
+	} {
+		var got string
+		for _, f := range matchingFilters(filters, regexp.MustCompile("(?i)"+pattern), names) {
+			got += f.Id
+		}
+		if got != expected {
+			t.Fatalf("%q: expected filters %q, got %q", pattern, expected, got)
+		}
+	}
+}
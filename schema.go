@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const schemaHelp = `Print the JSON Schema of the filter file format.`
+
+const schemaLongHelp = schemaHelp + `
+
+Editors use it to complete and check filter files while writing them, for
+example with a #:schema comment at the top of the file for Even Better TOML:
+
+  $ gmailfilters schema > ~/.config/gmailfilters/filters.schema.json
+
+  #:schema ~/.config/gmailfilters/filters.schema.json`
+
+func (cmd *schemaCommand) Name() string      { return "schema" }
+func (cmd *schemaCommand) Args() string      { return "" }
+func (cmd *schemaCommand) ShortHelp() string { return schemaHelp }
+func (cmd *schemaCommand) LongHelp() string  { return schemaLongHelp }
+func (cmd *schemaCommand) Hidden() bool      { return false }
+
+func (cmd *schemaCommand) Register(fs *flag.FlagSet) {}
+
+type schemaCommand struct{}
+
+func (cmd *schemaCommand) Run(ctx context.Context, args []string) error {
+	b, err := json.MarshalIndent(filterFileSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, string(b))
+	return err
+}
+
+// schema is a JSON Schema object.
+type schema map[string]interface{}
+
+// stringSchema returns the schema of a string with the description, limited
+// to the values if there are any.
+func stringSchema(description string, values ...string) schema {
+	s := schema{"type": "string", "description": description}
+	if len(values) > 0 {
+		s["enum"] = values
+	}
+	return s
+}
+
+// boolSchema returns the schema of a boolean with the description.
+func boolSchema(description string) schema {
+	return schema{"type": "boolean", "description": description}
+}
+
+// stringListSchema returns the schema of a stringList, which is either a
+// single string or a list of them.
+func stringListSchema(description string) schema {
+	return schema{
+		"description": description,
+		"anyOf": []schema{
+			{"type": "string"},
+			{"type": "array", "items": schema{"type": "string"}},
+		},
+	}
+}
+
+// objectSchema returns the schema of a table with the properties, where no
+// other keys are allowed like validate reports them.
+func objectSchema(description string, properties schema) schema {
+	return schema{
+		"type":                 "object",
+		"description":          description,
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// filterFileSchema returns the JSON Schema of the filter file. The keys are
+// spelled the way the README does, although the TOML decoder also accepts
+// them in any case.
+func filterFileSchema() schema {
+	colors := objectSchema("The colors of the label, from the Gmail palette.", schema{
+		"background": stringSchema("The background color, as #rrggbb."),
+		"text":       stringSchema("The text color, as #rrggbb."),
+	})
+	labelListVisibility := stringSchema("Whether the label is shown in the label list.", "labelShow", "labelShowIfUnread", "labelHide")
+	messageListVisibility := stringSchema("Whether the label is shown on the messages in the message list.", "show", "hide")
+
+	s := objectSchema("A gmailfilters filter file.", schema{
+		"suppress": schema{
+			"type":        "array",
+			"description": "Filters of the files passed before this one to leave out, by label, group or query text like --only.",
+			"items":       schema{"type": "string"},
+		},
+		"snippets": schema{
+			"type":                 "object",
+			"description":          "Named query fragments, referenced in queries as @name.",
+			"additionalProperties": schema{"type": "string"},
+		},
+		"protect": schema{
+			"type":        "array",
+			"description": "Filters in the account that are never deleted.",
+			"items": objectSchema("A filter to protect, by fingerprint or query.", schema{
+				"fingerprint": stringSchema("The fingerprint of the filter, as shown by diff and --dry-run."),
+				"query":       stringSchema("A regular expression matched against the query of the filter."),
+			}),
+		},
+		"label": schema{
+			"type":        "array",
+			"description": "Labels to create with their settings, even if no filter uses them.",
+			"items":       schema{"$ref": "#/definitions/label"},
+		},
+		"filter": schema{
+			"type":        "array",
+			"description": "The filters.",
+			"items":       schema{"$ref": "#/definitions/filter"},
+		},
+	})
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = "gmailfilters"
+	s["definitions"] = schema{
+		"label": objectSchema("A label.", schema{
+			"name":                  stringSchema("The name of the label, under the name of its parent."),
+			"color":                 colors,
+			"labelListVisibility":   labelListVisibility,
+			"messageListVisibility": messageListVisibility,
+			"label": schema{
+				"type":        "array",
+				"description": "Nested labels.",
+				"items":       schema{"$ref": "#/definitions/label"},
+			},
+		}),
+		"match": objectSchema("Structured criteria compiled into a query.", schema{
+			"all": schema{
+				"type":        "array",
+				"description": "Criteria that must all match.",
+				"items":       schema{"$ref": "#/definitions/match"},
+			},
+			"any": schema{
+				"type":        "array",
+				"description": "Criteria of which one must match.",
+				"items":       schema{"$ref": "#/definitions/match"},
+			},
+			"not":     schema{"$ref": "#/definitions/match", "description": "Criteria that must not match."},
+			"from":    stringSchema("The sender."),
+			"to":      stringSchema("The recipient."),
+			"subject": stringSchema("The subject."),
+			"has":     stringSchema("A has: operator value, such as attachment."),
+		}),
+		"filter": objectSchema("A filter.", schema{
+			"query":                 stringSchema("The Gmail search query the filter matches."),
+			"queryOr":               schema{"type": "array", "description": "Queries OR'd into the query of the filter.", "items": schema{"type": "string"}},
+			"match":                 schema{"$ref": "#/definitions/match"},
+			"archive":               boolSchema("Skip the inbox."),
+			"read":                  boolSchema("Mark as read."),
+			"delete":                boolSchema("Move to the trash."),
+			"star":                  boolSchema("Star the messages."),
+			"important":             boolSchema("Always mark as important."),
+			"neverImportant":        boolSchema("Never mark as important."),
+			"neverSpam":             boolSchema("Never send to spam."),
+			"toMe":                  boolSchema("Only match mail sent to me."),
+			"archiveUnlessToMe":     boolSchema("Skip the inbox unless the mail is sent to me."),
+			"archiveUnlessCcMe":     boolSchema("Skip the inbox unless the mail is sent or copied to me."),
+			"from":                  stringListSchema("The senders, OR'd together."),
+			"to":                    stringListSchema("The recipients, OR'd together."),
+			"subject":               stringSchema("The subject."),
+			"negatedQuery":          stringSchema("A query the mail must not match."),
+			"hasAttachment":         boolSchema("Only match mail with attachments."),
+			"excludeChats":          boolSchema("Do not match chats."),
+			"size":                  schema{"type": "integer", "minimum": 0, "description": "The size in bytes compared with sizeComparison."},
+			"sizeComparison":        stringSchema("How the size of the mail is compared with size.", "larger", "smaller"),
+			"label":                 stringSchema("The label to apply, created if it does not exist."),
+			"labelColor":            colors,
+			"labelListVisibility":   labelListVisibility,
+			"messageListVisibility": messageListVisibility,
+			"forwardTo":             stringSchema("The verified forwarding address to forward to."),
+			"group":                 stringSchema("The group of the filter, selected with --group. Defaults to the name of the file."),
+		}),
+	}
+	return s
+}
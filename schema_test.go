@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilterFileSchema(t *testing.T) {
+	s := filterFileSchema()
+	if _, err := json.Marshal(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every key the TOML decoder accepts is in the schema, and nothing else.
+	definitions := s["definitions"].(schema)
+	for _, tc := range []struct {
+		name   string
+		schema schema
+		value  interface{}
+	}{
+		{"filterfile", s, filterfile{}},
+		{"filter", definitions["filter"].(schema), filter{}},
+		{"label", definitions["label"].(schema), labelDefinition{}},
+		{"match", definitions["match"].(schema), match{}},
+		{"protect", s["properties"].(schema)["protect"].(schema)["items"].(schema), protectRule{}},
+		{"labelColor", definitions["filter"].(schema)["properties"].(schema)["labelColor"].(schema), labelColor{}},
+	} {
+		var expected []string
+		typ := reflect.TypeOf(tc.value)
+		for i := 0; i < typ.NumField(); i++ {
+			if f := typ.Field(i); len(f.PkgPath) < 1 {
+				expected = append(expected, strings.ToLower(f.Name))
+			}
+		}
+		sort.Strings(expected)
+
+		var got []string
+		for key := range tc.schema["properties"].(schema) {
+			got = append(got, strings.ToLower(key))
+		}
+		sort.Strings(got)
+
+		if diff := cmp.Diff(expected, got); len(diff) > 1 {
+			t.Fatalf("%s: got diff: %s", tc.name, diff)
+		}
+	}
+}
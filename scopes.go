@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// apiTokens is the token source of the Gmail client, to check the scopes of
+// its token.
+var apiTokens oauth2.TokenSource
+
+// fullAccessScope is the scope of full access to the account, which covers
+// all the others.
+const fullAccessScope = "https://mail.google.com/"
+
+// missingScopes returns the wanted scopes that were not granted.
+func missingScopes(wanted, granted []string) []string {
+	has := map[string]bool{}
+	for _, s := range granted {
+		has[s] = true
+	}
+	if has[fullAccessScope] {
+		return nil
+	}
+
+	var missing []string
+	for _, s := range wanted {
+		if !has[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// checkWriteScopes checks the token was granted the scopes needed to change
+// the labels and filters, so a command changing them fails before it starts
+// rather than halfway through. The check is skipped if the scopes of the
+// token cannot be looked up, the API will tell then.
+func checkWriteScopes(ctx context.Context) error {
+	if readOnly {
+		return withExitCode(exitAuth, fmt.Errorf("cannot change the account with --read-only"))
+	}
+	if apiTokens == nil {
+		return nil
+	}
+
+	tok, err := apiTokens.Token()
+	if err != nil {
+		return nil
+	}
+	granted, err := tokenScopes(ctx, tok.AccessToken)
+	if err != nil {
+		logrus.Debugf("Not checking the scopes of the token: %v", err)
+		return nil
+	}
+
+	if missing := missingScopes(gmailScopes, granted); len(missing) > 0 {
+		return withExitCode(exitAuth, fmt.Errorf("the token was not granted %s, needed to change the account, run gmailfilters auth and grant all the permissions asked for", strings.Join(missing, ", ")))
+	}
+	return nil
+}
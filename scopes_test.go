@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCheckWriteScopes(t *testing.T) {
+	var granted string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") != "access" {
+			http.Error(w, "invalid token", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"scope": %q}`, granted)
+	}))
+	defer srv.Close()
+
+	defer func(oldURL string, oldTokens oauth2.TokenSource, oldReadOnly bool) {
+		tokenInfoURL = oldURL
+		apiTokens = oldTokens
+		readOnly = oldReadOnly
+	}(tokenInfoURL, apiTokens, readOnly)
+	tokenInfoURL = srv.URL
+	apiTokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access"})
+	readOnly = false
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		granted string
+		ok      bool
+	}{
+		{strings.Join(gmailScopes, " "), true},
+		{fullAccessScope, true},
+		{gmail.GmailSettingsBasicScope, false},
+		{gmail.GmailReadonlyScope, false},
+	} {
+		granted = tc.granted
+		err := checkWriteScopes(ctx)
+		if tc.ok && err != nil {
+			t.Fatalf("%s: expected the scopes to be enough, got %v", tc.granted, err)
+		}
+		if !tc.ok && (err == nil || exitCode(err) != exitAuth) {
+			t.Fatalf("%s: expected an auth error, got %v", tc.granted, err)
+		}
+	}
+
+	// A token we cannot look up is left to the API.
+	apiTokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "other"})
+	if err := checkWriteScopes(ctx); err != nil {
+		t.Fatalf("expected the check to be skipped, got %v", err)
+	}
+
+	readOnly = true
+	if err := checkWriteScopes(ctx); err == nil {
+		t.Fatal("expected an error with --read-only")
+	}
+}
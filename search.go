@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/api/gmail/v1"
+)
+
+const searchHelp = `Search the queries, labels and forward addresses of filters.`
+
+const searchLongHelp = searchHelp + `
+
+The term is matched fuzzily, ignoring case, against the filters in the filter
+files passed and the filters in the account. The best matches are printed
+first along with the file and line or the account filter they were found in.`
+
+func (cmd *searchCommand) Name() string      { return "search" }
+func (cmd *searchCommand) Args() string      { return "<term> [<file>...]" }
+func (cmd *searchCommand) ShortHelp() string { return searchHelp }
+func (cmd *searchCommand) LongHelp() string  { return searchLongHelp }
+func (cmd *searchCommand) Hidden() bool      { return false }
+
+func (cmd *searchCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.local, "local", false, "only search the filter files, not the account")
+}
+
+type searchCommand struct {
+	local bool
+}
+
+func (cmd *searchCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass the term to search for")
+	}
+	term := args[0]
+	if cmd.local && len(args) < 2 {
+		return errors.New("must pass the filter files to search with --local")
+	}
+
+	values, err := flagTemplateValues()
+	if err != nil {
+		return err
+	}
+
+	var matches []searchMatch
+	for _, file := range args[1:] {
+		m, err := searchFile(file, values, term)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, m...)
+	}
+
+	if !cmd.local {
+		if err := connect(ctx); err != nil {
+			return err
+		}
+		remote, err := listRemoteFilters(ctx)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, searchRemoteFilters(remote, labelNamesByID(ctx), term)...)
+	}
+
+	if len(matches) < 1 {
+		return fmt.Errorf("no filters match %q", term)
+	}
+	printSearchMatches(os.Stdout, matches)
+
+	return nil
+}
+
+// searchMatch is a field of a filter that matched the search term.
+type searchMatch struct {
+	where string
+	field string
+	value string
+	score int
+}
+
+// searchFile returns the fields of the entries in the filter file that match
+// the term, as written in the file.
+func searchFile(file string, values templateValues, term string) ([]searchMatch, error) {
+	b, err := readFilterFile(file, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var ff filterfile
+	if _, err := toml.Decode(string(b), &ff); err != nil {
+		return nil, fmt.Errorf("decoding %s failed: %v", file, err)
+	}
+
+	pos := filePositions(string(b))
+	var matches []searchMatch
+	for i, f := range ff.Filter {
+		where := file
+		if line := pos.filter(i); line > 0 {
+			where = fmt.Sprintf("%s:%d", file, line)
+		}
+
+		fields := [][2]string{
+			{"query", f.Query},
+			{"negatedQuery", f.NegatedQuery},
+			{"subject", f.Subject},
+			{"label", f.Label},
+			{"forwardTo", f.ForwardTo},
+		}
+		for _, q := range f.QueryOr {
+			fields = append(fields, [2]string{"queryOr", q})
+		}
+		for _, from := range f.From {
+			fields = append(fields, [2]string{"from", from})
+		}
+		for _, to := range f.To {
+			fields = append(fields, [2]string{"to", to})
+		}
+		matches = append(matches, searchFields(where, fields, term)...)
+	}
+	return matches, nil
+}
+
+// searchRemoteFilters returns the fields of the account filters that match
+// the term, given a map of label IDs to names.
+func searchRemoteFilters(filters []gmail.Filter, names labelMap, term string) []searchMatch {
+	var matches []searchMatch
+	for _, f := range filters {
+		var fields [][2]string
+		if c := f.Criteria; c != nil {
+			fields = append(fields,
+				[2]string{"query", c.Query},
+				[2]string{"negatedQuery", c.NegatedQuery},
+				[2]string{"subject", c.Subject},
+				[2]string{"from", c.From},
+				[2]string{"to", c.To},
+			)
+		}
+		if a := f.Action; a != nil {
+			for _, name := range labelNames(a.AddLabelIds, names) {
+				fields = append(fields, [2]string{"addLabel", name})
+			}
+			for _, name := range labelNames(a.RemoveLabelIds, names) {
+				fields = append(fields, [2]string{"removeLabel", name})
+			}
+			fields = append(fields, [2]string{"forward", a.Forward})
+		}
+		matches = append(matches, searchFields("account filter "+f.Id, fields, term)...)
+	}
+	return matches
+}
+
+// searchFields returns the matches of the term among the named values.
+func searchFields(where string, fields [][2]string, term string) []searchMatch {
+	var matches []searchMatch
+	for _, fld := range fields {
+		if score, ok := fuzzyMatch(term, fld[1]); ok {
+			matches = append(matches, searchMatch{where: where, field: fld[0], value: fld[1], score: score})
+		}
+	}
+	return matches
+}
+
+// fuzzyMatch reports whether the characters of the term appear in s in the
+// same order, ignoring case, and scores the match. Exact substrings score
+// the highest, the earlier the better, followed by the matches with the
+// most consecutive characters.
+func fuzzyMatch(term, s string) (int, bool) {
+	term, s = strings.ToLower(term), strings.ToLower(s)
+	if len(term) < 1 || len(s) < 1 {
+		return 0, false
+	}
+
+	if i := strings.Index(s, term); i >= 0 {
+		return 1000 - utf8.RuneCountInString(s[:i]), true
+	}
+
+	t := []rune(term)
+	score, next, last := 0, 0, -2
+	for i, r := range []rune(s) {
+		if next < len(t) && r == t[next] {
+			if last == i-1 {
+				score += 5
+			} else {
+				score++
+			}
+			last = i
+			next++
+		}
+	}
+	if next < len(t) {
+		return 0, false
+	}
+	return score, true
+}
+
+// printSearchMatches writes the matches, best first.
+func printSearchMatches(w io.Writer, matches []searchMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	for _, m := range matches {
+		fmt.Fprintf(w, "%s: %s = %s\n", m.where, m.field, tomlString(m.value))
+	}
+}
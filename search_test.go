@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	for _, s := range []string{"Invoices", "from:billing subject:invoice", "in-voices"} {
+		if _, ok := fuzzyMatch("invoice", s); !ok {
+			t.Fatalf("expected %q to match", s)
+		}
+	}
+	if _, ok := fuzzyMatch("invoice", "receipts"); ok {
+		t.Fatal("expected receipts not to match")
+	}
+
+	exact, _ := fuzzyMatch("invoice", "invoices")
+	later, _ := fuzzyMatch("invoice", "subject:invoice")
+	fuzzy, _ := fuzzyMatch("invoice", "in-voices")
+	if !(exact > later && later > fuzzy) {
+		t.Fatalf("expected the scores to be ordered, got %d, %d, %d", exact, later, fuzzy)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(`[[filter]]
+query = "list:dev"
+label = "dev"
+
+[[filter]]
+from = ["billing@example.com"]
+label = "Invoices"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := searchFile(file, nil, "invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches = append(matches, searchRemoteFilters([]gmail.Filter{
+		{Id: "a", Criteria: &gmail.FilterCriteria{Query: "subject:invoice"}, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}},
+	}, labelMap{"Label_1": "Invoices"}, "invoice")...)
+
+	var buf bytes.Buffer
+	printSearchMatches(&buf, matches)
+	expected := file + `:5: label = "Invoices"
+account filter a: addLabel = "Invoices"
+account filter a: query = "subject:invoice"
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
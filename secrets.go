@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// secretBackend fetches the secret a reference points to. The reference is
+// what comes after the scheme, like projects/p/secrets/s for
+// gcp-secret://projects/p/secrets/s.
+type secretBackend func(ctx context.Context, ref string) (string, error)
+
+// secretBackends are the secret stores the credentials and the token can be
+// fetched from instead of files, by the scheme of their reference.
+var secretBackends = map[string]secretBackend{
+	"gcp-secret": gcpSecret,
+	"op":         onePasswordSecret,
+	"vault":      vaultSecret,
+}
+
+// secretClient is the client fetching the secrets.
+var secretClient = &http.Client{Timeout: 30 * time.Second}
+
+// secretBackendFor returns the backend of the secret reference, if the path
+// is one.
+func secretBackendFor(path string) (secretBackend, string, bool) {
+	i := strings.Index(path, "://")
+	if i < 0 {
+		return nil, "", false
+	}
+	b, ok := secretBackends[path[:i]]
+	return b, path[i+3:], ok
+}
+
+// isSecretRef returns true if the path is a reference to a secret.
+func isSecretRef(path string) bool {
+	_, _, ok := secretBackendFor(path)
+	return ok
+}
+
+// fetchSecret fetches the secret the reference points to.
+func fetchSecret(ctx context.Context, path string) (string, error) {
+	b, ref, ok := secretBackendFor(path)
+	if !ok {
+		return "", fmt.Errorf("%s is not a secret reference", path)
+	}
+	v, err := b(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s failed: %v", path, err)
+	}
+	return v, nil
+}
+
+// secretManagerURL is the endpoint of Google Secret Manager.
+var secretManagerURL = "https://secretmanager.googleapis.com/v1/"
+
+// secretManagerTokens returns the token source to access Google Secret
+// Manager with, the application default credentials.
+var secretManagerTokens = func(ctx context.Context) (oauth2.TokenSource, error) {
+	return google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+}
+
+// gcpSecret fetches a secret version from Google Secret Manager, the latest
+// one unless the reference names one.
+func gcpSecret(ctx context.Context, ref string) (string, error) {
+	parts := strings.Split(ref, "/")
+	if (len(parts) != 4 && len(parts) != 6) || parts[0] != "projects" || parts[2] != "secrets" {
+		return "", errors.New("expected projects/<project>/secrets/<secret>[/versions/<version>]")
+	}
+	if len(parts) == 4 {
+		ref += "/versions/latest"
+	}
+
+	ts, err := secretManagerTokens(ctx)
+	if err != nil {
+		return "", err
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", secretManagerURL+ref+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	tok.SetAuthHeader(req)
+
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := getJSON(ctx, secretClient, req, &resp); err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("decoding the secret failed: %v", err)
+	}
+	return string(b), nil
+}
+
+// vaultSecret fetches a secret from HashiCorp Vault, at VAULT_ADDR with the
+// token in VAULT_TOKEN or ~/.vault-token. The field of the secret comes after
+// a #, and can be left out if it has only one. Both versions of the KV
+// secrets engine work.
+func vaultSecret(ctx context.Context, ref string) (string, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if len(addr) < 1 {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return "", err
+	}
+
+	path, field := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		path, field = ref[:i], ref[i+1:]
+	}
+	req, err := http.NewRequest("GET", addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); len(ns) > 0 {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := getJSON(ctx, secretClient, req, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	// The KV version 2 engine nests the secret with its metadata.
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+
+	if len(field) < 1 {
+		if len(data) != 1 {
+			keys := make([]string, 0, len(data))
+			for k := range data {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return "", fmt.Errorf("the secret has the fields %s, pick one with #<field>", strings.Join(keys, ", "))
+		}
+		for k := range data {
+			field = k
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no field %s", field)
+	}
+	return v, nil
+}
+
+// onePasswordSecret reads a secret from 1Password with the op CLI, which
+// takes care of signing in, with op://<vault>/<item>/<field> references.
+func onePasswordSecret(ctx context.Context, ref string) (string, error) {
+	if _, err := exec.LookPath("op"); err != nil {
+		return "", fmt.Errorf("1Password references need the op CLI: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "op", "read", "--no-newline", "op://"+ref)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// vaultToken returns the Vault token, from VAULT_TOKEN or the file the vault
+// CLI saves it to when logging in.
+func vaultToken() (string, error) {
+	if t := os.Getenv("VAULT_TOKEN"); len(t) > 0 {
+		return t, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", errors.New("VAULT_TOKEN is not set and there is no ~/.vault-token, run vault login")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// getJSON does the request with the client and decodes the JSON response
+// into v.
+func getJSON(ctx context.Context, client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
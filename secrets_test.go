@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestGCPSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/projects/p/secrets/token/versions/latest:access" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"payload": {"data": %q}}`, base64.StdEncoding.EncodeToString([]byte(`{"refresh_token": "r"}`)))
+	}))
+	defer srv.Close()
+
+	defer func(oldURL string, oldTokens func(context.Context) (oauth2.TokenSource, error)) {
+		secretManagerURL = oldURL
+		secretManagerTokens = oldTokens
+	}(secretManagerURL, secretManagerTokens)
+	secretManagerURL = srv.URL + "/"
+	secretManagerTokens = func(ctx context.Context) (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "access"}), nil
+	}
+
+	defer func(old string) { tokenFile = old }(tokenFile)
+	tokenFile = "gcp-secret://projects/p/secrets/token"
+	tok, err := readToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.RefreshToken != "r" {
+		t.Fatalf("expected the refresh token r, got %+v", tok)
+	}
+	if err := writeToken(tok); err == nil {
+		t.Fatal("expected saving the token to the secret to fail")
+	}
+
+	if _, err := fetchSecret(context.Background(), "gcp-secret://p/token"); err == nil {
+		t.Fatal("expected a reference without projects/ to fail")
+	}
+}
+
+func TestVaultSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, `{"errors": ["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/gmailfilters":
+			fmt.Fprint(w, `{"data": {"data": {"credentials": "{\"installed\": {}}", "token": "r"}, "metadata": {"version": 1}}}`)
+		case "/v1/kv/gmailfilters":
+			fmt.Fprint(w, `{"data": {"token": "r"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, env := range []string{"VAULT_ADDR", "VAULT_TOKEN"} {
+		defer func(env, old string) { os.Setenv(env, old) }(env, os.Getenv(env))
+	}
+	os.Setenv("VAULT_ADDR", srv.URL)
+	os.Setenv("VAULT_TOKEN", "vault-token")
+
+	ctx := context.Background()
+	for ref, expected := range map[string]string{
+		"vault://secret/data/gmailfilters#credentials": `{"installed": {}}`,
+		"vault://secret/data/gmailfilters#token":       "r",
+		"vault://kv/gmailfilters":                      "r",
+	} {
+		v, err := fetchSecret(ctx, ref)
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+		if v != expected {
+			t.Fatalf("%s: expected %q, got %q", ref, expected, v)
+		}
+	}
+
+	for _, ref := range []string{"vault://secret/data/gmailfilters", "vault://secret/data/gmailfilters#other", "vault://secret/data/missing"} {
+		if _, err := fetchSecret(ctx, ref); err == nil {
+			t.Fatalf("%s: expected an error", ref)
+		}
+	}
+}
+
+func TestOnePasswordSecret(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake op is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake op knows a single secret.
+	script := `#!/bin/sh
+if [ "$3" = "op://Private/gmailfilters/token" ]; then
+	printf r
+else
+	echo "[ERROR] could not read secret" >&2
+	exit 1
+fi
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "op"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	ctx := context.Background()
+	v, err := fetchSecret(ctx, "op://Private/gmailfilters/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "r" {
+		t.Fatalf("expected r, got %q", v)
+	}
+	if _, err := fetchSecret(ctx, "op://Private/gmailfilters/other"); err == nil {
+		t.Fatal("expected a missing secret to fail")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+)
+
+// isServiceAccount returns true if the credentials are the key of a service
+// account rather than an OAuth client.
+func isServiceAccount(creds []byte) bool {
+	var f struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(creds, &f) == nil && f.Type == "service_account"
+}
+
+// serviceAccountConfig returns the config of the service account key
+// impersonating the user passed with --impersonate, or with --account. The
+// service account needs domain-wide delegation for the Gmail scopes in the
+// Google Workspace Admin console.
+func serviceAccountConfig(creds []byte) (*jwt.Config, error) {
+	subject := impersonate
+	if len(subject) < 1 {
+		subject = account
+	}
+	if len(subject) < 1 {
+		return nil, errors.New("the credentials are for a service account, pass the user to manage the filters of with --impersonate")
+	}
+
+	config, err := google.JWTConfigFromJSON(creds, oauthScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the service account key failed: %v", err)
+	}
+	config.Subject = subject
+
+	return config, nil
+}
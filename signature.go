@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// verifyKey is the minisign or signify public key the filter files must be
+// signed with, passed with --verify-key.
+var verifyKey string
+
+// signatureSuffixes are appended to the name of a filter file to find its
+// signature, minisign first and then signify.
+var signatureSuffixes = []string{".minisig", ".sig"}
+
+// publicKey is a minisign or signify Ed25519 public key.
+type publicKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// loadPublicKey reads the public key from the file, or from the flag itself
+// if it is the base64 encoded key as printed by minisign.
+func loadPublicKey(s string) (publicKey, error) {
+	var pk publicKey
+
+	encoded := s
+	if !strings.HasPrefix(s, "RW") {
+		b, err := ioutil.ReadFile(s)
+		if err != nil {
+			return pk, fmt.Errorf("reading public key %s failed: %v", s, err)
+		}
+		encoded = lastLine(string(b))
+	}
+
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return pk, fmt.Errorf("%s is not a minisign or signify public key", s)
+	}
+	copy(pk.id[:], b[2:10])
+	pk.key = ed25519.PublicKey(b[10:])
+	return pk, nil
+}
+
+// lastLine returns the last line that is not a comment, which is the key in
+// a minisign or signify public key file.
+func lastLine(s string) string {
+	var last string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "untrusted comment:") {
+			last = line
+		}
+	}
+	return last
+}
+
+// verifyFileSignature checks the filter file was signed with the key passed
+// with --verify-key, if one was, reading the signature from next to it.
+func verifyFileSignature(file string, data []byte) error {
+	if len(verifyKey) < 1 {
+		return nil
+	}
+	if file == stdio {
+		return fmt.Errorf("cannot verify the signature of a filter file read from stdin")
+	}
+
+	pk, err := loadPublicKey(verifyKey)
+	if err != nil {
+		return err
+	}
+
+	var sig []byte
+	for _, suffix := range signatureSuffixes {
+		if sig, err = readFile(file + suffix); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s is not signed, no %s.minisig or %s.sig found: %v", file, file, file, err)
+	}
+
+	if err := verifySignature(pk, data, sig); err != nil {
+		return fmt.Errorf("verifying the signature of %s failed: %v", file, err)
+	}
+	return nil
+}
+
+// verifySignature checks the minisign or signify signature of the data. Its
+// second line is the signature, of the BLAKE2b-512 hash of the data for the
+// ED algorithm minisign uses by default or of the data itself for Ed. Minisign
+// then has a trusted comment, signed along with the signature.
+func verifySignature(pk publicKey, data, sig []byte) error {
+	lines := strings.Split(strings.TrimRight(string(sig), "\n"), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "untrusted comment:") {
+		return fmt.Errorf("not a minisign or signify signature")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(b) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("not a minisign or signify signature")
+	}
+	alg, id, signature := string(b[:2]), b[2:10], b[10:]
+	if !bytes.Equal(id, pk.id[:]) {
+		return fmt.Errorf("signed with key %X, not %X", reverse(id), reverse(pk.id[:]))
+	}
+
+	message := data
+	switch alg {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	if !ed25519.Verify(pk.key, message, signature) {
+		return fmt.Errorf("the signature does not match, the file was changed since it was signed")
+	}
+
+	// The trusted comment of minisign.
+	if len(lines) < 4 {
+		return nil
+	}
+	comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if comment == lines[2] {
+		return fmt.Errorf("malformed trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || !ed25519.Verify(pk.key, append(append([]byte{}, signature...), comment...), global) {
+		return fmt.Errorf("the trusted comment does not match its signature")
+	}
+	return nil
+}
+
+// reverse returns the bytes in reverse order, minisign prints the key IDs
+// little endian.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestVerifyFileSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte("01234567")
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "minisign.pub")
+	key := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), pub...))
+	if err := ioutil.WriteFile(keyFile, []byte("untrusted comment: minisign public key\n"+key+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("[[filter]]\nquery = \"from:a@example.com\"\narchive = true\n")
+	sign := func(alg string, keyID []byte, message []byte) string {
+		return base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyID...), ed25519.Sign(priv, message)...))
+	}
+	sum := blake2b.Sum512(data)
+	signature := ed25519.Sign(priv, sum[:])
+	comment := "timestamp:1700000000\tfile:filters.toml\thashed"
+	minisig := "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), id...), signature...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(ed25519.Sign(priv, append(append([]byte{}, signature...), comment...))) + "\n"
+
+	minisignFile := filepath.Join(dir, "minisign.toml")
+	signifyFile := filepath.Join(dir, "signify.toml")
+	for file, sig := range map[string]string{
+		minisignFile + ".minisig": minisig,
+		signifyFile + ".sig":      "untrusted comment: verify with signify.pub\n" + sign("Ed", id, data) + "\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(sig), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func() { verifyKey = "" }()
+	for _, k := range []string{key, keyFile} {
+		verifyKey = k
+		for _, file := range []string{minisignFile, signifyFile} {
+			if err := verifyFileSignature(file, data); err != nil {
+				t.Fatalf("%s: %v", file, err)
+			}
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		file     string
+		data     []byte
+		expected string
+	}{
+		"tampered":    {file: minisignFile, data: append(data, "delete = true\n"...), expected: "does not match"},
+		"tampered-ed": {file: signifyFile, data: append(data, "delete = true\n"...), expected: "does not match"},
+		"unsigned":    {file: filepath.Join(dir, "unsigned.toml"), data: data, expected: "is not signed"},
+		"stdin":       {file: stdio, data: data, expected: "stdin"},
+	} {
+		if err := verifyFileSignature(tc.file, tc.data); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s: expected an error containing %q, got %v", name, tc.expected, err)
+		}
+	}
+
+	otherFile := filepath.Join(dir, "other.toml")
+	if err := ioutil.WriteFile(otherFile+".sig", []byte("untrusted comment: other key\n"+sign("Ed", []byte("76543210"), data)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFileSignature(otherFile, data); err == nil || !strings.Contains(err.Error(), "signed with key 3031323334353637") {
+		t.Fatalf("expected an error about the key, got %v", err)
+	}
+
+	forged := strings.Replace(minisig, "hashed", "hashed\tforged", 1)
+	if err := ioutil.WriteFile(minisignFile+".minisig", []byte(forged), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFileSignature(minisignFile, data); err == nil || !strings.Contains(err.Error(), "trusted comment") {
+		t.Fatalf("expected an error about the trusted comment, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// snippetRefRegexp matches @name snippet references at the start of a query
+// term. The leading character is captured so it can be preserved.
+var snippetRefRegexp = regexp.MustCompile(`(^|[\s({-])@([A-Za-z_][A-Za-z0-9_-]*)`)
+
+// expandSnippets replaces @name references in s with the snippet of the same
+// name. References to names that are not snippets are left untouched, since
+// queries can legitimately search for things like @username.
+func expandSnippets(s string, snippets map[string]string) (string, error) {
+	return expandSnippetsSeen(s, snippets, map[string]bool{})
+}
+
+func expandSnippetsSeen(s string, snippets map[string]string, seen map[string]bool) (string, error) {
+	var err error
+	expanded := snippetRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		m := snippetRefRegexp.FindStringSubmatch(ref)
+		prefix, name := m[1], m[2]
+
+		snippet, ok := snippets[name]
+		if !ok || err != nil {
+			return ref
+		}
+
+		if seen[name] {
+			err = fmt.Errorf("snippet @%s references itself", name)
+			return ref
+		}
+
+		// Snippets can reference other snippets.
+		seen[name] = true
+		snippet, err = expandSnippetsSeen(snippet, snippets, seen)
+		delete(seen, name)
+
+		return prefix + snippet
+	})
+
+	return expanded, err
+}
+
+// expandFilterSnippets expands the snippet references in the queries of the
+// filters.
+func expandFilterSnippets(filters []filter, snippets map[string]string) ([]filter, error) {
+	if len(snippets) < 1 {
+		return filters, nil
+	}
+
+	var err error
+	for i := range filters {
+		f := &filters[i]
+
+		if f.Query, err = expandSnippets(f.Query, snippets); err != nil {
+			return nil, err
+		}
+		for j := range f.QueryOr {
+			if f.QueryOr[j], err = expandSnippets(f.QueryOr[j], snippets); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return filters, nil
+}
+
+// collapseSnippets does the reverse of expandSnippets and replaces the
+// occurrences of expanded snippet values in s with a reference to the snippet.
+// Longer snippets are tried first so they win over any snippet they contain.
+func collapseSnippets(s string, snippets map[string]string) string {
+	values := map[string]string{}
+	names := make([]string, 0, len(snippets))
+	for name := range snippets {
+		v, err := expandSnippets("@"+name, snippets)
+		if err != nil || len(v) < 1 {
+			continue
+		}
+		values[name] = v
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(values[names[i]]) != len(values[names[j]]) {
+			return len(values[names[i]]) > len(values[names[j]])
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		s = replaceTerms(s, values[name], "@"+name)
+	}
+
+	return s
+}
+
+// replaceTerms replaces the occurrences of old in s that are whole query
+// terms with new, so a value like from:a is not replaced in from:alice. An
+// occurrence is a whole term if it is between the characters a reference can
+// follow in expandSnippets and the end of s, a space or a closing parenthesis
+// or brace.
+func replaceTerms(s, old, new string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i <= len(s)-len(old); {
+		j := strings.Index(s[i:], old)
+		if j < 0 {
+			break
+		}
+		i += j
+
+		end := i + len(old)
+		before := i == 0 || strings.ContainsRune(" \t\n\r({-", rune(s[i-1]))
+		after := end == len(s) || strings.ContainsRune(" \t\n\r)}", rune(s[end]))
+		if !before || !after {
+			i++
+			continue
+		}
+		b.WriteString(s[last:i])
+		b.WriteString(new)
+		last, i = end, end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stdio is the file name reading from stdin or writing to stdout.
+const stdio = "-"
+
+// stdin holds what was read from stdin, so the filter file can be read from
+// it more than once.
+var stdin struct {
+	once sync.Once
+	b    []byte
+	err  error
+}
+
+// urlHeaderEnv is the environment variable holding a header sent along when
+// fetching filter files, to authenticate to private repositories.
+const urlHeaderEnv = "GMAILFILTERS_URL_HEADER"
+
+// maxFetchedFileSize is the largest filter file fetched from a URL.
+const maxFetchedFileSize = 10 << 20
+
+// fetchClient fetches the filter files from URLs.
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetched holds the filter files fetched from URLs, so they are only fetched
+// once.
+var fetched = struct {
+	sync.Mutex
+	files map[string][]byte
+}{files: map[string][]byte{}}
+
+// readFile reads the file, stdin if it is named -, the URL if it is one, the
+// file in the git repository if it is a git source or the object in S3 or
+// Google Cloud Storage.
+func readFile(file string) ([]byte, error) {
+	switch {
+	case isObjectURL(file):
+		return readObject(context.Background(), file)
+	case file == stdio:
+		stdin.once.Do(func() {
+			stdin.b, stdin.err = ioutil.ReadAll(os.Stdin)
+		})
+		return stdin.b, stdin.err
+	case isGitSource(file):
+		return readGitFile(file)
+	case isURL(file):
+		return fetchFile(file)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// isURL returns true if the file is a URL rather than a path.
+func isURL(file string) bool {
+	return strings.HasPrefix(file, "https://") || strings.HasPrefix(file, "http://")
+}
+
+// isRemote returns true if the file is not a local file, so it cannot be
+// written to.
+func isRemote(file string) bool {
+	return isURL(file) || isGitSource(file)
+}
+
+// gitPrefix starts the filter files in git repositories.
+const gitPrefix = "git+"
+
+// isGitSource returns true if the file is in a git repository, as
+// git+<repository>//<path>?ref=<ref>.
+func isGitSource(file string) bool {
+	return strings.HasPrefix(file, gitPrefix)
+}
+
+// gitSource is a filter file in a git repository.
+type gitSource struct {
+	repo string
+	path string
+	ref  string
+}
+
+// parseGitSource splits the git source into the repository, the path of the
+// file in it and the ref to check out, HEAD if there is none.
+func parseGitSource(file string) (gitSource, error) {
+	s := gitSource{repo: strings.TrimPrefix(file, gitPrefix), ref: "HEAD"}
+	if i := strings.LastIndex(s.repo, "?ref="); i >= 0 {
+		s.repo, s.ref = s.repo[:i], s.repo[i+len("?ref="):]
+	}
+
+	// The path follows the first // after the one of the scheme.
+	start := 0
+	if i := strings.Index(s.repo, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	i := strings.Index(s.repo[start:], "//")
+	if i < 0 {
+		return s, fmt.Errorf("%s: must be in the form git+<repository>//<path>?ref=<ref>", file)
+	}
+	s.repo, s.path = s.repo[:start+i], s.repo[start+i+2:]
+	if len(s.repo) < 1 || len(s.path) < 1 || len(s.ref) < 1 {
+		return s, fmt.Errorf("%s: must be in the form git+<repository>//<path>?ref=<ref>", file)
+	}
+	return s, nil
+}
+
+// gitCheckoutDir returns the directory the repository is checked out to, in
+// the config directory.
+func gitCheckoutDir(repo string) string {
+	return filepath.Join(configDir, "repos", strings.Trim(nonAlnumRegexp.ReplaceAllString(repo, "_"), "_"))
+}
+
+// nonAlnumRegexp matches the characters replaced in the names of checkouts.
+var nonAlnumRegexp = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// readGitFile checks out the ref of the repository, cloning it the first
+// time, and reads the file from it.
+func readGitFile(file string) ([]byte, error) {
+	s, err := parseGitSource(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched.Lock()
+	defer fetched.Unlock()
+	if b, ok := fetched.files[file]; ok {
+		return b, nil
+	}
+
+	dir := gitCheckoutDir(s.repo)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := runGit(dir, "init", "--quiet"); err != nil {
+			return nil, err
+		}
+		if err := runGit(dir, "remote", "add", "origin", s.repo); err != nil {
+			return nil, err
+		}
+	}
+	// Only the ref we need is fetched, and the file is read from it
+	// whatever was changed in the checkout.
+	if err := runGit(dir, "fetch", "--quiet", "--depth", "1", "origin", s.ref); err != nil {
+		return nil, err
+	}
+	if err := runGit(dir, "checkout", "--quiet", "--force", "FETCH_HEAD"); err != nil {
+		return nil, err
+	}
+	commit, err := exec.Command("git", "-C", dir, "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-parse in %s failed: %v", dir, err)
+	}
+	logrus.Infof("Checked out %s at %s (%s)", s.repo, s.ref, strings.TrimSpace(string(commit)))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(s.path)))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from %s failed: %v", s.path, s.repo, err)
+	}
+	fetched.files[file] = b
+	return b, nil
+}
+
+// runGit runs the git command in the directory.
+func runGit(dir string, args ...string) error {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fetchFile fetches the file from the URL, sending the header in
+// GMAILFILTERS_URL_HEADER if it is set. Only HTTPS is allowed so nobody can
+// change the filters on the way.
+func fetchFile(u string) ([]byte, error) {
+	if !strings.HasPrefix(u, "https://") {
+		return nil, fmt.Errorf("refusing to fetch %s over plain HTTP, use https://", u)
+	}
+
+	fetched.Lock()
+	defer fetched.Unlock()
+	if b, ok := fetched.files[u]; ok {
+		return b, nil
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header := os.Getenv(urlHeaderEnv); len(header) > 0 {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s must be in the form Name: value", urlHeaderEnv)
+		}
+		req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s failed: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s failed: %s", u, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchedFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s failed: %v", u, err)
+	}
+	if len(b) > maxFetchedFileSize {
+		return nil, fmt.Errorf("fetching %s failed: larger than %d bytes", u, maxFetchedFileSize)
+	}
+
+	fetched.files[u] = b
+	return b, nil
+}
+
+// fileGroup returns the group of the filters in the file, its name without
+// the extension.
+func fileGroup(file string) string {
+	switch {
+	case file == stdio:
+		return "stdin"
+	case isGitSource(file):
+		if s, err := parseGitSource(file); err == nil {
+			file = s.path
+		}
+	case isURL(file), isObjectURL(file):
+		file = path.Base(strings.SplitN(file, "?", 2)[0])
+	}
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
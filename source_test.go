@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchFile(t *testing.T) {
+	requests := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Private-Token") != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[[filter]]\nquery = \"from:a@example.com\"\n"))
+	}))
+	defer srv.Close()
+
+	oldClient := fetchClient
+	fetchClient = srv.Client()
+	defer func() { fetchClient = oldClient }()
+
+	u := srv.URL + "/team/filters/raw/main/work.toml?inline=false"
+	if _, err := readFile(u); err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Fatalf("expected the fetch to be refused without the header, got %v", err)
+	}
+
+	os.Setenv(urlHeaderEnv, "Private-Token: secret")
+	defer os.Unsetenv(urlHeaderEnv)
+	for i := 0; i < 2; i++ {
+		b, err := readFile(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), "from:a@example.com") {
+			t.Fatalf("expected the filter file, got %q", b)
+		}
+	}
+	// It is only fetched once it succeeded.
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+
+	if got := fileGroup(u); got != "work" {
+		t.Fatalf("expected the group work, got %q", got)
+	}
+
+	if _, err := readFile("http://example.com/filters.toml"); err == nil || !strings.Contains(err.Error(), "plain HTTP") {
+		t.Fatalf("expected plain HTTP to be refused, got %v", err)
+	}
+}
+
+func TestParseGitSource(t *testing.T) {
+	for file, expected := range map[string]gitSource{
+		"git+https://github.com/me/dotfiles.git//mail/filters.toml?ref=v1.2": {repo: "https://github.com/me/dotfiles.git", path: "mail/filters.toml", ref: "v1.2"},
+		"git+ssh://git@github.com/me/dotfiles.git//filters.toml":             {repo: "ssh://git@github.com/me/dotfiles.git", path: "filters.toml", ref: "HEAD"},
+		"git+git@github.com:me/dotfiles.git//filters.toml?ref=main":          {repo: "git@github.com:me/dotfiles.git", path: "filters.toml", ref: "main"},
+	} {
+		got, err := parseGitSource(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if got != expected {
+			t.Fatalf("%s: expected %#v, got %#v", file, expected, got)
+		}
+	}
+
+	if _, err := parseGitSource("git+https://github.com/me/dotfiles.git"); err == nil {
+		t.Fatal("expected an error for a git source without a path")
+	}
+}
+
+func TestReadGitFile(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configDir = filepath.Join(dir, "config")
+	defer func() { configDir = "" }()
+
+	// A repository with the filter file changed on a branch.
+	repo := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, "mail"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(query string, args ...string) {
+		if err := ioutil.WriteFile(filepath.Join(repo, "mail", "filters.toml"), []byte("[[filter]]\nquery = \""+query+"\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range [][]string{args, {"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", query}} {
+			if len(a) < 1 {
+				continue
+			}
+			if err := runGit(repo, a...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := runGit(repo, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	commit("from:main@example.com", "checkout", "--quiet", "-b", "main")
+	commit("from:next@example.com", "checkout", "--quiet", "-b", "next")
+
+	for ref, expected := range map[string]string{
+		"?ref=main": "from:main@example.com",
+		"?ref=next": "from:next@example.com",
+		"":          "from:next@example.com",
+	} {
+		b, err := readFile("git+file://" + repo + "//mail/filters.toml" + ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("%q: expected %s in %q", ref, expected, b)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// syncState is the local record of the filters created by this tool. Only
+// these managed filters are ever deleted, filters created by hand in Gmail
+// are left alone.
+type syncState struct {
+	// Managed maps the Gmail filter IDs of the managed filters to their
+	// fingerprint.
+	Managed map[string]string `json:"managed"`
+	// Groups maps the Gmail filter IDs of the managed filters to the group
+	// they were synced from.
+	Groups map[string]string `json:"groups,omitempty"`
+	// Applied holds the fingerprints of the filters from the file that were
+	// in the account after the last sync. It is the base used to tell
+	// changes made in the file apart from changes made in the account.
+	Applied []string `json:"applied,omitempty"`
+	// LastSync is the journal of the changes made by the last sync.
+	LastSync *journal `json:"lastSync,omitempty"`
+}
+
+// journal records the changes made to the account by a sync so they can be
+// undone.
+type journal struct {
+	Time    time.Time      `json:"time"`
+	Created []gmail.Filter `json:"created"`
+	Deleted []gmail.Filter `json:"deleted"`
+	// Applied is the base from before the sync.
+	Applied []string `json:"applied,omitempty"`
+}
+
+// loadState reads the state file, returning an empty state if it does not
+// exist yet.
+func loadState(file string) (*syncState, error) {
+	s := &syncState{Managed: map[string]string{}, Groups: map[string]string{}}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state file %s failed: %v", file, err)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("decoding state file %s failed: %v", file, err)
+	}
+	if s.Managed == nil {
+		s.Managed = map[string]string{}
+	}
+	if s.Groups == nil {
+		s.Groups = map[string]string{}
+	}
+
+	return s, nil
+}
+
+// save writes the state to the state file.
+func (s *syncState) save(file string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding state failed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		return fmt.Errorf("writing state file %s failed: %v", file, err)
+	}
+
+	return nil
+}
+
+// managed returns true if the filter was created by this tool.
+func (s *syncState) managed(f gmail.Filter) bool {
+	_, ok := s.Managed[f.Id]
+	return ok
+}
+
+// add records the filter as managed.
+func (s *syncState) add(f gmail.Filter) {
+	s.Managed[f.Id] = fingerprint(f)
+}
+
+// remove forgets about the filter.
+func (s *syncState) remove(f gmail.Filter) {
+	delete(s.Managed, f.Id)
+	delete(s.Groups, f.Id)
+}
+
+// setGroups records the group of the managed filters, given the groups of the
+// filters in the file by fingerprint.
+func (s *syncState) setGroups(groups map[string]string) {
+	for id, fp := range s.Managed {
+		if g, ok := groups[fp]; ok {
+			s.Groups[id] = g
+		}
+	}
+}
+
+// withOnlyGroup returns the diff with the deletions of filters that were not
+// synced from the group turned into filters that are kept.
+func (d filterDiff) withOnlyGroup(state *syncState, group string) filterDiff {
+	var deletes []gmail.Filter
+	for _, f := range d.Delete {
+		if state.Groups[f.Id] == group {
+			deletes = append(deletes, f)
+			continue
+		}
+		d.Kept = append(d.Kept, f)
+	}
+	d.Delete = deletes
+	return d
+}
+
+// withOnlyManaged returns the diff with the deletions and updates of filters
+// that are not managed by this tool turned into filters that are kept.
+func (d filterDiff) withOnlyManaged(state *syncState) filterDiff {
+	var deletes []gmail.Filter
+	for _, f := range d.Delete {
+		if state.managed(f) {
+			deletes = append(deletes, f)
+			continue
+		}
+		d.Kept = append(d.Kept, f)
+	}
+	d.Delete = deletes
+	return d.withoutUnmanagedUpdates(state)
+}
+
+// withoutUnmanagedUpdates returns the diff with the updates of filters that
+// are not managed by this tool turned into the old filter being kept and the
+// new one created next to it, as updating a filter deletes it.
+func (d filterDiff) withoutUnmanagedUpdates(state *syncState) filterDiff {
+	var updates []filterUpdate
+	for _, u := range d.Update {
+		if state.managed(u.Old) {
+			updates = append(updates, u)
+			continue
+		}
+		d.Kept = append(d.Kept, u.Old)
+		d.Create = append(d.Create, u.New)
+	}
+	d.Update = updates
+	return d
+}
+
+// applied returns the set of fingerprints applied by the last sync.
+func (s *syncState) applied() map[string]bool {
+	base := map[string]bool{}
+	for _, fp := range s.Applied {
+		base[fp] = true
+	}
+	return base
+}
+
+// setApplied records the filters from the file that are in the account after
+// applying the diff, given the filters that were created, as the base for the
+// next sync. The conflicts were not applied so they keep their old base.
+func (s *syncState) setApplied(d filterDiff, created []gmail.Filter) {
+	base := s.applied()
+
+	applied := map[string]bool{}
+	// Only some of the filters were synced, the base of the others still
+	// stands.
+	if len(only) > 0 || len(syncGroup) > 0 {
+		applied = base
+	}
+	for _, f := range d.Unchanged {
+		applied[fingerprint(f)] = true
+	}
+	for _, f := range created {
+		applied[fingerprint(f)] = true
+	}
+	for _, c := range d.Conflicts {
+		if base[fingerprint(c.New)] {
+			applied[fingerprint(c.New)] = true
+		}
+	}
+
+	s.Applied = make([]string, 0, len(applied))
+	for fp := range applied {
+		s.Applied = append(s.Applied, fp)
+	}
+	sort.Strings(s.Applied)
+}
+
+// filterConflict is a change to a filter that was also changed in the
+// account since the last sync.
+type filterConflict struct {
+	Old gmail.Filter
+	New gmail.Filter
+	// Both is true if the filter changed in the file as well as in the
+	// account. If the filter was deleted in the account Old is empty.
+	Both bool
+}
+
+// withoutConflicts returns the diff with the changes to filters that were
+// changed in the account since the last sync turned into conflicts, so they
+// are not silently overwritten. Without a last sync there is nothing to
+// compare to and the diff is returned as is.
+func (d filterDiff) withoutConflicts(state *syncState) filterDiff {
+	base := state.applied()
+	if len(base) < 1 {
+		return d
+	}
+
+	// The remote filter is not what we left there, it was changed in the
+	// account.
+	var updates []filterUpdate
+	for _, u := range d.Update {
+		if base[fingerprint(u.Old)] {
+			updates = append(updates, u)
+			continue
+		}
+		d.Conflicts = append(d.Conflicts, filterConflict{Old: u.Old, New: u.New, Both: !base[fingerprint(u.New)]})
+	}
+	d.Update = updates
+
+	// We created the filter before, it was deleted in the account.
+	var creates []gmail.Filter
+	for _, f := range d.Create {
+		if !base[fingerprint(f)] {
+			creates = append(creates, f)
+			continue
+		}
+		d.Conflicts = append(d.Conflicts, filterConflict{New: f})
+	}
+	d.Create = creates
+
+	return d
+}
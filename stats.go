@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const statsHelp = `Summarize the filters in a filter file.`
+
+const statsLongHelp = statsHelp + `
+
+Shows how many filters take each action and apply each label, how long the
+queries are, how many Gmail filters each entry in the file turns into, and how
+close the file is to the limits of Gmail.`
+
+func (cmd *statsCommand) Name() string      { return "stats" }
+func (cmd *statsCommand) Args() string      { return "<file>..." }
+func (cmd *statsCommand) ShortHelp() string { return statsHelp }
+func (cmd *statsCommand) LongHelp() string  { return statsLongHelp }
+func (cmd *statsCommand) Hidden() bool      { return false }
+
+func (cmd *statsCommand) Register(fs *flag.FlagSet) {
+	registerSelectFlags(fs)
+
+	fs.StringVar(&cmd.output, "output", "text", "output format: text or json")
+}
+
+type statsCommand struct {
+	output string
+}
+
+func (cmd *statsCommand) Run(ctx context.Context, args []string) error {
+	switch cmd.output {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid output format %q, must be text or json", cmd.output)
+	}
+
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	ff, err := loadFilterFiles(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := computeStats(ctx, ff)
+	if err != nil {
+		return err
+	}
+
+	if cmd.output == "json" {
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding stats failed: %v", err)
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(b))
+		return err
+	}
+	return printStats(os.Stdout, s)
+}
+
+// filterStats summarizes a filter file.
+type filterStats struct {
+	// Entries is the number of filters in the file, and Filters the number
+	// of Gmail filters they are converted to.
+	Entries int `json:"entries"`
+	Filters int `json:"filters"`
+	// MaxFilters is the most filters Gmail allows in an account.
+	MaxFilters int `json:"maxFilters"`
+	// AverageQueryLength is over the Gmail filters with a query.
+	AverageQueryLength float64 `json:"averageQueryLength"`
+	// LongestCriteria is the longest query, from or to criteria, which Gmail
+	// limits to MaxCriteriaLength characters.
+	LongestCriteria   int `json:"longestCriteria"`
+	MaxCriteriaLength int `json:"maxCriteriaLength"`
+	// Actions is the number of Gmail filters taking each action, named after
+	// the filter file settings.
+	Actions []statsCount `json:"actions"`
+	// Labels is the number of Gmail filters applying each label, the most
+	// used first.
+	Labels []statsCount `json:"labels"`
+}
+
+// statsCount is the number of filters with an action or label.
+type statsCount struct {
+	Name    string `json:"name"`
+	Filters int    `json:"filters"`
+}
+
+// expansion returns the number of Gmail filters per entry in the file.
+func (s filterStats) expansion() float64 {
+	if s.Entries < 1 {
+		return 0
+	}
+	return float64(s.Filters) / float64(s.Entries)
+}
+
+// computeStats converts the filters in the file to Gmail filters and counts
+// what they do.
+func computeStats(ctx context.Context, ff filterfile) (filterStats, error) {
+	s := filterStats{
+		Entries:           len(ff.Filter),
+		MaxFilters:        maxFilters,
+		MaxCriteriaLength: maxCriteriaLength,
+	}
+
+	// The placeholder IDs of the labels are their names, so nothing needs to
+	// be looked up in the account.
+	labels, _, err := labelMap{}.pendingLabels(ff)
+	if err != nil {
+		return s, err
+	}
+
+	var (
+		actions     = map[string]int{}
+		labelCounts = map[string]int{}
+		queries     int
+		queryLength int
+	)
+	for _, f := range ff.Filter {
+		gf, err := f.toGmailFilters(ctx, &labels)
+		if err != nil {
+			return s, err
+		}
+		for _, g := range gf {
+			s.Filters++
+
+			if c := g.Criteria; c != nil {
+				if len(c.Query) > 0 {
+					queries++
+					queryLength += len(c.Query)
+				}
+				for _, v := range []string{c.Query, c.From, c.To} {
+					if len(v) > s.LongestCriteria {
+						s.LongestCriteria = len(v)
+					}
+				}
+			}
+
+			a, l := filterActions(g.Action, labelMap{})
+			for _, name := range a {
+				// Count the forwards together whatever the address.
+				actions[strings.SplitN(name, "=", 2)[0]]++
+			}
+			for _, name := range l {
+				labelCounts[name]++
+			}
+		}
+	}
+	if queries > 0 {
+		s.AverageQueryLength = float64(queryLength) / float64(queries)
+	}
+	s.Actions, s.Labels = sortedCounts(actions), sortedCounts(labelCounts)
+
+	return s, nil
+}
+
+// sortedCounts returns the counts, the highest first and then by name.
+func sortedCounts(m map[string]int) []statsCount {
+	counts := []statsCount{}
+	for name, n := range m {
+		counts = append(counts, statsCount{Name: name, Filters: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Filters != counts[j].Filters {
+			return counts[i].Filters > counts[j].Filters
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
+}
+
+// printStats writes the stats as text, with tables of the actions and labels.
+func printStats(w io.Writer, s filterStats) error {
+	percent := func(n, max int) int {
+		return n * 100 / max
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Entries:\t%d\n", s.Entries)
+	fmt.Fprintf(tw, "Gmail filters:\t%d (%.2f per entry)\n", s.Filters, s.expansion())
+	fmt.Fprintf(tw, "Filter limit:\t%d of %d (%d%%)\n", s.Filters, s.MaxFilters, percent(s.Filters, s.MaxFilters))
+	fmt.Fprintf(tw, "Average query length:\t%.1f characters\n", s.AverageQueryLength)
+	fmt.Fprintf(tw, "Longest criteria:\t%d of %d characters (%d%%)\n", s.LongestCriteria, s.MaxCriteriaLength, percent(s.LongestCriteria, s.MaxCriteriaLength))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, table := range []struct {
+		header string
+		counts []statsCount
+	}{
+		{"ACTION", s.Actions},
+		{"LABEL", s.Labels},
+	} {
+		if len(table.counts) < 1 {
+			continue
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(tw, "%s\tFILTERS\n", table.header)
+		for _, c := range table.counts {
+			fmt.Fprintf(tw, "%s\t%d\n", c.Name, c.Filters)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
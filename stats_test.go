@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestComputeStats(t *testing.T) {
+	ff := filterfile{Filter: []filter{
+		{From: stringList{"github.com"}, Label: "code", ArchiveUnlessToMe: true},
+		{Query: "list:dev", Label: "code", Read: true},
+		{Query: "list:announce", Label: "news", Archive: true, ForwardTo: "me@example.com"},
+		{Subject: "invoice", Star: true},
+	}}
+
+	s, err := computeStats(context.Background(), ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filterStats{
+		Entries:            4,
+		Filters:            5,
+		MaxFilters:         maxFilters,
+		AverageQueryLength: 10.5,
+		LongestCriteria:    13,
+		MaxCriteriaLength:  maxCriteriaLength,
+		Actions: []statsCount{
+			{Name: "archive", Filters: 2},
+			{Name: "forwardTo", Filters: 1},
+			{Name: "read", Filters: 1},
+			{Name: "star", Filters: 1},
+		},
+		Labels: []statsCount{
+			{Name: "code", Filters: 3},
+			{Name: "news", Filters: 1},
+		},
+	}
+	if diff := cmp.Diff(expected, s); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := printStats(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	expectedText := `Entries:               4
+Gmail filters:         5 (1.25 per entry)
+Filter limit:          5 of 1000 (0%)
+Average query length:  10.5 characters
+Longest criteria:      13 of 1500 characters (0%)
+
+ACTION     FILTERS
+archive    2
+forwardTo  1
+read       1
+star       1
+
+LABEL  FILTERS
+code   3
+news   1
+`
+	if diff := cmp.Diff(expectedText, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,932 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// filterDiff holds the changes needed to go from the remote filters to the
+// wanted filters.
+type filterDiff struct {
+	// Create holds the wanted filters that do not exist remotely.
+	Create []gmail.Filter
+	// Delete holds the remote filters that are not wanted.
+	Delete []gmail.Filter
+	// Update holds the remote filters with the same criteria as a wanted
+	// filter but different actions.
+	Update []filterUpdate
+	// Unchanged holds the remote filters that are exactly as wanted.
+	Unchanged []gmail.Filter
+	// Kept holds the remote filters that are not wanted but are left alone
+	// since we are not pruning.
+	Kept []gmail.Filter
+	// Protected holds the remote filters that would have been deleted or
+	// updated but are protected.
+	Protected []gmail.Filter
+	// Conflicts holds the changes to filters that were changed in the
+	// account since the last sync, they are left alone unless overwriting.
+	Conflicts []filterConflict
+}
+
+// scoped returns the diff restricted to the changes we are allowed to make.
+// Without pruning no filters are deleted, with pruning only the filters
+// managed by this tool are, limited to the group being synced if there is
+// one, and protected filters are never touched. Unless overwriting, filters
+// changed in the account since the last sync are left alone too. When
+// deduplicating, exact copies of other filters are deleted regardless of
+// pruning since the copy that stays does the same.
+func (d filterDiff) scoped(state *syncState, rules []protectRule) filterDiff {
+	var dups []gmail.Filter
+	if dedupe {
+		d, dups = d.withoutDuplicates()
+	}
+
+	switch {
+	case !prune:
+		d = d.withoutPrune(state)
+	case len(syncGroup) > 0:
+		d = d.withOnlyManaged(state).withOnlyGroup(state, syncGroup)
+	default:
+		d = d.withOnlyManaged(state)
+	}
+	d.Delete = append(d.Delete, dups...)
+	d = d.withoutProtected(rules)
+	if !overwrite {
+		d = d.withoutConflicts(state)
+	}
+	return d
+}
+
+// withoutPrune returns the diff with the deletions of remote filters that are
+// not in the file turned into filters that are kept, and the updates of
+// filters not managed by this tool too.
+func (d filterDiff) withoutPrune(state *syncState) filterDiff {
+	d.Kept = append(d.Kept, d.Delete...)
+	d.Delete = nil
+	return d.withoutUnmanagedUpdates(state)
+}
+
+// withoutDuplicates returns the diff without the deletions of remote filters
+// that are exact copies of another remote filter that stays, along with
+// those copies.
+func (d filterDiff) withoutDuplicates() (filterDiff, []gmail.Filter) {
+	dups := duplicateFilters(d.Unchanged, d.Delete)
+	if len(dups) < 1 {
+		return d, nil
+	}
+
+	ids := map[string]bool{}
+	for _, f := range dups {
+		ids[f.Id] = true
+	}
+	var deletes []gmail.Filter
+	for _, f := range d.Delete {
+		if !ids[f.Id] {
+			deletes = append(deletes, f)
+		}
+	}
+	d.Delete = deletes
+	return d, dups
+}
+
+// duplicateFilters returns the candidates with the same fingerprint as one of
+// the filters that are kept or as an earlier candidate. The first of several
+// copies is not a duplicate.
+func duplicateFilters(keep, candidates []gmail.Filter) []gmail.Filter {
+	seen := map[string]bool{}
+	for _, f := range keep {
+		seen[fingerprint(f)] = true
+	}
+
+	var dups []gmail.Filter
+	for _, f := range candidates {
+		fp := fingerprint(f)
+		if seen[fp] {
+			dups = append(dups, f)
+			continue
+		}
+		seen[fp] = true
+	}
+	return dups
+}
+
+// filterUpdate is a remote filter and the filter it should be replaced by.
+type filterUpdate struct {
+	Old gmail.Filter
+	New gmail.Filter
+}
+
+// empty returns true if there is nothing to change.
+func (d filterDiff) empty() bool {
+	return len(d.Create) == 0 && len(d.Delete) == 0 && len(d.Update) == 0
+}
+
+// computeDiff compares the wanted filters with the remote filters. Filters
+// with the same fingerprint are unchanged, the remaining filters are matched
+// on their criteria and are updates if they have different actions.
+func computeDiff(wanted, remote []gmail.Filter) filterDiff {
+	var diff filterDiff
+	used := make([]bool, len(remote))
+
+	// Index the remote filters so we can match them quickly.
+	byFingerprint := map[string][]int{}
+	byCriteria := map[string][]int{}
+	for j, r := range remote {
+		byFingerprint[fingerprint(r)] = append(byFingerprint[fingerprint(r)], j)
+		byCriteria[canonicalCriteria(r.Criteria)] = append(byCriteria[canonicalCriteria(r.Criteria)], j)
+	}
+
+	// take returns the first unused remote filter out of the candidates.
+	take := func(candidates []int) int {
+		for _, j := range candidates {
+			if !used[j] {
+				used[j] = true
+				return j
+			}
+		}
+		return -1
+	}
+
+	// First pass, match the filters that are exactly the same so they are
+	// not mistaken for updates when criteria are shared.
+	matched := make([]bool, len(wanted))
+	for i, w := range wanted {
+		if j := take(byFingerprint[fingerprint(w)]); j >= 0 {
+			matched[i] = true
+			diff.Unchanged = append(diff.Unchanged, remote[j])
+		}
+	}
+
+	// Second pass, match the remaining filters on their criteria.
+	for i, w := range wanted {
+		if matched[i] {
+			continue
+		}
+
+		if j := take(byCriteria[canonicalCriteria(w.Criteria)]); j >= 0 {
+			diff.Update = append(diff.Update, filterUpdate{Old: remote[j], New: w})
+			continue
+		}
+		diff.Create = append(diff.Create, w)
+	}
+
+	for j, r := range remote {
+		if !used[j] {
+			diff.Delete = append(diff.Delete, r)
+		}
+	}
+
+	return diff
+}
+
+// fingerprint returns a stable identity for the filter, derived from its
+// normalized criteria and action. Two filters with the same fingerprint
+// behave the same, regardless of their Gmail filter ID.
+func fingerprint(f gmail.Filter) string {
+	sum := sha256.Sum256([]byte(canonicalCriteria(f.Criteria) + "\n" + canonicalAction(f.Action)))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// canonicalCriteria returns the normalized form of the criteria.
+func canonicalCriteria(c *gmail.FilterCriteria) string {
+	if c == nil {
+		return ""
+	}
+
+	return strings.Join([]string{
+		"query=" + normalizeQuery(c.Query),
+		"negatedQuery=" + normalizeQuery(c.NegatedQuery),
+		"from=" + c.From,
+		"to=" + c.To,
+		"subject=" + c.Subject,
+		fmt.Sprintf("hasAttachment=%t", c.HasAttachment),
+		fmt.Sprintf("excludeChats=%t", c.ExcludeChats),
+		fmt.Sprintf("size=%s%d", c.SizeComparison, c.Size),
+	}, "\n")
+}
+
+// canonicalAction returns the normalized form of the action.
+func canonicalAction(a *gmail.FilterAction) string {
+	if a == nil {
+		return ""
+	}
+
+	return strings.Join([]string{
+		"addLabelIds=" + strings.Join(sortedStrings(a.AddLabelIds), ","),
+		"removeLabelIds=" + strings.Join(sortedStrings(a.RemoveLabelIds), ","),
+		"forward=" + a.Forward,
+	}, "\n")
+}
+
+// sortedStrings returns a sorted copy of s.
+func sortedStrings(s []string) []string {
+	sorted := append([]string{}, s...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// field is the name and TOML encoded value of a criteria or action field.
+type field struct {
+	name  string
+	value string
+}
+
+// filterFields returns the non-empty fields of the filter for display, with
+// label IDs replaced by their names.
+func filterFields(f gmail.Filter, names labelMap) []field {
+	var fields []field
+	add := func(name, value string) {
+		if len(value) > 0 {
+			fields = append(fields, field{name: name, value: tomlString(value)})
+		}
+	}
+	addBool := func(name string, value bool) {
+		if value {
+			fields = append(fields, field{name: name, value: "true"})
+		}
+	}
+	addList := func(name string, values []string) {
+		if len(values) < 1 {
+			return
+		}
+		items := make([]string, 0, len(values))
+		for _, v := range values {
+			items = append(items, tomlString(v))
+		}
+		fields = append(fields, field{name: name, value: "[" + strings.Join(items, ", ") + "]"})
+	}
+
+	if c := f.Criteria; c != nil {
+		add("query", normalizeQuery(c.Query))
+		add("negatedQuery", normalizeQuery(c.NegatedQuery))
+		add("from", c.From)
+		add("to", c.To)
+		add("subject", c.Subject)
+		addBool("hasAttachment", c.HasAttachment)
+		addBool("excludeChats", c.ExcludeChats)
+		if c.Size > 0 {
+			add("size", fmt.Sprintf("%s %d", c.SizeComparison, c.Size))
+		}
+	}
+
+	if a := f.Action; a != nil {
+		addList("addLabels", labelNames(a.AddLabelIds, names))
+		addList("removeLabels", labelNames(a.RemoveLabelIds, names))
+		add("forward", a.Forward)
+	}
+
+	return fields
+}
+
+// labelNames returns the sorted names of the label IDs.
+func labelNames(ids []string, names labelMap) []string {
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := names[id]; ok {
+			list = append(list, name)
+			continue
+		}
+		list = append(list, id)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// printDiff writes a readable representation of the diff to w.
+func printDiff(w io.Writer, diff filterDiff, names labelMap) {
+	fmt.Fprintf(w, "Plan: %d to create, %d to update, %d to delete, %d unchanged.\n",
+		len(diff.Create), len(diff.Update), len(diff.Delete), len(diff.Unchanged))
+	printDiffNotes(w, diff)
+
+	for _, f := range diff.Create {
+		fmt.Fprintln(w)
+		printFilter(w, "+", f, names)
+	}
+
+	for _, u := range diff.Update {
+		fmt.Fprintln(w)
+		printUpdate(w, u, names)
+	}
+
+	for _, f := range diff.Delete {
+		fmt.Fprintln(w)
+		printFilter(w, "-", f, names)
+	}
+
+	for _, c := range diff.Conflicts {
+		fmt.Fprintln(w)
+		printConflict(w, c, names)
+	}
+}
+
+// printDiffNotes writes a note about the filters the diff leaves alone.
+func printDiffNotes(w io.Writer, diff filterDiff) {
+	if len(diff.Kept) > 0 {
+		fmt.Fprintf(w, "Keeping %d filters that are not in the file or not created by gmailfilters.\n", len(diff.Kept))
+	}
+	if dups := duplicateFilters(diff.Unchanged, diff.Kept); len(dups) > 0 {
+		fmt.Fprintf(w, "Keeping %d filters that are exact copies of another filter, pass --dedupe to delete them.\n", len(dups))
+	}
+	if len(diff.Protected) > 0 {
+		fmt.Fprintf(w, "Leaving %d protected filters untouched.\n", len(diff.Protected))
+	}
+	if len(diff.Conflicts) > 0 {
+		fmt.Fprintf(w, "Leaving %d filters changed in the account since the last sync untouched, pass --overwrite to replace them.\n", len(diff.Conflicts))
+	}
+}
+
+// printConflict writes a filter that was changed in the account along with
+// the change we did not make.
+func printConflict(w io.Writer, c filterConflict, names labelMap) {
+	switch {
+	case len(c.Old.Id) < 1:
+		printDiffLine(w, "! deleted in the account since the last sync:")
+		printFilter(w, "!", c.New, names)
+	case c.Both:
+		printDiffLine(w, "! changed in both the file and the account since the last sync:")
+		printUpdate(w, filterUpdate{Old: c.Old, New: c.New}, names)
+	default:
+		printDiffLine(w, "! changed in the account since the last sync:")
+		printUpdate(w, filterUpdate{Old: c.Old, New: c.New}, names)
+	}
+}
+
+// printFilter writes the filter as TOML, each line prefixed with prefix,
+// under a hunk header identifying it.
+func printFilter(w io.Writer, prefix string, f gmail.Filter, names labelMap) {
+	header := "filter"
+	if len(f.Id) > 0 {
+		header = fmt.Sprintf("filter %s", f.Id)
+	}
+	printDiffLine(w, fmt.Sprintf("@@ %s (fingerprint %s) @@", header, fingerprint(f)))
+
+	printDiffLine(w, prefix+"[[filter]]")
+	for _, fld := range filterFields(f, names) {
+		printDiffLine(w, fmt.Sprintf("%s%s = %s", prefix, fld.name, fld.value))
+	}
+}
+
+// printUpdate writes a unified diff of the old and new filter as TOML.
+func printUpdate(w io.Writer, u filterUpdate, names labelMap) {
+	printDiffLine(w, fmt.Sprintf("@@ filter %s (fingerprint %s -> %s) @@", u.Old.Id, fingerprint(u.Old), fingerprint(u.New)))
+
+	printDiffLine(w, " [[filter]]")
+	for _, c := range fieldChanges(u.Old, u.New, names) {
+		if c.old == c.new {
+			printDiffLine(w, fmt.Sprintf(" %s = %s", c.name, c.new))
+			continue
+		}
+		if len(c.old) > 0 {
+			printDiffLine(w, fmt.Sprintf("-%s = %s", c.name, c.old))
+		}
+		if len(c.new) > 0 {
+			printDiffLine(w, fmt.Sprintf("+%s = %s", c.name, c.new))
+		}
+	}
+}
+
+// fieldChange is the old and new TOML encoded value of a field.
+type fieldChange struct {
+	name string
+	old  string
+	new  string
+}
+
+// fieldChanges returns all the fields of both filters along with their old
+// and new values, in a stable order.
+func fieldChanges(old, new gmail.Filter, names labelMap) []fieldChange {
+	var (
+		changes []fieldChange
+		index   = map[string]int{}
+	)
+
+	for _, fld := range filterFields(old, names) {
+		index[fld.name] = len(changes)
+		changes = append(changes, fieldChange{name: fld.name, old: fld.value})
+	}
+
+	for _, fld := range filterFields(new, names) {
+		if i, ok := index[fld.name]; ok {
+			changes[i].new = fld.value
+			continue
+		}
+		changes = append(changes, fieldChange{name: fld.name, new: fld.value})
+	}
+
+	return changes
+}
+
+// wantedFilters converts the filters from the file into Gmail filters. It
+// also returns the group of each of them, by fingerprint.
+func wantedFilters(ctx context.Context, filters []filter, labels *labelMap) ([]gmail.Filter, map[string]string, error) {
+	var wanted []gmail.Filter
+	groups := map[string]string{}
+	for _, f := range filters {
+		gf, err := f.toGmailFilters(ctx, labels)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range f.conflictingActions() {
+			logrus.Warnf("Filter with query %q: %s", f.Query, c)
+		}
+		for _, g := range gf {
+			groups[fingerprint(g)] = f.Group
+		}
+		wanted = append(wanted, gf...)
+	}
+	return wanted, groups, nil
+}
+
+// listRemoteFilters returns the filters that currently exist in the account.
+func listRemoteFilters(ctx context.Context) ([]gmail.Filter, error) {
+	l, err := api.Users.Settings.Filters.List(gmailUser).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("listing filters failed: %v", err)
+	}
+
+	filters := make([]gmail.Filter, 0, len(l.Filter))
+	for _, f := range l.Filter {
+		filters = append(filters, *f)
+	}
+	return filters, nil
+}
+
+// labelNamesByID returns a map of label IDs to names for display, or an empty
+// map if the labels cannot be listed.
+func labelNamesByID(ctx context.Context) labelMap {
+	names, err := getLabelMapOnID(ctx)
+	if err != nil {
+		logrus.Warn(err)
+		return labelMap{}
+	}
+	return names
+}
+
+// pendingLabels returns a copy of the label map that includes a placeholder
+// ID for every label the file would create, along with the names of those
+// labels. This lets a plan be computed without creating anything.
+func (m labelMap) pendingLabels(ff filterfile) (labelMap, []string, error) {
+	labels := labelMap{}
+	for k, v := range m {
+		labels[k] = v
+	}
+
+	var (
+		names []string
+		err   error
+	)
+	add := func(name string) {
+		key := strings.ToLower(name)
+		if _, ok := labels[key]; ok {
+			return
+		}
+		if verr := validateLabelName(name); verr != nil && err == nil {
+			err = verr
+		}
+		labels[key] = name
+		names = append(names, name)
+	}
+
+	for _, d := range ff.Label {
+		defs, err := d.flatten("")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, def := range defs {
+			for _, parent := range parentLabels(def.Name) {
+				add(parent)
+			}
+			add(def.Name)
+		}
+	}
+
+	for _, f := range ff.Filter {
+		if len(f.Label) > 0 {
+			add(f.Label)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return labels, names, nil
+}
+
+// planSync computes the diff between the filter file and the account without
+// changing anything. It returns the diff, the names of the labels that would
+// be created and a map of label IDs to names for display.
+func planSync(ctx context.Context, ff filterfile) (filterDiff, []string, labelMap, error) {
+	labels, err := getLabelMap(ctx)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+
+	names, err := getLabelMapOnID(ctx)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+
+	pending, newLabels, err := labels.pendingLabels(ff)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+	// The placeholder IDs of the pending labels are their names.
+	for _, name := range newLabels {
+		names[name] = name
+	}
+
+	wanted, _, err := wantedFilters(ctx, ff.Filter, &pending)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return filterDiff{}, nil, nil, err
+	}
+
+	return computeDiff(wanted, remote), newLabels, names, nil
+}
+
+// syncFilters makes the filters in the account match the wanted filters,
+// within the limits of the pruning and protection settings. The groups of the
+// wanted filters, by fingerprint, are recorded in the state.
+func syncFilters(ctx context.Context, wanted []gmail.Filter, groups map[string]string, rules []protectRule) error {
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only ever delete the filters we created ourselves.
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	// Pick up where an unfinished sync left off if we were asked to.
+	cp, err := loadCheckpoint(checkpointFile())
+	if err != nil {
+		return err
+	}
+	if cp != nil && !resume {
+		return fmt.Errorf("the sync started at %s did not finish, pass --resume to resume it or remove %s to start over",
+			cp.Time.Local().Format(time.RFC1123), cp.file)
+	}
+	if cp != nil {
+		infof("Resuming the sync started at %s\n", cp.Time.Local().Format(time.RFC1123))
+		// The filters it created are ours.
+		for _, f := range cp.Created {
+			state.add(f)
+		}
+	}
+
+	diff := computeDiff(wanted, remote).scoped(state, rules)
+	if cp != nil {
+		diff = diff.resumed(cp)
+	}
+	printDiffNotes(infoOut(), diff)
+	if err := checkFilterCount(diff); err != nil {
+		return err
+	}
+	if err := checkForwardingAddresses(ctx, diff); err != nil {
+		return err
+	}
+	if diff.empty() {
+		infof("All %d filters are up to date\n", len(diff.Unchanged))
+		if logFormat == "json" {
+			logrus.WithFields(syncSummary{unchanged: len(diff.Unchanged)}.fields()).Info("Sync finished")
+		}
+		// Remember the filters matching the file as managed.
+		for _, f := range diff.Unchanged {
+			state.add(f)
+		}
+		state.setApplied(diff, nil)
+		state.setGroups(groups)
+		if err := state.save(stateFile); err != nil {
+			return err
+		}
+		return cp.remove()
+	}
+
+	// Make sure the user really wants to delete filters.
+	if len(diff.Delete) > 0 {
+		printDiff(promptOut(), diff, labelNamesByID(ctx))
+		ok, err := confirm(fmt.Sprintf("Delete %d filters?", len(diff.Delete)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errAborted
+		}
+	}
+
+	// Take a backup before deleting anything.
+	if len(diff.Update) > 0 || len(diff.Delete) > 0 {
+		file, err := writeSnapshot(ctx, backupDir)
+		if err != nil {
+			return err
+		}
+		infof("Backed up existing filters to %s\n", file)
+	}
+
+	// Only make the changes we need to.
+	infof("Creating %d, updating %d and deleting %d filters, this might take a bit...\n",
+		len(diff.Create), len(diff.Update), len(diff.Delete))
+	if cp == nil {
+		cp = &checkpoint{Time: time.Now().UTC(), file: checkpointFile()}
+	}
+	cp.Delete = nil
+	for _, u := range diff.Update {
+		cp.Delete = append(cp.Delete, u.Old)
+	}
+	cp.Delete = append(cp.Delete, diff.Delete...)
+	if err := cp.save(); err != nil {
+		return err
+	}
+	j, err := applyDiff(ctx, diff, state, cp)
+	if j != nil {
+		// Record what we did so it can be undone, and the filters from the
+		// file as the base of the next sync.
+		j.Applied = state.Applied
+		state.LastSync = j
+		state.setApplied(diff, j.Created)
+	}
+	state.setGroups(groups)
+	// Always save the state so we remember what we did, even on failure.
+	if serr := state.save(stateFile); serr != nil {
+		logrus.Warn(serr)
+	}
+	if err != nil {
+		return err
+	}
+
+	infof("Successfully synced %d filters\n", len(wanted))
+
+	return nil
+}
+
+// applyDiff makes the changes in the diff to the account, recording the
+// filters it creates and deletes in the state, and returns the journal of
+// them once it made all the changes, even if some failed. Gmail filters cannot be
+// modified in place, so all the new filters are created and verified first
+// and only then are the old ones deleted. If anything fails the changes made
+// so far are rolled back, so the account is never left half synced, unless
+// we were asked to continue on errors, in which case all the failures are
+// reported at the end. Progress is written to the checkpoint, if there is
+// one, as we go. If the context is canceled the changes made so far are kept
+// and the checkpoint left behind to resume from.
+func applyDiff(ctx context.Context, diff filterDiff, state *syncState, cp *checkpoint) (j *journal, err error) {
+	// The unchanged filters match the file so they are managed now.
+	for _, f := range diff.Unchanged {
+		state.add(f)
+	}
+
+	var (
+		created  []gmail.Filter
+		deleted  []gmail.Filter
+		failures []syncFailure
+		summary  = syncSummary{unchanged: len(diff.Unchanged)}
+		start    = time.Now()
+		calls    = atomic.LoadInt64(&apiCalls)
+	)
+	// Every filter is created and verified, and every old one deleted.
+	bar := newProgress(infoErr(), 2*(len(diff.Update)+len(diff.Create))+len(diff.Update)+len(diff.Delete))
+	defer func() {
+		bar.finish()
+		if ctx.Err() != nil {
+			// Rolling back would need the API too, so whatever was done is
+			// kept and recorded in the checkpoint.
+			err = fmt.Errorf("sync interrupted after creating %d of %d and deleting %d of %d filters",
+				len(created), len(diff.Create)+len(diff.Update), len(deleted), len(diff.Update)+len(diff.Delete))
+			if cp != nil {
+				err = fmt.Errorf("%v, run again with --resume to finish it", err)
+			}
+			err = withExitCode(exitPartial, err)
+			return
+		}
+		if len(failures) > 0 {
+			// Keep the checkpoint so the failures can be retried.
+			return
+		}
+		if err == nil {
+			err = cp.remove()
+			return
+		}
+		logrus.Warnf("Sync failed, rolling back %d created and %d deleted filters", len(created), len(deleted))
+		if rerr := rollback(ctx, created, deleted, state); rerr != nil {
+			err = withExitCode(exitPartial, fmt.Errorf("%v; rolling back failed: %v", err, rerr))
+			return
+		}
+		if rerr := cp.remove(); rerr != nil {
+			logrus.Warn(rerr)
+		}
+	}()
+
+	// fail records the failure if we continue on errors, otherwise it
+	// returns the error to stop the sync.
+	fail := func(op string, f gmail.Filter, err error) error {
+		if !continueOnError || ctx.Err() != nil {
+			return err
+		}
+		logrus.Warn(err)
+		failures = append(failures, syncFailure{op: op, filter: f, err: err})
+		return nil
+	}
+
+	// Create all the new filters. If the replacement of a filter could not
+	// be created we keep the old one around.
+	keep := map[string]bool{}
+	for _, u := range diff.Update {
+		bar.step("creating filters")
+		c, err := createFilter(ctx, u.New)
+		if err != nil {
+			if err := fail("update", u.New, err); err != nil {
+				return nil, err
+			}
+			keep[u.Old.Id] = true
+			continue
+		}
+		summary.updated++
+		created = append(created, *c)
+		state.add(*c)
+		if err := cp.created(*c); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range diff.Create {
+		bar.step("creating filters")
+		c, err := createFilter(ctx, f)
+		if err != nil {
+			if err := fail("create", f, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		summary.created++
+		created = append(created, *c)
+		state.add(*c)
+		if err := cp.created(*c); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure they all exist as we asked.
+	for _, f := range created {
+		bar.step("verifying filters")
+		if err := verifyFilter(ctx, f); err != nil {
+			if err := fail("verify", f, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Delete the old filters.
+	var toDelete []gmail.Filter
+	for _, u := range diff.Update {
+		if !keep[u.Old.Id] {
+			toDelete = append(toDelete, u.Old)
+		}
+	}
+	toDelete = append(toDelete, diff.Delete...)
+	for i, f := range toDelete {
+		bar.step("deleting filters")
+		if err := deleteFilter(ctx, f); err != nil {
+			if err := fail("delete", f, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if i >= len(toDelete)-len(diff.Delete) {
+			summary.deleted++
+		}
+		deleted = append(deleted, f)
+		state.remove(f)
+		if err := cp.deleted(f); err != nil {
+			return nil, err
+		}
+	}
+
+	j = &journal{Time: time.Now().UTC(), Created: created, Deleted: deleted}
+
+	bar.finish()
+	summary.failed = len(failures)
+	summary.duration = time.Since(start)
+	summary.apiCalls = atomic.LoadInt64(&apiCalls) - calls
+	if logFormat == "json" {
+		logrus.WithFields(summary.fields()).Info("Sync finished")
+	} else if err := printSyncSummary(infoOut(), summary); err != nil {
+		return j, err
+	}
+
+	if len(failures) > 0 {
+		printFailures(ctx, os.Stderr, failures)
+		if cp != nil {
+			fmt.Fprintln(os.Stderr, "\nRun again with --resume to retry them.")
+		}
+		return j, withExitCode(exitPartial, fmt.Errorf("%d of %d filter operations failed", len(failures), len(diff.Create)+len(diff.Update)+len(diff.Delete)))
+	}
+
+	return j, nil
+}
+
+// syncFailure is an operation on a filter that failed.
+type syncFailure struct {
+	op     string
+	filter gmail.Filter
+	err    error
+}
+
+// printFailures writes a report of the failed operations.
+func printFailures(ctx context.Context, w io.Writer, failures []syncFailure) {
+	fmt.Fprintf(w, "\n%d filter operations failed:\n", len(failures))
+	for _, f := range failures {
+		fmt.Fprintln(w)
+		printFilter(w, "!", f.filter, labelNamesByID(ctx))
+		printDiffLine(w, fmt.Sprintf("! %s failed: %v", f.op, f.err))
+	}
+}
+
+// verifyFilter makes sure the filter exists in the account and does what we
+// asked for.
+func verifyFilter(ctx context.Context, f gmail.Filter) error {
+	got, err := api.Users.Settings.Filters.Get(gmailUser, f.Id).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("verifying filter id %s failed: %v", f.Id, err)
+	}
+
+	if fingerprint(*got) != fingerprint(f) {
+		return fmt.Errorf("verifying filter id %s failed: got fingerprint %s, expected %s", f.Id, fingerprint(*got), fingerprint(f))
+	}
+
+	return nil
+}
+
+// rollback deletes the created filters and recreates the deleted ones.
+func rollback(ctx context.Context, created, deleted []gmail.Filter, state *syncState) error {
+	var errs []string
+
+	for _, f := range deleted {
+		f.Id = ""
+		c, err := createFilter(ctx, f)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		state.add(*c)
+	}
+
+	for _, f := range created {
+		if err := deleteFilter(ctx, f); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		state.remove(f)
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// createFilter creates the filter in the account.
+func createFilter(ctx context.Context, f gmail.Filter) (*gmail.Filter, error) {
+	logrus.WithFields(logrus.Fields{
+		"action":   fmt.Sprintf("%#v", f.Action),
+		"criteria": fmt.Sprintf("%#v", f.Criteria),
+	}).Debug("adding Gmail filter")
+
+	created, err := api.Users.Settings.Filters.Create(gmailUser, &f).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("creating filter [%#v] failed: %v", f, err)
+	}
+	auditFilter("Created filter", *created)
+
+	return created, nil
+}
+
+// deleteFilter deletes the filter from the account.
+func deleteFilter(ctx context.Context, f gmail.Filter) error {
+	logrus.WithFields(logrus.Fields{
+		"id": f.Id,
+	}).Debug("deleting Gmail filter")
+
+	if err := api.Users.Settings.Filters.Delete(gmailUser, f.Id).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("deleting filter id %s failed: %v", f.Id, err)
+	}
+	auditFilter("Deleted filter", f)
+
+	return nil
+}
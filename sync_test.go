@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestComputeDiff(t *testing.T) {
+	archive := &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}
+	label := &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}
+
+	wanted := []gmail.Filter{
+		{Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"}, Action: archive},
+		{Criteria: &gmail.FilterCriteria{Query: "from:b@example.com"}, Action: label},
+		{Criteria: &gmail.FilterCriteria{Query: "from:c@example.com"}, Action: label},
+	}
+	remote := []gmail.Filter{
+		{Id: "1", Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+		{Id: "2", Criteria: &gmail.FilterCriteria{Query: "from:b@example.com"}, Action: archive},
+		{Id: "3", Criteria: &gmail.FilterCriteria{Query: "from:d@example.com"}, Action: archive},
+	}
+
+	got := computeDiff(wanted, remote)
+
+	expected := filterDiff{
+		Create:    []gmail.Filter{wanted[2]},
+		Delete:    []gmail.Filter{remote[2]},
+		Update:    []filterUpdate{{Old: remote[1], New: wanted[1]}},
+		Unchanged: []gmail.Filter{remote[0]},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	var buf bytes.Buffer
+	printDiff(&buf, got, labelMap{"Label_1": "github"})
+
+	expectedOutput := `Plan: 1 to create, 1 to update, 1 to delete, 1 unchanged.
+
+@@ filter (fingerprint 2f4d5585e4c52e8f) @@
++[[filter]]
++query = "from:c@example.com"
++addLabels = ["github"]
+
+@@ filter 2 (fingerprint b3466c04c6c96912 -> f24a7f88bd95ed36) @@
+ [[filter]]
+ query = "from:b@example.com"
+-removeLabels = ["INBOX"]
++addLabels = ["github"]
+
+@@ filter 3 (fingerprint 7d948aec7e990264) @@
+-[[filter]]
+-query = "from:d@example.com"
+-removeLabels = ["INBOX"]
+`
+	if diff := cmp.Diff(expectedOutput, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	buf.Reset()
+	printCheckSummary(&buf, got, []string{"github"})
+	expectedSummary := "status=drift labels=1 create=1 update=1 delete=1 unchanged=1 kept=0 protected=0 conflicts=0\n"
+	if diff := cmp.Diff(expectedSummary, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := gmail.Filter{
+		Id:       "1",
+		Criteria: &gmail.FilterCriteria{Query: "from:a@example.com  OR\nfrom:b@example.com"},
+		Action:   &gmail.FilterAction{RemoveLabelIds: []string{"UNREAD", "INBOX"}},
+	}
+	b := gmail.Filter{
+		Id:       "2",
+		Criteria: &gmail.FilterCriteria{Query: "from:a@example.com OR from:b@example.com"},
+		Action:   &gmail.FilterAction{RemoveLabelIds: []string{"INBOX", "UNREAD"}},
+	}
+	if fingerprint(a) != fingerprint(b) {
+		t.Fatalf("expected equivalent filters to have the same fingerprint, got %s and %s", fingerprint(a), fingerprint(b))
+	}
+
+	b.Action.Forward = "me@example.com"
+	if fingerprint(a) == fingerprint(b) {
+		t.Fatal("expected different filters to have different fingerprints")
+	}
+}
+
+func TestWithoutProtected(t *testing.T) {
+	rules, err := compileProtectRules([]protectRule{{Query: `@employer\.com`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	employer := gmail.Filter{Id: "1", Criteria: &gmail.FilterCriteria{Query: "from:it@employer.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"IMPORTANT"}}}
+	other := gmail.Filter{Id: "2", Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}}
+	rules = append(rules, protectRule{Fingerprint: fingerprint(other)})
+
+	diff := filterDiff{
+		Update: []filterUpdate{{Old: employer, New: gmail.Filter{Criteria: employer.Criteria, Action: &gmail.FilterAction{}}}},
+		Delete: []gmail.Filter{other},
+	}.withoutProtected(rules)
+
+	if !diff.empty() {
+		t.Fatalf("expected protected filters to be left alone, got %#v", diff)
+	}
+	if len(diff.Protected) != 2 {
+		t.Fatalf("expected 2 protected filters, got %d", len(diff.Protected))
+	}
+
+	if _, err := compileProtectRules([]protectRule{{}}); err == nil {
+		t.Fatal("expected an error for an empty protect rule")
+	}
+}
+
+func TestWithoutConflicts(t *testing.T) {
+	archive := &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}
+	label := &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}
+	criteria := func(q string) *gmail.FilterCriteria { return &gmail.FilterCriteria{Query: q} }
+
+	// What the last sync left in the account.
+	a := gmail.Filter{Criteria: criteria("from:a@example.com"), Action: archive}
+	b := gmail.Filter{Criteria: criteria("from:b@example.com"), Action: archive}
+	c := gmail.Filter{Criteria: criteria("from:c@example.com"), Action: archive}
+	d := gmail.Filter{Criteria: criteria("from:d@example.com"), Action: archive}
+	state := &syncState{Applied: []string{fingerprint(a), fingerprint(b), fingerprint(c), fingerprint(d)}}
+
+	changedInFile := filterUpdate{Old: gmail.Filter{Id: "1", Criteria: a.Criteria, Action: archive}, New: gmail.Filter{Criteria: a.Criteria, Action: label}}
+	changedInAccount := filterUpdate{Old: gmail.Filter{Id: "2", Criteria: b.Criteria, Action: label}, New: b}
+	changedInBoth := filterUpdate{Old: gmail.Filter{Id: "3", Criteria: c.Criteria, Action: label}, New: gmail.Filter{Criteria: c.Criteria}}
+	created := gmail.Filter{Criteria: criteria("from:e@example.com"), Action: archive}
+
+	got := filterDiff{
+		Update: []filterUpdate{changedInFile, changedInAccount, changedInBoth},
+		Create: []gmail.Filter{d, created},
+	}.withoutConflicts(state)
+
+	expected := filterDiff{
+		Update: []filterUpdate{changedInFile},
+		Create: []gmail.Filter{created},
+		Conflicts: []filterConflict{
+			{Old: changedInAccount.Old, New: changedInAccount.New},
+			{Old: changedInBoth.Old, New: changedInBoth.New, Both: true},
+			{New: d},
+		},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Without a last sync there is nothing to conflict with.
+	if got := (filterDiff{Update: []filterUpdate{changedInAccount}}).withoutConflicts(&syncState{}); len(got.Conflicts) > 0 {
+		t.Fatalf("expected no conflicts without a last sync, got %#v", got.Conflicts)
+	}
+}
+
+func TestScopedDedupe(t *testing.T) {
+	archive := &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}
+	a := gmail.Filter{Criteria: &gmail.FilterCriteria{From: "a@example.com"}, Action: archive}
+	b := gmail.Filter{Criteria: &gmail.FilterCriteria{From: "b@example.com"}, Action: archive}
+	copyOf := func(f gmail.Filter, id string) gmail.Filter {
+		f.Id = id
+		return f
+	}
+
+	// a is in the file and in the account three times, b is only in the
+	// account, twice.
+	remote := []gmail.Filter{copyOf(a, "1"), copyOf(a, "2"), copyOf(b, "3"), copyOf(a, "4"), copyOf(b, "5")}
+	diff := computeDiff([]gmail.Filter{a}, remote)
+	state := &syncState{Managed: map[string]string{}, Groups: map[string]string{}}
+
+	defer func() { dedupe = false }()
+	dedupe = true
+	got := diff.scoped(state, nil)
+
+	expected := filterDiff{
+		Unchanged: []gmail.Filter{remote[0]},
+		Kept:      []gmail.Filter{remote[2]},
+		Delete:    []gmail.Filter{remote[1], remote[3], remote[4]},
+	}
+	if d := cmp.Diff(expected, got); len(d) > 1 {
+		t.Fatalf("got diff: %s", d)
+	}
+
+	// Without deduplicating the copies are kept and mentioned.
+	dedupe = false
+	var buf bytes.Buffer
+	printDiffNotes(&buf, diff.scoped(state, nil))
+	if !strings.Contains(buf.String(), "Keeping 3 filters that are exact copies") {
+		t.Fatalf("expected a note about the copies, got %q", buf.String())
+	}
+}
+
+func TestScopedUnmanagedUpdate(t *testing.T) {
+	wanted := gmail.Filter{Criteria: &gmail.FilterCriteria{From: "a@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}}
+	// The filter in the account has the same criteria but was made by hand.
+	byHand := gmail.Filter{Id: "1", Criteria: &gmail.FilterCriteria{From: "a@example.com"}, Action: &gmail.FilterAction{AddLabelIds: []string{"STARRED"}}}
+	diff := computeDiff([]gmail.Filter{wanted}, []gmail.Filter{byHand})
+	if len(diff.Update) != 1 {
+		t.Fatalf("expected an update, got %#v", diff)
+	}
+
+	expected := filterDiff{
+		Create: []gmail.Filter{wanted},
+		Kept:   []gmail.Filter{byHand},
+	}
+	defer func() { prune = false }()
+	for _, prune = range []bool{false, true} {
+		state := &syncState{Managed: map[string]string{}, Groups: map[string]string{}}
+		if d := cmp.Diff(expected, diff.scoped(state, nil)); len(d) > 1 {
+			t.Fatalf("prune %t: got diff: %s", prune, d)
+		}
+
+		// Once it is managed it is updated.
+		state.add(byHand)
+		if got := diff.scoped(state, nil); len(got.Update) != 1 || len(got.Create) > 0 {
+			t.Fatalf("prune %t: expected the managed filter to be updated, got %#v", prune, got)
+		}
+	}
+}
+
+func TestRemapFilterLabels(t *testing.T) {
+	orig := gmail.Filter{
+		Id:       "1",
+		Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{"Label_1", "IMPORTANT"}, RemoveLabelIds: []string{"INBOX"}},
+	}
+
+	got := remapFilterLabels(orig, map[string]string{"Label_1": "Label_9", "INBOX": "INBOX"})
+
+	expected := gmail.Filter{
+		Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"},
+		Action:   &gmail.FilterAction{AddLabelIds: []string{"Label_9", "IMPORTANT"}, RemoveLabelIds: []string{"INBOX"}},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if orig.Action.AddLabelIds[0] != "Label_1" {
+		t.Fatal("expected the original filter to be left untouched")
+	}
+}
+
+func TestResumed(t *testing.T) {
+	archive := &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}
+	old := gmail.Filter{Id: "1", Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"}, Action: archive}
+	other := gmail.Filter{Id: "2", Criteria: &gmail.FilterCriteria{Query: "from:b@example.com"}, Action: archive}
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cp := &checkpoint{file: filepath.Join(dir, "checkpoint")}
+	cp.Delete = []gmail.Filter{old, other}
+	if err := cp.deleted(other); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadCheckpoint(cp.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]gmail.Filter{old}, got.Delete); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	d := filterDiff{Kept: []gmail.Filter{old, other}}.resumed(got)
+	expected := filterDiff{Delete: []gmail.Filter{old}, Kept: []gmail.Filter{other}}
+	if diff := cmp.Diff(expected, d); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestPrintDiffLineColor(t *testing.T) {
+	defer func(mode string) { colorMode = mode }(colorMode)
+
+	var buf bytes.Buffer
+	colorMode = "always"
+	printDiffLine(&buf, "+query = \"from:a@example.com\"")
+	printDiffLine(&buf, " [[filter]]")
+	colorMode = "auto"
+	printDiffLine(&buf, "-query = \"from:a@example.com\"")
+
+	expected := "\x1b[32m+query = \"from:a@example.com\"\x1b[0m\n [[filter]]\n-query = \"from:a@example.com\"\n"
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestWriteDiffJSON(t *testing.T) {
+	old := gmail.Filter{Id: "1", Criteria: &gmail.FilterCriteria{Query: "from:a@example.com"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}}
+	diff := filterDiff{
+		Update: []filterUpdate{{Old: old, New: gmail.Filter{Criteria: old.Criteria, Action: &gmail.FilterAction{AddLabelIds: []string{"Label_1"}}}}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeDiffJSON(&buf, "drift", diff, nil, labelMap{"Label_1": "github"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got jsonPlan
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := jsonPlan{
+		Status: "drift",
+		Labels: []string{},
+		Create: []jsonFilter{},
+		Update: []jsonUpdate{{
+			Old: jsonFilter{ID: "1", Fingerprint: fingerprint(old), Criteria: old.Criteria, RemoveLabels: []string{"INBOX"}},
+			New: jsonFilter{Fingerprint: fingerprint(diff.Update[0].New), Criteria: old.Criteria, AddLabels: []string{"github"}},
+		}},
+		Delete:    []jsonFilter{},
+		Conflicts: []jsonConflict{},
+		Counts:    map[string]int{"labels": 0, "create": 0, "update": 1, "delete": 0, "unchanged": 0, "kept": 0, "protected": 0, "conflicts": 0},
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestCheckForwarding(t *testing.T) {
+	d := filterDiff{
+		Create: []gmail.Filter{
+			{Action: &gmail.FilterAction{Forward: "me@example.com"}},
+			{Action: &gmail.FilterAction{AddLabelIds: []string{"TRASH"}}},
+		},
+		Update: []filterUpdate{{New: gmail.Filter{Action: &gmail.FilterAction{Forward: "other@example.com"}}}},
+		// Filters that are already there were accepted by Gmail.
+		Unchanged: []gmail.Filter{{Action: &gmail.FilterAction{Forward: "old@example.com"}}},
+	}
+
+	if diff := cmp.Diff([]string{"me@example.com", "other@example.com"}, forwardedTo(d)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	if err := checkForwarding(d, map[string]bool{"me@example.com": true, "other@example.com": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkForwarding(d, map[string]bool{"me@example.com": true})
+	if err == nil || !strings.Contains(err.Error(), "other@example.com") || strings.Contains(err.Error(), "me@example.com,") {
+		t.Fatalf("expected an error for other@example.com, got %v", err)
+	}
+}
+
+func TestSyncFilterFileUnverifiedForwarding(t *testing.T) {
+	// A fake Gmail API with no filters and a forwarding address that is
+	// still pending verification.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/me/labels":
+			json.NewEncoder(w).Encode(gmail.ListLabelsResponse{Labels: []*gmail.Label{
+				{Id: "INBOX", Name: "INBOX", Type: "system"},
+			}})
+		case "/me/settings/filters":
+			json.NewEncoder(w).Encode(gmail.ListFiltersResponse{})
+		case "/me/settings/forwardingAddresses":
+			json.NewEncoder(w).Encode(gmail.ListForwardingAddressesResponse{ForwardingAddresses: []*gmail.ForwardingAddress{
+				{ForwardingEmail: "me@example.com", VerificationStatus: "pending"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { stateFile = old }(stateFile)
+	stateFile = filepath.Join(dir, "state.json")
+
+	// The label of the filter must not be created as the filter cannot be.
+	ff := filterfile{Filter: []filter{{Query: "list:golang-nuts", Label: "Lists/golang", ForwardTo: "me@example.com"}}}
+	if err := syncFilterFile(context.Background(), ff, "text"); err == nil || !strings.Contains(err.Error(), "me@example.com") {
+		t.Fatalf("expected an error for the unverified address, got %v", err)
+	}
+}
+
+func TestApplyDiffInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A fake Gmail API creating the filters, interrupted while creating the
+	// second.
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if len(requests) > 1 {
+			cancel()
+			http.Error(w, "interrupted", http.StatusServiceUnavailable)
+			return
+		}
+		var f gmail.Filter
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		f.Id = fmt.Sprintf("new%d", len(requests))
+		json.NewEncoder(w).Encode(f)
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+
+	diff := filterDiff{Create: []gmail.Filter{
+		{Criteria: &gmail.FilterCriteria{Query: "one"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+		{Criteria: &gmail.FilterCriteria{Query: "two"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}},
+	}}
+	cp := &checkpoint{file: filepath.Join(dir, "state.json.checkpoint")}
+	_, err = applyDiff(ctx, diff, &syncState{Managed: map[string]string{}, Groups: map[string]string{}}, cp)
+	if err == nil || !strings.Contains(err.Error(), "interrupted after creating 1 of 2 and deleting 0 of 0 filters") {
+		t.Fatalf("expected the sync to be interrupted, got %v", err)
+	}
+
+	// Nothing is rolled back and the checkpoint is kept to resume from.
+	if diff := cmp.Diff([]string{"POST /me/settings/filters", "POST /me/settings/filters"}, requests); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	saved, err := loadCheckpoint(cp.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved == nil || len(saved.Created) != 1 || saved.Created[0].Id != "new1" {
+		t.Fatalf("expected the checkpoint to record the created filter, got %#v", saved)
+	}
+}
+
+func TestApplyDiffKeepsBase(t *testing.T) {
+	// A fake Gmail API deleting the filters.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if err := newService(srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { api = nil }()
+	api.BasePath = srv.URL + "/"
+	defer func(old bool) { quiet = old }(quiet)
+	quiet = true
+
+	f := gmail.Filter{Id: "1", Criteria: &gmail.FilterCriteria{Query: "one"}, Action: &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}}}
+	last := &journal{Created: []gmail.Filter{f}}
+	state := &syncState{Managed: map[string]string{}, Groups: map[string]string{}, Applied: []string{fingerprint(f)}, LastSync: last}
+	state.add(f)
+
+	// Deleting filters outside of a sync leaves its base and journal alone.
+	j, err := applyDiff(context.Background(), filterDiff{Delete: []gmail.Filter{f}}, state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j == nil || len(j.Deleted) != 1 || j.Deleted[0].Id != "1" {
+		t.Fatalf("expected the journal to record the deleted filter, got %#v", j)
+	}
+	if diff := cmp.Diff([]string{fingerprint(f)}, state.Applied); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if state.LastSync != last || state.managed(f) {
+		t.Fatalf("expected the last sync to be kept and the filter forgotten, got %#v", state)
+	}
+}
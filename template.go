@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+// templateValues holds the values made available to a filter file template.
+type templateValues map[string]interface{}
+
+// setFlag collects repeated key=val flags.
+type setFlag []string
+
+// String implements the flag.Value interface.
+func (s *setFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements the flag.Value interface.
+func (s *setFlag) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%q must be in the form key=val", value)
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+// loadTemplateValues reads the values from the optional TOML values file and
+// then applies the key=val overrides on top of them.
+func loadTemplateValues(file string, sets []string) (templateValues, error) {
+	values := templateValues{}
+
+	if len(file) > 0 {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading values file %s failed: %v", file, err)
+		}
+
+		if _, err := toml.Decode(string(b), &values); err != nil {
+			return nil, fmt.Errorf("decoding values file %s failed: %v", file, err)
+		}
+	}
+
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		values[kv[0]] = kv[1]
+	}
+
+	return values, nil
+}
+
+// renderTemplate renders the filter file b as a Go text/template with the
+// given values. Referencing a value that was not set is an error.
+func renderTemplate(name string, b []byte, values templateValues) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template %s failed: %v", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return nil, fmt.Errorf("rendering template %s failed: %v", name, err)
+	}
+
+	return buf.Bytes(), nil
+}
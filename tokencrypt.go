@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/oauth2"
+)
+
+// tokenPassphraseEnv is the environment variable the passphrase encrypting
+// the token can be passed in.
+const tokenPassphraseEnv = "GMAILFILTERS_TOKEN_PASSPHRASE"
+
+// tokenKeyFile is the file with the key encrypting the token, passed with
+// --token-key-file.
+var tokenKeyFile string
+
+// tokenKDFIterations is the number of PBKDF2 iterations deriving the key
+// from the passphrase, as recommended by OWASP for PBKDF2-HMAC-SHA256.
+const tokenKDFIterations = 600000
+
+// encryptedToken is how an encrypted token is saved: the token encrypted with
+// AES-256-GCM, with a key derived from the passphrase with PBKDF2.
+type encryptedToken struct {
+	Encryption string `json:"encryption"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// tokenEncryption is the encryption of the encrypted tokens, which tells
+// them apart from plain ones.
+const tokenEncryption = "pbkdf2-sha256-aes-256-gcm"
+
+// isEncryptedToken returns true if the contents of the token file are
+// encrypted.
+func isEncryptedToken(b []byte) bool {
+	var e encryptedToken
+	return json.Unmarshal(b, &e) == nil && e.Encryption == tokenEncryption
+}
+
+// tokenPassphrase returns the passphrase encrypting the token: the contents
+// of the --token-key-file, the GMAILFILTERS_TOKEN_PASSPHRASE environment
+// variable, or what is typed in the terminal, twice if confirm is true.
+func tokenPassphrase(confirm bool) ([]byte, error) {
+	if len(tokenKeyFile) > 0 {
+		b, err := ioutil.ReadFile(tokenKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading token key file %s failed: %v", tokenKeyFile, err)
+		}
+		if b = bytes.TrimSpace(b); len(b) < 1 {
+			return nil, fmt.Errorf("token key file %s is empty", tokenKeyFile)
+		}
+		return b, nil
+	}
+	if p := os.Getenv(tokenPassphraseEnv); len(p) > 0 {
+		return []byte(p), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("the token is encrypted, pass the passphrase in %s or the key with --token-key-file", tokenPassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "Passphrase for the token: ")
+	p, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("reading the passphrase failed: %v", err)
+	}
+	if len(p) < 1 {
+		return nil, errors.New("the passphrase cannot be empty")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Passphrase again: ")
+		again, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("reading the passphrase failed: %v", err)
+		}
+		if !bytes.Equal(p, again) {
+			return nil, errors.New("the passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+// encryptToken encrypts the token with the passphrase.
+func encryptToken(tok *oauth2.Token, passphrase []byte) ([]byte, error) {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+
+	e := encryptedToken{
+		Encryption: tokenEncryption,
+		Iterations: tokenKDFIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := tokenCipher(passphrase, e.Salt, e.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Ciphertext = gcm.Seal(nil, e.Nonce, plain, nil)
+
+	return json.MarshalIndent(e, "", "  ")
+}
+
+// decryptToken decrypts the token with the passphrase.
+func decryptToken(b, passphrase []byte) (*oauth2.Token, error) {
+	var e encryptedToken
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if e.Iterations < 1 {
+		return nil, errors.New("the encrypted token has no iterations")
+	}
+
+	gcm, err := tokenCipher(passphrase, e.Salt, e.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("the encrypted token has an invalid nonce")
+	}
+	plain, err := gcm.Open(nil, e.Nonce, e.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("decrypting the token failed, the passphrase is wrong or the token was changed")
+	}
+
+	tok := &oauth2.Token{}
+	return tok, json.Unmarshal(plain, tok)
+}
+
+// tokenCipher returns the AES-256-GCM cipher with the key derived from the
+// passphrase.
+func tokenCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
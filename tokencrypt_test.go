@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestEncryptedTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(store string) { tokenStore = store }(tokenStore)
+	defer os.Setenv(tokenPassphraseEnv, os.Getenv(tokenPassphraseEnv))
+	tokenStore = "encrypted"
+	os.Setenv(tokenPassphraseEnv, "correct horse")
+
+	file := filepath.Join(dir, "token.json")
+	if err := saveToken(file, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedToken(b) {
+		t.Fatalf("expected the token to be encrypted, got %s", b)
+	}
+
+	// The token is decrypted whatever the token store.
+	tokenStore = "file"
+	tok, err := tokenFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+		t.Fatalf("got unexpected token %+v", tok)
+	}
+
+	os.Setenv(tokenPassphraseEnv, "wrong")
+	if _, err := tokenFromFile(file); err == nil {
+		t.Fatal("expected an error with the wrong passphrase")
+	}
+
+	// A key file wins over the environment.
+	defer func() { tokenKeyFile = "" }()
+	tokenKeyFile = filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(tokenKeyFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenFromFile(file); err != nil {
+		t.Fatal(err)
+	}
+}
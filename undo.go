@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+const undoHelp = `Undo the changes made by the last sync.`
+
+func (cmd *undoCommand) Name() string      { return "undo" }
+func (cmd *undoCommand) Args() string      { return "" }
+func (cmd *undoCommand) ShortHelp() string { return undoHelp }
+func (cmd *undoCommand) LongHelp() string  { return undoHelp }
+func (cmd *undoCommand) Hidden() bool      { return false }
+
+func (cmd *undoCommand) Register(fs *flag.FlagSet) {}
+
+type undoCommand struct{}
+
+func (cmd *undoCommand) Run(ctx context.Context, args []string) error {
+	if err := connect(ctx); err != nil {
+		return err
+	}
+	if err := checkWriteScopes(ctx); err != nil {
+		return err
+	}
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		return err
+	}
+
+	if state.LastSync == nil {
+		return errors.New("there is no sync to undo")
+	}
+	j := state.LastSync
+
+	remote, err := listRemoteFilters(ctx)
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, f := range remote {
+		exists[f.Id] = true
+	}
+
+	// Delete what was created and recreate what was deleted.
+	var diff filterDiff
+	for _, f := range j.Created {
+		if !exists[f.Id] {
+			logrus.Warnf("Filter id %s created by the last sync no longer exists, skipping", f.Id)
+			continue
+		}
+		diff.Delete = append(diff.Delete, f)
+	}
+	for _, f := range j.Deleted {
+		f.Id = ""
+		diff.Create = append(diff.Create, f)
+	}
+
+	if diff.empty() {
+		infof("Nothing to undo\n")
+		return nil
+	}
+
+	infof("Undoing the sync from %s: deleting %d and recreating %d filters\n", j.Time, len(diff.Delete), len(diff.Create))
+
+	if len(diff.Delete) > 0 {
+		ok, err := confirm(fmt.Sprintf("Delete %d filters?", len(diff.Delete)))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errAborted
+		}
+
+		file, err := writeSnapshot(ctx, backupDir)
+		if err != nil {
+			return err
+		}
+		infof("Backed up existing filters to %s\n", file)
+	}
+
+	undone, err := applyDiff(ctx, diff, state, nil)
+	if undone != nil {
+		// Undoing again redoes the sync.
+		undone.Applied = state.Applied
+		state.LastSync = undone
+	}
+	if err == nil {
+		// Go back to the base from before the sync.
+		state.Applied = j.Applied
+	}
+	if serr := state.save(stateFile); serr != nil {
+		logrus.Warn(serr)
+	}
+	if err != nil {
+		return err
+	}
+
+	infof("Successfully undid the last sync\n")
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const validateHelp = `Check filter files for mistakes without talking to Gmail.`
+
+func (cmd *validateCommand) Name() string      { return "validate" }
+func (cmd *validateCommand) Args() string      { return "<file>..." }
+func (cmd *validateCommand) ShortHelp() string { return validateHelp }
+func (cmd *validateCommand) LongHelp() string  { return validateHelp }
+func (cmd *validateCommand) Hidden() bool      { return false }
+
+func (cmd *validateCommand) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&cmd.strict, "strict", false, "fail on warnings too")
+}
+
+type validateCommand struct {
+	strict bool
+}
+
+func (cmd *validateCommand) Run(ctx context.Context, args []string) error {
+	args = filterFileArgs(args)
+	if len(args) < 1 {
+		return errors.New("must pass the path to at least one gmail filter configuration file")
+	}
+
+	values, err := flagTemplateValues()
+	if err != nil {
+		return err
+	}
+
+	var problems []validationError
+	for _, file := range args {
+		problems = append(problems, validateFile(ctx, file, values)...)
+	}
+
+	failed := 0
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+		if !p.warning || cmd.strict {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return withExitCode(exitValidation, fmt.Errorf("found %d problems", failed))
+	}
+
+	infof("%s: ok\n", strings.Join(args, ", "))
+	return nil
+}
+
+// validationError is a problem found in a filter file, at the given line if
+// it is known. Warnings do not make validation fail unless it is strict.
+type validationError struct {
+	file    string
+	line    int
+	msg     string
+	warning bool
+}
+
+func (e validationError) Error() string {
+	msg := e.msg
+	if e.warning {
+		msg = "warning: " + msg
+	}
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.file, e.line, msg)
+	}
+	return fmt.Sprintf("%s: %s", e.file, msg)
+}
+
+// validateFile checks the filter file for mistakes without making any API
+// calls.
+func validateFile(ctx context.Context, file string, values templateValues) []validationError {
+	var problems []validationError
+	report := func(line int, format string, args ...interface{}) {
+		problems = append(problems, validationError{file: file, line: line, msg: fmt.Sprintf(format, args...)})
+	}
+
+	b, err := readFilterFile(file, values)
+	if err != nil {
+		report(0, "%v", err)
+		return problems
+	}
+
+	var ff filterfile
+	md, err := toml.Decode(string(b), &ff)
+	if err != nil {
+		// The TOML errors already say which line they are on.
+		report(0, "%v", err)
+		return problems
+	}
+
+	pos := filePositions(string(b))
+	for _, key := range md.Undecoded() {
+		report(pos.key(key[len(key)-1]), "unknown key %s", key)
+	}
+
+	if ff.Protect, err = compileProtectRules(ff.Protect); err != nil {
+		report(0, "%v", err)
+	}
+
+	ff.Filter, err = expandFilterSnippets(ff.Filter, ff.Snippets)
+	if err != nil {
+		report(0, "%v", err)
+		return problems
+	}
+
+	if expandEnvVars {
+		if ff.Filter, err = expandFilterEnv(ff.Filter); err != nil {
+			report(0, "%v", err)
+			return problems
+		}
+	}
+
+	// Resolve the labels to placeholders so nothing is created.
+	labels, _, err := labelMap{}.pendingLabels(ff)
+	if err != nil {
+		report(0, "%v", err)
+		return problems
+	}
+
+	var (
+		seen      = map[string]int{}
+		converted []lintFilter
+	)
+	for i, f := range ff.Filter {
+		line := pos.filter(i)
+
+		if len(f.ForwardTo) > 0 {
+			if addr, err := mail.ParseAddress(f.ForwardTo); err != nil || addr.Address != f.ForwardTo {
+				report(line, "forwardTo %q is not an email address", f.ForwardTo)
+			}
+		}
+
+		gf, err := f.toGmailFilters(ctx, &labels)
+		if err != nil {
+			report(line, "%v", err)
+			continue
+		}
+		for _, c := range f.conflictingActions() {
+			problems = append(problems, validationError{file: file, line: line, msg: c.String(), warning: true})
+		}
+
+		for _, g := range gf {
+			converted = append(converted, lintFilter{filter: g, entry: i, line: line})
+
+			fp := fingerprint(g)
+			if first, ok := seen[fp]; ok {
+				report(line, "duplicate of the filter on line %d", first)
+				continue
+			}
+			seen[fp] = line
+		}
+	}
+
+	// The entries can expand to many more filters than there are.
+	if len(converted) > maxFilters {
+		report(0, "the %d filters expand to %d Gmail filters, more than the %d Gmail allows", len(ff.Filter), len(converted), maxFilters)
+	} else if len(converted) >= filterCountWarning {
+		problems = append(problems, validationError{file: file, msg: fmt.Sprintf("the %d filters expand to %d Gmail filters, Gmail allows at most %d", len(ff.Filter), len(converted), maxFilters), warning: true})
+	}
+
+	for _, p := range lintOverlaps(converted) {
+		problems = append(problems, validationError{file: file, line: p.line, msg: p.msg, warning: true})
+	}
+
+	return problems
+}
+
+// positions holds the lines the statements of a filter file start on.
+type positions struct {
+	filters []int
+	keys    map[string]int
+}
+
+// filePositions finds the lines of the [[filter]] entries and the first line
+// of each key in the TOML text. If the text cannot be split into statements
+// the positions are unknown.
+func filePositions(text string) positions {
+	pos := positions{keys: map[string]int{}}
+
+	statements, err := splitStatements(text)
+	if err != nil {
+		return pos
+	}
+
+	line := 1
+	for _, s := range statements {
+		switch {
+		case s.kind == headerStatement && strings.EqualFold(s.key, "filter"):
+			pos.filters = append(pos.filters, line)
+		case s.kind == keyValueStatement:
+			if _, ok := pos.keys[s.key]; !ok {
+				pos.keys[s.key] = line
+			}
+		}
+		line += strings.Count(s.text, "\n")
+	}
+
+	return pos
+}
+
+// filter returns the line of the i-th filter, or 0 if it is unknown.
+func (p positions) filter(i int) int {
+	if i < len(p.filters) {
+		return p.filters[i]
+	}
+	return 0
+}
+
+// key returns the first line of the key, or 0 if it is unknown.
+func (p positions) key(name string) int {
+	return p.keys[name]
+}
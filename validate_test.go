@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(`[[filter]]
+query = "from:a@example.com"
+label = "a"
+
+[[filter]]
+query = "x"
+queryOr = ["y"]
+
+# Same as the first one.
+[[filter]]
+query = "from:a@example.com"
+label = "a"
+lable = "b"
+
+[[filter]]
+query = "z"
+forwardTo = "me at example.com"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range validateFile(context.Background(), file, nil) {
+		got = append(got, p.Error())
+	}
+
+	expected := []string{
+		file + ":13: unknown key filter.lable",
+		file + ":5: cannot have both a query and a queryOr",
+		file + ":10: duplicate of the filter on line 1",
+		file + ":15: forwardTo \"me at example.com\" is not an email address",
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestLintOverlaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "filters.toml")
+	if err := ioutil.WriteFile(file, []byte(`[[filter]]
+query = "from:github.com"
+label = "github"
+archive = true
+
+[[filter]]
+query = "from:github.com LGTM"
+label = "github"
+
+[[filter]]
+query = "from:github.com LGTM mention"
+label = "github/mention"
+archive = true
+
+[[filter]]
+query = "from:github.com"
+read = true
+
+[[filter]]
+query = "from:example.com"
+label = "example"
+archiveUnlessCcMe = true
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range validateFile(context.Background(), file, nil) {
+		got = append(got, p.Error())
+	}
+
+	expected := []string{
+		file + ":6: warning: is redundant, the filter on line 1 matches all of its mail and does the same",
+		file + ":15: warning: has the same criteria as the filter on line 1, they can be combined",
+	}
+	if diff := cmp.Diff(expected, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}